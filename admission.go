@@ -0,0 +1,549 @@
+package raftify
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// ErrDuplicateID is returned by InitNode if another cluster member already uses the node ID.
+var ErrDuplicateID = errors.New("node ID is already used by another cluster member")
+
+// errPeerUnreachable is returned if a peer couldn't be dialed to ask it for admission.
+var errPeerUnreachable = errors.New("peer unreachable")
+
+// Conflict describes two nodes claiming the same node ID.
+type Conflict struct {
+	// The node ID both nodes claim.
+	ID string
+
+	// The address of the member already known by the ID.
+	ExistingAddr string
+
+	// The address of the node trying to use the ID as well.
+	ConflictingAddr string
+}
+
+// clusterIDMigrationDeadline returns the point in time until which nodes without cluster ID are
+// admitted, the zero time if cluster_id_migration_until is not set. The setting must have been
+// validated before.
+func (c *Config) clusterIDMigrationDeadline() time.Time {
+	if c.ClusterIDMigrationUntil == "" {
+		return time.Time{}
+	}
+	deadline, _ := time.Parse(time.RFC3339, c.ClusterIDMigrationUntil)
+	return deadline
+}
+
+// AllowlistConfig restricts the nodes admitted to the cluster. Each list that is set must
+// match; an empty list admits everyone.
+type AllowlistConfig struct {
+	// The IDs of the nodes admitted to the cluster, including the local node.
+	IDs []string `json:"ids"`
+
+	// The IP addresses and CIDR ranges nodes are admitted from.
+	Addresses []string `json:"addresses"`
+}
+
+// enabled checks whether any of the allowlists is set.
+func (a *AllowlistConfig) enabled() bool {
+	return len(a.IDs) != 0 || len(a.Addresses) != 0
+}
+
+// validate checks for constraint violations in the allowlist and returns them in the same
+// format as Config.validate.
+func (a *AllowlistConfig) validate(localID string) string {
+	var errs string
+	if len(a.IDs) != 0 {
+		found := false
+		for _, id := range a.IDs {
+			found = found || id == localID
+		}
+		if !found {
+			errs += fmt.Sprintf("\tallowlist.ids must contain the local node %v\n", localID)
+		}
+	}
+	for _, address := range a.Addresses {
+		if _, err := parseAllowedAddress(address); err != nil {
+			errs += fmt.Sprintf("\tallowlist.addresses must only contain IP addresses and CIDR ranges: got %q\n", address)
+		}
+	}
+	return errs
+}
+
+// parseAllowedAddress parses an IP address or CIDR range of the allowlist. Single IP addresses
+// are turned into a range only containing the address.
+func parseAllowedAddress(address string) (*net.IPNet, error) {
+	if strings.Contains(address, "/") {
+		_, ipNet, err := net.ParseCIDR(address)
+		return ipNet, err
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", address)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// allowlist is the parsed form of the AllowlistConfig.
+type allowlist struct {
+	ids  map[string]bool
+	nets []*net.IPNet
+}
+
+// parse returns the parsed allowlist or nil if it is disabled. The allowlist must have been
+// validated before.
+func (a *AllowlistConfig) parse() *allowlist {
+	if !a.enabled() {
+		return nil
+	}
+
+	list := &allowlist{ids: map[string]bool{}}
+	for _, id := range a.IDs {
+		list.ids[id] = true
+	}
+	for _, address := range a.Addresses {
+		if ipNet, err := parseAllowedAddress(address); err == nil {
+			list.nets = append(list.nets, ipNet)
+		}
+	}
+	return list
+}
+
+// check returns an error if the node with the given ID and IP address is not allowlisted.
+func (l *allowlist) check(id string, ip net.IP) error {
+	if len(l.ids) != 0 && !l.ids[id] {
+		return fmt.Errorf("%v is not on the allowlist", id)
+	}
+	if len(l.nets) == 0 {
+		return nil
+	}
+	for _, ipNet := range l.nets {
+		if ipNet.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("address %v of %v is not on the allowlist", ip, id)
+}
+
+// admissionDelegate decides which nodes are admitted to the cluster. Members are refused if
+// their cluster ID differs from the local one, if they are not on the allowlist or if admitting
+// them would exceed max_nodes. The checks are applied when clusters are merged on join, when
+// members are learned about via gossip and when a node asks to join via a join request.
+type admissionDelegate struct {
+	logger    *log.Logger
+	localID   string
+	clusterID string
+	maxNodes  int
+
+	// The point in time until which nodes without cluster ID are admitted while the cluster
+	// adopts its cluster ID, the zero time if they are refused.
+	migrationUntil time.Time
+
+	// The parsed allowlist, nil if everyone is admitted.
+	allowlist *allowlist
+
+	// The alive delegate that is consulted once a member has been admitted, if any.
+	next memberlist.AliveDelegate
+
+	// The event delegate join, leave and update events are passed on to.
+	events memberlist.EventDelegate
+
+	// The function conflicting node IDs are reported to.
+	onConflict func(Conflict)
+
+	// The decoded node meta of the members, refreshed whenever a member joins, updates its meta
+	// or leaves.
+	metas *metaCache
+
+	// The addresses of the current members by node ID, including the local node. Kept
+	// separately since the memberlist must not be accessed from within its delegates.
+	sync.Mutex
+	members map[string]string
+
+	// The ID conflict detected while merging with another cluster on join, if any.
+	conflict error
+
+	// The memberlist used to probe the previous address of conflicting node IDs, nil until it
+	// has been created.
+	list *memberlist.Memberlist
+}
+
+// check returns an error if the node with the given ID, IP address and cluster ID must not be
+// a member, regardless of the current cluster size. So that a cluster ID can be adopted one node
+// at a time, nodes without cluster ID are admitted until cluster_id_migration_until, and a local
+// node without cluster ID admits everyone.
+func (d *admissionDelegate) check(id string, ip net.IP, clusterID string) error {
+	if clusterID != d.clusterID && d.clusterID != "" && (clusterID != "" || !d.migrating()) {
+		return fmt.Errorf("%v belongs to cluster %q, expected %q", id, clusterID, d.clusterID)
+	}
+	if d.allowlist != nil {
+		return d.allowlist.check(id, ip)
+	}
+	return nil
+}
+
+// migrating returns whether the cluster is adopting a cluster ID, i.e. whether nodes without
+// cluster ID are still admitted.
+func (d *admissionDelegate) migrating() bool {
+	return time.Now().Before(d.migrationUntil)
+}
+
+// checkCapacity returns an error if the nodes with the given IDs can't be admitted without
+// exceeding max_nodes. Nodes that are already members are not counted.
+func (d *admissionDelegate) checkCapacity(ids ...string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	size := len(d.members)
+	for _, id := range ids {
+		if _, ok := d.members[id]; !ok {
+			size++
+		}
+	}
+	if size > d.maxNodes {
+		return fmt.Errorf("admitting %v would exceed max_nodes of %v", strings.Join(ids, ", "), d.maxNodes)
+	}
+	return nil
+}
+
+// checkConflict returns an error wrapping ErrDuplicateID alongside the address of the existing
+// member if the node ID is already used by a member at another address.
+func (d *admissionDelegate) checkConflict(id, address string) (string, error) {
+	d.Lock()
+	existing, ok := d.members[id]
+	d.Unlock()
+
+	if ok && existing != address {
+		return existing, fmt.Errorf("%w: %v is already a member at %v", ErrDuplicateID, id, existing)
+	}
+	return "", nil
+}
+
+// probe returns whether a node with the given ID still responds at the given address. A node
+// that has been restarted at another address conflicts with its previous incarnation until that
+// has been detected as failed, so a conflict is only a duplicate ID if the other node responds.
+func (d *admissionDelegate) probe(id, address string) bool {
+	d.Lock()
+	list := d.list
+	d.Unlock()
+	if list == nil {
+		return true
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return false
+	}
+	_, err = list.Ping(id, addr)
+	return err == nil
+}
+
+// setMemberlist sets the memberlist conflicting node IDs are probed with.
+func (d *admissionDelegate) setMemberlist(list *memberlist.Memberlist) {
+	d.Lock()
+	defer d.Unlock()
+	d.list = list
+}
+
+// admit returns an error if the node asking to join must not become a member.
+func (d *admissionDelegate) admit(id string, ip net.IP, clusterID string) error {
+	if err := d.check(id, ip, clusterID); err != nil {
+		return err
+	}
+	return d.checkCapacity(id)
+}
+
+// takeConflict returns and clears the ID conflict detected while merging on join, if any.
+func (d *admissionDelegate) takeConflict() error {
+	d.Lock()
+	defer d.Unlock()
+
+	err := d.conflict
+	d.conflict = nil
+	return err
+}
+
+// checkMember decodes the metadata of a member and returns an error if it must not be a member.
+func (d *admissionDelegate) checkMember(peer *memberlist.Node) error {
+	meta, err := d.metas.lookup(memberOf(peer))
+	if err != nil {
+		return fmt.Errorf("%v [%v]: %v", peer.Name, peer.Address(), err)
+	}
+	if err := d.check(peer.Name, peer.Addr, meta.ClusterID); err != nil {
+		return fmt.Errorf("%v [%v]: %v", peer.Name, peer.Address(), err)
+	}
+	if _, err := negotiateVersion(meta.protocolVersions()); err != nil {
+		return fmt.Errorf("%v [%v] %v", peer.Name, peer.Address(), err)
+	}
+	return nil
+}
+
+// NotifyMerge implements the memberlist MergeDelegate interface. It is invoked on both the
+// joining node and the node it joins, so refusals are logged on both sides.
+func (d *admissionDelegate) NotifyMerge(peers []*memberlist.Node) error {
+	ids := []string{}
+	for _, peer := range peers {
+		if peer.State == memberlist.StateDead || peer.State == memberlist.StateLeft {
+			continue
+		}
+
+		// The other side knows another node by the ID of the local node or one of its members.
+		// Unless the node at the other address still responds, it is presumably a previous
+		// incarnation of the node that hasn't been detected as failed yet, so the merge is
+		// refused without reporting a conflict and the join is retried later on.
+		if existing, err := d.checkConflict(peer.Name, peer.Address()); err != nil {
+			previous := existing
+			if peer.Name == d.localID {
+				previous = peer.Address()
+			}
+			if !d.probe(peer.Name, previous) {
+				d.logger.Printf("[WARN] raftify: Refusing to merge until %v [%v] has been detected as failed, it doesn't respond anymore\n", peer.Name, previous)
+				return fmt.Errorf("%v is still known at %v which doesn't respond anymore", peer.Name, previous)
+			}
+			d.logger.Printf("[ERR] raftify: Refusing to merge, %v. Make sure every node has a unique id\n", err)
+			d.onConflict(Conflict{ID: peer.Name, ExistingAddr: existing, ConflictingAddr: peer.Address()})
+			if peer.Name == d.localID {
+				d.Lock()
+				d.conflict = err
+				d.Unlock()
+			}
+			return err
+		}
+		if peer.Name == d.localID {
+			continue
+		}
+		if err := d.checkMember(peer); err != nil {
+			d.logger.Printf("[ERR] raftify: Refusing to merge with %v. Make sure the peer_list only contains members of this cluster\n", err)
+			return fmt.Errorf("member refused: %v", err)
+		}
+		ids = append(ids, peer.Name)
+	}
+
+	if err := d.checkCapacity(ids...); err != nil {
+		d.logger.Printf("[ERR] raftify: Refusing to merge, %v\n", err)
+		return fmt.Errorf("member refused: %v", err)
+	}
+	return nil
+}
+
+// NotifyAlive implements the memberlist AliveDelegate interface.
+func (d *admissionDelegate) NotifyAlive(peer *memberlist.Node) error {
+	if peer.Name == d.localID {
+		return nil
+	}
+	if err := d.checkMember(peer); err != nil {
+		return fmt.Errorf("member refused: %v", err)
+	}
+	if err := d.checkCapacity(peer.Name); err != nil {
+		return fmt.Errorf("member refused: %v", err)
+	}
+	if d.next != nil {
+		return d.next.NotifyAlive(peer)
+	}
+	return nil
+}
+
+// NotifyJoin implements the memberlist EventDelegate interface.
+func (d *admissionDelegate) NotifyJoin(node *memberlist.Node) {
+	d.Lock()
+	d.members[node.Name] = node.Address()
+	d.metas.refresh(memberOf(node))
+	d.Unlock()
+	d.events.NotifyJoin(node)
+}
+
+// NotifyLeave implements the memberlist EventDelegate interface.
+func (d *admissionDelegate) NotifyLeave(node *memberlist.Node) {
+	d.Lock()
+	delete(d.members, node.Name)
+	d.metas.forget(node.Name)
+	d.Unlock()
+	d.events.NotifyLeave(node)
+}
+
+// NotifyUpdate implements the memberlist EventDelegate interface.
+func (d *admissionDelegate) NotifyUpdate(node *memberlist.Node) {
+	d.Lock()
+	d.metas.refresh(memberOf(node))
+	d.Unlock()
+	d.events.NotifyUpdate(node)
+}
+
+// NotifyConflict implements the memberlist ConflictDelegate interface. It is invoked if a
+// node announces itself with the ID of an existing member but from another address. Memberlist
+// keeps the existing member and ignores the other node. The conflict is only reported if the
+// existing member still responds, which is probed asynchronously since memberlist holds its
+// locks while invoking the delegate.
+func (d *admissionDelegate) NotifyConflict(existing, other *memberlist.Node) {
+	conflict := Conflict{ID: existing.Name, ExistingAddr: existing.Address(), ConflictingAddr: other.Address()}
+	go func() {
+		if d.probe(conflict.ID, conflict.ExistingAddr) {
+			d.onConflict(conflict)
+		}
+	}()
+}
+
+// decodeJoinContent unmarshals the content of a join request or response. Since neither side
+// of a join is necessarily a member of the other's cluster yet, only the sender and the name it
+// has authenticated with on the transport level are checked.
+func decodeJoinContent(msg Message, content sender) error {
+	if err := unmarshal(msg.format, msg.Content, content); err != nil {
+		return err
+	}
+	if content.senderID() != msg.Sender {
+		return fmt.Errorf("%v claims to originate from %v but was sent by %v", msg.Type.toString(), content.senderID(), msg.Sender)
+	}
+	if msg.peer != "" && msg.peer != msg.Sender {
+		return fmt.Errorf("%v claims to originate from %v but the sender authenticated as %v", msg.Type.toString(), msg.Sender, msg.peer)
+	}
+	return nil
+}
+
+// handleJoinRequest answers the join request of a node that is about to join the cluster via
+// the local node. Returns nil if the request is invalid and must not be answered.
+func (n *Node) handleJoinRequest(in InboundMessage) []byte {
+	msg, err := n.decodeMessage(in)
+	if err != nil {
+		n.logger.Printf("[ERR] raftify: %v\n", err.Error())
+		return nil
+	}
+
+	var req JoinRequest
+	if msg.Type != JoinRequestMsg {
+		n.logger.Printf("[ERR] raftify: Expected JoinRequestMsg from %v, got %v\n", in.From, msg.Type.toString())
+		return nil
+	}
+	if err := decodeJoinContent(msg, &req); err != nil {
+		n.logger.Printf("[ERR] raftify: %v\n", err.Error())
+		return nil
+	}
+
+	host, _, _ := net.SplitHostPort(in.From)
+	resp := JoinResponse{MemberID: n.config.ID, Admitted: true}
+	existing, err := n.admission.checkConflict(req.NodeID, req.Address)
+	if err != nil && !n.admission.probe(req.NodeID, existing) {
+		// The node has presumably been restarted at another address, so it is asked to retry
+		// once its previous incarnation has been detected as failed.
+		n.logger.Printf("[WARN] raftify: Refused join of %v [%v] until its previous address %v has been detected as failed\n", req.NodeID, host, existing)
+		resp.Admitted, resp.Reason = false, fmt.Sprintf("%v is still a member at %v which doesn't respond anymore, retry once it has been detected as failed", req.NodeID, existing)
+	} else if err != nil {
+		n.logger.Printf("[ERR] raftify: Refused join of %v [%v]: %v\n", req.NodeID, host, err.Error())
+		n.raiseConflict(Conflict{ID: req.NodeID, ExistingAddr: existing, ConflictingAddr: req.Address})
+		resp.Admitted, resp.Conflict, resp.Reason = false, true, err.Error()
+	} else if err := n.admission.admit(req.NodeID, net.ParseIP(host), req.ClusterID); err != nil {
+		n.logger.Printf("[ERR] raftify: Refused join of %v [%v]: %v\n", req.NodeID, host, err.Error())
+		resp.Admitted, resp.Reason = false, err.Error()
+	}
+	return n.encodeJoinMessage(JoinResponseMsg, resp)
+}
+
+// encodeJoinMessage wraps a join request or response into a message in the protocol version
+// the join message types have been introduced in, since the protocol version of the other side
+// isn't known yet. Neither is its node ID, so the message doesn't name a recipient.
+func (n *Node) encodeJoinMessage(msgType MessageType, content interface{}) []byte {
+	return n.encodeMessageAs(msgType.minProtocolVersion(), "", msgType, content)
+}
+
+// requestJoin asks the peer at the given address whether the local node is admitted to the
+// cluster. Returns an error if the peer couldn't be asked.
+func (n *Node) requestJoin(address string) (JoinResponse, error) {
+	var resp JoinResponse
+
+	req := JoinRequest{NodeID: n.config.ID, Address: n.LocalAddr(), ClusterID: n.config.ClusterID}
+	in, err := n.transport.request(address, n.encodeJoinMessage(JoinRequestMsg, req))
+	if err != nil {
+		return resp, err
+	}
+
+	msg, err := n.decodeMessage(in)
+	if err != nil {
+		return resp, err
+	}
+	if msg.Type != JoinResponseMsg {
+		return resp, fmt.Errorf("expected JoinResponseMsg from %v, got %v", address, msg.Type.toString())
+	}
+	return resp, decodeJoinContent(msg, &resp)
+}
+
+// requestAdmission asks all peers concurrently whether the local node is admitted to the cluster
+// and returns the ones that have admitted it in the order they have been passed in. Peers that can
+// be reached but don't answer, e.g. because they predate join requests, are kept as well. Peers
+// that can't be reached are dropped so that they aren't dialed again by the join. Returns an error
+// if no peer is left.
+func (n *Node) requestAdmission(peers []string) ([]string, error) {
+	type result struct {
+		resp JoinResponse
+		err  error
+	}
+	results := make([]result, len(peers))
+
+	var wg sync.WaitGroup
+	for i, address := range peers {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+			results[i].resp, results[i].err = n.requestJoin(address)
+		}(i, address)
+	}
+	wg.Wait()
+
+	admitted := []string{}
+	var refusals, unreachable string
+	for i, address := range peers {
+		resp, err := results[i].resp, results[i].err
+		if errors.Is(err, errPeerUnreachable) {
+			n.logger.Printf("[DEBUG] raftify: Couldn't request admission from %v: %v\n", address, err.Error())
+			unreachable += fmt.Sprintf("\t%v: %v\n", address, err.Error())
+			continue
+		}
+		if err != nil {
+			n.logger.Printf("[DEBUG] raftify: %v didn't answer the join request, joining it anyway: %v\n", address, err.Error())
+			admitted = append(admitted, address)
+			continue
+		}
+		if resp.Conflict {
+			return nil, fmt.Errorf("%w: %v [%v] refused to admit %v: %v", ErrDuplicateID, resp.MemberID, address, n.config.ID, resp.Reason)
+		}
+		if !resp.Admitted {
+			n.logger.Printf("[ERR] raftify: %v [%v] refused to admit %v: %v\n", resp.MemberID, address, n.config.ID, resp.Reason)
+			refusals += fmt.Sprintf("\t%v [%v]: %v\n", resp.MemberID, address, resp.Reason)
+			continue
+		}
+		admitted = append(admitted, address)
+	}
+
+	switch {
+	case len(admitted) != 0:
+		return admitted, nil
+	case refusals != "":
+		return nil, fmt.Errorf("join refused by all peers:\n%v%v", refusals, unreachable)
+	case unreachable != "":
+		return nil, fmt.Errorf("none of the peers could be reached:\n%v", unreachable)
+	}
+	return admitted, nil
+}
+
+// raiseConflict records two nodes claiming the same node ID and passes the conflict on to the
+// handler set via WithConflictHandler.
+func (n *Node) raiseConflict(conflict Conflict) {
+	atomic.AddUint64(&n.metrics.IDConflicts, 1)
+	n.logger.Printf("[ERR] raftify: Node ID %v is claimed by %v and %v\n", conflict.ID, conflict.ExistingAddr, conflict.ConflictingAddr)
+	n.audit("node ID %v is claimed by %v and %v", conflict.ID, conflict.ExistingAddr, conflict.ConflictingAddr)
+
+	// The handler is called asynchronously since conflicts are reported from within memberlist.
+	if n.conflictHandler != nil {
+		go n.conflictHandler(conflict)
+	}
+}
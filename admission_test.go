@@ -0,0 +1,459 @@
+package raftify
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// testMember returns a memberlist node with the given name, address and cluster ID.
+func testMember(name, ip, clusterID string) *memberlist.Node {
+	return &memberlist.Node{
+		Name: name,
+		Addr: net.ParseIP(ip),
+		Port: 7946,
+		Meta: (&Config{ClusterID: clusterID}).encodeNodeMeta(),
+	}
+}
+
+func TestValidateAllowlist(t *testing.T) {
+	allowlist := AllowlistConfig{
+		IDs:       []string{"TestNode_1", "TestNode_2"},
+		Addresses: []string{"127.0.0.1", "10.0.0.0/8", "::1"},
+	}
+	if errs := allowlist.validate("TestNode_1"); errs != "" {
+		t.Logf("Expected no errors for a valid allowlist, instead got: %v", errs)
+		t.FailNow()
+	}
+	if errs := allowlist.validate("TestNode_3"); errs == "" {
+		t.Logf("Expected error for allowlist without the local node, instead got none")
+		t.FailNow()
+	}
+
+	allowlist.Addresses = append(allowlist.Addresses, "example.com")
+	if errs := allowlist.validate("TestNode_1"); !strings.Contains(errs, "example.com") {
+		t.Logf("Expected error for hostname in allowlist, instead got: %v", errs)
+		t.FailNow()
+	}
+}
+
+func TestValidateAdmissionCustomTransport(t *testing.T) {
+	config := &Config{
+		ID:              "TestNode_1",
+		ClusterID:       "mainnet",
+		Allowlist:       AllowlistConfig{IDs: []string{"TestNode_1"}},
+		customTransport: true,
+	}
+	err := config.validate()
+	if err == nil || !strings.Contains(err.Error(), "allowlist must not be set") || !strings.Contains(err.Error(), "cluster_id must not be set") {
+		t.Logf("Expected errors for admission settings with a custom transport, instead got: %v", err)
+		t.FailNow()
+	}
+
+	config.customTransport = false
+	if err := config.validate(); err != nil && strings.Contains(err.Error(), "custom transport") {
+		t.Logf("Expected no errors for admission settings with memberlist, instead got: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestValidateClusterIDMigration(t *testing.T) {
+	config := &Config{ID: "TestNode_1", ClusterIDMigrationUntil: "tomorrow"}
+	err := config.validate()
+	if err == nil || !strings.Contains(err.Error(), "RFC 3339") || !strings.Contains(err.Error(), "cluster_id_migration_until must not be set if cluster_id is not set") {
+		t.Logf("Expected errors for invalid cluster_id_migration_until, instead got: %v", err)
+		t.FailNow()
+	}
+
+	config.ClusterID, config.ClusterIDMigrationUntil = "mainnet", "2026-01-02T15:04:05Z"
+	if err := config.validate(); err != nil && strings.Contains(err.Error(), "cluster_id_migration_until") {
+		t.Logf("Expected no errors for valid cluster_id_migration_until, instead got: %v", err)
+		t.FailNow()
+	}
+	if deadline := config.clusterIDMigrationDeadline(); !deadline.Equal(time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)) {
+		t.Logf("Unexpected migration deadline %v", deadline)
+		t.FailNow()
+	}
+}
+
+func TestAllowlistCheck(t *testing.T) {
+	list := (&AllowlistConfig{
+		IDs:       []string{"TestNode_1"},
+		Addresses: []string{"127.0.0.1", "10.0.0.0/8"},
+	}).parse()
+
+	if err := list.check("TestNode_1", net.ParseIP("10.1.2.3")); err != nil {
+		t.Logf("Expected allowlisted node to pass, instead got error: %v", err)
+		t.FailNow()
+	}
+	if err := list.check("TestNode_2", net.ParseIP("127.0.0.1")); err == nil {
+		t.Logf("Expected node with unlisted ID to be refused, instead error was nil")
+		t.FailNow()
+	}
+	if err := list.check("TestNode_1", net.ParseIP("192.168.0.1")); err == nil {
+		t.Logf("Expected node with unlisted address to be refused, instead error was nil")
+		t.FailNow()
+	}
+
+	if list := (&AllowlistConfig{}).parse(); list != nil {
+		t.Logf("Expected empty allowlist to be disabled, instead got %+v", list)
+		t.FailNow()
+	}
+}
+
+func TestAdmissionDelegate(t *testing.T) {
+	// The event channel needs room for all join and leave events below
+	node := initDummyNode("TestNode_1", 1, 8, 0)
+	delegate := &admissionDelegate{
+		logger:     node.logger,
+		localID:    "TestNode_1",
+		clusterID:  "mainnet",
+		maxNodes:   2,
+		allowlist:  (&AllowlistConfig{Addresses: []string{"127.0.0.1"}}).parse(),
+		events:     node.events,
+		onConflict: node.raiseConflict,
+		members:    map[string]string{},
+	}
+	delegate.NotifyJoin(testMember("TestNode_1", "127.0.0.1", "mainnet"))
+
+	if err := delegate.NotifyAlive(testMember("TestNode_2", "127.0.0.1", "mainnet")); err != nil {
+		t.Logf("Expected member of the same cluster to be accepted, instead got error: %v", err)
+		t.FailNow()
+	}
+	if err := delegate.NotifyAlive(testMember("TestNode_2", "127.0.0.1", "testnet")); err == nil {
+		t.Logf("Expected member of another cluster to be refused, instead error was nil")
+		t.FailNow()
+	}
+	if err := delegate.NotifyAlive(testMember("TestNode_2", "127.0.0.1", "")); err == nil {
+		t.Logf("Expected member without cluster ID to be refused, instead error was nil")
+		t.FailNow()
+	}
+	if err := delegate.NotifyAlive(testMember("TestNode_2", "10.0.0.1", "mainnet")); err == nil {
+		t.Logf("Expected member with unlisted address to be refused, instead error was nil")
+		t.FailNow()
+	}
+
+	// While the cluster adopts its cluster ID, members without one are accepted
+	delegate.migrationUntil = time.Now().Add(time.Minute)
+	if err := delegate.check("TestNode_2", net.ParseIP("127.0.0.1"), ""); err != nil {
+		t.Logf("Expected member without cluster ID to be accepted during the migration, instead got error: %v", err)
+		t.FailNow()
+	}
+	if err := delegate.check("TestNode_2", net.ParseIP("127.0.0.1"), "testnet"); err == nil {
+		t.Logf("Expected member of another cluster to be refused during the migration, instead error was nil")
+		t.FailNow()
+	}
+	delegate.migrationUntil = time.Now().Add(-time.Second)
+	if err := delegate.check("TestNode_2", net.ParseIP("127.0.0.1"), ""); err == nil {
+		t.Logf("Expected member without cluster ID to be refused after the migration, instead error was nil")
+		t.FailNow()
+	}
+
+	// Members without cluster ID don't start a migration on their own
+	delegate.migrationUntil = time.Time{}
+	delegate.NotifyJoin(testMember("TestNode_3", "127.0.0.1", ""))
+	if err := delegate.check("TestNode_2", net.ParseIP("127.0.0.1"), ""); err == nil {
+		t.Logf("Expected member without cluster ID to be refused without cluster_id_migration_until, instead error was nil")
+		t.FailNow()
+	}
+	delegate.NotifyLeave(testMember("TestNode_3", "127.0.0.1", ""))
+
+	// Nodes that haven't adopted a cluster ID yet accept everyone
+	unlabeled := &admissionDelegate{localID: "TestNode_3"}
+	if err := unlabeled.check("TestNode_1", net.ParseIP("127.0.0.1"), "mainnet"); err != nil {
+		t.Logf("Expected node without cluster ID to accept members with one, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	// The local node is part of the merged state of the other side
+	peers := []*memberlist.Node{testMember("TestNode_1", "127.0.0.1", ""), testMember("TestNode_2", "127.0.0.1", "mainnet")}
+	if err := delegate.NotifyMerge(peers); err != nil {
+		t.Logf("Expected merge with the same cluster to be accepted, instead got error: %v", err)
+		t.FailNow()
+	}
+	if err := delegate.NotifyMerge(append(peers, testMember("TestNode_3", "127.0.0.1", "testnet"))); err == nil {
+		t.Logf("Expected merge with another cluster to be refused, instead error was nil")
+		t.FailNow()
+	}
+
+	// The cluster is full once TestNode_2 has joined
+	delegate.NotifyJoin(testMember("TestNode_2", "127.0.0.1", "mainnet"))
+	if err := delegate.NotifyAlive(testMember("TestNode_2", "127.0.0.1", "mainnet")); err != nil {
+		t.Logf("Expected existing member to be accepted, instead got error: %v", err)
+		t.FailNow()
+	}
+	if err := delegate.NotifyAlive(testMember("TestNode_3", "127.0.0.1", "mainnet")); err == nil {
+		t.Logf("Expected member exceeding max_nodes to be refused, instead error was nil")
+		t.FailNow()
+	}
+	if err := delegate.NotifyMerge(append(peers, testMember("TestNode_3", "127.0.0.1", "mainnet"))); err == nil {
+		t.Logf("Expected merge exceeding max_nodes to be refused, instead error was nil")
+		t.FailNow()
+	}
+
+	// Dead members don't count
+	dead := testMember("TestNode_3", "127.0.0.1", "mainnet")
+	dead.State = memberlist.StateDead
+	if err := delegate.NotifyMerge(append(peers, dead)); err != nil {
+		t.Logf("Expected dead member not to be counted, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	delegate.NotifyLeave(testMember("TestNode_2", "127.0.0.1", "mainnet"))
+	if err := delegate.NotifyAlive(testMember("TestNode_3", "127.0.0.1", "mainnet")); err != nil {
+		t.Logf("Expected member to be accepted after another one left, instead got error: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestJoinRefused(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(3)
+
+	// node1 only admits node2
+	node1 := initDummyNode("TestNode_1", 1, 3, ports[0])
+	node2 := initDummyNode("TestNode_2", 1, 3, ports[1])
+	node3 := initDummyNode("TestNode_3", 1, 3, ports[2])
+	node1.config.Allowlist.IDs = []string{"TestNode_1", "TestNode_2"}
+
+	for _, node := range []*Node{node1, node2, node3} {
+		node.createMemberlist()
+		defer node.memberlist.Shutdown()
+		node.config.PeerList = []string{node1.LocalAddr()}
+	}
+
+	if err := node2.tryJoin(); err != nil {
+		t.Logf("Expected allowlisted node2 to join, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	err := node3.tryJoin()
+	if err == nil || !strings.Contains(err.Error(), "TestNode_3 is not on the allowlist") {
+		t.Logf("Expected node3 to be refused with the reason, instead got error: %v", err)
+		t.FailNow()
+	}
+	if num := node1.memberlist.NumMembers(); num != 2 {
+		t.Logf("Expected node1 to have 2 members, instead got %v", num)
+		t.FailNow()
+	}
+}
+
+func TestJoinExceedingMaxNodes(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(3)
+
+	// node3 would exceed max_nodes
+	node1 := initDummyNode("TestNode_1", 1, 2, ports[0])
+	node2 := initDummyNode("TestNode_2", 1, 2, ports[1])
+	node3 := initDummyNode("TestNode_3", 1, 2, ports[2])
+
+	for _, node := range []*Node{node1, node2, node3} {
+		node.createMemberlist()
+		defer node.memberlist.Shutdown()
+		node.config.PeerList = []string{node1.LocalAddr()}
+	}
+
+	if err := node2.tryJoin(); err != nil {
+		t.Logf("Expected node2 to join, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	err := node3.tryJoin()
+	if err == nil || !strings.Contains(err.Error(), "max_nodes") {
+		t.Logf("Expected node3 to be refused due to max_nodes, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	// Even if node3 bypasses the join request, the cluster doesn't merge with it
+	if _, err := node3.memberlist.Join([]string{node1.LocalAddr()}); err == nil {
+		t.Logf("Expected merge exceeding max_nodes to fail, instead error was nil")
+		t.FailNow()
+	}
+	if num := node1.memberlist.NumMembers(); num != 2 {
+		t.Logf("Expected node1 to have 2 members, instead got %v", num)
+		t.FailNow()
+	}
+}
+
+func TestAdmissionDelegateConflict(t *testing.T) {
+	node := initDummyNode("TestNode_1", 1, 8, 0)
+	delegate := &admissionDelegate{
+		logger:     node.logger,
+		localID:    "TestNode_1",
+		events:     node.events,
+		onConflict: node.raiseConflict,
+		members:    map[string]string{},
+	}
+	delegate.NotifyJoin(testMember("TestNode_1", "127.0.0.1", ""))
+	delegate.NotifyJoin(testMember("TestNode_2", "127.0.0.1", ""))
+
+	// Another node claims the ID of the local node
+	duplicate := testMember("TestNode_1", "127.0.0.2", "")
+	if err := delegate.NotifyMerge([]*memberlist.Node{duplicate}); !errors.Is(err, ErrDuplicateID) {
+		t.Logf("Expected merge with a duplicate of the local node to be refused, instead got error: %v", err)
+		t.FailNow()
+	}
+	if err := delegate.takeConflict(); !errors.Is(err, ErrDuplicateID) {
+		t.Logf("Expected conflict to be recorded, instead got: %v", err)
+		t.FailNow()
+	}
+	if err := delegate.takeConflict(); err != nil {
+		t.Logf("Expected conflict to be cleared, instead got: %v", err)
+		t.FailNow()
+	}
+
+	// Another node claims the ID of a member
+	duplicate = testMember("TestNode_2", "127.0.0.2", "")
+	if err := delegate.NotifyMerge([]*memberlist.Node{duplicate}); !errors.Is(err, ErrDuplicateID) {
+		t.Logf("Expected merge with a duplicate of a member to be refused, instead got error: %v", err)
+		t.FailNow()
+	}
+	if err := delegate.takeConflict(); err != nil {
+		t.Logf("Expected only conflicts with the local node to be recorded, instead got: %v", err)
+		t.FailNow()
+	}
+
+	// Conflicts learned about via gossip are reported asynchronously
+	delegate.NotifyConflict(testMember("TestNode_2", "127.0.0.1", ""), duplicate)
+	for i := 0; node.GetMetrics().IDConflicts != 3; i++ {
+		if i == 100 {
+			t.Logf("Expected 3 conflicts to be counted, instead got %v", node.GetMetrics().IDConflicts)
+			t.FailNow()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJoinDuplicateID(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(3)
+
+	// node3 has been started with the ID of node2
+	conflicts := make(chan Conflict, 4)
+	node1 := initDummyNode("TestNode_1", 1, 3, ports[0])
+	node2 := initDummyNode("TestNode_2", 1, 3, ports[1])
+	node3 := initDummyNode("TestNode_2", 1, 3, ports[2])
+	WithConflictHandler(func(conflict Conflict) { conflicts <- conflict })(node1)
+
+	for _, node := range []*Node{node1, node2, node3} {
+		node.createMemberlist()
+		defer node.memberlist.Shutdown()
+		node.config.PeerList = []string{node1.LocalAddr()}
+	}
+
+	if err := node2.tryJoin(); err != nil {
+		t.Logf("Expected node2 to join, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	if err := node3.tryJoin(); !errors.Is(err, ErrDuplicateID) {
+		t.Logf("Expected node3 to be refused due to its duplicate ID, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	select {
+	case conflict := <-conflicts:
+		if conflict.ID != "TestNode_2" || conflict.ExistingAddr != node2.LocalAddr() || conflict.ConflictingAddr != node3.LocalAddr() {
+			t.Logf("Expected conflict between node2 and node3, instead got %+v", conflict)
+			t.FailNow()
+		}
+	case <-time.After(time.Second):
+		t.Logf("Expected conflict handler to be called, instead nothing happened")
+		t.FailNow()
+	}
+
+	// Even if node3 bypasses the join request, the cluster doesn't merge with it
+	if _, err := node3.memberlist.Join([]string{node1.LocalAddr()}); err == nil {
+		t.Logf("Expected merge with a duplicate ID to fail, instead error was nil")
+		t.FailNow()
+	}
+	if member, _ := node1.getNodeByName("TestNode_2"); member == nil || member.Address() != node2.LocalAddr() {
+		t.Logf("Expected node1 to keep node2 as TestNode_2, instead got %v", member)
+		t.FailNow()
+	}
+}
+
+func TestJoinRestartedNode(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(3)
+
+	// node3 is node2 restarted at another address before node1 has detected node2 as failed
+	conflicts := make(chan Conflict, 4)
+	node1 := initDummyNode("TestNode_1", 1, 3, ports[0])
+	node2 := initDummyNode("TestNode_2", 1, 3, ports[1])
+	node3 := initDummyNode("TestNode_2", 1, 3, ports[2])
+	WithConflictHandler(func(conflict Conflict) { conflicts <- conflict })(node1)
+
+	for _, node := range []*Node{node1, node2, node3} {
+		node.createMemberlist()
+		defer node.memberlist.Shutdown()
+		node.config.PeerList = []string{node1.LocalAddr()}
+	}
+
+	if err := node2.tryJoin(); err != nil {
+		t.Logf("Expected node2 to join, instead got error: %v", err)
+		t.FailNow()
+	}
+	node2.memberlist.Shutdown()
+
+	// The join is refused without reporting a conflict until node2 has been detected as failed
+	if err := node3.tryJoin(); err == nil || errors.Is(err, ErrDuplicateID) {
+		t.Logf("Expected node3 to be asked to retry, instead got error: %v", err)
+		t.FailNow()
+	}
+	select {
+	case conflict := <-conflicts:
+		t.Logf("Expected no conflict to be reported, instead got %+v", conflict)
+		t.FailNow()
+	default:
+	}
+	if conflicts := node1.GetMetrics().IDConflicts; conflicts != 0 {
+		t.Logf("Expected no conflict to be counted, instead got %v", conflicts)
+		t.FailNow()
+	}
+}
+
+func TestJoinUnreachablePeers(t *testing.T) {
+	// Reserve ports for this test, nothing listens on the last one
+	ports := reservePorts(3)
+
+	node1 := initDummyNode("TestNode_1", 1, 2, ports[0])
+	node2 := initDummyNode("TestNode_2", 1, 2, ports[1])
+	unreachable := fmt.Sprintf("127.0.0.1:%v", ports[2])
+
+	for _, node := range []*Node{node1, node2} {
+		node.createMemberlist()
+		defer node.memberlist.Shutdown()
+	}
+
+	// Only the peers that have admitted node2 are passed on to the join
+	peers, err := node2.requestAdmission([]string{unreachable, node1.LocalAddr()})
+	if err != nil {
+		t.Logf("Expected node2 to be admitted by node1, instead got error: %v", err)
+		t.FailNow()
+	}
+	if len(peers) != 1 || peers[0] != node1.LocalAddr() {
+		t.Logf("Expected only node1 to be joined, instead got %v", peers)
+		t.FailNow()
+	}
+
+	node2.config.PeerList = []string{unreachable, node1.LocalAddr()}
+	if err := node2.tryJoin(); err != nil {
+		t.Logf("Expected node2 to join despite the unreachable peer, instead got error: %v", err)
+		t.FailNow()
+	}
+	if num := node1.memberlist.NumMembers(); num != 2 {
+		t.Logf("Expected node1 to have 2 members, instead got %v", num)
+		t.FailNow()
+	}
+
+	if _, err := node2.requestAdmission([]string{unreachable}); err == nil || !strings.Contains(err.Error(), "none of the peers could be reached") {
+		t.Logf("Expected an error if no peer could be reached, instead got: %v", err)
+		t.FailNow()
+	}
+}
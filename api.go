@@ -4,8 +4,8 @@ import "log"
 
 // InitNode initializes a new raftified node.
 // Blocks until cluster is successfully bootstrapped.
-func InitNode(logger *log.Logger, workingDir string) (*Node, error) {
-	return initNode(logger, workingDir)
+func InitNode(logger *log.Logger, workingDir string, opts ...Option) (*Node, error) {
+	return initNode(logger, workingDir, opts...)
 }
 
 // Shutdown stops all timers/tickers and listeners, closes channels, leaves the
@@ -17,8 +17,12 @@ func (n *Node) Shutdown() error {
 }
 
 // GetHealthScore returns the health score according to memberlist. Lower numbers
-// are better, and 0 means "totally healthy".
+// are better, and 0 means "totally healthy". Always 0 if another transport has been
+// passed in.
 func (n *Node) GetHealthScore() int {
+	if n.memberlist == nil {
+		return 0
+	}
 	return n.memberlist.GetHealthScore()
 }
 
@@ -26,12 +30,35 @@ func (n *Node) GetHealthScore() int {
 // value "address" in the host:port format.
 func (n *Node) GetMembers() map[string]string {
 	members := map[string]string{}
-	for _, member := range n.memberlist.Members() {
+	for _, member := range n.network.Members() {
 		members[member.Name] = member.Address()
 	}
 	return members
 }
 
+// LocalAddr returns the address in the host:port format other cluster members reach the
+// node at. If the bind_port is 0, it contains the port picked by the operating system.
+func (n *Node) LocalAddr() string {
+	return n.network.LocalMember().Address()
+}
+
+// GetMetrics returns the counters of the messages the node has rejected since it was started.
+func (n *Node) GetMetrics() Metrics {
+	return n.metrics.snapshot()
+}
+
+// GetProtocolVersions returns the range of protocol versions every cluster member speaks by
+// node ID, including the local node. Use it to follow rolling upgrades.
+func (n *Node) GetProtocolVersions() map[string]ProtocolVersions {
+	return n.protocolMatrix()
+}
+
+// GetClusterProtocolVersion returns the highest protocol version spoken by all cluster members.
+// Message types introduced in later versions aren't sent before every member has been upgraded.
+func (n *Node) GetClusterProtocolVersion() int {
+	return n.clusterVersion()
+}
+
 // GetID returns the node's unique ID.
 func (n *Node) GetID() string {
 	return n.config.ID
@@ -42,3 +69,11 @@ func (n *Node) GetID() string {
 func (n *Node) GetState() State {
 	return n.state
 }
+
+// GetPaths returns the reachability of every cluster member but the local node via each of its
+// addresses by node ID. The address known by the memberlist comes first, followed by the
+// additional addresses the member advertises. Paths count as reachable if a message has been
+// received via them recently.
+func (n *Node) GetPaths() map[string][]PathStatus {
+	return n.pathStatus()
+}
@@ -64,3 +64,36 @@ func TestAPI(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestLocalAddrBindPortZero(t *testing.T) {
+	// Initialize dummy node with a port picked by the operating system
+	node := initDummyNode("TestNode", 1, 1, 0)
+
+	// Create directory for test data
+	os.MkdirAll(node.workingDir+"/testing/TestNode", 0755)
+	defer os.RemoveAll(node.workingDir + "/testing")
+
+	// Write configuration data to raftify.json file
+	nodesBytes, _ := json.Marshal(node.config)
+	ioutil.WriteFile(node.workingDir+"/testing/TestNode/raftify.json", nodesBytes, 0755)
+
+	node, err := InitNode(node.logger, node.workingDir+"/testing/TestNode")
+	if err != nil {
+		t.Logf("Expected node to initialize successfully, instead got error: %v", err.Error())
+		t.FailNow()
+	}
+
+	if node.LocalAddr() == "127.0.0.1:0" {
+		t.Log("Expected local address to contain the port picked by the operating system, instead got port 0")
+		t.FailNow()
+	}
+	if members := node.GetMembers(); members["TestNode"] != node.LocalAddr() {
+		t.Logf("Expected memberlist to contain %v, instead got %v", node.LocalAddr(), members["TestNode"])
+		t.FailNow()
+	}
+
+	if err := node.Shutdown(); err != nil {
+		t.Logf("Expected successful shutdown of %v, instead got error: %v", node.config.ID, err.Error())
+		t.FailNow()
+	}
+}
@@ -1,14 +1,16 @@
 package raftify
 
 import (
+	"errors"
 	"time"
 )
 
 // toBootstrap initiates the transition into the bootstrap mode. In this mode, nodes wait for
 // the expected number of nodes specified in the expect field of the raftify.json to go online
-// and start all nodes of the cluster at the same time.
-func (n *Node) toBootstrap() {
-	n.logger.Printf("[DEBUG] raftify: %v/%v nodes for bootstrap...\n", len(n.memberlist.Members()), n.config.Expect)
+// and start all nodes of the cluster at the same time. Returns an error if the node ID is
+// already used by a member of the cluster since retrying the join can't succeed.
+func (n *Node) toBootstrap() error {
+	n.logger.Printf("[DEBUG] raftify: %v/%v nodes for bootstrap...\n", len(n.network.Members()), n.config.Expect)
 	n.state = Bootstrap
 
 	if n.config.Expect == 1 {
@@ -21,51 +23,73 @@ func (n *Node) toBootstrap() {
 		// away since that would cause double-signing. Instead they become followers which gives
 		// enough leeway for heartbeat messages to be sent and received such that no two leaders
 		// exist simultaneously.
-		if len(n.config.PeerList) == 0 {
+		if !n.hasPeers() {
 			n.toLeader()
 		} else {
-			n.logger.Printf("[INFO] raftify: Expecting 1 node, but found %v peers. Going through full leader election cycle...", len(n.config.PeerList))
+			n.logger.Println("[INFO] raftify: Expecting 1 node, but found peers. Going through full leader election cycle...")
 			n.toFollower(0)
 
 			// Try joining one of the peers only once. If none can be reached, it just continues
 			// operation as a follower anc gradually works its way up to becoming the leader.
-			if err := n.tryJoin(); err != nil {
+			if err := n.tryJoin(); errors.Is(err, ErrDuplicateID) {
+				return err
+			} else if err != nil {
 				n.logger.Printf("[ERR] raftify: failed to join cluster: %v\nTrying again...\n", err.Error())
 			}
 		}
 
 		n.printMemberlist()
-		return
+		return nil
 	}
 
-	if err := n.tryJoin(); err != nil {
+	if err := n.tryJoin(); errors.Is(err, ErrDuplicateID) {
+		return err
+	} else if err != nil {
 		n.logger.Printf("[ERR] raftify: failed to join cluster: %v\nTrying again...\n", err.Error())
 	}
+	return nil
 }
 
 // runBootstrap waits for the number of nodes specified in the expect field of the raftify.json
-// to join the cluster. This function is called within the runLoop function.
-func (n *Node) runBootstrap() {
+// to join the cluster. This function is called within the runLoop function. Returns an error
+// if the bootstrap has to be aborted.
+func (n *Node) runBootstrap() error {
+	retry := n.clock.NewTimer(5 * time.Second)
+	defer retry.Stop()
+
+	events, retryC := n.network.Events(), retry.C()
+	n.idle(events, retryC)
+
 	select {
-	case <-n.events.eventCh:
-		n.logger.Printf("[DEBUG] raftify: %v/%v nodes for bootstrap...\n", len(n.memberlist.Members()), n.config.Expect)
+	case <-events:
+		n.logger.Printf("[DEBUG] raftify: %v/%v nodes for bootstrap...\n", len(n.network.Members()), n.config.Expect)
 		n.printMemberlist()
 		n.saveState()
 
-		if len(n.memberlist.Members()) >= n.config.Expect {
+		if len(n.network.Members()) >= n.config.Expect {
 			n.logger.Println("[DEBUG] raftify: Successfully bootstrapped cluster ✓")
 			n.toFollower(0)
 
 			// Signal successful bootstrap and allow InitNode to return.
-			n.bootstrapCh <- true
+			n.bootstrapCh <- nil
 		}
 
-	case <-time.After(5 * time.Second):
-		if err := n.tryJoin(); err != nil {
+	case <-retryC:
+		if err := n.tryJoin(); errors.Is(err, ErrDuplicateID) {
+			return err
+		} else if err != nil {
 			n.logger.Printf("[ERR] raftify: failed to join cluster: %v\nTrying again...\n", err.Error())
 		}
 
 	case <-n.shutdownCh:
 		n.toPreShutdown()
 	}
+	return nil
+}
+
+// abortBootstrap shuts down the transport and passes the error on to the blocking InitNode.
+func (n *Node) abortBootstrap(err error) {
+	n.logger.Printf("[ERR] raftify: Aborting bootstrap: %v\n", err.Error())
+	n.network.Shutdown()
+	n.bootstrapCh <- err
 }
@@ -1,8 +1,6 @@
 package raftify
 
-import (
-	"encoding/json"
-)
+import "errors"
 
 // toCandidate initiates the transition into a candidate node for the next term. Calling toCandidate
 // on a node that already is in the candidate state just resets the data.
@@ -17,7 +15,7 @@ func (n *Node) toCandidate() {
 
 	n.currentTerm++
 	n.votedFor = n.config.ID
-	n.voteList.reset(n.memberlist.Members())
+	n.voteList.reset(n.network.Members())
 	n.voteList.remove(n.config.ID) // Self vote
 	n.state = Candidate
 
@@ -27,18 +25,23 @@ func (n *Node) toCandidate() {
 
 // runCandidate runs the candidate loop. This function is called within the runLoop function.
 func (n *Node) runCandidate() {
+	messages, ticker, timeout, events := n.network.Messages(), n.messageTicker.C(), n.timeoutTimer.C(), n.membershipEvents()
+	n.idle(messages, ticker, timeout, events)
+
 	select {
-	case msgBytes := <-n.messages.messageCh:
-		var msg Message
-		if err := json.Unmarshal(msgBytes, &msg); err != nil {
-			n.logger.Printf("[ERR] raftify: error while unmarshaling wrapper message: %v\n", err.Error())
+	case in := <-messages:
+		msg, err := n.decodeMessage(in)
+		if err != nil {
+			n.logger.Printf("[ERR] raftify: %v\n", err.Error())
 			break
 		}
 
 		switch msg.Type {
 		case HeartbeatMsg:
 			var content Heartbeat
-			if err := json.Unmarshal(msg.Content, &content); err != nil {
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
 				n.logger.Printf("[ERR] raftify: error while unmarshaling heartbeat message: %v\n", err.Error())
 				break
 			}
@@ -46,7 +49,9 @@ func (n *Node) runCandidate() {
 
 		case PreVoteRequestMsg:
 			var content PreVoteRequest
-			if err := json.Unmarshal(msg.Content, &content); err != nil {
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
 				n.logger.Printf("[ERR] raftify: error while unmarshaling prevote request message: %v\n", err.Error())
 				break
 			}
@@ -54,7 +59,9 @@ func (n *Node) runCandidate() {
 
 		case VoteRequestMsg:
 			var content VoteRequest
-			if err := json.Unmarshal(msg.Content, &content); err != nil {
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
 				n.logger.Printf("[ERR] raftify: error while unmarshaling vote request message: %v\n", err.Error())
 				break
 			}
@@ -62,7 +69,9 @@ func (n *Node) runCandidate() {
 
 		case VoteResponseMsg:
 			var content VoteResponse
-			if err := json.Unmarshal(msg.Content, &content); err != nil {
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
 				n.logger.Printf("[ERR] raftify: error while unmarshaling vote response message: %v\n", err.Error())
 				break
 			}
@@ -70,20 +79,32 @@ func (n *Node) runCandidate() {
 
 		case NewQuorumMsg:
 			var content NewQuorum
-			if err := json.Unmarshal(msg.Content, &content); err != nil {
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
 				n.logger.Printf("[ERR] raftify: error while unmarshaling new quorum message: %v\n", err.Error())
 				break
 			}
 			n.handleNewQuorum(content)
 
+		case AckMsg:
+			var content Ack
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
+				n.logger.Printf("[ERR] raftify: error while unmarshaling ack message: %v\n", err.Error())
+				break
+			}
+			n.handleAck(content)
+
 		default:
 			n.logger.Printf("[WARN] raftify: received %v as candidate, discarding...\n", msg.Type.toString())
 		}
 
-	case <-n.messageTicker.C:
+	case <-ticker:
 		n.sendVoteRequestToAll(n.voteList.pending)
 
-	case <-n.timeoutTimer.C:
+	case <-timeout:
 		n.logger.Println("[DEBUG] raftify: Election timeout elapsed")
 
 		if n.quorumReached(n.voteList.received) {
@@ -94,8 +115,11 @@ func (n *Node) runCandidate() {
 
 		n.toCandidate()
 
-	case <-n.events.eventCh:
-		n.saveState()
+	case event := <-events:
+		n.handleMembershipEvent(event)
+
+	case call := <-n.keyringCh:
+		n.rejectKeyringOp(call)
 
 	case <-n.shutdownCh:
 		n.toPreShutdown()
@@ -0,0 +1,138 @@
+package raftify
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"time"
+)
+
+// Clock is the source of time the node's election timeouts, message intervals, retransmissions
+// and other deadlines are measured with. Defaults to the system clock. Other clocks can be
+// passed in with WithClock, e.g. to run nodes on a virtual clock in simulations.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTimer creates a timer that delivers the current time on its channel once the given
+	// duration has elapsed.
+	NewTimer(d time.Duration) Timer
+
+	// NewTicker creates a ticker that delivers the current time on its channel every time the
+	// given duration has elapsed.
+	NewTicker(d time.Duration) Ticker
+
+	// AfterFunc waits for the given duration to elapse and then calls f in its own
+	// goroutine. The returned timer can be used to cancel or reset the call, its channel
+	// isn't used.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a single event created by a Clock. It behaves like a time.Timer.
+type Timer interface {
+	// C returns the channel the time is delivered on once the timer fires.
+	C() <-chan time.Time
+
+	// Reset changes the timer to fire after the given duration. Returns whether the timer
+	// had been active.
+	Reset(d time.Duration) bool
+
+	// Stop prevents the timer from firing. Returns whether the timer had been active.
+	Stop() bool
+}
+
+// Ticker is a periodic event created by a Clock. It behaves like a time.Ticker.
+type Ticker interface {
+	// C returns the channel the ticks are delivered on.
+	C() <-chan time.Time
+
+	// Stop turns off the ticker. No more ticks are delivered afterwards.
+	Stop()
+}
+
+// Idler can be implemented by clocks that need to know when a node waits for its next event, e.g.
+// to run nodes one event after another in simulations.
+type Idler interface {
+	// Idle is called by the node's main loop right before it waits for its next event with the
+	// channels it waits on, i.e. the message and event channels of the transport and the
+	// channels of the clock's timers and tickers. Channels the node doesn't wait on are nil.
+	Idle(chans ...interface{})
+}
+
+// Rand is the source of randomness the election timeouts are drawn from. It is only used by the
+// node's own goroutine and thus doesn't need to be safe for concurrent use. Defaults to a source
+// seeded individually for every node so that nodes started at the same time don't draw the same
+// timeouts. A *rand.Rand can be passed in with WithRand.
+type Rand interface {
+	// Intn returns a non-negative pseudo-random number in [0,n).
+	Intn(n int) int
+}
+
+// systemClock is the default clock based on the time package.
+type systemClock struct{}
+
+// Now implements the Clock interface.
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer implements the Clock interface.
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{timer: time.NewTimer(d)}
+}
+
+// NewTicker implements the Clock interface.
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{ticker: time.NewTicker(d)}
+}
+
+// AfterFunc implements the Clock interface.
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return systemTimer{timer: time.AfterFunc(d, f)}
+}
+
+// systemTimer is a Timer backed by a time.Timer.
+type systemTimer struct {
+	timer *time.Timer
+}
+
+// C implements the Timer interface.
+func (t systemTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+// Reset implements the Timer interface.
+func (t systemTimer) Reset(d time.Duration) bool {
+	return t.timer.Reset(d)
+}
+
+// Stop implements the Timer interface.
+func (t systemTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+// systemTicker is a Ticker backed by a time.Ticker.
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+// C implements the Ticker interface.
+func (t systemTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+// Stop implements the Ticker interface.
+func (t systemTicker) Stop() {
+	t.ticker.Stop()
+}
+
+// newRand returns a source of randomness seeded from the operating system's random number
+// generator. The global source of the math/rand package isn't used since it always starts with
+// the same seed, which would make all nodes draw the same sequence of election timeouts.
+func newRand() Rand {
+	var seed [8]byte
+	if _, err := crand.Read(seed[:]); err != nil {
+		return rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(seed[:]))))
+}
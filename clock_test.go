@@ -0,0 +1,146 @@
+package raftify
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// recordingClock is a Clock whose timers and tickers never fire but record how they are used.
+type recordingClock struct {
+	timers  []*recordingTimer
+	tickers []*recordingTimer
+}
+
+func (c *recordingClock) Now() time.Time {
+	return time.Time{}
+}
+
+func (c *recordingClock) NewTimer(d time.Duration) Timer {
+	t := &recordingTimer{c: make(chan time.Time), durations: []time.Duration{d}, active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *recordingClock) NewTicker(d time.Duration) Ticker {
+	t := &recordingTimer{c: make(chan time.Time), durations: []time.Duration{d}, active: true}
+	c.tickers = append(c.tickers, t)
+	return recordingTicker{t}
+}
+
+func (c *recordingClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.NewTimer(d)
+}
+
+// recordingTimer records the durations it has been reset to.
+type recordingTimer struct {
+	c         chan time.Time
+	durations []time.Duration
+	active    bool
+}
+
+func (t *recordingTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *recordingTimer) Reset(d time.Duration) bool {
+	active := t.active
+	t.durations = append(t.durations, d)
+	t.active = true
+	return active
+}
+
+func (t *recordingTimer) Stop() bool {
+	active := t.active
+	t.active = false
+	return active
+}
+
+type recordingTicker struct {
+	*recordingTimer
+}
+
+func (t recordingTicker) Stop() {
+	t.recordingTimer.Stop()
+}
+
+func TestClockAndRand(t *testing.T) {
+	clock := &recordingClock{}
+	node := initDummyNode("TestNode", 1, 1, 0)
+	WithClock(clock)(node)
+	WithRand(rand.New(rand.NewSource(1)))(node)
+
+	node.timeoutTimer = clock.NewTimer(time.Second)
+	node.messageTicker = clock.NewTicker(time.Second)
+
+	// Timeouts drawn from sources with the same seed are the same
+	expected := rand.New(rand.NewSource(1))
+	for i := 0; i < 3; i++ {
+		node.resetTimeout()
+		timeout := time.Duration(expected.Intn(MaxTimeout-MinTimeout)+MinTimeout) * time.Millisecond
+		if last := clock.timers[0].durations[len(clock.timers[0].durations)-1]; last != timeout {
+			t.Logf("Expected timeout of %v, instead got %v", timeout, last)
+			t.FailNow()
+		}
+	}
+
+	// Restarting the message ticker stops the previous one
+	node.startMessageTicker()
+	node.startMessageTicker()
+	if len(clock.tickers) != 3 || clock.tickers[0].active || clock.tickers[1].active || !clock.tickers[2].active {
+		t.Logf("Expected only the last of %v tickers to be active", len(clock.tickers))
+		t.FailNow()
+	}
+	if interval := clock.tickers[2].durations[0]; interval != TickerInterval*time.Millisecond {
+		t.Logf("Expected ticker interval of %vms, instead got %v", TickerInterval, interval)
+		t.FailNow()
+	}
+}
+
+func TestNewRand(t *testing.T) {
+	// Nodes started at the same time draw different election timeouts
+	first, second := newRand(), newRand()
+	same := true
+	for i := 0; i < 10; i++ {
+		if first.Intn(MaxTimeout-MinTimeout) != second.Intn(MaxTimeout-MinTimeout) {
+			same = false
+		}
+	}
+	if same {
+		t.Logf("Expected separately seeded sources to draw different timeouts")
+		t.FailNow()
+	}
+}
+
+func TestClockDeadlines(t *testing.T) {
+	clock := &recordingClock{}
+	node := initDummyNode("TestNode", 2, 2, 0)
+	WithClock(clock)(node)
+	node.network = newFakeTransport()
+	node.config.PeerList = []string{"127.0.0.1:1"}
+
+	// The bootstrap retry is scheduled on the clock and stopped once the loop returns
+	go func() { node.shutdownCh <- nil }()
+	node.runBootstrap()
+	if len(clock.timers) != 1 || clock.timers[0].durations[0] != 5*time.Second || clock.timers[0].active {
+		t.Logf("Expected a stopped bootstrap retry timer of 5s, instead got %v timers", len(clock.timers))
+		t.FailNow()
+	}
+
+	// Retransmissions are scheduled on the clock
+	node.config.Delivery = DeliveryConfig{Acks: true, AckTimeout: 300, MaxRetransmits: 1}
+	member := pathMember("TestNode_2")
+	node.network = newFakeTransport(member)
+	node.send(member, VoteResponseMsg, VoteResponse{Term: 1, FollowerID: "TestNode", VoteGranted: true})
+	if len(clock.timers) != 2 || clock.timers[1].durations[0] != 300*time.Millisecond {
+		t.Logf("Expected a retransmission timer of 300ms, instead got %v timers", len(clock.timers))
+		t.FailNow()
+	}
+
+	// Announced leaves expire according to the clock
+	node.handleNewQuorum(NewQuorum{NewQuorum: 1, LeavingID: "TestNode_2"})
+	if leave := node.pendingLeaves.pending["TestNode_2"]; !leave.deadline.Equal(clock.Now().Add(LeaveTimeout * time.Millisecond)) {
+		t.Logf("Expected the leave to expire %vms after the clock's time, instead got %v", LeaveTimeout, leave.deadline)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,308 @@
+package raftify
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+// wireFormat is the encoding of a raftify message on the wire.
+type wireFormat uint8
+
+const (
+	// The message is encoded as JSON. JSON messages always start with '{'.
+	formatJSON wireFormat = iota
+
+	// The message is encoded as msgpack and prefixed with msgpackMarker.
+	formatMsgpack
+)
+
+// msgpackMarker is the first byte of every msgpack-encoded message. It can never be the first
+// byte of a JSON message.
+const msgpackMarker = 'M'
+
+// msgpackHandle is the handle used to encode and decode msgpack messages. Byte slices are
+// encoded as binary data and fields unknown to the receiver are rejected just like with JSON.
+var msgpackHandle = func() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{WriteExt: true, RawToString: true}
+	h.ErrorIfNoField = true
+	return h
+}()
+
+// msgpackPeekHandle is the handle used to decode single fields of msgpack messages while
+// skipping all others.
+var msgpackPeekHandle = &codec.MsgpackHandle{WriteExt: true, RawToString: true}
+
+// versionFormat returns the wire format messages encoded in the given protocol version are sent in.
+func versionFormat(version int) wireFormat {
+	if version >= protocolMsgpack {
+		return formatMsgpack
+	}
+	return formatJSON
+}
+
+// formatOf returns the wire format of a received message.
+func formatOf(payload []byte) wireFormat {
+	if len(payload) > 0 && payload[0] == msgpackMarker {
+		return formatMsgpack
+	}
+	return formatJSON
+}
+
+// marshal encodes v in the given wire format.
+func marshal(format wireFormat, v interface{}) ([]byte, error) {
+	if format == formatJSON {
+		return json.Marshal(v)
+	}
+	var out []byte
+	err := codec.NewEncoderBytes(&out, msgpackHandle).Encode(v)
+	return out, err
+}
+
+// unmarshal decodes data received in the given wire format into v. Like unmarshalStrict, it
+// rejects unknown fields and trailing data.
+func unmarshal(format wireFormat, data []byte, v interface{}) error {
+	if format == formatJSON {
+		return unmarshalStrict(data, v)
+	}
+	if err := checkMsgpack(data); err != nil {
+		return err
+	}
+	return codec.NewDecoderBytes(data, msgpackHandle).Decode(v)
+}
+
+// checkMsgpack walks the msgpack value in data without decoding it and makes sure it consists of
+// exactly one value whose lengths all fit into data. The decoder allocates containers of the
+// declared length up front, so a few bytes declaring a huge array must never reach it.
+func checkMsgpack(data []byte) error {
+	errTruncated := errors.New("truncated msgpack data")
+
+	pos, pending := 0, 1
+	for ; pending > 0; pending-- {
+		if pos >= len(data) {
+			return errTruncated
+		}
+		b := data[pos]
+		pos++
+
+		var size, items, lenBytes int
+		switch {
+		case b <= 0x7f || b >= 0xe0 || b == 0xc0 || b == 0xc2 || b == 0xc3:
+			// Fixed integers, nil and booleans consist of the type byte only.
+		case b <= 0x8f:
+			items = 2 * int(b&0x0f)
+		case b <= 0x9f:
+			items = int(b & 0x0f)
+		case b <= 0xbf:
+			size = int(b & 0x1f)
+		case b == 0xc4 || b == 0xd9:
+			lenBytes = 1
+		case b == 0xc5 || b == 0xda:
+			lenBytes = 2
+		case b == 0xc6 || b == 0xdb:
+			lenBytes = 4
+		case b == 0xc7, b == 0xc8, b == 0xc9:
+			lenBytes = 1 << (b - 0xc7)
+			size = 1 // The extension type
+		case b == 0xca:
+			size = 4
+		case b == 0xcb:
+			size = 8
+		case b >= 0xcc && b <= 0xcf:
+			size = 1 << (b - 0xcc)
+		case b >= 0xd0 && b <= 0xd3:
+			size = 1 << (b - 0xd0)
+		case b >= 0xd4 && b <= 0xd8:
+			size = 1 + 1<<(b-0xd4)
+		case b == 0xdc, b == 0xdd:
+			lenBytes = 2 << (b - 0xdc)
+			items = -1
+		case b == 0xde, b == 0xdf:
+			lenBytes = 2 << (b - 0xde)
+			items = -2
+		default:
+			return fmt.Errorf("invalid msgpack type 0x%x", b)
+		}
+
+		if lenBytes > 0 {
+			if len(data)-pos < lenBytes {
+				return errTruncated
+			}
+			var length uint64
+			for _, lb := range data[pos : pos+lenBytes] {
+				length = length<<8 | uint64(lb)
+			}
+			pos += lenBytes
+			if length > uint64(len(data)) {
+				return errTruncated
+			}
+			switch items {
+			case -1:
+				items = int(length)
+			case -2:
+				items = 2 * int(length)
+			default:
+				size += int(length)
+			}
+		}
+
+		// Every item takes up at least one byte.
+		if len(data)-pos < size || len(data)-pos-size < items {
+			return errTruncated
+		}
+		pos += size
+		pending += items
+	}
+
+	if pos != len(data) {
+		return errors.New("unexpected data after the message")
+	}
+	return nil
+}
+
+// signingPayload returns the bytes a message's signature is computed over. The message type,
+// the sender, the recipient, the incarnation, the sequence number, the protocol version, whether
+// an ack has been requested and the content are all covered so that none of them can be swapped
+// out. Messages are signed the way nodes speaking their protocol version expect, i.e. without the
+// fields introduced in later versions.
+func signingPayload(msg *Message) []byte {
+	header := 19
+	if msg.Version != 0 {
+		header += 2
+	}
+	if msg.Version >= protocolAcks {
+		header++
+	}
+	if msg.Version >= protocolRecipient {
+		header += 2
+	}
+
+	payload := make([]byte, header, header+len(msg.Sender)+len(msg.Recipient)+len(msg.Content))
+	payload[0] = byte(msg.Type)
+	binary.BigEndian.PutUint16(payload[1:], uint16(len(msg.Sender)))
+	binary.BigEndian.PutUint64(payload[3:], uint64(msg.Incarnation))
+	binary.BigEndian.PutUint64(payload[11:], msg.Seq)
+	if msg.Version != 0 {
+		binary.BigEndian.PutUint16(payload[19:], uint16(msg.Version))
+	}
+	if msg.Version >= protocolAcks && msg.AckRequested {
+		payload[21] = 1
+	}
+	if msg.Version >= protocolRecipient {
+		binary.BigEndian.PutUint16(payload[22:], uint16(len(msg.Recipient)))
+	}
+	payload = append(payload, msg.Sender...)
+	if msg.Version >= protocolRecipient {
+		payload = append(payload, msg.Recipient...)
+	}
+	return append(payload, msg.Content...)
+}
+
+// encodeMessage wraps the content into a message of the given type in the lowest protocol version
+// spoken by the local node. It is used for messages sent to nodes whose protocol version isn't
+// known yet.
+func (n *Node) encodeMessage(msgType MessageType, content interface{}) []byte {
+	return n.encodeMessageAs(ProtocolVersionMin, "", msgType, content)
+}
+
+// encodeMessageAs wraps the content into a message of the given type for the given recipient in
+// the given protocol version, stamps it with the next sequence number and signs it if per-node
+// identities are configured. The recipient is only named from protocolRecipient on. The content
+// is encoded in the same wire format as the wrapper message.
+func (n *Node) encodeMessageAs(version int, recipient string, msgType MessageType, content interface{}) []byte {
+	msgBytes, _ := n.encodeEnvelope(version, recipient, msgType, content, false)
+	return msgBytes
+}
+
+// encodeEnvelope works like encodeMessageAs, but additionally asks the receiver to acknowledge
+// the message if ackRequested is set. Returns the sequence number the message has been stamped
+// with alongside the encoded message.
+func (n *Node) encodeEnvelope(version int, recipient string, msgType MessageType, content interface{}, ackRequested bool) ([]byte, uint64) {
+	format := versionFormat(version)
+	contentBytes, _ := marshal(format, content)
+	msg := Message{
+		Type:         msgType,
+		Content:      contentBytes,
+		Sender:       n.config.ID,
+		Incarnation:  n.incarnation,
+		Seq:          atomic.AddUint64(&n.seq, 1),
+		AckRequested: ackRequested && version >= protocolAcks,
+	}
+
+	// Nodes speaking protocolJSON only reject the unknown field
+	if version > protocolJSON {
+		msg.Version = version
+	}
+	if version >= protocolRecipient {
+		msg.Recipient = recipient
+	}
+
+	if n.identity != nil {
+		msg.Signature = ed25519.Sign(n.identity.privateKey, signingPayload(&msg))
+	}
+
+	msgBytes, _ := marshal(format, msg)
+	if format == formatMsgpack {
+		return append([]byte{msgpackMarker}, msgBytes...), msg.Seq
+	}
+	return msgBytes, msg.Seq
+}
+
+// broadcast sends a message of the given type to all given members but the local node in the
+// delivery mode configured for its type and over their paths like sendOver. Messages in protocol
+// versions before protocolRecipient are encoded once per version spoken by the members instead of
+// once per member. Returns the errors of the members the message couldn't be sent to by node ID.
+func (n *Node) broadcast(members []*Member, msgType MessageType, content interface{}) map[string]error {
+	errs := map[string]error{}
+	gateErr := n.checkMessageType(msgType)
+
+	byVersion := map[int][]*Member{}
+	for _, member := range members {
+		if member.Name == n.config.ID {
+			continue
+		}
+		if gateErr != nil {
+			errs[member.Name] = gateErr
+			continue
+		}
+		version := n.metas.versionFor(member)
+		byVersion[version] = append(byVersion[version], member)
+	}
+
+	mode := n.config.Delivery.mode(msgType)
+	for version, group := range byVersion {
+		// The message is broadcast over the preferred path of every member first and
+		// then sent over their other paths if necessary.
+		routes, all := make([][]*Member, len(group)), make([]bool, len(group))
+		preferred := make([]*Member, len(group))
+		for i, member := range group {
+			routes[i], all[i] = n.routes(member, msgType)
+			preferred[i] = routes[i][0]
+		}
+
+		// Messages naming their recipient are encoded for every member on its own.
+		if version >= protocolRecipient {
+			for i, member := range group {
+				msg := n.encodeMessageAs(version, member.Name, msgType, content)
+				if err := n.sendAlternates(routes[i][1:], all[i], msg, mode, n.network.Send(preferred[i], msg, mode)); err != nil {
+					errs[member.Name] = err
+				}
+			}
+			continue
+		}
+
+		msg := n.encodeMessageAs(version, "", msgType, content)
+		groupErrs := n.network.Broadcast(preferred, msg, mode)
+		for i, member := range group {
+			if err := n.sendAlternates(routes[i][1:], all[i], msg, mode, groupErrs[member.Name]); err != nil {
+				errs[member.Name] = err
+			}
+		}
+	}
+	return errs
+}
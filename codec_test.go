@@ -0,0 +1,164 @@
+package raftify
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestWireFormats(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(2)
+
+	// Initialize and start dummy nodes
+	node1 := initDummyNode("TestNode_1", 1, 2, ports[0])
+	node2 := initDummyNode("TestNode_2", 1, 2, ports[1])
+
+	node1.createMemberlist()
+	defer node1.memberlist.Shutdown()
+	node2.createMemberlist()
+	defer node2.memberlist.Shutdown()
+
+	node2.memberlist.Join([]string{node1.LocalAddr()})
+
+	contents := map[MessageType]sender{
+		HeartbeatMsg:       &Heartbeat{Term: 1, Quorum: 2, HeartbeatID: 3, LeaderID: "TestNode_1"},
+		VoteResponseMsg:    &VoteResponse{Term: 1, FollowerID: "TestNode_1", VoteGranted: true},
+		KeyringResponseMsg: &KeyringResponse{RequestID: 4, FollowerID: "TestNode_1", Keys: []string{"a", "b"}, PrimaryKey: "a"},
+	}
+
+	// Both formats are understood regardless of the one negotiated
+	for _, version := range []int{protocolJSON, protocolMsgpack, ProtocolVersionMax} {
+		format := versionFormat(version)
+		for msgType, content := range contents {
+			if msgType.minProtocolVersion() > version {
+				continue
+			}
+			payload := node1.encodeMessageAs(version, "TestNode_2", msgType, content)
+			if formatOf(payload) != format {
+				t.Logf("Expected %v to be encoded in format %v, instead got %v", msgType.toString(), format, formatOf(payload))
+				t.FailNow()
+			}
+			if peeked, ok := peekType(payload); !ok || peeked != msgType {
+				t.Logf("Expected to peek %v in format %v, instead got %v", msgType.toString(), format, peeked.toString())
+				t.FailNow()
+			}
+
+			msg, err := node2.decodeMessage(InboundMessage{From: node1.LocalAddr(), Payload: payload})
+			if err != nil {
+				t.Logf("Expected %v in format %v to be decoded, instead got error: %v", msgType.toString(), format, err)
+				t.FailNow()
+			}
+			decoded := reflect.New(reflect.TypeOf(content).Elem()).Interface().(sender)
+			if err := node2.decodeContent(msg, decoded); err != nil {
+				t.Logf("Expected content of %v in format %v to be decoded, instead got error: %v", msgType.toString(), format, err)
+				t.FailNow()
+			}
+			if !reflect.DeepEqual(decoded, content) {
+				t.Logf("Expected %+v, instead got %+v", content, decoded)
+				t.FailNow()
+			}
+		}
+	}
+
+	// Unknown fields are rejected in msgpack just like in JSON
+	msg, err := node2.decodeMessage(InboundMessage{
+		From:    node1.LocalAddr(),
+		Payload: node1.encodeMessageAs(protocolMsgpack, "", HeartbeatMsg, map[string]interface{}{"term": 1, "quorum": 1, "leader_id": "TestNode_1", "extra": true}),
+	})
+	if err != nil {
+		t.Logf("Expected wrapper message to be decoded, instead got error: %v", err)
+		t.FailNow()
+	}
+	if err := node2.decodeContent(msg, &Heartbeat{}); err == nil {
+		t.Logf("Expected msgpack message with unknown field to be rejected, instead error was nil")
+		t.FailNow()
+	}
+}
+
+func TestCheckMsgpack(t *testing.T) {
+	valid, _ := marshal(formatMsgpack, KeyringResponse{FollowerID: "TestNode_1", Keys: []string{"a", "b"}})
+	if err := checkMsgpack(valid); err != nil {
+		t.Logf("Expected valid msgpack to pass, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	invalid := map[string][]byte{
+		"empty":            {},
+		"trailing data":    append(valid, 0x01),
+		"truncated":        valid[:len(valid)-1],
+		"huge array":       {0xdd, 0xff, 0xff, 0xff, 0xff, 0xc0},
+		"huge map":         {0xdf, 0x7f, 0xff, 0xff, 0xff, 0xc0, 0xc0},
+		"huge string":      {0xdb, 0xff, 0xff, 0xff, 0xff, 'a'},
+		"never used type":  {0xc1},
+		"truncated length": {0xc5, 0x01},
+	}
+	for name, data := range invalid {
+		if err := checkMsgpack(data); err == nil {
+			t.Logf("Expected msgpack with %v to be rejected, instead error was nil", name)
+			t.FailNow()
+		}
+	}
+}
+
+// benchmarkMessages are the messages the wire formats are compared with.
+var benchmarkMessages = []struct {
+	msgType MessageType
+	content interface{}
+}{
+	{HeartbeatMsg, Heartbeat{Term: 42, Quorum: 3, HeartbeatID: 1337, LeaderID: "raftify-node-1"}},
+	{VoteResponseMsg, VoteResponse{Term: 42, FollowerID: "raftify-node-2", VoteGranted: true}},
+	{KeyringResponseMsg, KeyringResponse{RequestID: 7, FollowerID: "raftify-node-2", Keys: []string{"0123456789abcdef0123456789abcdef", "fedcba9876543210fedcba9876543210"}, PrimaryKey: "0123456789abcdef0123456789abcdef"}},
+}
+
+func BenchmarkEncodeMessage(b *testing.B) {
+	node := initDummyNode("raftify-node-1", 1, 3, 0)
+	for _, version := range []int{protocolJSON, protocolMsgpack} {
+		format := versionFormat(version)
+		for _, m := range benchmarkMessages {
+			b.Run(fmt.Sprintf("%v/%v", formatName(format), m.msgType.toString()), func(b *testing.B) {
+				var payload []byte
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					payload = node.encodeMessageAs(version, "", m.msgType, m.content)
+				}
+				b.ReportMetric(float64(len(payload)), "bytes/msg")
+			})
+		}
+	}
+}
+
+func BenchmarkDecodeMessage(b *testing.B) {
+	node := initDummyNode("raftify-node-1", 1, 3, 0)
+	for _, version := range []int{protocolJSON, protocolMsgpack} {
+		format := versionFormat(version)
+		for _, m := range benchmarkMessages {
+			payload := node.encodeMessageAs(version, "", m.msgType, m.content)
+			if format == formatMsgpack {
+				payload = payload[1:]
+			}
+			b.Run(fmt.Sprintf("%v/%v", formatName(format), m.msgType.toString()), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					var msg Message
+					if err := unmarshal(format, payload, &msg); err != nil {
+						b.Fatal(err)
+					}
+					content := reflect.New(reflect.TypeOf(m.content)).Interface()
+					if err := unmarshal(format, msg.Content, content); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(payload)), "bytes/msg")
+			})
+		}
+	}
+}
+
+// formatName returns the name of the wire format used in the benchmark names.
+func formatName(format wireFormat) string {
+	if format == formatMsgpack {
+		return "msgpack"
+	}
+	return "json"
+}
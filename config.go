@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
@@ -16,6 +17,9 @@ import (
 	"github.com/hashicorp/logutils"
 )
 
+// The port a node binds to if the bind_port is omitted in the raftify.json.
+const DefaultBindPort = 7946
+
 // Timeout and ticker settings for maximum performance.
 const (
 	// Time interval measured in milliseconds in which candidates send out
@@ -43,6 +47,11 @@ const (
 	// never reach the quorum. Upon reaching this threshold, a rejoin event
 	// is triggered to make the node in question aware of the network partition.
 	MaxMissedPrevoteCycles = 5
+
+	// Maximum time measured in milliseconds that a node waits for the leave
+	// event of a node that announced its leave via a new quorum message. If
+	// the node hasn't left by then, the new quorum is discarded.
+	LeaveTimeout = 5000
 )
 
 // Config contains the contents of the raftify.json file.
@@ -50,15 +59,60 @@ type Config struct {
 	// Mandatory. The unique identifier of a node.
 	ID string `json:"id"`
 
+	// The ID of the cluster the node belongs to. If set, only nodes with the
+	// same cluster ID are accepted as members.
+	ClusterID string `json:"cluster_id"`
+
+	// The point in time in RFC 3339 format until which nodes without cluster ID
+	// are still accepted as members so that an existing cluster can adopt its
+	// ClusterID one node at a time.
+	ClusterIDMigrationUntil string `json:"cluster_id_migration_until"`
+
 	// Mandatory. Self-imposed limit of nodes that can be run in one cluster.
 	// This is needed to allocate enough memory for the buffered channel used
 	// for event messages.
 	MaxNodes int `json:"max_nodes"`
 
-	// Mandatory. The 16-, 24- or 32-byte AES encryption key used to encrypt
-	// the message exchange between cluster members.
+	// The hex representation of the 16-, 24- or 32-byte AES encryption key
+	// used to encrypt the message exchange between cluster members. Only one
+	// of Encrypt, EncryptFile, EncryptEnv and EncryptCommand may be set.
 	Encrypt string `json:"encrypt"`
 
+	// The path to a file containing the hex representation of the encryption
+	// key. Relative paths are relative to the working directory. The file must
+	// not be accessible by group or others.
+	EncryptFile string `json:"encrypt_file"`
+
+	// The name of the environment variable containing the hex representation
+	// of the encryption key.
+	EncryptEnv string `json:"encrypt_env"`
+
+	// The command and its arguments printing the hex representation of the
+	// encryption key to stdout, e.g. a call to a secret store's CLI.
+	EncryptCommand []string `json:"encrypt_command"`
+
+	// The path to a file containing the hex representation of the node's Ed25519
+	// private key used to sign all messages. Relative paths are relative to the
+	// working directory. The file must not be accessible by group or others.
+	IdentityKeyFile string `json:"identity_key_file"`
+
+	// The hex representations of the Ed25519 public keys of all cluster members,
+	// including the local node, by node ID. If set, messages that are unsigned or
+	// signed by any other key are rejected.
+	TrustedKeys map[string]string `json:"trusted_keys"`
+
+	// The path to the PEM-encoded certificate of the node. If set, all traffic is
+	// exchanged via mutual TLS and the subject common name of the certificate must
+	// be the node's ID. Relative paths are relative to the working directory.
+	TLSCert string `json:"tls_cert"`
+
+	// The path to the PEM-encoded private key of the node's certificate.
+	TLSKey string `json:"tls_key"`
+
+	// The path to the PEM-encoded certificates of the CAs that issue the
+	// certificates of all cluster members.
+	TLSCA string `json:"tls_ca"`
+
 	// The performance multiplier that determines how the timeouts and
 	// intervals scale. This can be used to adjust the timeout settings
 	// for higher latency environments.
@@ -74,31 +128,108 @@ type Config struct {
 	// The address to bind the node to.
 	BindAddr string `json:"bind_addr"`
 
-	// The port to bind the node to.
+	// The port to bind the node to. If set to 0, the operating system picks a
+	// free port. Defaults to 7946 if omitted.
 	BindPort int `json:"bind_port"`
 
+	// The address to advertise to other cluster members. This is needed if the
+	// node is bound to 0.0.0.0 or runs behind a NAT, e.g. inside a container.
+	// Defaults to the bind address.
+	AdvertiseAddr string `json:"advertise_addr"`
+
+	// The port to advertise to other cluster members. Defaults to the bind port.
+	AdvertisePort int `json:"advertise_port"`
+
+	// Messages of senders that haven't been authenticated via trusted_keys or TLS
+	// are only accepted from the IP address or paths of the member they claim to
+	// originate from. Set this to skip the check, e.g. for members behind a NAT.
+	SkipSourceAddrCheck bool `json:"skip_source_addr_check"`
+
+	// Limits the size and rate of the messages accepted from other nodes.
+	Limits LimitsConfig `json:"limits"`
+
+	// Determines how messages are delivered to other nodes by message type and
+	// whether prevote and vote responses are acknowledged.
+	Delivery DeliveryConfig `json:"delivery"`
+
+	// The additional addresses the node is reachable at, e.g. on a second network
+	// interface, and how messages are sent to members reachable via several paths.
+	Paths PathsConfig `json:"paths"`
+
+	// Restricts the nodes admitted to the cluster by ID and address. Admits
+	// everyone if omitted.
+	Allowlist AllowlistConfig `json:"allowlist"`
+
 	// The list of peers to contact in order to join an existing cluster
 	// or form a new one.
 	PeerList []string `json:"peer_list"`
+
+	// The discovery providers queried for additional peers on every join
+	// and rejoin attempt.
+	Discovery DiscoveryConfig `json:"discovery"`
+
+	// Whether discovery providers have been passed in on initialization.
+	// Used to relax the peerlist constraint during validation.
+	externalDiscovery bool
+
+	// Whether a transport has been passed in on initialization. Custom transports handle
+	// membership themselves, so the admission settings are rejected during validation.
+	customTransport bool
+}
+
+// localAddrs returns all host:port addresses the local node is known by, i.e. the
+// bind address, the advertise address if it differs from the former and the
+// addresses of additional paths.
+func (c *Config) localAddrs() []string {
+	bindAddr := net.JoinHostPort(c.BindAddr, strconv.Itoa(c.BindPort))
+
+	advertiseHost, advertisePort := c.AdvertiseAddr, c.AdvertisePort
+	if advertiseHost == "" {
+		advertiseHost = c.BindAddr
+	}
+	if advertisePort == 0 {
+		advertisePort = c.BindPort
+	}
+
+	addrs := []string{bindAddr}
+	if advertiseAddr := net.JoinHostPort(advertiseHost, strconv.Itoa(advertisePort)); advertiseAddr != bindAddr {
+		addrs = append(addrs, advertiseAddr)
+	}
+	return append(addrs, c.Paths.Addrs...)
 }
 
-// truncPeerList removes the local node from the peerlist.
-func (c *Config) truncPeerList(address string) error {
-	for i := range c.PeerList {
-		if c.PeerList[i] == address {
-			c.PeerList = append(c.PeerList[:i], c.PeerList[i+1:]...)
-			return nil
+// isLocalAddr checks whether the given host:port address belongs to the local node.
+func (c *Config) isLocalAddr(address string) bool {
+	for _, addr := range c.localAddrs() {
+		if addr == address {
+			return true
 		}
 	}
-	return errors.New("local node is not listed as a peer")
+	return false
 }
 
-// validate checks for constraint violations in the raftify.json file.
-func (c *Config) validate() error {
-	// Variable used to aggregate all errors found during validation.
-	var errs string
+// truncPeerList removes all addresses passed in from the peerlist. Returns an error
+// if none of them could be found.
+func (c *Config) truncPeerList(addresses ...string) error {
+	found := false
+	for _, address := range addresses {
+		for i := 0; i < len(c.PeerList); i++ {
+			if c.PeerList[i] == address {
+				c.PeerList = append(c.PeerList[:i], c.PeerList[i+1:]...)
+				found = true
+				i--
+			}
+		}
+	}
+	if !found {
+		return errors.New("local node is not listed as a peer")
+	}
+	return nil
+}
 
-	// Set defaults.
+// setDefaults sets the default values for all optional fields left empty. The default
+// bind port is applied before the raftify.json is unmarshaled since 0 is a valid value.
+func (c *Config) setDefaults() {
 	if c.Performance == 0 {
 		c.Performance = 1
 	}
@@ -108,40 +239,91 @@ func (c *Config) validate() error {
 	if c.BindAddr == "" {
 		c.BindAddr = "0.0.0.0"
 	}
-	if c.BindPort == 0 {
-		c.BindPort = 7946
+	if c.AdvertisePort == 0 {
+		c.AdvertisePort = c.BindPort
 	}
+	c.Limits.setDefaults()
+	c.Delivery.setDefaults()
+	c.Paths.setDefaults()
+}
+
+// validate checks for constraint violations in the raftify.json file.
+func (c *Config) validate() error {
+	// Variable used to aggregate all errors found during validation.
+	var errs string
+
+	c.setDefaults()
 
 	// Check constraints.
 	if c.ID == "" {
 		errs += "\tid must not be empty\n"
 	}
+	if len(c.ClusterID) > maxClusterIDLength {
+		errs += fmt.Sprintf("\tcluster_id must not be longer than %v characters\n", maxClusterIDLength)
+	}
+	if c.ClusterIDMigrationUntil != "" {
+		if c.ClusterID == "" {
+			errs += "\tcluster_id_migration_until must not be set if cluster_id is not set\n"
+		}
+		if deadline := c.clusterIDMigrationDeadline(); deadline.IsZero() {
+			errs += fmt.Sprintf("\tcluster_id_migration_until %v must be a point in time in RFC 3339 format\n", c.ClusterIDMigrationUntil)
+		}
+	}
 	if c.MaxNodes <= 0 {
 		errs += "\tmax_nodes must be greater than 0\n"
 	}
-	if secretKey, err := hexToByte(c.Encrypt); err != nil {
-		if err := memberlist.ValidateKey(secretKey); err != nil {
+	if c.Encrypt != "" {
+		if secretKey, err := hexToByte(c.Encrypt); err != nil {
+			errs += "\tencrypt must be the hex representation of the key\n"
+		} else if err := memberlist.ValidateKey(secretKey); err != nil {
 			errs += fmt.Sprintf("\tencrypt must be of length 16, 24 or 32 bytes: got %v bytes\n", len(secretKey))
 		}
 	}
+	errs += c.validateKeySources()
+	errs += c.validateIdentity()
+	errs += c.validateTLS()
+	errs += c.Limits.validate()
+	errs += c.Delivery.validate()
+	errs += c.Paths.validate(c.BindPort)
+	errs += c.Allowlist.validate(c.ID)
+	if c.customTransport && c.Allowlist.enabled() {
+		errs += "\tallowlist must not be set if a custom transport is used\n"
+	}
+	if c.customTransport && c.ClusterID != "" {
+		errs += "\tcluster_id must not be set if a custom transport is used\n"
+	}
 	if c.Performance < 0 {
 		errs += "\tperformance must be greater than 0\n"
 	}
 	if c.Expect < 1 || c.Expect > c.MaxNodes {
 		errs += fmt.Sprintf("\texpect must be between 1 and %v\n", c.MaxNodes)
 	}
-	if c.Expect > 1 && len(c.PeerList) == 0 {
-		errs += "\tpeerlist must not be empty if more than one node is expected for bootstrap\n"
+	if c.Expect > 1 && len(c.PeerList) == 0 && !c.Discovery.enabled() && !c.externalDiscovery {
+		errs += "\tpeer_list must not be empty if more than one node is expected for bootstrap and no discovery is configured\n"
 	}
+	errs += c.Discovery.validate()
 	if match, _ := regexp.MatchString(`DEBUG|INFO|WARN|ERR`, c.LogLevel); !match {
 		errs += "\tlog_level must be DEBUG, INFO, WARN or ERR\n"
 	}
 	if ip := net.ParseIP(c.BindAddr); ip == nil {
-		errs += "\tbind_addr is not a valid IPv4\n"
+		errs += fmt.Sprintf("\tbind_addr %v is not a valid IP address\n", c.BindAddr)
 	}
 	if c.BindPort < 0 || c.BindPort > 65535 {
 		errs += fmt.Sprintf("\tbind_port %v must be in range 0-65535\n", c.BindPort)
 	}
+	if c.AdvertiseAddr != "" {
+		if ip := net.ParseIP(c.AdvertiseAddr); ip == nil {
+			errs += fmt.Sprintf("\tadvertise_addr %v is not a valid IP address\n", c.AdvertiseAddr)
+		} else if ip.IsUnspecified() {
+			errs += fmt.Sprintf("\tadvertise_addr %v must be a routable address\n", c.AdvertiseAddr)
+		}
+	}
+	if c.AdvertisePort < 0 || c.AdvertisePort > 65535 {
+		errs += fmt.Sprintf("\tadvertise_port %v must be in range 0-65535\n", c.AdvertisePort)
+	}
+	if c.BindPort == 0 && c.AdvertisePort != 0 {
+		errs += "\tadvertise_port must not be set if bind_port is 0\n"
+	}
 	if len(c.PeerList) > c.MaxNodes {
 		errs += fmt.Sprintf("\tpeer_list must not contain more than %v peers, including the local node: got %v peers\n", c.MaxNodes, len(c.PeerList))
 	}
@@ -149,12 +331,13 @@ func (c *Config) validate() error {
 		host, port, err := net.SplitHostPort(peer)
 		if err != nil {
 			errs += fmt.Sprintf("\tpeer address %v is not a valid host:port address\n", peer)
+			continue
 		}
-		if ip := net.ParseIP(host); ip == nil {
-			errs += fmt.Sprintf("\tbind_addr %v is not a valid IPv4\n", host)
+		if !isValidHost(host) {
+			errs += fmt.Sprintf("\tpeer address %v must contain an IP address or a hostname: got %v\n", peer, host)
 		}
-		if p, _ := strconv.Atoi(port); p < 0 || p > 65535 {
-			errs += fmt.Sprintf("\tbind_port %v must be in range 0-65535\n", port)
+		if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+			errs += fmt.Sprintf("\tpeer address %v must contain a port in range 0-65535: got %v\n", peer, port)
 		}
 	}
 
@@ -176,45 +359,98 @@ func (n *Node) loadConfig(stateJSONExists bool) error {
 	if err != nil {
 		return err
 	}
-	if err = json.Unmarshal(configBytes, &n.config); err != nil {
+
+	// Keys missing in the raftify.json keep their default values.
+	config := &Config{BindPort: DefaultBindPort}
+	if err = json.Unmarshal(configBytes, config); err != nil {
 		return err
 	}
+	config.setDefaults()
+
+	// If the config is reloaded while the node is running and the port has been picked
+	// by the operating system, the actual port is restored.
+	if n.memberlist != nil {
+		n.applyLocalAddr(config)
+	}
 
-	// If the state.json file exists, overwrite the peerlist from the raftify.json
-	// with the memberlist persisted in the state.json file.
+	// If the state.json file exists, load the memberlist persisted in it as additional rejoin
+	// candidates. The peerlist from the raftify.json is kept as a fallback in case all of the
+	// persisted members have moved in the meantime.
+	statePeers := []string{}
 	if stateJSONExists {
-		n.logger.Println("[DEBUG] raftify: Overwriting peerlist with peers from state.json...")
+		n.logger.Println("[DEBUG] raftify: Loading persisted peers from state.json...")
 
 		list, err := n.loadState()
 		if err != nil {
 			return err
 		}
 
-		n.config.PeerList = []string{}
-		localNode := fmt.Sprintf("%v:%v", n.config.BindAddr, n.config.BindPort)
-
 		for _, node := range list {
-			if node.Address() == localNode {
+			if node.Name == config.ID || config.isLocalAddr(node.Address()) {
 				continue
 			}
-			n.config.PeerList = append(n.config.PeerList, node.Address())
+			statePeers = append(statePeers, node.Address())
 		}
 	}
 
 	// Remove local node from peerlist such that the join event throws an error if none of
 	// the other peers could be reached. It needs to be removed because it will always reach
 	// itself which is obvious on one hand and not necessary on the other.
-	// Also, the truncation needs to be done before the validation.
-	n.config.truncPeerList(fmt.Sprintf("%v:%v", n.config.BindAddr, n.config.BindPort))
+	// Also, the truncation needs to be done before the validation. Both the bind and the
+	// advertise address identify the local node.
+	config.truncPeerList(config.localAddrs()...)
 
-	if err = n.config.validate(); err != nil {
+	config.externalDiscovery = len(n.discovery) > 0
+	_, builtin := n.network.(*memberlistTransport)
+	config.customTransport = n.network != nil && !builtin
+	if err = config.validate(); err != nil {
 		return err
 	}
+	n.statePeers = statePeers
+	n.configDiscovery = config.Discovery.providers(n.workingDir, n.resolver)
+
+	// The config is reloaded whenever a leader steps down while delegates, timers and the
+	// transport keep reading it. It is therefore only updated in place and only if the
+	// raftify.json has actually changed.
+	previous := n.config
+	if previous != nil && reflect.DeepEqual(*previous, *config) {
+		return nil
+	}
+	reloadKey := len(n.secretKey) == 0 || previous == nil || !previous.sameKeySource(config)
+	if previous == nil {
+		n.config = config
+	} else {
+		*n.config = *config
+	}
 
+	// The encryption key is only loaded again if its source has changed so that the
+	// encrypt_command isn't run every time.
+	if reloadKey {
+		if n.secretKey, err = n.config.loadSecretKey(n.workingDir); err != nil {
+			return fmt.Errorf("couldn't load encryption key: %v", err)
+		}
+	}
+	if n.identity, err = n.config.loadIdentity(n.workingDir); err != nil {
+		return fmt.Errorf("couldn't load identity: %v", err)
+	}
+
+	// The transport is created with the certificates loaded before the memberlist is started.
+	// From then on, the tlsReloader reloads them itself whenever the files change.
+	if n.memberlist == nil {
+		if n.tls, err = n.config.loadTLS(n.workingDir, n.logger); err != nil {
+			return fmt.Errorf("couldn't load TLS certificates: %v", err)
+		}
+	}
+
+	// The logs are filtered before they are written to the output of the logger passed in.
+	output := n.logger.Writer()
+	if filter, ok := output.(*logutils.LevelFilter); ok {
+		output = filter.Writer
+	}
 	n.logger.SetOutput(&logutils.LevelFilter{
 		Levels:   []logutils.LogLevel{"DEBUG", "INFO", "WARN", "ERR"},
 		MinLevel: logutils.LogLevel(n.config.LogLevel),
-		Writer:   os.Stderr,
+		Writer:   output,
 	})
 	return nil
 }
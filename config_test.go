@@ -1,7 +1,9 @@
 package raftify
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"testing"
@@ -19,7 +21,13 @@ func TestConfigDefaults(t *testing.T) {
 		},
 	}
 
-	genConfig(node)
+	// Only write the mandatory fields so that all optional ones are missing
+	configBytes, _ := json.Marshal(map[string]interface{}{
+		"id":        node.config.ID,
+		"max_nodes": node.config.MaxNodes,
+		"expect":    node.config.Expect,
+	})
+	ioutil.WriteFile(pwd+"/raftify.json", configBytes, 0755)
 	defer os.Remove(pwd + "/raftify.json")
 
 	if err := node.loadConfig(false); err != nil {
@@ -74,6 +82,10 @@ func TestLoadConfig(t *testing.T) {
 		t.Logf("Expected valid configuration, instead got: %v", err.Error())
 		t.Fail()
 	}
+	if len(node.secretKey) != 32 {
+		t.Logf("Expected secret key of 32 bytes to be loaded, instead got %v bytes", len(node.secretKey))
+		t.Fail()
+	}
 
 	// Invalid ID.
 	node.config.ID = ""
@@ -105,6 +117,26 @@ func TestLoadConfig(t *testing.T) {
 	}
 	node.config.Encrypt = "8ba4770b00f703fcc9e7d94f857db0e76fd53178d3d55c3e600a9f0fda9a75ad"
 
+	// Invalid encryption key: Wrong length
+	node.config.Encrypt = "8ba4770b00f703fcc9e7"
+	genConfig(node)
+
+	if err := node.loadConfig(false); err == nil {
+		t.Logf("Expected invalid encryption key length, instead %v passed as valid", node.config.Encrypt)
+		t.Fail()
+	}
+	node.config.Encrypt = "8ba4770b00f703fcc9e7d94f857db0e76fd53178d3d55c3e600a9f0fda9a75ad"
+
+	// Invalid encryption key: Multiple sources
+	node.config.EncryptEnv = "RAFTIFY_KEY"
+	genConfig(node)
+
+	if err := node.loadConfig(false); err == nil {
+		t.Log("Expected multiple encryption key sources to be invalid, instead they passed as valid")
+		t.Fail()
+	}
+	node.config.EncryptEnv = ""
+
 	// Invalid performance.
 	node.config.Performance = -1
 	genConfig(node)
@@ -164,6 +196,50 @@ func TestLoadConfig(t *testing.T) {
 	}
 	node.config.BindPort = ports[0]
 
+	// Invalid advertise address.
+	node.config.AdvertiseAddr = "0.0.0.0"
+	genConfig(node)
+
+	if err := node.loadConfig(false); err == nil {
+		t.Logf("Expected invalid advertise address, instead %v passed as valid", node.config.AdvertiseAddr)
+		t.Fail()
+	}
+	node.config.AdvertiseAddr = ""
+
+	// Invalid advertise port.
+	node.config.AdvertisePort = 123456
+	genConfig(node)
+
+	if err := node.loadConfig(false); err == nil {
+		t.Logf("Expected invalid advertise port, instead %v passed as valid", node.config.AdvertisePort)
+		t.Fail()
+	}
+	node.config.AdvertisePort = 0
+
+	// Valid port: Picked by the operating system
+	node.config.BindPort = 0
+	genConfig(node)
+
+	if err := node.loadConfig(false); err != nil {
+		t.Logf("Expected bind port 0 to be valid, instead got: %v", err.Error())
+		t.Fail()
+	}
+	if node.config.BindPort != 0 {
+		t.Logf("Expected bind port 0 to be kept, instead got %v", node.config.BindPort)
+		t.Fail()
+	}
+
+	// Invalid advertise port: Bind port picked by the operating system
+	node.config.AdvertisePort = ports[1]
+	genConfig(node)
+
+	if err := node.loadConfig(false); err == nil {
+		t.Log("Expected advertise port to be invalid with bind port 0, instead it passed as valid")
+		t.Fail()
+	}
+	node.config.AdvertisePort = 0
+	node.config.BindPort = ports[0]
+
 	// Invalid peerlist: Wrong address format
 	node.config.PeerList = []string{
 		"192.168.500.213:6000",
@@ -182,6 +258,24 @@ func TestLoadConfig(t *testing.T) {
 		fmt.Sprintf("127.0.0.1:%v", ports[2]),
 	}
 
+	// Valid peerlist: Hostnames and IPv6 addresses
+	node.config.PeerList = []string{
+		fmt.Sprintf("127.0.0.1:%v", ports[0]),
+		fmt.Sprintf("node-2.raftify.local:%v", ports[1]),
+		fmt.Sprintf("[::1]:%v", ports[2]),
+	}
+	genConfig(node)
+
+	if err := node.loadConfig(false); err != nil {
+		t.Logf("Expected valid peerlist with hostnames and IPv6 addresses, instead got: %v", err.Error())
+		t.Fail()
+	}
+	node.config.PeerList = []string{
+		fmt.Sprintf("127.0.0.1:%v", ports[0]),
+		fmt.Sprintf("127.0.0.1:%v", ports[1]),
+		fmt.Sprintf("127.0.0.1:%v", ports[2]),
+	}
+
 	// Invalid peerlist: Empty list and more than one node expected
 	node.config.Expect = 2
 	node.config.PeerList = []string{}
@@ -242,15 +336,69 @@ func TestLoadConfigRejoin(t *testing.T) {
 	node2.tryJoin()
 	node3.tryJoin()
 
-	// Create dummy state.json file from node1's memberlist into the working directory
+	// Create dummy state.json file from node1's memberlist into the working directory. A
+	// leftover state.json from other tests must not be merged into it.
+	node1.deleteState()
 	node1.saveState()
 	defer node1.deleteState()
 
+	// Add a seed to node2's raftify.json that is not part of the persisted memberlist
+	node2.config.PeerList = []string{"10.0.0.10:7946"}
+	genConfig(node2)
+
 	// Trigger rejoin and load the config
 	node2.loadConfig(true)
 
-	if len(node2.config.PeerList) != 2 {
-		t.Logf("Expected peerlist of node2 to have two entries, instead got %v", len(node2.config.PeerList))
+	if len(node2.statePeers) != 2 {
+		t.Logf("Expected persisted peers of node2 to have two entries, instead got %v", len(node2.statePeers))
+		t.FailNow()
+	}
+	if len(node2.config.PeerList) != 1 || node2.config.PeerList[0] != "10.0.0.10:7946" {
+		t.Logf("Expected peerlist of node2 to keep the seed from the raftify.json, instead got %v", node2.config.PeerList)
+		t.FailNow()
+	}
+
+	// The persisted members must be tried before the seeds
+	peers := node2.discoverPeers()
+	if len(peers) != 3 || peers[0].source != "state" || peers[1].source != "state" || peers[2].source != "static" {
+		t.Logf("Expected two persisted peers followed by one seed, instead got %v", peers)
+		t.FailNow()
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	seed, publicKey := genIdentity()
+
+	dir, _ := ioutil.TempDir("", "raftify-config")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/identity.key", []byte(seed), 0600)
+
+	node := initDummyNode("TestNode", 1, 3, 0)
+	node.workingDir = dir
+	node.config.IdentityKeyFile = "identity.key"
+	node.config.TrustedKeys = map[string]string{"TestNode": publicKey}
+	genConfig(node)
+
+	if err := node.loadConfig(false); err != nil || node.identity == nil {
+		t.Logf("Expected config and identity to be loaded, instead got error: %v", err)
+		t.FailNow()
+	}
+	config, identity := node.config, node.identity
+
+	// An unchanged raftify.json leaves the config and the identity untouched
+	if err := node.loadConfig(false); err != nil || node.config != config || node.identity != identity {
+		t.Logf("Expected config and identity to be kept for an unchanged raftify.json, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	// A changed raftify.json is applied in place
+	changed := *node.config
+	changed.Performance = 2
+	node.config = &changed
+	genConfig(node)
+	node.config = config
+	if err := node.loadConfig(false); err != nil || node.config != config || node.config.Performance != 2 {
+		t.Logf("Expected changed config to be applied in place, instead got performance %v and error: %v", node.config.Performance, err)
 		t.FailNow()
 	}
 }
@@ -276,3 +424,49 @@ func TestTruncPeerList(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestTruncPeerListAdvertiseAddr(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(3)
+
+	// Initialize dummy node bound to all interfaces and advertising a public address
+	node := initDummyNode("TestNode", 1, 3, ports[0])
+	node.config.BindAddr = "0.0.0.0"
+	node.config.AdvertiseAddr = "10.0.0.1"
+	node.config.AdvertisePort = ports[1]
+	node.config.PeerList = []string{
+		fmt.Sprintf("10.0.0.1:%v", ports[1]),
+		fmt.Sprintf("10.0.0.2:%v", ports[2]),
+	}
+
+	if err := node.config.truncPeerList(node.config.localAddrs()...); err != nil {
+		t.Logf("Expected truncation of peerlist, instead got: %v", err.Error())
+		t.FailNow()
+	}
+	if len(node.config.PeerList) != 1 || node.config.PeerList[0] != fmt.Sprintf("10.0.0.2:%v", ports[2]) {
+		t.Logf("Expected only the remote peer to be left in the peerlist, instead got %v", node.config.PeerList)
+		t.FailNow()
+	}
+}
+
+func TestIsLocalAddr(t *testing.T) {
+	config := &Config{
+		BindAddr:      "0.0.0.0",
+		BindPort:      7946,
+		AdvertiseAddr: "192.168.0.10",
+		AdvertisePort: 17946,
+	}
+
+	if !config.isLocalAddr("0.0.0.0:7946") {
+		t.Log("Expected bind address to be detected as local address")
+		t.Fail()
+	}
+	if !config.isLocalAddr("192.168.0.10:17946") {
+		t.Log("Expected advertise address to be detected as local address")
+		t.Fail()
+	}
+	if config.isLocalAddr("192.168.0.10:7946") {
+		t.Log("Expected advertise host with bind port not to be detected as local address")
+		t.Fail()
+	}
+}
@@ -0,0 +1,268 @@
+package raftify
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default delivery settings applied if they are omitted in the raftify.json.
+const (
+	// Time in milliseconds after which an unacknowledged message is retransmitted.
+	DefaultAckTimeout = 200
+
+	// Number of times an unacknowledged message is retransmitted before giving up.
+	DefaultMaxRetransmits = 3
+)
+
+// deliveryModes maps the delivery modes to their names in the raftify.json.
+var deliveryModes = map[string]DeliveryMode{
+	"best_effort": BestEffort,
+	"reliable":    Reliable,
+}
+
+// deliveryTypes maps the message types whose delivery mode can be configured to their names in
+// the raftify.json. Join requests and responses are always exchanged via TCP.
+var deliveryTypes = map[string]MessageType{
+	"heartbeat":          HeartbeatMsg,
+	"heartbeat_response": HeartbeatResponseMsg,
+	"prevote_request":    PreVoteRequestMsg,
+	"prevote_response":   PreVoteResponseMsg,
+	"vote_request":       VoteRequestMsg,
+	"vote_response":      VoteResponseMsg,
+	"new_quorum":         NewQuorumMsg,
+	"keyring_request":    KeyringRequestMsg,
+	"keyring_response":   KeyringResponseMsg,
+	"ack":                AckMsg,
+}
+
+// defaultDeliveryMode returns the delivery mode of the message type if none is configured. The
+// messages of leaving nodes and keyring operations are sent reliably, all others best effort
+// since they are repeated periodically anyway.
+func (t *MessageType) defaultDeliveryMode() DeliveryMode {
+	switch *t {
+	case NewQuorumMsg, KeyringRequestMsg, KeyringResponseMsg:
+		return Reliable
+	default:
+		return BestEffort
+	}
+}
+
+// isAcknowledgeable checks whether messages of the type can ask to be acknowledged. Prevote and
+// vote responses are only sent once per request, losing them delays the election.
+func (t *MessageType) isAcknowledgeable() bool {
+	return *t == PreVoteResponseMsg || *t == VoteResponseMsg
+}
+
+// DeliveryConfig determines how raftify messages are delivered to other nodes.
+type DeliveryConfig struct {
+	// The delivery mode by message type, either "best_effort" or "reliable". Types
+	// omitted keep their default mode, which is "reliable" for new_quorum,
+	// keyring_request and keyring_response and "best_effort" for all others.
+	Modes map[string]string `json:"modes"`
+
+	// If true, prevote and vote responses sent best effort ask the receiver for an
+	// acknowledgement and are retransmitted until they are acknowledged.
+	Acks bool `json:"acks"`
+
+	// The time in milliseconds after which an unacknowledged response is
+	// retransmitted. Defaults to 200.
+	AckTimeout int `json:"ack_timeout"`
+
+	// The number of times an unacknowledged response is retransmitted before
+	// giving up. Defaults to 3.
+	MaxRetransmits int `json:"max_retransmits"`
+}
+
+// setDefaults sets the default values for all delivery settings left empty.
+func (d *DeliveryConfig) setDefaults() {
+	if d.AckTimeout == 0 {
+		d.AckTimeout = DefaultAckTimeout
+	}
+	if d.MaxRetransmits == 0 {
+		d.MaxRetransmits = DefaultMaxRetransmits
+	}
+}
+
+// validate checks for constraint violations in the delivery settings and returns them in the
+// same format as Config.validate.
+func (d *DeliveryConfig) validate() string {
+	var errs string
+
+	names := make([]string, 0, len(d.Modes))
+	for name := range d.Modes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, ok := deliveryTypes[name]; !ok {
+			errs += fmt.Sprintf("\tdelivery.modes contains unknown message type %v\n", name)
+		}
+		if _, ok := deliveryModes[d.Modes[name]]; !ok {
+			errs += fmt.Sprintf("\tdelivery.modes.%v must be either best_effort or reliable\n", name)
+		}
+	}
+	if d.AckTimeout < 0 {
+		errs += "\tdelivery.ack_timeout must be greater than 0\n"
+	}
+	if d.MaxRetransmits < 0 {
+		errs += "\tdelivery.max_retransmits must be greater than 0\n"
+	}
+	return errs
+}
+
+// mode returns the delivery mode configured for the message type.
+func (d *DeliveryConfig) mode(msgType MessageType) DeliveryMode {
+	for name, t := range deliveryTypes {
+		if t != msgType {
+			continue
+		}
+		if mode, ok := deliveryModes[d.Modes[name]]; ok {
+			return mode
+		}
+	}
+	return msgType.defaultDeliveryMode()
+}
+
+// acknowledged checks whether messages of the type ask the receiver for an acknowledgement.
+// Reliably delivered messages are never acknowledged since their transport already is.
+func (d *DeliveryConfig) acknowledged(msgType MessageType) bool {
+	return d.Acks && msgType.isAcknowledgeable() && d.mode(msgType) == BestEffort
+}
+
+// ackKey identifies a message sent to a member by its sequence number.
+type ackKey struct {
+	member string
+	seq    uint64
+}
+
+// pendingAck is a message waiting to be acknowledged.
+type pendingAck struct {
+	member      *Member
+	msgType     MessageType
+	msg         []byte
+	retransmits int
+	timer       Timer
+}
+
+// ackTracker keeps track of the messages that haven't been acknowledged yet and retransmits
+// them until they are or the maximum number of retransmits has been reached.
+type ackTracker struct {
+	sync.Mutex
+	pending map[ackKey]*pendingAck
+	stopped bool
+}
+
+// send encodes a message of the given type in the protocol version negotiated with the member
+// and delivers it in the mode configured for its type. If configured, prevote and vote responses
+// ask to be acknowledged and are retransmitted until they are. Returns an error if the message
+// type must not be sent yet because some cluster members don't speak the protocol version it
+// has been introduced in.
+func (n *Node) send(member *Member, msgType MessageType, content interface{}) error {
+	if err := n.checkMessageType(msgType); err != nil {
+		return err
+	}
+
+	version := n.metas.versionFor(member)
+	ack := n.config.Delivery.acknowledged(msgType) && version >= protocolAcks
+	msgBytes, seq := n.encodeEnvelope(version, member.Name, msgType, content, ack)
+
+	if err := n.sendOver(member, msgType, msgBytes, n.config.Delivery.mode(msgType)); err != nil {
+		return err
+	}
+	if ack {
+		n.trackAck(&pendingAck{member: member, msgType: msgType, msg: msgBytes}, seq)
+	}
+	return nil
+}
+
+// trackAck waits for the acknowledgement of a message and schedules its retransmission.
+func (n *Node) trackAck(p *pendingAck, seq uint64) {
+	key := ackKey{member: p.member.Name, seq: seq}
+
+	n.acks.Lock()
+	defer n.acks.Unlock()
+
+	if n.acks.stopped {
+		return
+	}
+	if n.acks.pending == nil {
+		n.acks.pending = map[ackKey]*pendingAck{}
+	}
+	n.acks.pending[key] = p
+	p.timer = n.clock.AfterFunc(time.Duration(n.config.Delivery.AckTimeout)*time.Millisecond, func() {
+		n.retransmit(key)
+	})
+}
+
+// retransmit sends an unacknowledged message again or gives up once it has been retransmitted
+// max_retransmits times. It is called by the message's timer.
+func (n *Node) retransmit(key ackKey) {
+	n.acks.Lock()
+	defer n.acks.Unlock()
+
+	p, ok := n.acks.pending[key]
+	if !ok || n.acks.stopped {
+		return
+	}
+	if p.retransmits >= n.config.Delivery.MaxRetransmits {
+		delete(n.acks.pending, key)
+		atomic.AddUint64(&n.metrics.Unacknowledged, 1)
+		n.logger.Printf("[WARN] raftify: %v to %v hasn't been acknowledged after %v retransmits, giving up\n", p.msgType.toString(), key.member, p.retransmits)
+		return
+	}
+
+	p.retransmits++
+	atomic.AddUint64(&n.metrics.Retransmits, 1)
+	if err := n.sendOver(p.member, p.msgType, p.msg, BestEffort); err != nil {
+		n.logger.Printf("[ERR] raftify: couldn't retransmit %v to %v: %v\n", p.msgType.toString(), key.member, err.Error())
+	} else {
+		n.logger.Printf("[DEBUG] raftify: Retransmitted %v to %v (%v/%v)\n", p.msgType.toString(), key.member, p.retransmits, n.config.Delivery.MaxRetransmits)
+	}
+	p.timer.Reset(time.Duration(n.config.Delivery.AckTimeout) * time.Millisecond)
+}
+
+// stopAcks stops all retransmissions. Messages sent afterwards aren't tracked anymore.
+func (n *Node) stopAcks() {
+	n.acks.Lock()
+	defer n.acks.Unlock()
+
+	for _, p := range n.acks.pending {
+		p.timer.Stop()
+	}
+	n.acks.pending = nil
+	n.acks.stopped = true
+}
+
+// sendAck acknowledges a received message that asked to be acknowledged.
+func (n *Node) sendAck(msg Message) {
+	member, err := n.getNodeByName(msg.Sender)
+	if err != nil {
+		n.logger.Printf("[ERR] raftify: %v\n", err.Error())
+		return
+	}
+	if err := n.send(member, AckMsg, Ack{Seq: msg.Seq, NodeID: n.config.ID}); err != nil {
+		n.logger.Printf("[ERR] raftify: couldn't acknowledge %v to %v: %v\n", msg.Type.toString(), msg.Sender, err.Error())
+		return
+	}
+	n.logger.Printf("[DEBUG] raftify: Acknowledged %v to %v\n", msg.Type.toString(), msg.Sender)
+}
+
+// handleAck stops the retransmission of the acknowledged message.
+func (n *Node) handleAck(msg Ack) {
+	key := ackKey{member: msg.NodeID, seq: msg.Seq}
+
+	n.acks.Lock()
+	defer n.acks.Unlock()
+
+	p, ok := n.acks.pending[key]
+	if !ok {
+		return
+	}
+	p.timer.Stop()
+	delete(n.acks.pending, key)
+	atomic.AddUint64(&n.metrics.Acknowledged, 1)
+}
@@ -0,0 +1,176 @@
+package raftify
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeliveryConfig(t *testing.T) {
+	delivery := DeliveryConfig{
+		Modes: map[string]string{
+			"vote_response":   "reliable",
+			"keyring_request": "best_effort",
+		},
+	}
+	if errs := delivery.validate(); errs != "" {
+		t.Logf("Expected delivery settings to be valid, instead got errors:\n%v", errs)
+		t.FailNow()
+	}
+
+	expected := map[MessageType]DeliveryMode{
+		HeartbeatMsg:       BestEffort,
+		VoteResponseMsg:    Reliable,
+		NewQuorumMsg:       Reliable,
+		KeyringRequestMsg:  BestEffort,
+		KeyringResponseMsg: Reliable,
+	}
+	for msgType, mode := range expected {
+		if delivery.mode(msgType) != mode {
+			t.Logf("Expected delivery mode %v for %v, instead got %v", mode, msgType.toString(), delivery.mode(msgType))
+			t.FailNow()
+		}
+	}
+
+	// Reliably delivered responses don't ask for acks
+	delivery.Acks = true
+	if delivery.acknowledged(VoteResponseMsg) || !delivery.acknowledged(PreVoteResponseMsg) || delivery.acknowledged(HeartbeatMsg) {
+		t.Logf("Expected only prevote responses to be acknowledged")
+		t.FailNow()
+	}
+
+	invalid := DeliveryConfig{
+		Modes:          map[string]string{"join_request": "reliable", "heartbeat": "tcp"},
+		AckTimeout:     -1,
+		MaxRetransmits: -1,
+	}
+	if errs := invalid.validate(); errs != "\tdelivery.modes.heartbeat must be either best_effort or reliable\n\tdelivery.modes contains unknown message type join_request\n\tdelivery.ack_timeout must be greater than 0\n\tdelivery.max_retransmits must be greater than 0\n" {
+		t.Logf("Unexpected validation errors:\n%v", errs)
+		t.FailNow()
+	}
+}
+
+func TestAcks(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(2)
+
+	// Initialize and start dummy nodes
+	follower := initDummyNode("TestNode_1", 1, 2, ports[0])
+	candidate := initDummyNode("TestNode_2", 1, 2, ports[1])
+	follower.config.Delivery = DeliveryConfig{Acks: true, AckTimeout: 1000, MaxRetransmits: 3}
+
+	follower.createMemberlist()
+	defer follower.memberlist.Shutdown()
+	candidate.createMemberlist()
+	defer candidate.memberlist.Shutdown()
+
+	if _, err := candidate.memberlist.Join([]string{follower.LocalAddr()}); err != nil {
+		t.Logf("Expected candidate to join follower, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	receive := func(node *Node, msgType MessageType, content sender) Message {
+		select {
+		case in := <-node.network.Messages():
+			msg, err := node.decodeMessage(in)
+			if err != nil || msg.Type != msgType {
+				t.Logf("Expected %v, instead got %v and error %v", msgType.toString(), msg.Type.toString(), err)
+				t.FailNow()
+			}
+			if err := node.decodeContent(msg, content); err != nil {
+				t.Logf("Expected content of %v to be decoded, instead got error: %v", msgType.toString(), err)
+				t.FailNow()
+			}
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Logf("Expected %v to be received by %v", msgType.toString(), node.config.ID)
+			t.FailNow()
+		}
+		return Message{}
+	}
+
+	follower.sendVoteResponse("TestNode_2", true)
+
+	var response VoteResponse
+	msg := receive(candidate, VoteResponseMsg, &response)
+	if !msg.AckRequested || !response.VoteGranted {
+		t.Logf("Expected granted vote response asking for an ack, instead got %+v", msg)
+		t.FailNow()
+	}
+
+	var ack Ack
+	receive(follower, AckMsg, &ack)
+	follower.handleAck(ack)
+
+	if metrics := follower.GetMetrics(); metrics.Acknowledged != 1 || metrics.Retransmits != 0 {
+		t.Logf("Expected 1 acknowledged and 0 retransmitted messages, instead got %+v", metrics)
+		t.FailNow()
+	}
+	if len(follower.acks.pending) != 0 {
+		t.Logf("Expected no messages to be pending after the ack, instead got %v", len(follower.acks.pending))
+		t.FailNow()
+	}
+
+	// A retransmit whose first ack got lost is acknowledged again but not counted as replay
+	if err := candidate.decodeContent(msg, &response); !errors.Is(err, errDuplicate) {
+		t.Logf("Expected retransmitted vote response to be dropped as duplicate, instead got error: %v", err)
+		t.FailNow()
+	}
+	receive(follower, AckMsg, &ack)
+	if metrics := candidate.GetMetrics(); metrics.Replays != 0 {
+		t.Logf("Expected no replays to be counted for the retransmit, instead got %v", metrics.Replays)
+		t.FailNow()
+	}
+}
+
+func TestRetransmit(t *testing.T) {
+	node := initDummyNode("TestNode", 1, 2, 0)
+	node.config.Delivery = DeliveryConfig{Acks: true, AckTimeout: 10, MaxRetransmits: 2}
+
+	meta, _ := json.Marshal(nodeMeta{ProtocolMin: ProtocolVersionMin, ProtocolMax: ProtocolVersionMax})
+	member := &Member{Name: "TestNode_2", Meta: meta}
+
+	transport := newFakeTransport(member)
+	node.network = transport
+
+	if err := node.send(member, PreVoteResponseMsg, PreVoteResponse{Term: 1, FollowerID: "TestNode", PreVoteGranted: true}); err != nil {
+		t.Logf("Expected prevote response to be sent, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for node.GetMetrics().Unacknowledged == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	transport.Lock()
+	sent := transport.sent["TestNode_2"]
+	transport.Unlock()
+
+	if metrics := node.GetMetrics(); metrics.Retransmits != 2 || metrics.Unacknowledged != 1 || len(sent) != 3 {
+		t.Logf("Expected the response to be sent 3 times before giving up, instead got %v sends and %+v", len(sent), metrics)
+		t.FailNow()
+	}
+
+	// Members speaking an older protocol version aren't asked for acks
+	meta, _ = json.Marshal(nodeMeta{ProtocolMin: protocolJSON, ProtocolMax: protocolMsgpack})
+	older := &Member{Name: "TestNode_3", Meta: meta}
+	transport.members = append(transport.members, older)
+
+	node.send(older, PreVoteResponseMsg, PreVoteResponse{Term: 1, FollowerID: "TestNode", PreVoteGranted: true})
+	if len(node.acks.pending) != 0 {
+		t.Logf("Expected no ack to be awaited from a member speaking protocol version %v", protocolMsgpack)
+		t.FailNow()
+	}
+
+	// Nothing is retransmitted after shutdown
+	node.send(member, PreVoteResponseMsg, PreVoteResponse{Term: 1, FollowerID: "TestNode", PreVoteGranted: true})
+	node.stopAcks()
+	time.Sleep(50 * time.Millisecond)
+
+	if metrics := node.GetMetrics(); metrics.Retransmits != 2 {
+		t.Logf("Expected no retransmits after shutdown, instead got %v", metrics.Retransmits)
+		t.FailNow()
+	}
+}
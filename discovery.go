@@ -0,0 +1,313 @@
+package raftify
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// srvNameRegexp matches SRV record names whose service and protocol labels start with an
+// underscore, e.g. _raftify._udp.example.com.
+var srvNameRegexp = regexp.MustCompile(`^(_?[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)(\._?[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*\.?$`)
+
+// Discovery is the interface that peer discovery providers must implement. All providers
+// are queried for seed peers on every join and rejoin attempt.
+type Discovery interface {
+	// Name returns the name of the provider used for logging.
+	Name() string
+
+	// Peers returns the addresses of the discovered peers in the host:port format.
+	Peers() ([]string, error)
+}
+
+// DiscoveryConfig contains the settings for the peer discovery providers that can be
+// configured in the raftify.json file.
+type DiscoveryConfig struct {
+	// The hostname to look up A/AAAA records for, in the host:port format. The port is
+	// used for all IP addresses returned.
+	DNS string `json:"dns"`
+
+	// The name of the SRV record to look up. The target and port of each record are used
+	// as peer address.
+	SRV string `json:"srv"`
+
+	// The path to a file containing one host:port address per line. Relative paths are
+	// relative to the working directory. The file is re-read whenever it changes.
+	File string `json:"file"`
+}
+
+// enabled checks whether any discovery provider is configured.
+func (d *DiscoveryConfig) enabled() bool {
+	return d.DNS != "" || d.SRV != "" || d.File != ""
+}
+
+// validate checks for constraint violations in the discovery settings and returns them
+// in the same format as Config.validate.
+func (d *DiscoveryConfig) validate() string {
+	var errs string
+	if d.DNS != "" {
+		host, port, err := net.SplitHostPort(d.DNS)
+		if err != nil {
+			errs += fmt.Sprintf("\tdiscovery.dns %v is not a valid host:port address\n", d.DNS)
+		} else {
+			if !isValidHost(host) {
+				errs += fmt.Sprintf("\tdiscovery.dns %v must contain a hostname: got %v\n", d.DNS, host)
+			}
+			if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+				errs += fmt.Sprintf("\tdiscovery.dns %v must contain a port in range 0-65535: got %v\n", d.DNS, port)
+			}
+		}
+	}
+	if d.SRV != "" && !srvNameRegexp.MatchString(d.SRV) {
+		errs += fmt.Sprintf("\tdiscovery.srv %v is not a valid record name\n", d.SRV)
+	}
+	return errs
+}
+
+// providers builds the discovery providers configured in the raftify.json file.
+func (d *DiscoveryConfig) providers(workingDir string, resolver Resolver) []Discovery {
+	providers := []Discovery{}
+	if d.DNS != "" {
+		host, port, _ := net.SplitHostPort(d.DNS)
+		p, _ := strconv.Atoi(port)
+		providers = append(providers, &DNSDiscovery{Host: host, Port: p, Resolver: resolver})
+	}
+	if d.SRV != "" {
+		providers = append(providers, &DNSDiscovery{Host: d.SRV, SRV: true, Resolver: resolver})
+	}
+	if d.File != "" {
+		path := d.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(workingDir, path)
+		}
+		providers = append(providers, &FileDiscovery{Path: path})
+	}
+	return providers
+}
+
+// StaticDiscovery is a discovery provider returning a fixed list of peers. It is used for
+// the peer_list of the raftify.json file.
+type StaticDiscovery []string
+
+// Name implements the Discovery interface.
+func (s StaticDiscovery) Name() string {
+	return "static"
+}
+
+// Peers implements the Discovery interface.
+func (s StaticDiscovery) Peers() ([]string, error) {
+	return s, nil
+}
+
+// SRVResolver is the interface used to look up SRV records. It is satisfied by
+// *net.Resolver.
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSDiscovery is a discovery provider that looks up peers via DNS, either by resolving
+// the A/AAAA records of a hostname or by querying SRV records.
+type DNSDiscovery struct {
+	// The hostname or, if SRV is set, the name of the SRV record to look up.
+	Host string
+
+	// The port used for all addresses returned from A/AAAA records. Ignored for SRV records
+	// since they carry their own port.
+	Port int
+
+	// Whether to query SRV records instead of A/AAAA records.
+	SRV bool
+
+	// The resolver used for the lookups. Must implement SRVResolver if SRV is set.
+	// Defaults to net.DefaultResolver.
+	Resolver Resolver
+}
+
+// Name implements the Discovery interface.
+func (d *DNSDiscovery) Name() string {
+	if d.SRV {
+		return "dns-srv"
+	}
+	return "dns"
+}
+
+// Peers implements the Discovery interface.
+func (d *DNSDiscovery) Peers() ([]string, error) {
+	var resolver Resolver = net.DefaultResolver
+	if d.Resolver != nil {
+		resolver = d.Resolver
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), LookupTimeout*time.Millisecond)
+	defer cancel()
+
+	peers := []string{}
+	if d.SRV {
+		srvResolver, ok := resolver.(SRVResolver)
+		if !ok {
+			return nil, errors.New("resolver does not support SRV lookups")
+		}
+
+		_, records, err := srvResolver.LookupSRV(ctx, "", "", d.Host)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			peers = append(peers, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))))
+		}
+		return peers, nil
+	}
+
+	ips, err := resolver.LookupHost(ctx, d.Host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		peers = append(peers, net.JoinHostPort(ip, strconv.Itoa(d.Port)))
+	}
+	return peers, nil
+}
+
+// FileDiscovery is a discovery provider that reads peers from a file containing one
+// host:port address per line. Empty lines and lines starting with # are ignored. The
+// file is watched for changes and only re-read if it has been modified.
+type FileDiscovery struct {
+	// The path to the peers file.
+	Path string
+
+	mutex   sync.Mutex
+	modTime time.Time
+	peers   []string
+}
+
+// Name implements the Discovery interface.
+func (f *FileDiscovery) Name() string {
+	return "file"
+}
+
+// Peers implements the Discovery interface.
+func (f *FileDiscovery) Peers() ([]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	if f.peers != nil && info.ModTime().Equal(f.modTime) {
+		return f.peers, nil
+	}
+
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	peers := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(line); err != nil {
+			return nil, fmt.Errorf("%v contains invalid peer address %v", f.Path, line)
+		}
+		peers = append(peers, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	f.modTime = info.ModTime()
+	f.peers = peers
+	return peers, nil
+}
+
+// DiscoveryFunc is an adapter that allows the use of an ordinary function as discovery
+// provider.
+type DiscoveryFunc func() ([]string, error)
+
+// Name implements the Discovery interface.
+func (f DiscoveryFunc) Name() string {
+	return "func"
+}
+
+// Peers implements the Discovery interface.
+func (f DiscoveryFunc) Peers() ([]string, error) {
+	return f()
+}
+
+// discoveredPeer is a peer address alongside the name of the source it has been discovered by.
+type discoveredPeer struct {
+	address string
+	source  string
+}
+
+// discoverPeers queries all sources for peers and merges their results. The members persisted
+// in the state.json come first, ordered by the time they were last seen, followed by the peerlist
+// and discovery settings of the raftify.json and the providers passed in on initialization.
+// Duplicates and the local node are removed. Providers that fail are skipped.
+func (n *Node) discoverPeers() []discoveredPeer {
+	providers := []Discovery{stateDiscovery(n.statePeers), StaticDiscovery(n.config.PeerList)}
+	providers = append(providers, n.configDiscovery...)
+	providers = append(providers, n.discovery...)
+
+	peers := []discoveredPeer{}
+	seen := map[string]bool{}
+
+	for _, provider := range providers {
+		found, err := provider.Peers()
+		if err != nil {
+			n.logger.Printf("[WARN] raftify: %v discovery failed: %v\n", provider.Name(), err.Error())
+			continue
+		}
+
+		for _, peer := range found {
+			if seen[peer] || n.config.isLocalAddr(peer) {
+				continue
+			}
+			seen[peer] = true
+			peers = append(peers, discoveredPeer{address: peer, source: provider.Name()})
+		}
+	}
+	return peers
+}
+
+// hasPeers checks whether the node has any peers to join without querying the discovery
+// providers, so that deciding whether to bootstrap alone neither depends on DNS nor reads any
+// files. Every configured provider counts since it may return peers once queried.
+func (n *Node) hasPeers() bool {
+	if len(n.configDiscovery) != 0 || len(n.discovery) != 0 {
+		return true
+	}
+	for _, peer := range append(append([]string{}, n.statePeers...), n.config.PeerList...) {
+		if !n.config.isLocalAddr(peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// stateDiscovery is a discovery provider returning the members persisted in the state.json file.
+type stateDiscovery []string
+
+// Name implements the Discovery interface.
+func (s stateDiscovery) Name() string {
+	return "state"
+}
+
+// Peers implements the Discovery interface.
+func (s stateDiscovery) Peers() ([]string, error) {
+	return s, nil
+}
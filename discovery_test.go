@@ -0,0 +1,200 @@
+package raftify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// staticSRVResolver is a local stand-in for a DNS resolver serving SRV records.
+type staticSRVResolver struct {
+	staticResolver
+	records map[string][]*net.SRV
+}
+
+// LookupSRV implements the SRVResolver interface.
+func (r staticSRVResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if records, ok := r.records[name]; ok {
+		return name, records, nil
+	}
+	return "", nil, fmt.Errorf("no such record %v", name)
+}
+
+func TestDNSDiscovery(t *testing.T) {
+	resolver := staticSRVResolver{
+		staticResolver: staticResolver{"peers.raftify.local": []string{"10.0.0.2", "fd00::3"}},
+		records: map[string][]*net.SRV{
+			"_raftify._udp.raftify.local": []*net.SRV{
+				{Target: "node-2.raftify.local.", Port: 7946},
+				{Target: "node-3.raftify.local.", Port: 7947},
+			},
+		},
+	}
+
+	dns := &DNSDiscovery{Host: "peers.raftify.local", Port: 7946, Resolver: resolver}
+	peers, err := dns.Peers()
+	if err != nil {
+		t.Logf("Expected A/AAAA records to be looked up, instead got error: %v", err.Error())
+		t.FailNow()
+	}
+	if len(peers) != 2 || peers[0] != "10.0.0.2:7946" || peers[1] != "[fd00::3]:7946" {
+		t.Logf("Expected peers [10.0.0.2:7946 [fd00::3]:7946], instead got %v", peers)
+		t.FailNow()
+	}
+
+	srv := &DNSDiscovery{Host: "_raftify._udp.raftify.local", SRV: true, Resolver: resolver}
+	peers, err = srv.Peers()
+	if err != nil {
+		t.Logf("Expected SRV records to be looked up, instead got error: %v", err.Error())
+		t.FailNow()
+	}
+	if len(peers) != 2 || peers[0] != "node-2.raftify.local:7946" || peers[1] != "node-3.raftify.local:7947" {
+		t.Logf("Expected peers [node-2.raftify.local:7946 node-3.raftify.local:7947], instead got %v", peers)
+		t.FailNow()
+	}
+
+	// SRV lookups with a resolver that doesn't support them
+	srv.Resolver = staticResolver{}
+	if _, err := srv.Peers(); err == nil {
+		t.Log("Expected SRV lookup to fail with a resolver not supporting SRV records, instead got nil")
+		t.FailNow()
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	file, _ := ioutil.TempFile("", "raftify-peers")
+	defer os.Remove(file.Name())
+
+	ioutil.WriteFile(file.Name(), []byte("# Validators\n10.0.0.2:7946\n\nnode-3.raftify.local:7946\n"), 0644)
+
+	discovery := &FileDiscovery{Path: file.Name()}
+	peers, err := discovery.Peers()
+	if err != nil {
+		t.Logf("Expected peers file to be read, instead got error: %v", err.Error())
+		t.FailNow()
+	}
+	if len(peers) != 2 || peers[0] != "10.0.0.2:7946" || peers[1] != "node-3.raftify.local:7946" {
+		t.Logf("Expected peers [10.0.0.2:7946 node-3.raftify.local:7946], instead got %v", peers)
+		t.FailNow()
+	}
+
+	// Change the peers file
+	ioutil.WriteFile(file.Name(), []byte("10.0.0.4:7946\n"), 0644)
+	os.Chtimes(file.Name(), time.Now(), time.Now().Add(time.Second))
+
+	peers, err = discovery.Peers()
+	if err != nil {
+		t.Logf("Expected changed peers file to be read, instead got error: %v", err.Error())
+		t.FailNow()
+	}
+	if len(peers) != 1 || peers[0] != "10.0.0.4:7946" {
+		t.Logf("Expected peers [10.0.0.4:7946] after the file changed, instead got %v", peers)
+		t.FailNow()
+	}
+
+	// Invalid peer address
+	ioutil.WriteFile(file.Name(), []byte("10.0.0.4\n"), 0644)
+	os.Chtimes(file.Name(), time.Now(), time.Now().Add(2*time.Second))
+
+	if _, err := discovery.Peers(); err == nil {
+		t.Log("Expected error for invalid peer address, instead got nil")
+		t.FailNow()
+	}
+}
+
+func TestDiscoverPeers(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(1)
+
+	// Initialize dummy node with peers from the peerlist and two user-supplied providers
+	node := initDummyNode("TestNode", 1, 5, ports[0])
+	node.config.PeerList = []string{"10.0.0.2:7946", "10.0.0.3:7946"}
+	node.discovery = []Discovery{
+		DiscoveryFunc(func() ([]string, error) {
+			return []string{"10.0.0.3:7946", "10.0.0.4:7946", fmt.Sprintf("127.0.0.1:%v", ports[0])}, nil
+		}),
+		DiscoveryFunc(func() ([]string, error) {
+			return nil, errors.New("provider unavailable")
+		}),
+	}
+
+	node.statePeers = []string{"10.0.0.4:7946"}
+
+	peers := node.discoverPeers()
+	expected := []discoveredPeer{
+		{address: "10.0.0.4:7946", source: "state"},
+		{address: "10.0.0.2:7946", source: "static"},
+		{address: "10.0.0.3:7946", source: "static"},
+	}
+	if len(peers) != len(expected) {
+		t.Logf("Expected merged peers %v, instead got %v", expected, peers)
+		t.FailNow()
+	}
+	for i := range expected {
+		if peers[i] != expected[i] {
+			t.Logf("Expected merged peers %v, instead got %v", expected, peers)
+			t.FailNow()
+		}
+	}
+}
+
+func TestHasPeers(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(1)
+
+	// The local node alone doesn't count as a peer
+	node := initDummyNode("TestNode", 1, 5, ports[0])
+	node.config.PeerList = []string{fmt.Sprintf("127.0.0.1:%v", ports[0])}
+	if node.hasPeers() {
+		t.Logf("Expected node listing only itself to have no peers")
+		t.FailNow()
+	}
+
+	node.statePeers = []string{"10.0.0.2:7946"}
+	if !node.hasPeers() {
+		t.Logf("Expected members of the state.json file to count as peers")
+		t.FailNow()
+	}
+
+	// Providers count without being queried
+	node.statePeers = nil
+	node.discovery = []Discovery{DiscoveryFunc(func() ([]string, error) {
+		t.Logf("Expected discovery provider not to be queried")
+		t.FailNow()
+		return nil, nil
+	})}
+	if !node.hasPeers() {
+		t.Logf("Expected configured discovery provider to count as peers")
+		t.FailNow()
+	}
+}
+
+func TestDiscoveryConfig(t *testing.T) {
+	valid := DiscoveryConfig{
+		DNS:  "peers.raftify.local:7946",
+		SRV:  "_raftify._udp.raftify.local",
+		File: "peers.txt",
+	}
+	if errs := valid.validate(); errs != "" {
+		t.Logf("Expected valid discovery config, instead got:\n%v", errs)
+		t.FailNow()
+	}
+	if providers := valid.providers("/tmp", nil); len(providers) != 3 {
+		t.Logf("Expected 3 discovery providers, instead got %v", len(providers))
+		t.FailNow()
+	}
+
+	invalid := DiscoveryConfig{
+		DNS: "peers.raftify.local",
+		SRV: "_raftify._udp.raftify_local",
+	}
+	if errs := invalid.validate(); errs == "" {
+		t.Log("Expected invalid discovery config, instead it passed as valid")
+		t.FailNow()
+	}
+}
@@ -1,8 +1,6 @@
 package raftify
 
-import (
-	"encoding/json"
-)
+import "errors"
 
 // toFollower initiates the transition into a follower node for a given term. Calling toFollower
 // on a node that already is in the follower state just resets the data.
@@ -14,23 +12,29 @@ func (n *Node) toFollower(term uint64) {
 
 	n.currentTerm = term
 	n.votedFor = ""
+	n.leaderID = "" // Set once the first heartbeat of the term arrives.
 	n.state = Follower
 }
 
 // runFollower runs the follower loop. This function is called within the runLoop function.
 func (n *Node) runFollower() {
+	messages, timeout, events := n.network.Messages(), n.timeoutTimer.C(), n.membershipEvents()
+	n.idle(messages, timeout, events)
+
 	select {
-	case msgBytes := <-n.messages.messageCh:
-		var msg Message
-		if err := json.Unmarshal(msgBytes, &msg); err != nil {
-			n.logger.Printf("[ERR] raftify: error while unmarshaling wrapper message: %v\n", err.Error())
+	case in := <-messages:
+		msg, err := n.decodeMessage(in)
+		if err != nil {
+			n.logger.Printf("[ERR] raftify: %v\n", err.Error())
 			break
 		}
 
 		switch msg.Type {
 		case HeartbeatMsg:
 			var content Heartbeat
-			if err := json.Unmarshal(msg.Content, &content); err != nil {
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
 				n.logger.Printf("[ERR] raftify: error while unmarshaling heartbeat message: %v\n", err.Error())
 				break
 			}
@@ -38,7 +42,9 @@ func (n *Node) runFollower() {
 
 		case PreVoteRequestMsg:
 			var content PreVoteRequest
-			if err := json.Unmarshal(msg.Content, &content); err != nil {
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
 				n.logger.Printf("[ERR] raftify: error while unmarshaling prevote request message: %v\n", err.Error())
 				break
 			}
@@ -46,7 +52,9 @@ func (n *Node) runFollower() {
 
 		case VoteRequestMsg:
 			var content VoteRequest
-			if err := json.Unmarshal(msg.Content, &content); err != nil {
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
 				n.logger.Printf("[ERR] raftify: error while unmarshaling vote request message: %v\n", err.Error())
 				break
 			}
@@ -54,22 +62,47 @@ func (n *Node) runFollower() {
 
 		case NewQuorumMsg:
 			var content NewQuorum
-			if err := json.Unmarshal(msg.Content, &content); err != nil {
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
 				n.logger.Printf("[ERR] raftify: error while unmarshaling new quorum message: %v\n", err.Error())
 				break
 			}
 			n.handleNewQuorum(content)
 
+		case KeyringRequestMsg:
+			var content KeyringRequest
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
+				n.logger.Printf("[ERR] raftify: error while unmarshaling keyring request message: %v\n", err.Error())
+				break
+			}
+			n.handleKeyringRequest(content)
+
+		case AckMsg:
+			var content Ack
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
+				n.logger.Printf("[ERR] raftify: error while unmarshaling ack message: %v\n", err.Error())
+				break
+			}
+			n.handleAck(content)
+
 		default:
 			n.logger.Printf("[WARN] raftify: received %v as follower, discarding...\n", msg.Type.toString())
 		}
 
-	case <-n.timeoutTimer.C:
+	case <-timeout:
 		n.logger.Println("[DEBUG] raftify: Heartbeat timeout elapsed")
 		n.toPreCandidate()
 
-	case <-n.events.eventCh:
-		n.saveState()
+	case event := <-events:
+		n.handleMembershipEvent(event)
+
+	case call := <-n.keyringCh:
+		n.rejectKeyringOp(call)
 
 	case <-n.shutdownCh:
 		n.toPreShutdown()
@@ -3,6 +3,8 @@ module github.com/BlockscapeLab/raftify
 go 1.14
 
 require (
+	github.com/hashicorp/go-msgpack v0.5.3
+	github.com/hashicorp/go-sockaddr v1.0.0
 	github.com/hashicorp/logutils v1.0.0
 	github.com/hashicorp/memberlist v0.2.2
 )
@@ -2,8 +2,6 @@ package raftify
 
 import (
 	"fmt"
-
-	"github.com/hashicorp/memberlist"
 )
 
 // handleHeartbeat handles the receival of a heartbeat message from a leader.
@@ -24,6 +22,7 @@ func (n *Node) handleHeartbeat(msg Heartbeat) {
 		}
 
 		n.logger.Printf("[DEBUG] raftify: Received heartbeat from %v\n", msg.LeaderID)
+		n.leaderID = msg.LeaderID
 		n.sendHeartbeatResponse(msg.LeaderID, msg.HeartbeatID)
 		n.resetTimeout()
 
@@ -31,6 +30,7 @@ func (n *Node) handleHeartbeat(msg Heartbeat) {
 		if n.currentTerm <= msg.Term {
 			n.logger.Printf("[DEBUG] raftify: Received heartbeat with same/higher term from %v, adopting term %v...\n", msg.LeaderID, msg.Term)
 			n.toFollower(msg.Term)
+			n.leaderID = msg.LeaderID
 			n.sendHeartbeatResponse(msg.LeaderID, msg.HeartbeatID)
 			break
 		}
@@ -41,6 +41,7 @@ func (n *Node) handleHeartbeat(msg Heartbeat) {
 		if n.currentTerm <= msg.Term {
 			n.logger.Printf("[DEBUG] raftify: Received heartbeat with same/higher term from %v, adopting term %v...\n", msg.LeaderID, msg.Term)
 			n.toFollower(msg.Term)
+			n.leaderID = msg.LeaderID
 		} else {
 			n.logger.Printf("[DEBUG] raftify: Received outdated heartbeat from %v, skipping...\n", msg.LeaderID)
 		}
@@ -194,36 +195,38 @@ func (n *Node) handleVoteResponse(msg VoteResponse) {
 }
 
 // handleNewQuorum handles the receival of a new quorum message from a node in the PreShutdown state.
+// The new quorum is only applied once the leave event of the node arrives, or right away if it
+// has already been handled. If it doesn't arrive within the leave timeout, the announcement
+// expires.
 func (n *Node) handleNewQuorum(msg NewQuorum) {
-	n.logger.Printf("[DEBUG] raftify: Received new quorum, waiting for %v to leave...\n", msg.LeavingID)
-
-	// If the event is not the leave event fired by the node that announced its exit, do nothing
-	if event := <-n.events.eventCh; event.Node.Name != msg.LeavingID || event.Event != memberlist.NodeLeave {
-		switch event.Event {
-		case memberlist.NodeJoin:
-			n.logger.Printf("[ERR] raftify: Unsuspected join event from %v\n", event.Node.Name)
-		case memberlist.NodeUpdate:
-			n.logger.Printf("[ERR] raftify: Unsuspected update event from %v\n", event.Node.Name)
-		case memberlist.NodeLeave:
-			n.logger.Printf("[ERR] raftify: Unsuspected leave event from %v, expected leave from %v\n", event.Node.Name, msg.LeavingID)
-		}
+	now := n.clock.Now()
+	if n.pendingLeaves.lookupDeparted(msg.LeavingID, now) != nil {
+		n.pendingLeaves.forget(msg.LeavingID)
+		n.applyNewQuorum(msg.LeavingID, msg.NewQuorum)
 		return
 	}
 
-	n.logger.Printf("[DEBUG] raftify: Setting the quorum from %v to %v\n", n.quorum, msg.NewQuorum)
-	n.quorum = msg.NewQuorum
-	n.saveState()
+	n.logger.Printf("[DEBUG] raftify: Received new quorum, waiting for %v to leave...\n", msg.LeavingID)
+	n.pendingLeaves.add(msg.LeavingID, msg.NewQuorum, now.Add(n.leaveTimeout()))
+}
 
-	if msg.NewQuorum == 1 {
-		n.logger.Printf("[DEBUG] raftify: %v is the only node left in the cluster, entering leader state for term %v...", n.config.ID, n.currentTerm)
+// handleKeyringRequest handles the receival of a keyring request message from a leader. Only
+// requests from the leader of the current term are executed.
+func (n *Node) handleKeyringRequest(msg KeyringRequest) {
+	if msg.LeaderID != n.leaderID || msg.Term != n.currentTerm {
+		n.logger.Printf("[WARN] raftify: Received keyring request from %v (term: %v) which is not the current leader, skipping...\n", msg.LeaderID, msg.Term)
+		return
+	}
 
-		// Switch to the Leader state without calling toLeader in order to bypass the state change
-		// restriction in this corner case.
-		n.timeoutTimer.Stop()  // Leaders have no timeout
-		n.startMessageTicker() // Used to periodically send out heartbeat messages
-		n.heartbeatIDList.reset()
+	n.logger.Printf("[DEBUG] raftify: Received keyring request %v from %v\n", msg.Op.toString(), msg.LeaderID)
+	n.sendKeyringResponse(msg.LeaderID, n.applyKeyringOp(msg))
+}
 
-		n.votedFor = ""
-		n.state = Leader
+// handleKeyringResponse handles the receival of a keyring response message from a follower.
+func (n *Node) handleKeyringResponse(msg KeyringResponse) {
+	if err := n.keyringRequests.deliver(msg); err != nil {
+		n.logger.Printf("[DEBUG] raftify: Discarding keyring response from %v: %v\n", msg.FollowerID, err.Error())
+		return
 	}
+	n.logger.Printf("[DEBUG] raftify: Received keyring response from %v\n", msg.FollowerID)
 }
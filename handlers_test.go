@@ -3,8 +3,6 @@ package raftify
 import (
 	"testing"
 	"time"
-
-	"github.com/hashicorp/memberlist"
 )
 
 func TestHandleHeartbeatAsFollower(t *testing.T) {
@@ -47,7 +45,7 @@ func TestHandleHeartbeatAsFollower(t *testing.T) {
 	node.handleHeartbeat(hb)
 
 	select {
-	case <-node.timeoutTimer.C:
+	case <-node.timeoutTimer.C():
 		break
 	case <-time.After((MaxTimeout*time.Duration(node.config.Performance) + 1) * time.Millisecond):
 		t.Logf("Expected election timeout to be reset after receival of heartbeat with same term, instead nothing happened")
@@ -339,7 +337,7 @@ func TestHandlePreVoteResponse(t *testing.T) {
 	// Prevote granted
 	node.quorum = 1
 	pvr.PreVoteGranted = true
-	node.preVoteList.pending = append(node.preVoteList.pending, node.memberlist.LocalNode())
+	node.preVoteList.pending = append(node.preVoteList.pending, node.network.LocalMember())
 	node.handlePreVoteResponse(pvr)
 
 	if node.preVoteList.received != 2 {
@@ -418,7 +416,7 @@ func TestHandleVoteResponse(t *testing.T) {
 	node.toCandidate()
 
 	vr.Term = node.currentTerm
-	node.voteList.pending = append(node.voteList.pending, node.memberlist.LocalNode())
+	node.voteList.pending = append(node.voteList.pending, node.network.LocalMember())
 	node.handleVoteResponse(vr)
 
 	if node.voteList.received != 1 {
@@ -428,7 +426,7 @@ func TestHandleVoteResponse(t *testing.T) {
 
 	node.quorum = 1
 	vr.VoteGranted = true
-	node.voteList.pending = append(node.voteList.pending, node.memberlist.LocalNode())
+	node.voteList.pending = append(node.voteList.pending, node.network.LocalMember())
 	node.handleVoteResponse(vr)
 
 	if node.state != Leader {
@@ -448,19 +446,46 @@ func TestHandleNewQuorum(t *testing.T) {
 
 	nq := NewQuorum{
 		NewQuorum: 2,
-		LeavingID: "TestNode",
+		LeavingID: "LeavingTestNode",
 	}
 
 	defer node.deleteState()
 
-	// Valid test case if new quorum greater than 1 is handled and leave event is fired
-	node.events.eventCh <- memberlist.NodeEvent{
-		Event: memberlist.NodeLeave,
-		Node: &memberlist.Node{
-			Name: "TestNode",
+	// The new quorum is not applied before the leave event arrives
+	node.quorum = 3
+	node.handleNewQuorum(nq)
+
+	if node.quorum != 3 {
+		t.Logf("Expected the quorum to stay 3 until the leave event arrives, instead got %v", node.quorum)
+		t.FailNow()
+	}
+
+	// Unrelated join and leave events don't apply the new quorum and are not lost
+	node.handleMembershipEvent(MemberEvent{
+		Type: MemberJoin,
+		Member: &Member{
+			Name: "LeavingTestNode",
+		},
+	})
+	node.handleMembershipEvent(MemberEvent{
+		Type: MemberLeave,
+		Member: &Member{
+			Name: "WrongTestNode",
 		},
+	})
+
+	if node.quorum != 3 {
+		t.Logf("Expected quorum to have stayed 3, instead got %v", node.quorum)
+		t.FailNow()
 	}
-	node.handleNewQuorum(nq)
+
+	// Valid test case if new quorum greater than 1 is handled and leave event is fired
+	node.handleMembershipEvent(MemberEvent{
+		Type: MemberLeave,
+		Member: &Member{
+			Name: "LeavingTestNode",
+		},
+	})
 
 	if node.quorum != 2 {
 		t.Logf("Expected the quorum to be 2, instead got %v", node.quorum)
@@ -473,14 +498,13 @@ func TestHandleNewQuorum(t *testing.T) {
 
 	// Valid test case if new quorum is 1 and leave event is fired
 	nq.NewQuorum = 1
-
-	node.events.eventCh <- memberlist.NodeEvent{
-		Event: memberlist.NodeLeave,
-		Node: &memberlist.Node{
-			Name: "TestNode",
-		},
-	}
 	node.handleNewQuorum(nq)
+	node.handleMembershipEvent(MemberEvent{
+		Type: MemberLeave,
+		Member: &Member{
+			Name: "LeavingTestNode",
+		},
+	})
 
 	if node.quorum != 1 {
 		t.Logf("Expected the quorum to be 1, instead got %v", node.quorum)
@@ -491,33 +515,34 @@ func TestHandleNewQuorum(t *testing.T) {
 		t.FailNow()
 	}
 
-	// Invalid test case if join event is fired
-	nq.NewQuorum = 0
-
-	node.events.eventCh <- memberlist.NodeEvent{
-		Event: memberlist.NodeJoin,
-		Node: &memberlist.Node{
-			Name: "TestNode",
+	// Invalid test case if the leave event arrives after the announcement expired
+	node.pendingLeaves.add("LeavingTestNode", 2, time.Now().Add(-time.Second))
+	node.handleMembershipEvent(MemberEvent{
+		Type: MemberLeave,
+		Member: &Member{
+			Name: "LeavingTestNode",
 		},
-	}
-	node.handleNewQuorum(nq)
+	})
 
 	if node.quorum != 1 {
 		t.Logf("Expected quorum to have stayed 1, instead got %v", node.quorum)
 		t.FailNow()
 	}
-
-	// Invalid test case if leave event is fired by wrong node
-	node.events.eventCh <- memberlist.NodeEvent{
-		Event: memberlist.NodeLeave,
-		Node: &memberlist.Node{
-			Name: "WrongTestNode",
+	// The announcement is applied right away if the leave event has been handled first
+	node.handleMembershipEvent(MemberEvent{
+		Type: MemberLeave,
+		Member: &Member{
+			Name: "LeftTestNode",
 		},
-	}
-	node.handleNewQuorum(nq)
+	})
+	node.handleNewQuorum(NewQuorum{NewQuorum: 2, LeavingID: "LeftTestNode"})
 
-	if node.quorum != 1 {
-		t.Logf("Expected quorum to have stayed 1, instead got %v", node.quorum)
+	if node.quorum != 2 {
+		t.Logf("Expected the quorum to be 2, instead got %v", node.quorum)
+		t.FailNow()
+	}
+	if _, ok := node.pendingLeaves.pending["LeftTestNode"]; ok {
+		t.Logf("Expected the applied announcement not to wait for another leave event")
 		t.FailNow()
 	}
 }
@@ -2,32 +2,33 @@ package raftify
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
-	"sync"
 	"testing"
 	"time"
-
-	"github.com/hashicorp/memberlist"
-)
-
-var (
-	mutex      = sync.Mutex{}
-	unusedPort = 3000
 )
 
-// reservePorts returns a slice of unused ports.
+// reservePorts returns a slice of unused ports picked by the operating system. Each port
+// is free for both TCP and UDP at the time of reservation.
 func reservePorts(number int) []int {
-	mutex.Lock()
-	defer mutex.Unlock()
-
 	var ports []int
-	for i := unusedPort; i < (unusedPort + number); i++ {
-		ports = append(ports, i)
-	}
+	for len(ports) < number {
+		tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			continue
+		}
+		port := tcpListener.Addr().(*net.TCPAddr).Port
 
-	unusedPort += number
+		udpListener, err := net.ListenPacket("udp", fmt.Sprintf("127.0.0.1:%v", port))
+		if err == nil {
+			udpListener.Close()
+			ports = append(ports, port)
+		}
+		tcpListener.Close()
+	}
 	return ports
 }
 
@@ -44,9 +45,11 @@ func TestReservePorts(t *testing.T) {
 		t.FailNow()
 	}
 
-	if ports1[9]+1 != ports2[0] {
-		t.Logf("Expected the second set of ports to immediately follow up the first one")
-		t.FailNow()
+	for _, port := range append(ports1, ports2...) {
+		if port <= 0 || port > 65535 {
+			t.Logf("Expected ports in range 1-65535, instead got %v", port)
+			t.FailNow()
+		}
 	}
 }
 
@@ -63,6 +66,7 @@ func initDummyNode(id string, expect, maxnodes, port int) *Node {
 	node := &Node{
 		logger:     logger,
 		workingDir: pwd,
+		resolver:   net.DefaultResolver,
 		config: &Config{
 			ID:          id,
 			MaxNodes:    maxnodes,
@@ -71,19 +75,28 @@ func initDummyNode(id string, expect, maxnodes, port int) *Node {
 			LogLevel:    "DEBUG",
 			BindAddr:    "127.0.0.1",
 			BindPort:    port,
+			Limits: LimitsConfig{
+				MaxMessageSize: DefaultMaxMessageSize,
+				MessageRate:    DefaultMessageRate,
+				MessageBurst:   DefaultMessageBurst,
+			},
 		},
 		messages: &MessageDelegate{
 			logger:    logger,
-			messageCh: make(chan []byte),
+			messageCh: make(chan InboundMessage),
 		},
+		metrics: &Metrics{},
+		metas:   &metaCache{},
 		events: &ChannelEventDelegate{
 			logger:  logger,
-			eventCh: make(chan memberlist.NodeEvent, maxnodes),
+			eventCh: make(chan MemberEvent, maxnodes),
+			localID: id,
 		},
-		timeoutTimer:  time.NewTimer(time.Second),
-		messageTicker: time.NewTicker(time.Second),
-		bootstrapCh:   make(chan bool),
-		shutdownCh:    make(chan error),
+		clock:       systemClock{},
+		rand:        newRand(),
+		bootstrapCh: make(chan error),
+		shutdownCh:  make(chan error),
+		keyringCh:   make(chan keyringCall),
 		heartbeatIDList: &HeartbeatIDList{
 			logger:             logger,
 			currentHeartbeatID: 0,
@@ -94,17 +107,21 @@ func initDummyNode(id string, expect, maxnodes, port int) *Node {
 		preVoteList: &VoteList{
 			logger:              logger,
 			received:            0,
-			pending:             []*memberlist.Node{},
+			pending:             []*Member{},
 			missedPrevoteCycles: 0,
 		},
 		voteList: &VoteList{
 			logger:              logger,
 			received:            0,
-			pending:             []*memberlist.Node{},
+			pending:             []*Member{},
 			missedPrevoteCycles: 0,
 		},
 	}
 
+	node.events.metrics = node.metrics
+
+	node.timeoutTimer = node.clock.NewTimer(time.Second)
+	node.messageTicker = node.clock.NewTicker(time.Second)
 	node.timeoutTimer.Stop()
 	node.messageTicker.Stop()
 	return node
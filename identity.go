@@ -0,0 +1,343 @@
+package raftify
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// identity contains the keys used to sign outgoing messages and verify incoming ones.
+type identity struct {
+	// The private key of the local node used to sign outgoing messages.
+	privateKey ed25519.PrivateKey
+
+	// The public keys of all cluster members, including the local node, by node ID.
+	trustedKeys map[string]ed25519.PublicKey
+}
+
+// sender is implemented by all message contents and returns the node ID the content claims
+// to originate from.
+type sender interface {
+	senderID() string
+}
+
+func (m *Heartbeat) senderID() string         { return m.LeaderID }
+func (m *HeartbeatResponse) senderID() string { return m.FollowerID }
+func (m *PreVoteRequest) senderID() string    { return m.PreCandidateID }
+func (m *PreVoteResponse) senderID() string   { return m.FollowerID }
+func (m *VoteRequest) senderID() string       { return m.CandidateID }
+func (m *VoteResponse) senderID() string      { return m.FollowerID }
+func (m *NewQuorum) senderID() string         { return m.LeavingID }
+func (m *KeyringRequest) senderID() string    { return m.LeaderID }
+func (m *KeyringResponse) senderID() string   { return m.FollowerID }
+func (m *JoinRequest) senderID() string       { return m.NodeID }
+func (m *JoinResponse) senderID() string      { return m.MemberID }
+func (m *Ack) senderID() string               { return m.NodeID }
+
+// legacyTerm returns the term of the sender a message content has been sent in, if it carries
+// one. A prevote request announces the term following the one of its sender.
+func legacyTerm(content sender) (uint64, bool) {
+	switch m := content.(type) {
+	case *Heartbeat:
+		return m.Term, true
+	case *HeartbeatResponse:
+		return m.Term, true
+	case *PreVoteRequest:
+		if m.NextTerm == 0 {
+			return 0, true
+		}
+		return m.NextTerm - 1, true
+	case *PreVoteResponse:
+		return m.Term, true
+	case *VoteRequest:
+		return m.Term, true
+	case *VoteResponse:
+		return m.Term, true
+	case *KeyringRequest:
+		return m.Term, true
+	}
+	return 0, false
+}
+
+// uniqueContent checks whether the content of messages of the given type differs between any two
+// messages of the same sender and term. Prevotes and votes as well as their responses are sent
+// again with the same content, e.g. on every tick while a candidate waits for votes, and handling
+// them twice has no effect.
+func uniqueContent(msgType MessageType) bool {
+	switch msgType {
+	case HeartbeatMsg, HeartbeatResponseMsg, NewQuorumMsg, KeyringRequestMsg, KeyringResponseMsg:
+		return true
+	}
+	return false
+}
+
+// signingEnabled checks whether per-node identities are configured.
+func (c *Config) signingEnabled() bool {
+	return len(c.TrustedKeys) != 0
+}
+
+// validateIdentity checks for constraint violations in the identity settings and returns them
+// in the same format as Config.validate.
+func (c *Config) validateIdentity() string {
+	var errs string
+	if c.IdentityKeyFile != "" && !c.signingEnabled() {
+		errs += "\ttrusted_keys must not be empty if identity_key_file is set\n"
+	}
+	if !c.signingEnabled() {
+		return errs
+	}
+
+	if c.IdentityKeyFile == "" {
+		errs += "\tidentity_key_file must be set if trusted_keys is set\n"
+	}
+	if _, ok := c.TrustedKeys[c.ID]; !ok {
+		errs += fmt.Sprintf("\ttrusted_keys must contain the public key of the local node %v\n", c.ID)
+	}
+
+	// Sort the IDs so that the errors are reported in a deterministic order.
+	ids := make([]string, 0, len(c.TrustedKeys))
+	for id := range c.TrustedKeys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		key, err := hexToByte(c.TrustedKeys[id])
+		if err != nil {
+			errs += fmt.Sprintf("\ttrusted_keys.%v must be the hex representation of the public key\n", id)
+		} else if len(key) != ed25519.PublicKeySize {
+			errs += fmt.Sprintf("\ttrusted_keys.%v must be of length %v bytes: got %v bytes\n", id, ed25519.PublicKeySize, len(key))
+		}
+	}
+	return errs
+}
+
+// loadIdentity reads the private key from the identity_key_file and parses the trusted public
+// keys. Returns nil if signing is disabled. The file may contain either the hex representation
+// of the 32-byte seed or of the 64-byte private key. The key itself is never part of the error
+// messages returned.
+func (c *Config) loadIdentity(workingDir string) (*identity, error) {
+	if !c.signingEnabled() {
+		return nil, nil
+	}
+
+	path := c.IdentityKeyFile
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workingDir, path)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read identity_key_file: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return nil, fmt.Errorf("identity_key_file %v must not be accessible by group or others: got permissions %04o, expected 0600 or 0400", path, perm)
+	}
+
+	keyBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read identity_key_file: %v", err)
+	}
+	key, err := hexToByte(strings.TrimSpace(string(keyBytes)))
+	if err != nil {
+		return nil, errors.New("identity_key_file does not contain a valid hex-encoded key")
+	}
+
+	id := &identity{trustedKeys: map[string]ed25519.PublicKey{}}
+	switch len(key) {
+	case ed25519.SeedSize:
+		id.privateKey = ed25519.NewKeyFromSeed(key)
+	case ed25519.PrivateKeySize:
+		id.privateKey = ed25519.PrivateKey(key)
+	default:
+		return nil, fmt.Errorf("identity_key_file must contain a key of length %v or %v bytes: got %v bytes", ed25519.SeedSize, ed25519.PrivateKeySize, len(key))
+	}
+
+	for nodeID, hexKey := range c.TrustedKeys {
+		publicKey, _ := hexToByte(hexKey) // Already checked during validation.
+		id.trustedKeys[nodeID] = ed25519.PublicKey(publicKey)
+	}
+
+	if !bytes.Equal(id.privateKey.Public().(ed25519.PublicKey), id.trustedKeys[c.ID]) {
+		return nil, fmt.Errorf("identity_key_file does not match the public key of %v in trusted_keys", c.ID)
+	}
+	return id, nil
+}
+
+// decodeMessage unwraps a received message in either wire format. Messages of unknown types,
+// without a sender, in a protocol version the local node doesn't speak or addressed to another
+// node are rejected. If per-node identities are configured, messages that are unsigned, signed
+// by an unknown node or carry an invalid signature are rejected as well, as are messages without
+// recipient from members that name it.
+func (n *Node) decodeMessage(in InboundMessage) (Message, error) {
+	var msg Message
+	format, payload := formatOf(in.Payload), in.Payload
+	if format == formatMsgpack {
+		payload = payload[1:]
+	}
+	if err := unmarshal(format, payload, &msg); err != nil {
+		atomic.AddUint64(&n.metrics.InvalidMessages, 1)
+		return msg, fmt.Errorf("error while unmarshaling wrapper message from %v: %v", in.From, err)
+	}
+	msg.from, msg.peer, msg.format, msg.legacy = in.From, in.Peer, format, in.legacy
+
+	// Members predating the message transport don't name themselves as sender.
+	if msg.Type > AckMsg || (msg.Sender == "" && !msg.legacy) {
+		atomic.AddUint64(&n.metrics.InvalidMessages, 1)
+		return msg, fmt.Errorf("rejected message of unknown type %v or without sender from %v", uint8(msg.Type), msg.from)
+	}
+	if err := checkVersion(&msg); err != nil {
+		atomic.AddUint64(&n.metrics.InvalidMessages, 1)
+		return msg, err
+	}
+	if msg.Version >= protocolRecipient && msg.Recipient != n.config.ID && !msg.Type.isJoin() {
+		atomic.AddUint64(&n.metrics.Replays, 1)
+		err := fmt.Errorf("rejected %v from %v (%v) addressed to %v", msg.Type.toString(), msg.Sender, msg.from, msg.Recipient)
+		n.audit("%v", err.Error())
+		return msg, err
+	}
+	if n.identity == nil {
+		return msg, nil
+	}
+
+	var err error
+	if msg.Sender == "" || len(msg.Signature) == 0 {
+		err = fmt.Errorf("rejected unsigned %v from %v", msg.Type.toString(), msg.from)
+	} else if publicKey, ok := n.identity.trustedKeys[msg.Sender]; !ok {
+		err = fmt.Errorf("rejected %v from untrusted node %v (%v)", msg.Type.toString(), msg.Sender, msg.from)
+	} else if !ed25519.Verify(publicKey, signingPayload(&msg), msg.Signature) {
+		err = fmt.Errorf("rejected %v from %v (%v) with invalid signature", msg.Type.toString(), msg.Sender, msg.from)
+	}
+	if err != nil {
+		atomic.AddUint64(&n.metrics.InvalidSignatures, 1)
+		n.audit("%v", err.Error())
+		return msg, err
+	}
+
+	// Messages without recipient could have been sent to any other node, so they are only
+	// accepted from members that don't name the recipient yet.
+	if err := n.checkRecipientVersion(&msg); err != nil {
+		atomic.AddUint64(&n.metrics.Replays, 1)
+		n.audit("%v", err.Error())
+		return msg, err
+	}
+	return msg, nil
+}
+
+// checkRecipientVersion returns an error if a message has been encoded in a protocol version
+// before protocolRecipient although its sender is a member that speaks protocolRecipient with the
+// local node. Join requests and responses are exempt since they are sent before the protocol
+// version of the peer is known.
+func (n *Node) checkRecipientVersion(msg *Message) error {
+	if msg.Version >= protocolRecipient || msg.Type.isJoin() {
+		return nil
+	}
+	member, err := n.getNodeByName(msg.Sender)
+	if err != nil {
+		return nil
+	}
+	if version := n.metas.versionFor(member); version >= protocolRecipient {
+		return fmt.Errorf("rejected %v from %v (%v) in protocol version %v without recipient, expected version %v", msg.Type.toString(), msg.Sender, msg.from, msg.Version, version)
+	}
+	return nil
+}
+
+// departedSender returns the member a new quorum message originates from if the member has
+// already left. A leaving node announces its new quorum right before it leaves, so its leave
+// event may be handled first. Returns nil for all other messages and current members.
+func (n *Node) departedSender(msgType MessageType, id string) *Member {
+	if msgType != NewQuorumMsg {
+		return nil
+	}
+	if _, err := n.getNodeByName(id); err == nil {
+		return nil
+	}
+
+	// The leave event may not have been handled yet
+	n.handleQueuedEvents()
+	return n.pendingLeaves.lookupDeparted(id, n.clock.Now())
+}
+
+// decodeContent unmarshals the content of a received message in the wire format of the message
+// itself and makes sure it originates from the member it claims to, see verifySource. The claimed
+// member must also match the sender of the envelope, which is the signer if per-node identities are
+// configured, so that a member cannot send messages on behalf of others. Messages received as
+// memberlist user messages must originate from a member predating the message transport. Messages
+// with implausible values as well as replayed and stale messages are rejected. errDuplicate is
+// returned for copies already received via another path and for retransmits of messages that
+// have already been accepted, which are acknowledged again.
+func (n *Node) decodeContent(msg Message, content sender) error {
+	if err := unmarshal(msg.format, msg.Content, content); err != nil {
+		atomic.AddUint64(&n.metrics.InvalidMessages, 1)
+		return err
+	}
+
+	var err error
+	if msg.legacy {
+		if srcErr := n.verifyLegacySender(content.senderID(), msg); srcErr != nil {
+			err = fmt.Errorf("%v %v", msg.Type.toString(), srcErr.Error())
+		}
+	} else if content.senderID() != msg.Sender {
+		err = fmt.Errorf("%v claims to originate from %v but was sent by %v", msg.Type.toString(), content.senderID(), msg.Sender)
+	} else if departed := n.departedSender(msg.Type, content.senderID()); departed != nil {
+		if srcErr := n.verifyMemberSource(departed, msg.from, msg.peer); srcErr != nil {
+			err = fmt.Errorf("%v %v", msg.Type.toString(), srcErr.Error())
+		}
+	} else if srcErr := n.verifySource(content.senderID(), msg.from, msg.peer); srcErr != nil {
+		err = fmt.Errorf("%v %v", msg.Type.toString(), srcErr.Error())
+	}
+	if err != nil {
+		atomic.AddUint64(&n.metrics.SourceMismatches, 1)
+		n.audit("rejected %v", err.Error())
+		return err
+	}
+
+	if v, ok := content.(validator); ok {
+		if err := v.validate(n); err != nil {
+			atomic.AddUint64(&n.metrics.InvalidMessages, 1)
+			return fmt.Errorf("invalid %v from %v: %v", msg.Type.toString(), msg.Sender, err.Error())
+		}
+	}
+
+	// Members predating the message transport neither request acks nor number their messages, so
+	// their replays are detected by term and content instead.
+	if msg.legacy {
+		term, hasTerm := legacyTerm(content)
+		if err := n.legacyGuard.check(content.senderID(), msg.Type, term, hasTerm, uniqueContent(msg.Type), msg.Content); err != nil {
+			atomic.AddUint64(&n.metrics.Replays, 1)
+			n.audit("rejected %v", err.Error())
+			return err
+		}
+		return nil
+	}
+
+	// Copies of accepted messages, received via other paths or retransmitted because the first
+	// ack got lost, are neither handled twice nor counted as replays. They are only recognized
+	// once they have passed all checks, so that forged copies cannot mark a path as reachable.
+	if err := n.checkDuplicate(msg); err != nil {
+		return err
+	}
+
+	// The replay check comes last so that only authentic messages can advance the window.
+	previous := n.replayGuard.incarnation(msg.Sender)
+	if err := n.replayGuard.check(msg.Sender, msg.Incarnation, msg.Seq); err != nil {
+		atomic.AddUint64(&n.metrics.Replays, 1)
+		n.audit("rejected %v: %v", msg.Type.toString(), err.Error())
+		return err
+	}
+	if msg.AckRequested {
+		n.sendAck(msg)
+	}
+	if msg.Incarnation > previous {
+		n.recordIncarnation()
+	}
+	n.acceptPath(msg)
+	return nil
+}
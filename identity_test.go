@@ -0,0 +1,292 @@
+package raftify
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// genIdentity generates a new Ed25519 key pair and returns the hex representations of the
+// seed and the public key.
+func genIdentity() (string, string) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	return hex.EncodeToString(privateKey.Seed()), hex.EncodeToString(publicKey)
+}
+
+// initSigningNodes returns dummy nodes whose identities trust each other.
+func initSigningNodes(ids ...string) []*Node {
+	seeds := map[string]string{}
+	trusted := map[string]string{}
+	for _, id := range ids {
+		seeds[id], trusted[id] = genIdentity()
+	}
+
+	nodes := []*Node{}
+	for _, id := range ids {
+		node := initDummyNode(id, 1, len(ids), 0)
+		seed, _ := hexToByte(seeds[id])
+		node.identity = &identity{
+			privateKey:  ed25519.NewKeyFromSeed(seed),
+			trustedKeys: map[string]ed25519.PublicKey{},
+		}
+		for trustedID, hexKey := range trusted {
+			publicKey, _ := hexToByte(hexKey)
+			node.identity.trustedKeys[trustedID] = publicKey
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func TestValidateIdentity(t *testing.T) {
+	_, publicKey := genIdentity()
+
+	// Signing disabled
+	if errs := (&Config{ID: "TestNode"}).validateIdentity(); errs != "" {
+		t.Logf("Expected no errors without identities, instead got: %v", errs)
+		t.FailNow()
+	}
+
+	// Valid identity settings
+	config := &Config{
+		ID:              "TestNode",
+		IdentityKeyFile: "identity.key",
+		TrustedKeys:     map[string]string{"TestNode": publicKey},
+	}
+	if errs := config.validateIdentity(); errs != "" {
+		t.Logf("Expected valid identity settings, instead got: %v", errs)
+		t.FailNow()
+	}
+
+	// Key file without trusted keys
+	if errs := (&Config{ID: "TestNode", IdentityKeyFile: "identity.key"}).validateIdentity(); errs == "" {
+		t.Logf("Expected identity_key_file without trusted_keys to be rejected, instead it passed as valid")
+		t.FailNow()
+	}
+
+	// Trusted keys without key file
+	config.IdentityKeyFile = ""
+	if errs := config.validateIdentity(); errs == "" {
+		t.Logf("Expected trusted_keys without identity_key_file to be rejected, instead it passed as valid")
+		t.FailNow()
+	}
+	config.IdentityKeyFile = "identity.key"
+
+	// Local node missing
+	config.ID = "TestNode_2"
+	if errs := config.validateIdentity(); !strings.Contains(errs, "local node") {
+		t.Logf("Expected missing local node to be rejected, instead got: %v", errs)
+		t.FailNow()
+	}
+	config.ID = "TestNode"
+
+	// Invalid public keys
+	config.TrustedKeys["TestNode_2"] = "not-hex"
+	config.TrustedKeys["TestNode_3"] = "abcdef"
+	if errs := config.validateIdentity(); strings.Count(errs, "\n") != 2 {
+		t.Logf("Expected 2 invalid public keys to be rejected, instead got: %v", errs)
+		t.FailNow()
+	}
+}
+
+func TestLoadIdentity(t *testing.T) {
+	seed, publicKey := genIdentity()
+	_, otherPublicKey := genIdentity()
+
+	dir, _ := ioutil.TempDir("", "raftify-identity")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/identity.key", []byte(seed+"\n"), 0600)
+
+	config := &Config{
+		ID:              "TestNode",
+		IdentityKeyFile: "identity.key",
+		TrustedKeys:     map[string]string{"TestNode": publicKey, "TestNode_2": otherPublicKey},
+	}
+
+	id, err := config.loadIdentity(dir)
+	if err != nil {
+		t.Logf("Expected identity to be loaded, instead got error: %v", err)
+		t.FailNow()
+	}
+	if len(id.trustedKeys) != 2 {
+		t.Logf("Expected 2 trusted keys, instead got %v", len(id.trustedKeys))
+		t.FailNow()
+	}
+
+	// Full private key instead of the seed
+	seedBytes, _ := hexToByte(seed)
+	ioutil.WriteFile(dir+"/identity.key", []byte(hex.EncodeToString(ed25519.NewKeyFromSeed(seedBytes))), 0600)
+	if _, err := config.loadIdentity(dir); err != nil {
+		t.Logf("Expected identity to be loaded from the full private key, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	// Key file with permissions too open
+	os.Chmod(dir+"/identity.key", 0644)
+	if _, err := config.loadIdentity(dir); err == nil {
+		t.Logf("Expected key file accessible by others to be rejected, instead error was nil")
+		t.FailNow()
+	}
+	os.Chmod(dir+"/identity.key", 0600)
+
+	// Private key not matching the trusted public key
+	config.TrustedKeys["TestNode"] = otherPublicKey
+	if _, err := config.loadIdentity(dir); err == nil {
+		t.Logf("Expected mismatching key pair to be rejected, instead error was nil")
+		t.FailNow()
+	}
+	config.TrustedKeys["TestNode"] = publicKey
+
+	// Invalid key file contents; the key must not be part of the error
+	ioutil.WriteFile(dir+"/identity.key", []byte("abcdef"), 0600)
+	if _, err := config.loadIdentity(dir); err == nil || strings.Contains(err.Error(), "abcdef") {
+		t.Logf("Expected invalid key to be rejected without exposing it, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	// Signing disabled
+	if id, err := (&Config{}).loadIdentity(dir); id != nil || err != nil {
+		t.Logf("Expected no identity and no error without trusted keys, instead got %v and %v", id, err)
+		t.FailNow()
+	}
+}
+
+func TestSignedMessages(t *testing.T) {
+	nodes := initSigningNodes("TestNode_1", "TestNode_2")
+	sender, receiver := nodes[0], nodes[1]
+
+	sender.createMemberlist()
+	defer sender.memberlist.Shutdown()
+	receiver.createMemberlist()
+	defer receiver.memberlist.Shutdown()
+
+	if _, err := receiver.memberlist.Join([]string{sender.LocalAddr()}); err != nil {
+		t.Logf("Expected receiver to join sender, instead got error: %v", err)
+		t.FailNow()
+	}
+	received := func(msgBytes []byte) InboundMessage {
+		return InboundMessage{From: sender.LocalAddr(), Payload: msgBytes}
+	}
+
+	// Valid signature
+	msgBytes := sender.encodeMessageAs(ProtocolVersionMax, "TestNode_2", VoteRequestMsg, VoteRequest{Term: 1, CandidateID: "TestNode_1"})
+	msg, err := receiver.decodeMessage(received(msgBytes))
+	if err != nil {
+		t.Logf("Expected signed message to be accepted, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	var content VoteRequest
+	if err := receiver.decodeContent(msg, &content); err != nil || content.Term != 1 {
+		t.Logf("Expected content to be decoded, instead got %+v and error %v", content, err)
+		t.FailNow()
+	}
+
+	// Tampered content
+	jsonBytes := sender.encodeMessage(VoteRequestMsg, VoteRequest{Term: 1, CandidateID: "TestNode_1"})
+	var signed Message
+	json.Unmarshal(jsonBytes, &signed)
+	signed.Content = json.RawMessage(`{"term":2,"candidate_id":"TestNode_1"}`)
+	tampered, _ := json.Marshal(signed)
+	if _, err := receiver.decodeMessage(received(tampered)); err == nil {
+		t.Logf("Expected tampered message to be rejected, instead error was nil")
+		t.FailNow()
+	}
+
+	// Tampered type
+	signed = Message{}
+	json.Unmarshal(jsonBytes, &signed)
+	signed.Type = PreVoteRequestMsg
+	tampered, _ = json.Marshal(signed)
+	if _, err := receiver.decodeMessage(received(tampered)); err == nil {
+		t.Logf("Expected message with swapped type to be rejected, instead error was nil")
+		t.FailNow()
+	}
+
+	// Unsigned message
+	unsigned := initDummyNode("TestNode_1", 1, 2, 0).encodeMessage(VoteRequestMsg, VoteRequest{Term: 1, CandidateID: "TestNode_1"})
+	if _, err := receiver.decodeMessage(received(unsigned)); err == nil {
+		t.Logf("Expected unsigned message to be rejected, instead error was nil")
+		t.FailNow()
+	}
+
+	// Untrusted sender
+	outsider := initSigningNodes("TestNode_3")[0]
+	if _, err := receiver.decodeMessage(received(outsider.encodeMessage(VoteRequestMsg, VoteRequest{Term: 1, CandidateID: "TestNode_3"}))); err == nil {
+		t.Logf("Expected message from untrusted node to be rejected, instead error was nil")
+		t.FailNow()
+	}
+
+	if metrics := receiver.GetMetrics(); metrics.InvalidSignatures != 4 {
+		t.Logf("Expected 4 invalid signatures to be counted, instead got %v", metrics.InvalidSignatures)
+		t.FailNow()
+	}
+
+	// Vote forged on behalf of another node
+	msg, err = receiver.decodeMessage(received(sender.encodeMessageAs(ProtocolVersionMax, "TestNode_2", VoteResponseMsg, VoteResponse{Term: 1, FollowerID: "TestNode_2", VoteGranted: true})))
+	if err != nil {
+		t.Logf("Expected signature to be valid, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	var vote VoteResponse
+	if err := receiver.decodeContent(msg, &vote); err == nil {
+		t.Logf("Expected vote on behalf of another node to be rejected, instead error was nil")
+		t.FailNow()
+	}
+}
+
+func TestRecipientBinding(t *testing.T) {
+	nodes := initSigningNodes("TestNode_1", "TestNode_2", "TestNode_3")
+	sender, receiver := nodes[0], nodes[1]
+
+	sender.createMemberlist()
+	defer sender.memberlist.Shutdown()
+	receiver.createMemberlist()
+	defer receiver.memberlist.Shutdown()
+
+	if _, err := receiver.memberlist.Join([]string{sender.LocalAddr()}); err != nil {
+		t.Logf("Expected receiver to join sender, instead got error: %v", err)
+		t.FailNow()
+	}
+	received := func(msgBytes []byte) error {
+		_, err := receiver.decodeMessage(InboundMessage{From: sender.LocalAddr(), Payload: msgBytes})
+		return err
+	}
+
+	// A vote response captured on its way to TestNode_3 is replayed to the receiver
+	captured := sender.encodeMessageAs(ProtocolVersionMax, "TestNode_3", VoteResponseMsg, VoteResponse{Term: 1, FollowerID: "TestNode_1", VoteGranted: true})
+	if err := received(captured); err == nil {
+		t.Logf("Expected message addressed to another node to be rejected, instead error was nil")
+		t.FailNow()
+	}
+
+	// The recipient is covered by the signature
+	var msg Message
+	unmarshal(formatMsgpack, captured[1:], &msg)
+	msg.Recipient = "TestNode_2"
+	forged, _ := marshal(formatMsgpack, msg)
+	if err := received(append([]byte{msgpackMarker}, forged...)); err == nil {
+		t.Logf("Expected message with swapped recipient to be rejected, instead error was nil")
+		t.FailNow()
+	}
+
+	// Members speaking protocolRecipient must name the recipient
+	if err := received(sender.encodeMessageAs(protocolAcks, "", VoteResponseMsg, VoteResponse{Term: 1, FollowerID: "TestNode_1", VoteGranted: true})); err == nil {
+		t.Logf("Expected message without recipient to be rejected, instead error was nil")
+		t.FailNow()
+	}
+
+	if err := received(sender.encodeMessageAs(ProtocolVersionMax, "TestNode_2", VoteResponseMsg, VoteResponse{Term: 1, FollowerID: "TestNode_1", VoteGranted: true})); err != nil {
+		t.Logf("Expected message addressed to the receiver to be accepted, instead got error: %v", err)
+		t.FailNow()
+	}
+	if metrics := receiver.GetMetrics(); metrics.Replays != 2 || metrics.InvalidSignatures != 1 {
+		t.Logf("Expected 2 replays and 1 invalid signature, instead got %+v", metrics)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,399 @@
+package raftify
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// The name of the file in the working directory the keyring is persisted in.
+const keyringFile = "keyring.json"
+
+// Time measured in milliseconds the leader waits for all cluster members to respond to a
+// keyring request.
+const KeyringTimeout = 5000
+
+// KeyResponse contains the results of a cluster-wide keyring operation.
+type KeyResponse struct {
+	// The number of cluster members the operation was issued to, including the leader.
+	NumNodes int
+
+	// The number of cluster members that responded, including the leader.
+	NumResp int
+
+	// The number of cluster members that failed to execute the operation or didn't respond
+	// in time.
+	NumErr int
+
+	// The error messages of all cluster members that failed, keyed by member ID. Members
+	// that succeeded are not listed.
+	Messages map[string]string
+
+	// The hex representations of all installed keys and the number of members they are
+	// installed on. Only set for ListKeys.
+	Keys map[string]int
+
+	// The hex representations of all primary keys and the number of members using them.
+	// Only set for ListKeys.
+	PrimaryKeys map[string]int
+}
+
+// keyringRequests keeps track of the keyring requests sent out by the leader which are still
+// waiting for responses.
+type keyringRequests struct {
+	sync.Mutex
+
+	// The ID the next keyring request is identified by.
+	nextID uint64
+
+	// The channels the responses to the pending requests are delivered to.
+	pending map[uint64]chan KeyringResponse
+}
+
+// add registers a new keyring request and returns its ID alongside the channel its responses
+// are delivered to.
+func (k *keyringRequests) add(size int) (uint64, chan KeyringResponse) {
+	k.Lock()
+	defer k.Unlock()
+
+	if k.pending == nil {
+		k.pending = map[uint64]chan KeyringResponse{}
+	}
+
+	k.nextID++
+	respCh := make(chan KeyringResponse, size)
+	k.pending[k.nextID] = respCh
+	return k.nextID, respCh
+}
+
+// remove unregisters the keyring request with the given ID.
+func (k *keyringRequests) remove(id uint64) {
+	k.Lock()
+	defer k.Unlock()
+	delete(k.pending, id)
+}
+
+// deliver hands a keyring response over to the request it belongs to. Returns an error if
+// there is no such request pending.
+func (k *keyringRequests) deliver(resp KeyringResponse) error {
+	k.Lock()
+	defer k.Unlock()
+
+	respCh, ok := k.pending[resp.RequestID]
+	if !ok {
+		return fmt.Errorf("no keyring request pending with id %v", resp.RequestID)
+	}
+
+	select {
+	case respCh <- resp:
+		return nil
+	default:
+		return fmt.Errorf("received too many responses for keyring request %v", resp.RequestID)
+	}
+}
+
+// InstallKey installs a new encryption key on all cluster members. The key is used to decrypt
+// messages right away, but only used for encryption once it is made the primary key via UseKey.
+// Must be called on the leader.
+func (n *Node) InstallKey(key string) (*KeyResponse, error) {
+	return n.keyringOp(InstallKeyOp, key)
+}
+
+// UseKey makes an installed encryption key the primary key used for encryption on all cluster
+// members. Refuses to do so if the key is not installed on every member yet. Must be called on
+// the leader.
+func (n *Node) UseKey(key string) (*KeyResponse, error) {
+	resp, err := n.keyringOp(ListKeysOp, "")
+	if err != nil {
+		return resp, fmt.Errorf("couldn't verify key is installed on all members: %v", err)
+	}
+	if resp.Keys[key] != resp.NumNodes {
+		return resp, fmt.Errorf("key is installed on %v/%v members only, install it on all members first", resp.Keys[key], resp.NumNodes)
+	}
+	return n.keyringOp(UseKeyOp, key)
+}
+
+// RemoveKey removes an encryption key from all cluster members. Refuses to do so while any
+// member still uses the key as its primary key, e.g. after UseKey has failed on some members.
+// Must be called on the leader.
+func (n *Node) RemoveKey(key string) (*KeyResponse, error) {
+	keyBytes, err := decodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := n.keyringOp(ListKeysOp, "")
+	if err != nil {
+		return resp, fmt.Errorf("couldn't verify key is no primary key: %v", err)
+	}
+	if primary := resp.PrimaryKeys[hex.EncodeToString(keyBytes)]; primary != 0 {
+		return resp, fmt.Errorf("key is the primary key of %v/%v members, use another key on all members first", primary, resp.NumNodes)
+	}
+	return n.keyringOp(RemoveKeyOp, key)
+}
+
+// ListKeys lists the encryption keys installed on all cluster members. Must be called on the
+// leader.
+func (n *Node) ListKeys() (*KeyResponse, error) {
+	return n.keyringOp(ListKeysOp, "")
+}
+
+// keyringCall is a keyring operation handed over to the main loop, which only starts it if the
+// node is the leader.
+type keyringCall struct {
+	op  KeyringOp
+	key string
+
+	// The channel the started operation or the reason it couldn't be started is delivered on.
+	started chan keyringStart
+}
+
+// keyringStart is a keyring operation started by the leader. Its responses are collected by the
+// goroutine that has issued it while the main loop keeps running.
+type keyringStart struct {
+	// The ID of the keyring request and the channel its responses are delivered to.
+	id     uint64
+	respCh chan KeyringResponse
+
+	// The result so far, containing the members the request couldn't be sent to.
+	resp *KeyResponse
+
+	// The members that haven't responded yet.
+	waitingFor map[string]bool
+
+	// The reason the operation couldn't be started, nil if it has been.
+	err error
+}
+
+// keyringOp coordinates a keyring operation cluster-wide. The operation is started by the main
+// loop so that the node's state and term aren't accessed concurrently. The leader executes it
+// locally and sends it to all other members, then its responses are collected until every
+// member has responded or the keyring timeout has elapsed.
+func (n *Node) keyringOp(op KeyringOp, key string) (*KeyResponse, error) {
+	if n.keyring == nil {
+		return nil, errors.New("encryption is not enabled")
+	}
+	if op != ListKeysOp {
+		if _, err := decodeKey(key); err != nil {
+			return nil, err
+		}
+	}
+
+	timeout := n.clock.NewTimer(KeyringTimeout * time.Millisecond)
+	defer timeout.Stop()
+
+	call := keyringCall{op: op, key: key, started: make(chan keyringStart, 1)}
+	select {
+	case n.keyringCh <- call:
+	case <-timeout.C():
+		return nil, fmt.Errorf("%v didn't accept the keyring operation within the keyring timeout", n.config.ID)
+	}
+
+	start := <-call.started
+	if start.err != nil {
+		return nil, start.err
+	}
+	defer n.keyringRequests.remove(start.id)
+	resp, waitingFor := start.resp, start.waitingFor
+
+	for len(waitingFor) > 0 {
+		select {
+		case memberResp := <-start.respCh:
+			if !waitingFor[memberResp.FollowerID] {
+				continue
+			}
+			delete(waitingFor, memberResp.FollowerID)
+			resp.NumResp++
+
+			if memberResp.Error != "" {
+				resp.Messages[memberResp.FollowerID] = memberResp.Error
+				resp.NumErr++
+				continue
+			}
+			for _, k := range memberResp.Keys {
+				resp.Keys[k]++
+			}
+			if memberResp.PrimaryKey != "" {
+				resp.PrimaryKeys[memberResp.PrimaryKey]++
+			}
+
+		case <-timeout.C():
+			for memberID := range waitingFor {
+				resp.Messages[memberID] = "no response within keyring timeout"
+				resp.NumErr++
+			}
+			waitingFor = map[string]bool{}
+		}
+	}
+
+	if resp.NumErr > 0 {
+		return resp, fmt.Errorf("%v/%v members reported failure", resp.NumErr, resp.NumNodes)
+	}
+	n.logger.Printf("[INFO] raftify: Keyring operation %v succeeded on %v/%v members ✓\n", op.toString(), resp.NumResp, resp.NumNodes)
+	return resp, nil
+}
+
+// startKeyringOp starts a keyring operation handed over to the leader's main loop. The leader
+// executes it locally first so that it never ends up behind its followers and then sends it
+// to all other members.
+func (n *Node) startKeyringOp(call keyringCall) {
+	members := n.network.Members()
+	id, respCh := n.keyringRequests.add(len(members))
+	respCh <- n.applyKeyringOp(KeyringRequest{RequestID: id, Op: call.op, Key: call.key})
+
+	start := keyringStart{
+		id:     id,
+		respCh: respCh,
+		resp: &KeyResponse{
+			NumNodes:    len(members),
+			Messages:    map[string]string{},
+			Keys:        map[string]int{},
+			PrimaryKeys: map[string]int{},
+		},
+		waitingFor: map[string]bool{},
+	}
+	for _, member := range members {
+		start.waitingFor[member.Name] = true
+	}
+
+	errs := n.broadcast(members, KeyringRequestMsg, KeyringRequest{
+		RequestID: id,
+		Term:      n.currentTerm,
+		Op:        call.op,
+		Key:       call.key,
+		LeaderID:  n.config.ID,
+	})
+	for memberID, err := range errs {
+		n.logger.Printf("[ERR] raftify: couldn't send keyring request to %v: %v\n", memberID, err.Error())
+		start.resp.Messages[memberID] = fmt.Sprintf("couldn't send keyring request: %v", err)
+		start.resp.NumErr++
+		delete(start.waitingFor, memberID)
+	}
+	call.started <- start
+}
+
+// rejectKeyringOp refuses a keyring operation handed over to the main loop of a node that isn't
+// the leader.
+func (n *Node) rejectKeyringOp(call keyringCall) {
+	call.started <- keyringStart{
+		err: fmt.Errorf("keyring operations must be issued on the leader, %v is in the %v state", n.config.ID, n.state.toString()),
+	}
+}
+
+// applyKeyringOp executes a keyring operation on the local keyring and returns the response
+// to be sent back to the leader.
+func (n *Node) applyKeyringOp(req KeyringRequest) KeyringResponse {
+	resp := KeyringResponse{
+		RequestID:  req.RequestID,
+		FollowerID: n.config.ID,
+	}
+	if n.keyring == nil {
+		resp.Error = "encryption is not enabled"
+		return resp
+	}
+
+	var err error
+	switch req.Op {
+	case InstallKeyOp, UseKeyOp, RemoveKeyOp:
+		var key []byte
+		if key, err = decodeKey(req.Key); err != nil {
+			break
+		}
+
+		switch req.Op {
+		case InstallKeyOp:
+			err = n.keyring.AddKey(key)
+		case UseKeyOp:
+			err = n.keyring.UseKey(key)
+		case RemoveKeyOp:
+			err = n.keyring.RemoveKey(key)
+		}
+
+	case ListKeysOp:
+		for _, key := range n.keyring.GetKeys() {
+			resp.Keys = append(resp.Keys, hex.EncodeToString(key))
+		}
+		resp.PrimaryKey = hex.EncodeToString(n.keyring.GetPrimaryKey())
+
+	default:
+		err = fmt.Errorf("unknown keyring operation %v", req.Op)
+	}
+
+	if err == nil && req.Op != ListKeysOp {
+		err = n.saveKeyring()
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	n.logger.Printf("[DEBUG] raftify: Executed keyring operation %v\n", req.Op.toString())
+	return resp
+}
+
+// saveKeyring persists the keys of the keyring to the keyring.json file, starting with the
+// primary key, so that rotated keys are used again after a restart. The file is only readable
+// by the owner since it contains the keys.
+func (n *Node) saveKeyring() error {
+	keys := []string{hex.EncodeToString(n.keyring.GetPrimaryKey())}
+	for _, key := range n.keyring.GetKeys() {
+		if !bytes.Equal(key, n.keyring.GetPrimaryKey()) {
+			keys = append(keys, hex.EncodeToString(key))
+		}
+	}
+
+	keyringJSON, _ := json.MarshalIndent(keys, "", "	")
+	if err := ioutil.WriteFile(n.workingDir+"/"+keyringFile, keyringJSON, 0600); err != nil {
+		return fmt.Errorf("couldn't persist keyring: %v", err)
+	}
+	n.logger.Println("[DEBUG] raftify: Created/Updated keyring.json ✓")
+	return nil
+}
+
+// loadKeyring loads the keys persisted in the keyring.json file, starting with the primary key.
+// Returns nil if no keyring has been persisted yet. The keys themselves are never part of the
+// error messages returned.
+func (n *Node) loadKeyring() ([][]byte, error) {
+	keyringJSON, err := ioutil.ReadFile(n.workingDir + "/" + keyringFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("couldn't read keyring.json: %v", err)
+	}
+
+	var hexKeys []string
+	if err := json.Unmarshal(keyringJSON, &hexKeys); err != nil {
+		return nil, errors.New("keyring.json must contain a list of hex-encoded keys")
+	}
+	if len(hexKeys) == 0 {
+		return nil, errors.New("keyring.json doesn't contain any keys")
+	}
+
+	keys := [][]byte{}
+	for _, hexKey := range hexKeys {
+		key, err := decodeKey(hexKey)
+		if err != nil {
+			return nil, fmt.Errorf("keyring.json contains an invalid key: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// decodeKey decodes and validates the hex representation of an encryption key.
+func decodeKey(key string) ([]byte, error) {
+	keyBytes, err := hexToByte(key)
+	if err != nil {
+		return nil, errors.New("key must be the hex representation of the encryption key")
+	}
+	if err := memberlist.ValidateKey(keyBytes); err != nil {
+		return nil, fmt.Errorf("key must be of length 16, 24 or 32 bytes: got %v bytes", len(keyBytes))
+	}
+	return keyBytes, nil
+}
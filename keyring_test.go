@@ -0,0 +1,317 @@
+package raftify
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testHexKey2 = "5f4dcc3b5aa765d61d8327deb882cf99"
+
+// pumpKeyringMessages hands all keyring messages and operations received by the node to the
+// respective handlers like the main loop does until the done channel is closed.
+func pumpKeyringMessages(node *Node, done chan struct{}) {
+	for {
+		select {
+		case in := <-node.messages.messageCh:
+			msg, err := node.decodeMessage(in)
+			if err != nil {
+				continue
+			}
+
+			switch msg.Type {
+			case KeyringRequestMsg:
+				var content KeyringRequest
+				if node.decodeContent(msg, &content) == nil {
+					node.handleKeyringRequest(content)
+				}
+			case KeyringResponseMsg:
+				var content KeyringResponse
+				if node.decodeContent(msg, &content) == nil {
+					node.handleKeyringResponse(content)
+				}
+			}
+		case call := <-node.keyringCh:
+			if node.state == Leader {
+				node.startKeyringOp(call)
+			} else {
+				node.rejectKeyringOp(call)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func TestDecodeKey(t *testing.T) {
+	if _, err := decodeKey(testHexKey); err != nil {
+		t.Logf("Expected 32-byte key to be valid, instead got error: %v", err)
+		t.FailNow()
+	}
+	if _, err := decodeKey(testHexKey2); err != nil {
+		t.Logf("Expected 16-byte key to be valid, instead got error: %v", err)
+		t.FailNow()
+	}
+	if _, err := decodeKey("not-hex"); err == nil {
+		t.Logf("Expected non-hex key to be rejected, instead error was nil")
+		t.FailNow()
+	}
+	if _, err := decodeKey("abcdef"); err == nil {
+		t.Logf("Expected 3-byte key to be rejected, instead error was nil")
+		t.FailNow()
+	}
+}
+
+func TestKeyringRequests(t *testing.T) {
+	var requests keyringRequests
+
+	id, respCh := requests.add(1)
+	if err := requests.deliver(KeyringResponse{RequestID: id, FollowerID: "TestNode"}); err != nil {
+		t.Logf("Expected response to be delivered, instead got error: %v", err)
+		t.FailNow()
+	}
+	if resp := <-respCh; resp.FollowerID != "TestNode" {
+		t.Logf("Expected response from TestNode, instead got response from %v", resp.FollowerID)
+		t.FailNow()
+	}
+
+	// More responses than members
+	requests.deliver(KeyringResponse{RequestID: id})
+	if err := requests.deliver(KeyringResponse{RequestID: id}); err == nil {
+		t.Logf("Expected surplus response to be rejected, instead error was nil")
+		t.FailNow()
+	}
+
+	// Request no longer pending
+	requests.remove(id)
+	if err := requests.deliver(KeyringResponse{RequestID: id}); err == nil {
+		t.Logf("Expected response to removed request to be rejected, instead error was nil")
+		t.FailNow()
+	}
+}
+
+func TestApplyKeyringOp(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(1)
+
+	// Initialize and start dummy node with encryption enabled
+	node := initDummyNode("TestNode", 1, 1, ports[0])
+	node.workingDir, _ = ioutil.TempDir("", "raftify-keyring")
+	defer os.RemoveAll(node.workingDir)
+	node.secretKey, _ = hexToByte(testHexKey)
+	node.createMemberlist()
+	defer node.memberlist.Shutdown()
+
+	if resp := node.applyKeyringOp(KeyringRequest{Op: InstallKeyOp, Key: testHexKey2}); resp.Error != "" {
+		t.Logf("Expected key to be installed, instead got error: %v", resp.Error)
+		t.FailNow()
+	}
+	if resp := node.applyKeyringOp(KeyringRequest{Op: RemoveKeyOp, Key: testHexKey}); resp.Error == "" {
+		t.Logf("Expected removal of the primary key to fail, instead error was empty")
+		t.FailNow()
+	}
+	if resp := node.applyKeyringOp(KeyringRequest{Op: UseKeyOp, Key: testHexKey2}); resp.Error != "" {
+		t.Logf("Expected key to be used, instead got error: %v", resp.Error)
+		t.FailNow()
+	}
+	if resp := node.applyKeyringOp(KeyringRequest{Op: RemoveKeyOp, Key: testHexKey}); resp.Error != "" {
+		t.Logf("Expected old key to be removed, instead got error: %v", resp.Error)
+		t.FailNow()
+	}
+
+	resp := node.applyKeyringOp(KeyringRequest{Op: ListKeysOp})
+	if len(resp.Keys) != 1 || resp.Keys[0] != testHexKey2 || resp.PrimaryKey != testHexKey2 {
+		t.Logf("Expected %v to be the only and primary key, instead got keys %v and primary key %v", testHexKey2, resp.Keys, resp.PrimaryKey)
+		t.FailNow()
+	}
+
+	// The rotated keyring is persisted with owner-only permissions
+	if info, err := os.Stat(node.workingDir + "/keyring.json"); err != nil || info.Mode().Perm() != 0600 {
+		t.Logf("Expected keyring.json to be written with permissions 0600, instead got %v and error %v", info, err)
+		t.FailNow()
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(1)
+
+	// Initialize dummy node configured with the old key that has been rotated before the restart
+	node := initDummyNode("TestNode", 1, 1, ports[0])
+	node.workingDir, _ = ioutil.TempDir("", "raftify-keyring")
+	defer os.RemoveAll(node.workingDir)
+	node.secretKey, _ = hexToByte(testHexKey)
+
+	if keys, err := node.loadKeyring(); keys != nil || err != nil {
+		t.Logf("Expected no keys without keyring.json, instead got %v keys and error %v", len(keys), err)
+		t.FailNow()
+	}
+
+	ioutil.WriteFile(node.workingDir+"/keyring.json", []byte(`["`+testHexKey2+`"]`), 0600)
+	node.createMemberlist()
+	defer node.memberlist.Shutdown()
+
+	if keys := node.keyring.GetKeys(); len(keys) != 1 || hex.EncodeToString(node.keyring.GetPrimaryKey()) != testHexKey2 {
+		t.Logf("Expected persisted key to replace the configured one, instead got %v keys", len(keys))
+		t.FailNow()
+	}
+
+	// Invalid keyrings are refused without revealing their contents
+	ioutil.WriteFile(node.workingDir+"/keyring.json", []byte(`["abcdef0123"]`), 0600)
+	if _, err := node.loadKeyring(); err == nil || strings.Contains(err.Error(), "abcdef0123") {
+		t.Logf("Expected invalid keyring to be refused without revealing the key, instead got error: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestKeyringOpErrors(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(2)
+
+	// Encryption disabled
+	node1 := initDummyNode("TestNode_1", 1, 1, ports[0])
+	node1.createMemberlist()
+	defer node1.memberlist.Shutdown()
+	node1.state = Leader
+
+	if _, err := node1.ListKeys(); err == nil {
+		t.Logf("Expected keyring operation to fail without encryption, instead error was nil")
+		t.FailNow()
+	}
+
+	// Not the leader
+	node2 := initDummyNode("TestNode_2", 1, 1, ports[1])
+	node2.secretKey, _ = hexToByte(testHexKey)
+	node2.createMemberlist()
+	defer node2.memberlist.Shutdown()
+	node2.toFollower(0)
+
+	done := make(chan struct{})
+	defer close(done)
+	go pumpKeyringMessages(node2, done)
+
+	if _, err := node2.ListKeys(); err == nil {
+		t.Logf("Expected keyring operation to fail on a follower, instead error was nil")
+		t.FailNow()
+	}
+
+	// Invalid key
+	node2.state = Leader
+	if _, err := node2.InstallKey("abcdef"); err == nil {
+		t.Logf("Expected invalid key to be rejected, instead error was nil")
+		t.FailNow()
+	}
+}
+
+func TestHandleKeyringRequestFromNonLeader(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(1)
+
+	// Initialize and start dummy node with encryption enabled
+	node := initDummyNode("TestNode", 1, 1, ports[0])
+	node.secretKey, _ = hexToByte(testHexKey)
+	node.createMemberlist()
+	defer node.memberlist.Shutdown()
+
+	node.toFollower(1)
+	node.leaderID = "TestLeader"
+
+	node.handleKeyringRequest(KeyringRequest{Term: 1, Op: InstallKeyOp, Key: testHexKey2, LeaderID: "TestImpostor"})
+	node.handleKeyringRequest(KeyringRequest{Term: 0, Op: InstallKeyOp, Key: testHexKey2, LeaderID: "TestLeader"})
+
+	if keys := node.keyring.GetKeys(); len(keys) != 1 {
+		t.Logf("Expected keyring requests from non-leaders to be skipped, instead got %v keys", len(keys))
+		t.FailNow()
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(2)
+
+	// Initialize and start dummy nodes with encryption enabled
+	node1 := initDummyNode("TestNode_1", 1, 2, ports[0])
+	node2 := initDummyNode("TestNode_2", 1, 2, ports[1])
+	node1.secretKey, _ = hexToByte(testHexKey)
+	node2.secretKey, _ = hexToByte(testHexKey)
+	node1.workingDir, _ = ioutil.TempDir("", "raftify-keyring")
+	defer os.RemoveAll(node1.workingDir)
+	node2.workingDir, _ = ioutil.TempDir("", "raftify-keyring")
+	defer os.RemoveAll(node2.workingDir)
+
+	node1.createMemberlist()
+	defer node1.memberlist.Shutdown()
+	node2.createMemberlist()
+	defer node2.memberlist.Shutdown()
+
+	node2.config.PeerList = []string{fmt.Sprintf("127.0.0.1:%v", node1.config.BindPort)}
+	if err := node2.tryJoin(); err != nil {
+		t.Logf("Expected node2 to successfully join node1, instead got error: %v", err.Error())
+		t.FailNow()
+	}
+
+	// Make node1 the leader of node2
+	node1.currentTerm = 1
+	node1.state = Leader
+	node2.toFollower(1)
+	node2.leaderID = node1.config.ID
+
+	done := make(chan struct{})
+	defer close(done)
+	go pumpKeyringMessages(node1, done)
+	go pumpKeyringMessages(node2, done)
+
+	// Using a key that is not installed yet is refused
+	if _, err := node1.UseKey(testHexKey2); err == nil {
+		t.Logf("Expected use of a key that is not installed to fail, instead error was nil")
+		t.FailNow()
+	}
+
+	if resp, err := node1.InstallKey(testHexKey2); err != nil || resp.NumResp != 2 {
+		t.Logf("Expected key to be installed on 2 members, instead got response %+v and error %v", resp, err)
+		t.FailNow()
+	}
+
+	// The old key isn't removed while node2 still uses it, e.g. after UseKey failed on node2
+	node1.applyKeyringOp(KeyringRequest{Op: UseKeyOp, Key: testHexKey2})
+	if _, err := node1.RemoveKey(testHexKey); err == nil || !strings.Contains(err.Error(), "1/2 members") {
+		t.Logf("Expected removal of a key still used by node2 to fail, instead got error: %v", err)
+		t.FailNow()
+	}
+	if primary := hex.EncodeToString(node2.keyring.GetPrimaryKey()); primary != testHexKey {
+		t.Logf("Expected node2 to keep %v as primary key, instead got %v", testHexKey, primary)
+		t.FailNow()
+	}
+	if _, err := node1.UseKey(testHexKey2); err != nil {
+		t.Logf("Expected key to be used on all members, instead got error: %v", err)
+		t.FailNow()
+	}
+	if _, err := node1.RemoveKey(testHexKey2); err == nil {
+		t.Logf("Expected removal of the primary key to fail, instead error was nil")
+		t.FailNow()
+	}
+	if _, err := node1.RemoveKey(testHexKey); err != nil {
+		t.Logf("Expected old key to be removed from all members, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	resp, err := node1.ListKeys()
+	if err != nil {
+		t.Logf("Expected keys to be listed, instead got error: %v", err)
+		t.FailNow()
+	}
+	if len(resp.Keys) != 1 || resp.Keys[testHexKey2] != 2 || resp.PrimaryKeys[testHexKey2] != 2 {
+		t.Logf("Expected %v to be the only and primary key on 2 members, instead got %+v", testHexKey2, resp)
+		t.FailNow()
+	}
+
+	for _, node := range []*Node{node1, node2} {
+		if primary := hex.EncodeToString(node.keyring.GetPrimaryKey()); primary != testHexKey2 {
+			t.Logf("Expected %v to use %v as primary key, instead got %v", node.config.ID, testHexKey2, primary)
+			t.FailNow()
+		}
+	}
+}
@@ -1,8 +1,6 @@
 package raftify
 
-import (
-	"encoding/json"
-)
+import "errors"
 
 // toLeader initiates the transition into a leader node. Calling toLeader on a node that already is
 // in the leader state just resets the data.
@@ -25,18 +23,23 @@ func (n *Node) toLeader() {
 
 // runLeader runs the leader loop. This function is called within the runLoop function.
 func (n *Node) runLeader() {
+	messages, ticker, events := n.network.Messages(), n.messageTicker.C(), n.membershipEvents()
+	n.idle(messages, ticker, events)
+
 	select {
-	case msgBytes := <-n.messages.messageCh:
-		var msg Message
-		if err := json.Unmarshal(msgBytes, &msg); err != nil {
-			n.logger.Printf("[ERR] raftify: error while unmarshaling wrapper message: %v\n", err.Error())
+	case in := <-messages:
+		msg, err := n.decodeMessage(in)
+		if err != nil {
+			n.logger.Printf("[ERR] raftify: %v\n", err.Error())
 			break
 		}
 
 		switch msg.Type {
 		case HeartbeatMsg:
 			var content Heartbeat
-			if err := json.Unmarshal(msg.Content, &content); err != nil {
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
 				n.logger.Printf("[ERR] raftify: error while unmarshaling heartbeat message: %v\n", err.Error())
 				break
 			}
@@ -44,7 +47,9 @@ func (n *Node) runLeader() {
 
 		case HeartbeatResponseMsg:
 			var content HeartbeatResponse
-			if err := json.Unmarshal(msg.Content, &content); err != nil {
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
 				n.logger.Printf("[ERR] raftify: error while unmarshaling heartbeat response message: %v\n", err.Error())
 				break
 			}
@@ -52,7 +57,9 @@ func (n *Node) runLeader() {
 
 		case PreVoteRequestMsg:
 			var content PreVoteRequest
-			if err := json.Unmarshal(msg.Content, &content); err != nil {
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
 				n.logger.Printf("[ERR] raftify: error while unmarshaling prevote request message: %v\n", err.Error())
 				break
 			}
@@ -60,7 +67,9 @@ func (n *Node) runLeader() {
 
 		case VoteRequestMsg:
 			var content VoteRequest
-			if err := json.Unmarshal(msg.Content, &content); err != nil {
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
 				n.logger.Printf("[ERR] raftify: error while unmarshaling vote request message: %v\n", err.Error())
 				break
 			}
@@ -68,17 +77,39 @@ func (n *Node) runLeader() {
 
 		case NewQuorumMsg:
 			var content NewQuorum
-			if err := json.Unmarshal(msg.Content, &content); err != nil {
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
 				n.logger.Printf("[ERR] raftify: error while unmarshaling new quorum message: %v\n", err.Error())
 				break
 			}
 			n.handleNewQuorum(content)
 
+		case KeyringResponseMsg:
+			var content KeyringResponse
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
+				n.logger.Printf("[ERR] raftify: error while unmarshaling keyring response message: %v\n", err.Error())
+				break
+			}
+			n.handleKeyringResponse(content)
+
+		case AckMsg:
+			var content Ack
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
+				n.logger.Printf("[ERR] raftify: error while unmarshaling ack message: %v\n", err.Error())
+				break
+			}
+			n.handleAck(content)
+
 		default:
 			n.logger.Printf("[WARN] raftify: received %v as leader, discarding...\n", msg.Type.toString())
 		}
 
-	case <-n.messageTicker.C:
+	case <-ticker:
 		if !n.quorumReached(n.heartbeatIDList.received) {
 			n.heartbeatIDList.subQuorumCycles++
 			n.logger.Printf("[DEBUG] raftify: Not enough heartbeat responses for %v cycles\n", n.heartbeatIDList.subQuorumCycles)
@@ -90,8 +121,8 @@ func (n *Node) runLeader() {
 				n.heartbeatIDList.currentHeartbeatID = 0
 				n.heartbeatIDList.subQuorumCycles = 0
 
-				// Reload the config so that the memberlist from the state.json is loaded into
-				// the peerlist.
+				// Reload the config so that the memberlist from the state.json is loaded as
+				// rejoin candidates alongside the peerlist from the raftify.json.
 				if err := n.loadConfig(true); err != nil {
 					n.logger.Printf("[ERR] raftify: %v, fall back to raftify.json\n", err.Error())
 				}
@@ -111,8 +142,11 @@ func (n *Node) runLeader() {
 
 		n.sendHeartbeatToAll()
 
-	case <-n.events.eventCh:
-		n.saveState()
+	case event := <-events:
+		n.handleMembershipEvent(event)
+
+	case call := <-n.keyringCh:
+		n.startKeyringOp(call)
 
 	case <-n.shutdownCh:
 		n.toPreShutdown()
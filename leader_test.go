@@ -63,7 +63,7 @@ func TestRunLeaderTickerCase(t *testing.T) {
 		done <- true
 	}()
 
-	node.messageTicker = time.NewTicker(10 * time.Millisecond)
+	node.messageTicker = node.clock.NewTicker(10 * time.Millisecond)
 	<-done
 
 	if node.heartbeatIDList.subQuorumCycles != 0 {
@@ -81,7 +81,7 @@ func TestRunLeaderTickerCase(t *testing.T) {
 		done <- true
 	}()
 
-	node.messageTicker = time.NewTicker(10 * time.Millisecond)
+	node.messageTicker = node.clock.NewTicker(10 * time.Millisecond)
 	<-done
 
 	if node.heartbeatIDList.subQuorumCycles != 1 {
@@ -100,7 +100,7 @@ func TestRunLeaderTickerCase(t *testing.T) {
 		done <- true
 	}()
 
-	node.messageTicker = time.NewTicker(10 * time.Millisecond)
+	node.messageTicker = node.clock.NewTicker(10 * time.Millisecond)
 	<-done
 
 	if node.heartbeatIDList.currentHeartbeatID != 0 {
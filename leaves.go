@@ -0,0 +1,179 @@
+package raftify
+
+import (
+	"time"
+)
+
+// pendingLeave is a voluntary leave announced via a new quorum message whose leave event
+// hasn't been received yet.
+type pendingLeave struct {
+	// The quorum to apply once the node has left.
+	quorum int
+
+	// The time after which the announcement expires if the node hasn't left by then.
+	deadline time.Time
+}
+
+// departedMember is a member whose leave event has been received without a preceding
+// announcement.
+type departedMember struct {
+	// The member as it was known before it left.
+	node *Member
+
+	// The time after which an announcement of the member is no longer expected.
+	deadline time.Time
+}
+
+// pendingLeaves keeps track of the voluntary leaves announced by other nodes. Since the new
+// quorum message and the leave event of a leaving node are queued separately, either of them
+// may be handled first, so the members that have left without announcement are kept as well
+// until their announcement is no longer expected. It is only accessed from within the runLoop
+// function.
+type pendingLeaves struct {
+	// The pending leaves by the ID of the leaving node.
+	pending map[string]pendingLeave
+
+	// The members that have left without announcement by their ID.
+	departed map[string]departedMember
+}
+
+// add records the announced leave of the node with the given ID. A later announcement of
+// the same node replaces the previous one.
+func (p *pendingLeaves) add(id string, quorum int, deadline time.Time) {
+	if p.pending == nil {
+		p.pending = map[string]pendingLeave{}
+	}
+	p.pending[id] = pendingLeave{quorum: quorum, deadline: deadline}
+}
+
+// match removes and returns the pending leave of the node with the given ID. Returns false if
+// the node hasn't announced its leave or the announcement has expired.
+func (p *pendingLeaves) match(id string, now time.Time) (pendingLeave, bool) {
+	leave, ok := p.pending[id]
+	if !ok {
+		return leave, false
+	}
+	delete(p.pending, id)
+	return leave, now.Before(leave.deadline)
+}
+
+// depart records the member that has left without announcement.
+func (p *pendingLeaves) depart(node *Member, deadline time.Time) {
+	if p.departed == nil {
+		p.departed = map[string]departedMember{}
+	}
+	p.departed[node.Name] = departedMember{node: node, deadline: deadline}
+}
+
+// lookupDeparted returns the member with the given ID if it has left without announcement and
+// its announcement is still expected, nil otherwise.
+func (p *pendingLeaves) lookupDeparted(id string, now time.Time) *Member {
+	if departed, ok := p.departed[id]; ok && now.Before(departed.deadline) {
+		return departed.node
+	}
+	return nil
+}
+
+// forget forgets that the member with the given ID has left, e.g. because it has rejoined.
+func (p *pendingLeaves) forget(id string) {
+	delete(p.departed, id)
+}
+
+// expire removes all pending leaves and departed members whose deadline has passed and returns
+// the IDs of the nodes whose pending leave has expired.
+func (p *pendingLeaves) expire(now time.Time) []string {
+	expired := []string{}
+	for id, leave := range p.pending {
+		if !now.Before(leave.deadline) {
+			delete(p.pending, id)
+			expired = append(expired, id)
+		}
+	}
+	for id, departed := range p.departed {
+		if !now.Before(departed.deadline) {
+			delete(p.departed, id)
+		}
+	}
+	return expired
+}
+
+// expireLeaves discards the announced leaves whose node hasn't left in time. It is called on
+// every iteration of the runLoop function, which wakes up at least on every heartbeat, message
+// tick or timeout, so stale announcements don't wait for the next membership event.
+func (n *Node) expireLeaves() {
+	for _, id := range n.pendingLeaves.expire(n.clock.Now()) {
+		n.logger.Printf("[WARN] raftify: %v announced its leave but didn't leave in time, discarding new quorum\n", id)
+	}
+}
+
+// leaveTimeout returns how long an announced leave waits for the leave event of its node and
+// vice versa.
+func (n *Node) leaveTimeout() time.Duration {
+	return time.Duration(LeaveTimeout*n.config.Performance) * time.Millisecond
+}
+
+// handleMembershipEvent handles a join or leave event received in the runLoop function. Leave
+// events of nodes that have announced their leave trigger the announced quorum change, all
+// other leaves are kept in case the announcement is handled after the leave event. The
+// state.json is updated for all events.
+func (n *Node) handleMembershipEvent(event MemberEvent) {
+	// Memberlist members are cached by the admission delegate as soon as they are reported,
+	// the members of other transports once their events are handled.
+	if n.admission == nil {
+		switch event.Type {
+		case MemberJoin:
+			n.metas.refresh(event.Member)
+		case MemberLeave:
+			n.metas.forget(event.Member.Name)
+		}
+	}
+
+	now := n.clock.Now()
+	switch event.Type {
+	case MemberJoin:
+		n.pendingLeaves.forget(event.Member.Name)
+		n.legacyGuard.forget(event.Member.Name)
+	case MemberLeave:
+		if leave, ok := n.pendingLeaves.match(event.Member.Name, now); ok {
+			n.applyNewQuorum(event.Member.Name, leave.quorum)
+		} else {
+			n.pendingLeaves.depart(event.Member, now.Add(n.leaveTimeout()))
+		}
+	}
+	n.saveState()
+}
+
+// handleQueuedEvents handles all membership events that are currently queued.
+func (n *Node) handleQueuedEvents() {
+	if n.events != nil {
+		n.events.flush()
+	}
+	for {
+		select {
+		case event := <-n.network.Events():
+			n.handleMembershipEvent(event)
+		default:
+			return
+		}
+	}
+}
+
+// applyNewQuorum sets the quorum announced by a node that has left voluntarily. If the local node
+// is the only one left, it becomes the leader right away.
+func (n *Node) applyNewQuorum(leavingID string, quorum int) {
+	n.logger.Printf("[DEBUG] raftify: %v left, setting the quorum from %v to %v\n", leavingID, n.quorum, quorum)
+	n.quorum = quorum
+
+	if quorum == 1 {
+		n.logger.Printf("[DEBUG] raftify: %v is the only node left in the cluster, entering leader state for term %v...", n.config.ID, n.currentTerm)
+
+		// Switch to the Leader state without calling toLeader in order to bypass the state change
+		// restriction in this corner case.
+		n.timeoutTimer.Stop()  // Leaders have no timeout
+		n.startMessageTicker() // Used to periodically send out heartbeat messages
+		n.heartbeatIDList.reset()
+
+		n.votedFor = ""
+		n.state = Leader
+	}
+}
@@ -0,0 +1,119 @@
+package raftify
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPendingLeaves(t *testing.T) {
+	var leaves pendingLeaves
+	now := time.Now()
+
+	leaves.add("TestNode_1", 2, now.Add(time.Second))
+	leaves.add("TestNode_2", 1, now.Add(-time.Second))
+
+	if _, ok := leaves.match("TestNode_3", now); ok {
+		t.Logf("Expected node without announced leave not to match")
+		t.FailNow()
+	}
+	if leave, ok := leaves.match("TestNode_1", now); !ok || leave.quorum != 2 {
+		t.Logf("Expected announced leave of TestNode_1 with quorum 2, instead got %+v", leave)
+		t.FailNow()
+	}
+	if _, ok := leaves.match("TestNode_1", now); ok {
+		t.Logf("Expected announced leave to match only once")
+		t.FailNow()
+	}
+
+	if expired := leaves.expire(now); len(expired) != 1 || expired[0] != "TestNode_2" {
+		t.Logf("Expected announced leave of TestNode_2 to expire, instead got %v", expired)
+		t.FailNow()
+	}
+	if len(leaves.pending) != 0 {
+		t.Logf("Expected no pending leaves to be left, instead got %v", len(leaves.pending))
+		t.FailNow()
+	}
+}
+
+func TestDepartedMembers(t *testing.T) {
+	var leaves pendingLeaves
+	now := time.Now()
+
+	leaves.depart(&Member{Name: "TestNode_1"}, now.Add(time.Second))
+	leaves.depart(&Member{Name: "TestNode_2"}, now.Add(time.Second))
+	if member := leaves.lookupDeparted("TestNode_1", now); member == nil || member.Name != "TestNode_1" {
+		t.Logf("Expected TestNode_1 to have departed, instead got %v", member)
+		t.FailNow()
+	}
+
+	// Departed members are forgotten once they rejoin or their announcement is no longer expected
+	leaves.forget("TestNode_1")
+	if member := leaves.lookupDeparted("TestNode_1", now); member != nil {
+		t.Logf("Expected TestNode_1 to be forgotten, instead got %v", member)
+		t.FailNow()
+	}
+	if member := leaves.lookupDeparted("TestNode_2", now.Add(time.Second)); member != nil {
+		t.Logf("Expected TestNode_2 to be forgotten after its deadline, instead got %v", member)
+		t.FailNow()
+	}
+	if expired := leaves.expire(now.Add(time.Second)); len(expired) != 0 || len(leaves.departed) != 0 {
+		t.Logf("Expected departed members to expire without being reported, instead got %v and %v departed members", expired, len(leaves.departed))
+		t.FailNow()
+	}
+}
+
+func TestNewQuorumAfterLeave(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(2)
+
+	node1 := initDummyNode("TestNode_1", 1, 2, ports[0])
+	node2 := initDummyNode("TestNode_2", 1, 2, ports[1])
+	node1.createMemberlist()
+	defer node1.memberlist.Shutdown()
+	node2.createMemberlist()
+	defer node2.memberlist.Shutdown()
+	defer node1.deleteState()
+
+	if _, err := node2.memberlist.Join([]string{node1.LocalAddr()}); err != nil {
+		t.Logf("Expected node2 to join node1, instead got error: %v", err)
+		t.FailNow()
+	}
+	for len(node1.events.eventCh) != 0 {
+		node1.handleMembershipEvent(<-node1.events.eventCh)
+	}
+
+	// node2 announces its leave, but node1 handles its leave event first
+	payload := node2.encodeMessage(NewQuorumMsg, NewQuorum{NewQuorum: 1, LeavingID: "TestNode_2"})
+	node2.memberlist.Leave(time.Second)
+	node2.memberlist.Shutdown()
+	for start := time.Now(); len(node1.memberlist.Members()) != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Logf("Expected node2 to leave, instead node1 still has %v members", len(node1.memberlist.Members()))
+			t.FailNow()
+		}
+	}
+
+	node1.quorum = 2
+	msg, err := node1.decodeMessage(InboundMessage{From: node2.LocalAddr(), Payload: payload})
+	if err != nil {
+		t.Logf("Expected new quorum to be decoded, instead got error: %v", err)
+		t.FailNow()
+	}
+	var content NewQuorum
+	if err := node1.decodeContent(msg, &content); err != nil {
+		t.Logf("Expected new quorum of node2 to be accepted after its leave, instead got error: %v", err)
+		t.FailNow()
+	}
+	node1.handleNewQuorum(content)
+	if node1.quorum != 1 {
+		t.Logf("Expected the new quorum to be applied right away, instead got %v", node1.quorum)
+		t.FailNow()
+	}
+
+	// Other messages of departed members are still rejected
+	msg, _ = node1.decodeMessage(InboundMessage{From: node2.LocalAddr(), Payload: node2.encodeMessage(HeartbeatMsg, Heartbeat{Term: 1, Quorum: 1, LeaderID: "TestNode_2"})})
+	if err := node1.decodeContent(msg, &Heartbeat{}); err == nil {
+		t.Logf("Expected heartbeat of departed node2 to be rejected, instead error was nil")
+		t.FailNow()
+	}
+}
@@ -0,0 +1,227 @@
+package raftify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Default limits applied to the raftify messages received from other nodes if the limits are
+// omitted in the raftify.json.
+const (
+	// Maximum size in bytes of a received message.
+	DefaultMaxMessageSize = 64 * 1024
+
+	// Number of messages per second accepted from a single sender.
+	DefaultMessageRate = 50
+
+	// Number of messages a single sender may send at once before the rate applies.
+	DefaultMessageBurst = 100
+)
+
+// MaxTermLead is the number of terms a received message may be ahead of the local node's term.
+// Messages with terms further ahead are rejected since no cluster goes through that many
+// elections while a node is away, but a single such message could exhaust the term space.
+const MaxTermLead = 1 << 20
+
+// Maximum number of senders whose message rate is tracked at the same time. Messages of new
+// senders are dropped once the limit is reached until tracked senders go quiet.
+const maxRateLimitedSenders = 4096
+
+// errMessageTooLarge is returned if a received message exceeds the max_message_size.
+var errMessageTooLarge = errors.New("message too large")
+
+// LimitsConfig restricts the raftify messages a node accepts from other nodes. Messages
+// exceeding the limits are dropped before they are decrypted or decoded.
+type LimitsConfig struct {
+	// Maximum size in bytes of a received message. Defaults to 65536.
+	MaxMessageSize int `json:"max_message_size"`
+
+	// Number of messages per second accepted from a single sender. Defaults to 50.
+	MessageRate int `json:"message_rate"`
+
+	// Number of messages a single sender may send at once before the message rate
+	// applies. Defaults to 100.
+	MessageBurst int `json:"message_burst"`
+}
+
+// setDefaults sets the default values for all limits left empty.
+func (l *LimitsConfig) setDefaults() {
+	if l.MaxMessageSize == 0 {
+		l.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if l.MessageRate == 0 {
+		l.MessageRate = DefaultMessageRate
+	}
+	if l.MessageBurst == 0 {
+		l.MessageBurst = DefaultMessageBurst
+	}
+}
+
+// validate checks for constraint violations in the limits and returns them in the same format
+// as Config.validate.
+func (l *LimitsConfig) validate() string {
+	var errs string
+	if l.MaxMessageSize < 0 {
+		errs += "\tlimits.max_message_size must be greater than 0\n"
+	}
+	if l.MessageRate < 0 {
+		errs += "\tlimits.message_rate must be greater than 0\n"
+	}
+	if l.MessageBurst < 0 {
+		errs += "\tlimits.message_burst must be greater than 0\n"
+	}
+	return errs
+}
+
+// tokenBucket holds the messages a single sender may still send right now.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the number of messages accepted from each sender with a token bucket
+// that is refilled at the message rate and holds up to the message burst.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// newRateLimiter creates a rate limiter for the given limits.
+func newRateLimiter(limits LimitsConfig) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(limits.MessageRate),
+		burst:   float64(limits.MessageBurst),
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// allow takes a token out of the sender's bucket. Returns false if the bucket is empty and
+// the message must be dropped.
+func (l *rateLimiter) allow(sender string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	bucket, ok := l.buckets[sender]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitedSenders && !l.prune(now) {
+			return false
+		}
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[sender] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// prune removes the buckets of all senders that have been quiet long enough for their bucket
+// to be refilled completely. Returns true if any bucket has been removed.
+func (l *rateLimiter) prune(now time.Time) bool {
+	pruned := false
+	for sender, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, sender)
+			pruned = true
+		}
+	}
+	return pruned
+}
+
+// rateLimitKey returns the key the messages received from the given address are rate limited
+// by. Peers that have authenticated on the transport level are limited by their name. Packets
+// are limited by their source address so that nodes sharing an IP address, e.g. behind a NAT,
+// don't exhaust each other's limit. Streams are limited by their IP address in a bucket of
+// their own since their source port changes with every connection.
+func rateLimitKey(from net.Addr, stream bool) string {
+	if name := peerName(from); name != "" {
+		return name
+	}
+	if !stream {
+		return from.String()
+	}
+	if host, _, err := net.SplitHostPort(from.String()); err == nil {
+		return "stream/" + host
+	}
+	return "stream/" + from.String()
+}
+
+// validator is implemented by all message contents that carry values which must be checked
+// before the message is handled.
+type validator interface {
+	validate(n *Node) error
+}
+
+// checkTerm returns an error if the term is implausibly far ahead of the local node's term.
+func (n *Node) checkTerm(term uint64) error {
+	if term > n.currentTerm && term-n.currentTerm > MaxTermLead {
+		return fmt.Errorf("term %v is more than %v terms ahead of the current term %v", term, MaxTermLead, n.currentTerm)
+	}
+	return nil
+}
+
+// checkQuorum returns an error if the quorum can't be reached in a cluster of max_nodes nodes.
+func (n *Node) checkQuorum(quorum int) error {
+	if quorum < 1 || quorum > n.config.MaxNodes {
+		return fmt.Errorf("quorum %v must be between 1 and %v", quorum, n.config.MaxNodes)
+	}
+	return nil
+}
+
+func (m *Heartbeat) validate(n *Node) error {
+	if err := n.checkQuorum(m.Quorum); err != nil {
+		return err
+	}
+	return n.checkTerm(m.Term)
+}
+
+func (m *HeartbeatResponse) validate(n *Node) error { return n.checkTerm(m.Term) }
+func (m *PreVoteRequest) validate(n *Node) error    { return n.checkTerm(m.NextTerm) }
+func (m *PreVoteResponse) validate(n *Node) error   { return n.checkTerm(m.Term) }
+func (m *VoteRequest) validate(n *Node) error       { return n.checkTerm(m.Term) }
+func (m *VoteResponse) validate(n *Node) error      { return n.checkTerm(m.Term) }
+func (m *NewQuorum) validate(n *Node) error         { return n.checkQuorum(m.NewQuorum) }
+
+func (m *Ack) validate(n *Node) error {
+	if m.Seq == 0 {
+		return errors.New("sequence number must be greater than 0")
+	}
+	return nil
+}
+
+func (m *KeyringRequest) validate(n *Node) error {
+	if m.Op > ListKeysOp {
+		return fmt.Errorf("unknown keyring operation %v", m.Op)
+	}
+	return n.checkTerm(m.Term)
+}
+
+// unmarshalStrict unmarshals a received message like json.Unmarshal, but rejects unknown
+// fields and trailing data.
+func unmarshalStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return errors.New("unexpected data after the message")
+	}
+	return nil
+}
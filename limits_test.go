@@ -0,0 +1,219 @@
+package raftify
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateLimits(t *testing.T) {
+	limits := LimitsConfig{}
+	limits.setDefaults()
+	if limits.MaxMessageSize != DefaultMaxMessageSize || limits.MessageRate != DefaultMessageRate || limits.MessageBurst != DefaultMessageBurst {
+		t.Logf("Expected default limits, instead got %+v", limits)
+		t.FailNow()
+	}
+	if errs := limits.validate(); errs != "" {
+		t.Logf("Expected no errors for the default limits, instead got: %v", errs)
+		t.FailNow()
+	}
+
+	limits.MessageRate = -1
+	if errs := limits.validate(); !strings.Contains(errs, "message_rate") {
+		t.Logf("Expected error for negative message_rate, instead got: %v", errs)
+		t.FailNow()
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(LimitsConfig{MessageRate: 10, MessageBurst: 3})
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !limiter.allow("127.0.0.1", now) {
+			t.Logf("Expected message %v within the burst to be allowed", i)
+			t.FailNow()
+		}
+	}
+	if limiter.allow("127.0.0.1", now) {
+		t.Logf("Expected message exceeding the burst to be dropped")
+		t.FailNow()
+	}
+
+	// Other senders have their own bucket
+	if !limiter.allow("127.0.0.2", now) {
+		t.Logf("Expected message of another sender to be allowed")
+		t.FailNow()
+	}
+
+	// The bucket is refilled at the message rate
+	if !limiter.allow("127.0.0.1", now.Add(100*time.Millisecond)) {
+		t.Logf("Expected message to be allowed once the bucket has been refilled")
+		t.FailNow()
+	}
+	if limiter.allow("127.0.0.1", now.Add(100*time.Millisecond)) {
+		t.Logf("Expected message exceeding the message rate to be dropped")
+		t.FailNow()
+	}
+
+	// Quiet senders are no longer tracked once the bucket is refilled completely
+	if !limiter.prune(now.Add(time.Second)) || len(limiter.buckets) != 0 {
+		t.Logf("Expected quiet senders to be pruned, instead %v are still tracked", len(limiter.buckets))
+		t.FailNow()
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	// Nodes behind the same IP address are limited separately via packets
+	first := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 7946}
+	second := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 7947}
+	if rateLimitKey(first, false) == rateLimitKey(second, false) {
+		t.Logf("Expected packets from different ports to be limited separately, instead both got %v", rateLimitKey(first, false))
+		t.FailNow()
+	}
+
+	// Streams change their port with every connection
+	if rateLimitKey(first, true) != rateLimitKey(second, true) || rateLimitKey(first, true) == rateLimitKey(first, false) {
+		t.Logf("Expected streams to be limited per IP address in a bucket of their own, instead got %v", rateLimitKey(first, true))
+		t.FailNow()
+	}
+
+	authenticated := &authenticatedAddr{Addr: first, name: "TestNode_1"}
+	if key := rateLimitKey(authenticated, true); key != "TestNode_1" {
+		t.Logf("Expected authenticated peers to be limited by their name, instead got %v", key)
+		t.FailNow()
+	}
+}
+
+func TestMessageValidation(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(2)
+
+	// Initialize and start dummy nodes
+	node1 := initDummyNode("TestNode_1", 1, 2, ports[0])
+	node2 := initDummyNode("TestNode_2", 1, 2, ports[1])
+
+	node1.createMemberlist()
+	defer node1.memberlist.Shutdown()
+	node2.createMemberlist()
+	defer node2.memberlist.Shutdown()
+
+	node2.memberlist.Join([]string{fmt.Sprintf("127.0.0.1:%v", ports[0])})
+
+	invalid := map[string]InboundMessage{
+		"quorum of 0": {
+			Payload: node1.encodeMessage(HeartbeatMsg, Heartbeat{Term: 1, Quorum: 0, LeaderID: "TestNode_1"}),
+		},
+		"quorum exceeding max_nodes": {
+			Payload: node1.encodeMessage(HeartbeatMsg, Heartbeat{Term: 1, Quorum: 3, LeaderID: "TestNode_1"}),
+		},
+		"term far ahead": {
+			Payload: node1.encodeMessage(HeartbeatMsg, Heartbeat{Term: MaxTermLead + 1, Quorum: 1, LeaderID: "TestNode_1"}),
+		},
+		"unknown field": {
+			Payload: node1.encodeMessage(HeartbeatMsg, map[string]interface{}{"term": 1, "quorum": 1, "leader_id": "TestNode_1", "extra": true}),
+		},
+		"negative new quorum": {
+			Payload: node1.encodeMessage(NewQuorumMsg, NewQuorum{NewQuorum: -1, LeavingID: "TestNode_1"}),
+		},
+	}
+
+	for name, in := range invalid {
+		in.From = node1.LocalAddr()
+		msg, err := node2.decodeMessage(in)
+		if err != nil {
+			t.Logf("Expected wrapper message with %v to be decoded, instead got error: %v", name, err)
+			t.FailNow()
+		}
+
+		var content sender = &Heartbeat{}
+		if msg.Type == NewQuorumMsg {
+			content = &NewQuorum{}
+		}
+		if err := node2.decodeContent(msg, content); err == nil {
+			t.Logf("Expected message with %v to be rejected, instead error was nil", name)
+			t.FailNow()
+		}
+	}
+
+	// Wrapper messages of unknown types are rejected right away
+	if _, err := node2.decodeMessage(InboundMessage{From: node1.LocalAddr(), Payload: node1.encodeMessage(MessageType(200), Heartbeat{})}); err == nil {
+		t.Logf("Expected message of unknown type to be rejected, instead error was nil")
+		t.FailNow()
+	}
+
+	if metrics := node2.GetMetrics(); metrics.InvalidMessages != uint64(len(invalid)+1) {
+		t.Logf("Expected %v invalid messages to be counted, instead got %v", len(invalid)+1, metrics.InvalidMessages)
+		t.FailNow()
+	}
+
+	// Valid heartbeats pass
+	msg, _ := node2.decodeMessage(InboundMessage{
+		From:    node1.LocalAddr(),
+		Payload: node1.encodeMessage(HeartbeatMsg, Heartbeat{Term: 1, Quorum: 2, LeaderID: "TestNode_1"}),
+	})
+	if err := node2.decodeContent(msg, &Heartbeat{}); err != nil {
+		t.Logf("Expected valid heartbeat to be accepted, instead got error: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestTransportLimits(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(2)
+
+	// node2 accepts small messages at a low rate only
+	node1 := initDummyNode("TestNode_1", 1, 2, ports[0])
+	node2 := initDummyNode("TestNode_2", 1, 2, ports[1])
+	node2.config.Limits = LimitsConfig{MaxMessageSize: 64, MessageRate: 1, MessageBurst: 3}
+
+	node1.createMemberlist()
+	defer node1.memberlist.Shutdown()
+	node2.createMemberlist()
+	defer node2.memberlist.Shutdown()
+
+	if _, err := node2.memberlist.Join([]string{node1.LocalAddr()}); err != nil {
+		t.Logf("Expected node2 to join node1, instead got error: %v", err)
+		t.FailNow()
+	}
+	member, _ := node1.getNodeByName("TestNode_2")
+
+	// The size of streams is only known once their sender has been checked against the rate
+	node1.sendBestEffort(member, make([]byte, 65))
+	node1.sendReliable(member, make([]byte, 65))
+
+	for start := time.Now(); node2.GetMetrics().OversizedMessages != 2; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Logf("Expected 2 oversized messages to be counted, instead got %v", node2.GetMetrics().OversizedMessages)
+			t.FailNow()
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		node1.sendBestEffort(member, []byte("small"))
+	}
+
+	// Oversized packets are dropped before the rate applies and streams are limited in a bucket of
+	// their own, so only the last message exceeds the burst
+	for i := 0; i < 3; i++ {
+		select {
+		case <-node2.messages.messageCh:
+		case <-time.After(time.Second):
+			t.Logf("Expected message %v to be received, instead nothing happened", i)
+			t.FailNow()
+		}
+	}
+	select {
+	case <-node2.messages.messageCh:
+		t.Logf("Expected messages exceeding the burst to be dropped, instead one was received")
+		t.FailNow()
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if metrics := node2.GetMetrics(); metrics.RateLimited != 1 {
+		t.Logf("Expected 1 rate limited message to be counted, instead got %v", metrics.RateLimited)
+		t.FailNow()
+	}
+}
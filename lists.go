@@ -3,8 +3,6 @@ package raftify
 import (
 	"fmt"
 	"log"
-
-	"github.com/hashicorp/memberlist"
 )
 
 // HeartbeatIDList is a custom type for a list of heartbeat IDs. This is
@@ -64,7 +62,7 @@ type VoteList struct {
 	received int
 
 	// The nodes who have not yet replied to a (pre)vote request.
-	pending []*memberlist.Node
+	pending []*Member
 
 	// The number of cycles a precandidate has not received any reply
 	// to a prevote request. This is used to make a follower turning
@@ -87,7 +85,7 @@ func (v *VoteList) remove(voter string) error {
 // reset resets the votes received and votes pending of the vote list.
 // The memberlist which needs to be passed in is the initial list for
 // the (pre)votes pending.
-func (v *VoteList) reset(initPending []*memberlist.Node) {
+func (v *VoteList) reset(initPending []*Member) {
 	v.received = 1 // 1 in order to account for self prevote/vote
 	v.pending = initPending
 }
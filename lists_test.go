@@ -2,8 +2,6 @@ package raftify
 
 import (
 	"testing"
-
-	"github.com/hashicorp/memberlist"
 )
 
 func TestHeartbeatIDList(t *testing.T) {
@@ -42,12 +40,12 @@ func TestHeartbeatIDList(t *testing.T) {
 }
 
 func TestVoteList(t *testing.T) {
-	initPending := []*memberlist.Node{
+	initPending := []*Member{
 		{Name: "1-One"},
 		{Name: "2-Two"},
 	}
 
-	initPendingCopy := make([]*memberlist.Node, len(initPending))
+	initPendingCopy := make([]*Member, len(initPending))
 	copy(initPendingCopy, initPending)
 
 	list := VoteList{
@@ -2,65 +2,128 @@ package raftify
 
 import (
 	"encoding/json"
-
-	"github.com/hashicorp/memberlist"
 )
 
-// Message is a wrapper struct for all messages used to determine the message type.
+// Message is a wrapper struct for all messages used to determine the message type. The
+// incarnation and the sequence number, which increases with every message sent, are used
+// to detect replays. Recipient is the node the message is sent to so that it can't be
+// replayed to other nodes and omitted before protocolRecipient. Signature is only set if
+// per-node identities are configured. Version is the protocol version the message is
+// encoded with and omitted for protocolJSON. AckRequested is set if the receiver is asked
+// to acknowledge the message with an AckMsg and omitted otherwise.
 type Message struct {
-	Type    MessageType     `json:"type"`
-	Content json.RawMessage `json:"content"`
+	Type         MessageType     `json:"type" codec:"type"`
+	Version      int             `json:"version,omitempty" codec:"version,omitempty"`
+	AckRequested bool            `json:"ack_requested,omitempty" codec:"ack_requested,omitempty"`
+	Content      json.RawMessage `json:"content" codec:"content"`
+	Sender       string          `json:"sender" codec:"sender"`
+	Recipient    string          `json:"recipient,omitempty" codec:"recipient,omitempty"`
+	Incarnation  int64           `json:"incarnation" codec:"incarnation"`
+	Seq          uint64          `json:"seq" codec:"seq"`
+	Signature    []byte          `json:"signature,omitempty" codec:"signature,omitempty"`
+
+	// The address the message has been received from, the name the sender has
+	// authenticated with on the transport level, if any, the wire format the
+	// message has been received in and whether it has been received as memberlist
+	// user message.
+	from   string
+	peer   string
+	format wireFormat
+	legacy bool
 }
 
 // Heartbeat defines the message sent out by the leader to all cluster members.
 type Heartbeat struct {
-	Term        uint64 `json:"term"`
-	Quorum      int    `json:"quorum"`
-	HeartbeatID uint64 `json:"heartbeat_id"`
-	LeaderID    string `json:"leader_id"`
+	Term        uint64 `json:"term" codec:"term"`
+	Quorum      int    `json:"quorum" codec:"quorum"`
+	HeartbeatID uint64 `json:"heartbeat_id" codec:"heartbeat_id"`
+	LeaderID    string `json:"leader_id" codec:"leader_id"`
 }
 
 // HeartbeatResponse defines the response of a follower to a leader's heartbeat message.
 type HeartbeatResponse struct {
-	Term        uint64 `json:"term"`
-	HeartbeatID uint64 `json:"heartbeat_id"`
-	FollowerID  string `json:"follower_id"`
+	Term        uint64 `json:"term" codec:"term"`
+	HeartbeatID uint64 `json:"heartbeat_id" codec:"heartbeat_id"`
+	FollowerID  string `json:"follower_id" codec:"follower_id"`
 }
 
 // PreVoteRequest defines the message sent out by a follower who is about to become a
 // candidate in order to check whether there truly isn't a leader anymore.
 type PreVoteRequest struct {
-	NextTerm       uint64 `json:"next_term"`
-	PreCandidateID string `json:"pre_candidate_id"`
+	NextTerm       uint64 `json:"next_term" codec:"next_term"`
+	PreCandidateID string `json:"pre_candidate_id" codec:"pre_candidate_id"`
 }
 
 // PreVoteResponse defines the response of a follower to a candidate-to-be's pre vote
 // request.
 type PreVoteResponse struct {
-	Term           uint64 `json:"term"`
-	FollowerID     string `json:"follower_id"`
-	PreVoteGranted bool   `json:"pre_vote_granted"`
+	Term           uint64 `json:"term" codec:"term"`
+	FollowerID     string `json:"follower_id" codec:"follower_id"`
+	PreVoteGranted bool   `json:"pre_vote_granted" codec:"pre_vote_granted"`
 }
 
 // VoteRequest defines the message sent out by a candidate to all cluster members to ask
 // for votes in order to become leader.
 type VoteRequest struct {
-	Term        uint64 `json:"term"`
-	CandidateID string `json:"candidate_id"`
+	Term        uint64 `json:"term" codec:"term"`
+	CandidateID string `json:"candidate_id" codec:"candidate_id"`
 }
 
 // VoteResponse defines the response of a follower to a candidate's vote request message.
 type VoteResponse struct {
-	Term        uint64 `json:"term"`
-	FollowerID  string `json:"follower_id"`
-	VoteGranted bool   `json:"vote_granted"`
+	Term        uint64 `json:"term" codec:"term"`
+	FollowerID  string `json:"follower_id" codec:"follower_id"`
+	VoteGranted bool   `json:"vote_granted" codec:"vote_granted"`
 }
 
 // NewQuorum defines the message sent out by a node that is voluntarily leaving the cluster,
 // triggering an immediate quorum change. This does not include crash-related leave events.
 type NewQuorum struct {
-	NewQuorum int    `json:"new_quorum"`
-	LeavingID string `json:"leaving_id"`
+	NewQuorum int    `json:"new_quorum" codec:"new_quorum"`
+	LeavingID string `json:"leaving_id" codec:"leaving_id"`
+}
+
+// KeyringRequest defines the message sent out by the leader to all cluster members in order to
+// execute a keyring operation cluster-wide.
+type KeyringRequest struct {
+	RequestID uint64    `json:"request_id" codec:"request_id"`
+	Term      uint64    `json:"term" codec:"term"`
+	Op        KeyringOp `json:"op" codec:"op"`
+	Key       string    `json:"key" codec:"key"`
+	LeaderID  string    `json:"leader_id" codec:"leader_id"`
+}
+
+// KeyringResponse defines the response of a follower to a leader's keyring request. Keys and
+// PrimaryKey are only set for ListKeysOp.
+type KeyringResponse struct {
+	RequestID  uint64   `json:"request_id" codec:"request_id"`
+	FollowerID string   `json:"follower_id" codec:"follower_id"`
+	Error      string   `json:"error" codec:"error"`
+	Keys       []string `json:"keys" codec:"keys"`
+	PrimaryKey string   `json:"primary_key" codec:"primary_key"`
+}
+
+// JoinRequest defines the request of a node to be admitted to the cluster.
+type JoinRequest struct {
+	NodeID    string `json:"node_id" codec:"node_id"`
+	Address   string `json:"address" codec:"address"`
+	ClusterID string `json:"cluster_id" codec:"cluster_id"`
+}
+
+// JoinResponse defines the answer of a cluster member to a join request. Reason is only set if
+// the join has been refused, Conflict if it has been refused because the node ID is in use.
+type JoinResponse struct {
+	MemberID string `json:"member_id" codec:"member_id"`
+	Admitted bool   `json:"admitted" codec:"admitted"`
+	Conflict bool   `json:"conflict" codec:"conflict"`
+	Reason   string `json:"reason" codec:"reason"`
+}
+
+// Ack defines the acknowledgement of a message that asked to be acknowledged. Seq is the
+// sequence number of the acknowledged message.
+type Ack struct {
+	Seq    uint64 `json:"seq" codec:"seq"`
+	NodeID string `json:"node_id" codec:"node_id"`
 }
 
 // sendHeartbeatToAll sends a heartbeat message to all the other cluster members.
@@ -74,18 +137,12 @@ func (n *Node) sendHeartbeatToAll() {
 		LeaderID:    n.config.ID,
 	}
 
-	for _, member := range n.memberlist.Members() {
+	for _, member := range n.network.Members() {
 		if member.Name == n.config.ID {
 			continue
 		}
 
-		hbBytes, _ := json.Marshal(hb)
-		msgBytes, _ := json.Marshal(Message{
-			Type:    HeartbeatMsg,
-			Content: hbBytes,
-		})
-
-		if err := n.memberlist.SendBestEffort(member, msgBytes); err != nil {
+		if err := n.send(member, HeartbeatMsg, hb); err != nil {
 			n.logger.Printf("[ERR] raftify: couldn't send heartbeat to %v: %v\n", member.Name, err.Error())
 			continue
 		}
@@ -100,23 +157,17 @@ func (n *Node) sendHeartbeatToAll() {
 
 // sendHeartbeatResponse sends a heartbeat response message back to the leader it came from.
 func (n *Node) sendHeartbeatResponse(leaderid string, heartbeatid uint64) {
-	hbRespBytes, _ := json.Marshal(HeartbeatResponse{
-		HeartbeatID: heartbeatid,
-		Term:        n.currentTerm,
-		FollowerID:  n.config.ID,
-	})
-	msgBytes, _ := json.Marshal(Message{
-		Type:    HeartbeatResponseMsg,
-		Content: hbRespBytes,
-	})
-
 	leaderNode, err := n.getNodeByName(leaderid)
 	if err != nil {
 		n.logger.Printf("[ERR] raftify: %v\n", err.Error())
 		return
 	}
 
-	if err := n.memberlist.SendBestEffort(leaderNode, msgBytes); err != nil {
+	if err := n.send(leaderNode, HeartbeatResponseMsg, HeartbeatResponse{
+		HeartbeatID: heartbeatid,
+		Term:        n.currentTerm,
+		FollowerID:  n.config.ID,
+	}); err != nil {
 		n.logger.Printf("couldn't send heartbeat response to %v: %v\n", leaderid, err.Error())
 		return
 	}
@@ -125,17 +176,16 @@ func (n *Node) sendHeartbeatResponse(leaderid string, heartbeatid uint64) {
 
 // sendPreVoteRequestToAll sends a pre vote request message to all cluster members.
 func (n *Node) sendPreVoteRequestToAll() {
-	reqBytes, _ := json.Marshal(PreVoteRequest{
+	errs := n.broadcast(n.preVoteList.pending, PreVoteRequestMsg, PreVoteRequest{
 		NextTerm:       n.currentTerm + 1,
 		PreCandidateID: n.config.ID,
 	})
-	msgBytes, _ := json.Marshal(Message{
-		Type:    PreVoteRequestMsg,
-		Content: reqBytes,
-	})
 
 	for _, member := range n.preVoteList.pending {
-		if err := n.memberlist.SendBestEffort(member, msgBytes); err != nil {
+		if member.Name == n.config.ID {
+			continue
+		}
+		if err, ok := errs[member.Name]; ok {
 			n.logger.Printf("[ERR] raftify: couldn't send prevote request to %v: %v\n", member.Name, err.Error())
 			continue
 		}
@@ -145,23 +195,17 @@ func (n *Node) sendPreVoteRequestToAll() {
 
 // sendPreVoteResponse sends a prevote response message to the precandidate.
 func (n *Node) sendPreVoteResponse(precandidateid string, grant bool) {
-	respBytes, _ := json.Marshal(PreVoteResponse{
-		Term:           n.currentTerm,
-		FollowerID:     n.config.ID,
-		PreVoteGranted: grant,
-	})
-	msgBytes, _ := json.Marshal(Message{
-		Type:    PreVoteResponseMsg,
-		Content: respBytes,
-	})
-
 	precandidateNode, err := n.getNodeByName(precandidateid)
 	if err != nil {
 		n.logger.Printf("[ERR] raftify: %v\n", err.Error())
 		return
 	}
 
-	if err := n.memberlist.SendBestEffort(precandidateNode, msgBytes); err != nil {
+	if err := n.send(precandidateNode, PreVoteResponseMsg, PreVoteResponse{
+		Term:           n.currentTerm,
+		FollowerID:     n.config.ID,
+		PreVoteGranted: grant,
+	}); err != nil {
 		n.logger.Printf("couldn't send prevote response to %v: %v\n", precandidateid, err.Error())
 		return
 	}
@@ -174,21 +218,17 @@ func (n *Node) sendPreVoteResponse(precandidateid string, grant bool) {
 }
 
 // sendVoteRequest sends a vote request message to the nodes specified in the list passed in.
-func (n *Node) sendVoteRequestToAll(list []*memberlist.Node) {
-	reqBytes, _ := json.Marshal(VoteRequest{
+func (n *Node) sendVoteRequestToAll(list []*Member) {
+	errs := n.broadcast(list, VoteRequestMsg, VoteRequest{
 		Term:        n.currentTerm,
 		CandidateID: n.config.ID,
 	})
-	msgBytes, _ := json.Marshal(Message{
-		Type:    VoteRequestMsg,
-		Content: reqBytes,
-	})
 
 	for _, member := range list {
 		if member.Name == n.config.ID {
 			continue
 		}
-		if err := n.memberlist.SendBestEffort(member, msgBytes); err != nil {
+		if err, ok := errs[member.Name]; ok {
 			n.logger.Printf("[ERR] raftify: couldn't send vote request to %v: %v\n", member.Name, err.Error())
 			continue
 		}
@@ -198,23 +238,17 @@ func (n *Node) sendVoteRequestToAll(list []*memberlist.Node) {
 
 // sendVoteResponse sends a vote response message back to the candidate who sent the vote request.
 func (n *Node) sendVoteResponse(candidateid string, grant bool) {
-	respBytes, _ := json.Marshal(VoteResponse{
-		Term:        n.currentTerm,
-		FollowerID:  n.config.ID,
-		VoteGranted: grant,
-	})
-	msgBytes, _ := json.Marshal(Message{
-		Type:    VoteResponseMsg,
-		Content: respBytes,
-	})
-
 	candidateNode, err := n.getNodeByName(candidateid)
 	if err != nil {
 		n.logger.Printf("[ERR] raftify: %v\n", err.Error())
 		return
 	}
 
-	if err := n.memberlist.SendBestEffort(candidateNode, msgBytes); err != nil {
+	if err := n.send(candidateNode, VoteResponseMsg, VoteResponse{
+		Term:        n.currentTerm,
+		FollowerID:  n.config.ID,
+		VoteGranted: grant,
+	}); err != nil {
 		n.logger.Printf("[ERR] raftify: couldn't send vote response to %v: %v", candidateid, err.Error())
 		return
 	}
@@ -231,23 +265,20 @@ func (n *Node) sendVoteResponse(candidateid string, grant bool) {
 // to trigger an immediate change of the new quorum instead of waiting for the dead node to
 // be kicked. This function returns the number of nodes that the new quorum could be sent to.
 func (n *Node) sendNewQuorumToAll(newquorum int) int {
-	nqBytes, _ := json.Marshal(NewQuorum{
+	members := n.network.Members()
+	errs := n.broadcast(members, NewQuorumMsg, NewQuorum{
 		NewQuorum: newquorum,
 		LeavingID: n.config.ID,
 	})
-	msgBytes, _ := json.Marshal(Message{
-		Type:    NewQuorumMsg,
-		Content: nqBytes,
-	})
 
 	// Count how many members received the new quorum message
 	membersReached := 0
 
-	for _, member := range n.memberlist.Members() {
+	for _, member := range members {
 		if member.Name == n.config.ID {
 			continue
 		}
-		if err := n.memberlist.SendReliable(member, msgBytes); err != nil {
+		if err, ok := errs[member.Name]; ok {
 			n.logger.Printf("[ERR] raftify: couldn't send new quorum to %v: %v\n", member.Name, err.Error())
 			continue
 		}
@@ -255,3 +286,18 @@ func (n *Node) sendNewQuorumToAll(newquorum int) int {
 	}
 	return membersReached
 }
+
+// sendKeyringResponse sends a keyring response message back to the leader the request came from.
+func (n *Node) sendKeyringResponse(leaderid string, resp KeyringResponse) {
+	leaderNode, err := n.getNodeByName(leaderid)
+	if err != nil {
+		n.logger.Printf("[ERR] raftify: %v\n", err.Error())
+		return
+	}
+
+	if err := n.send(leaderNode, KeyringResponseMsg, resp); err != nil {
+		n.logger.Printf("[ERR] raftify: couldn't send keyring response to %v: %v\n", leaderid, err.Error())
+		return
+	}
+	n.logger.Printf("[DEBUG] raftify: Sent keyring response to %v\n", leaderid)
+}
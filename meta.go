@@ -0,0 +1,110 @@
+package raftify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Maximum length of the cluster ID. Keeps the node meta well below memberlist's limit.
+const maxClusterIDLength = 128
+
+// nodeMeta is the metadata every node gossips about itself alongside its address.
+type nodeMeta struct {
+	// The ID of the cluster the node belongs to, empty if none is configured.
+	ClusterID string `json:"cluster_id,omitempty"`
+
+	// The range of protocol versions the node speaks, zero for nodes that predate protocol
+	// versions and only speak protocolJSON.
+	ProtocolMin int `json:"protocol_min,omitempty"`
+	ProtocolMax int `json:"protocol_max,omitempty"`
+
+	// The additional host:port addresses the node is reachable at.
+	Paths []string `json:"paths,omitempty"`
+}
+
+// encodeNodeMeta returns the metadata gossiped for the local node.
+func (c *Config) encodeNodeMeta() []byte {
+	meta, _ := json.Marshal(nodeMeta{
+		ClusterID:   c.ClusterID,
+		ProtocolMin: ProtocolVersionMin,
+		ProtocolMax: ProtocolVersionMax,
+		Paths:       c.Paths.Addrs,
+	})
+	return meta
+}
+
+// decodeNodeMeta parses the metadata of a member. Members that don't gossip any metadata have
+// the zero value.
+func decodeNodeMeta(raw []byte) (nodeMeta, error) {
+	var meta nodeMeta
+	if len(raw) == 0 {
+		return meta, nil
+	}
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return meta, fmt.Errorf("couldn't decode node meta: %v", err)
+	}
+	return meta, nil
+}
+
+// metaCache holds the decoded node meta of the cluster members by node ID so that it isn't
+// decoded every time a message is sent. Entries are refreshed when memberlist reports a member
+// to have joined or updated its meta and removed once the member has left. Since the meta of a
+// member may change before the update has been reported, an entry is only used as long as the
+// meta it has been decoded from is unchanged. A nil cache decodes the meta on every lookup.
+type metaCache struct {
+	sync.RWMutex
+	entries map[string]cachedMeta
+}
+
+// cachedMeta is the decoded node meta of a member alongside the raw meta it has been decoded from.
+type cachedMeta struct {
+	raw  []byte
+	meta nodeMeta
+	err  error
+}
+
+// lookup returns the decoded node meta of the member. If the cached entry is missing or
+// outdated, the meta is decoded without caching it so that nodes that never become members,
+// e.g. because they are refused, aren't cached.
+func (c *metaCache) lookup(member *Member) (nodeMeta, error) {
+	if c == nil {
+		return decodeNodeMeta(member.Meta)
+	}
+
+	c.RLock()
+	entry, ok := c.entries[member.Name]
+	c.RUnlock()
+	if ok && bytes.Equal(entry.raw, member.Meta) {
+		return entry.meta, entry.err
+	}
+	return decodeNodeMeta(member.Meta)
+}
+
+// refresh decodes and caches the node meta of the member.
+func (c *metaCache) refresh(member *Member) (nodeMeta, error) {
+	meta, err := decodeNodeMeta(member.Meta)
+	if c == nil {
+		return meta, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]cachedMeta{}
+	}
+	c.entries[member.Name] = cachedMeta{raw: member.Meta, meta: meta, err: err}
+	return meta, err
+}
+
+// forget removes the node meta of the member with the given ID from the cache.
+func (c *metaCache) forget(id string) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	delete(c.entries, id)
+}
@@ -0,0 +1,97 @@
+package raftify
+
+import (
+	"testing"
+)
+
+func TestDecodeNodeMeta(t *testing.T) {
+	config := &Config{ClusterID: "mainnet"}
+	if meta, err := decodeNodeMeta(config.encodeNodeMeta()); err != nil || meta.ClusterID != "mainnet" {
+		t.Logf("Expected cluster ID mainnet, instead got %q and error %v", meta.ClusterID, err)
+		t.FailNow()
+	}
+
+	// Members without metadata
+	if meta, err := decodeNodeMeta(nil); err != nil || meta.ClusterID != "" {
+		t.Logf("Expected empty cluster ID, instead got %q and error %v", meta.ClusterID, err)
+		t.FailNow()
+	}
+
+	if _, err := decodeNodeMeta([]byte("{")); err == nil {
+		t.Logf("Expected malformed node meta to be rejected, instead error was nil")
+		t.FailNow()
+	}
+}
+
+func TestMetaCache(t *testing.T) {
+	var metas metaCache
+	member := &Member{Name: "TestNode_1", Meta: (&Config{ClusterID: "mainnet"}).encodeNodeMeta()}
+
+	// Unknown members are decoded without being cached
+	if meta, err := metas.lookup(member); err != nil || meta.ClusterID != "mainnet" || len(metas.entries) != 0 {
+		t.Logf("Expected cluster ID mainnet without caching it, instead got %q, error %v and %v entries", meta.ClusterID, err, len(metas.entries))
+		t.FailNow()
+	}
+
+	metas.refresh(member)
+	if entry, ok := metas.entries["TestNode_1"]; !ok || entry.meta.ClusterID != "mainnet" {
+		t.Logf("Expected the meta of TestNode_1 to be cached, instead got %+v", entry)
+		t.FailNow()
+	}
+
+	// Outdated entries are not used
+	updated := &Member{Name: "TestNode_1", Meta: (&Config{ClusterID: "testnet"}).encodeNodeMeta()}
+	if meta, _ := metas.lookup(updated); meta.ClusterID != "testnet" {
+		t.Logf("Expected the updated cluster ID testnet, instead got %q", meta.ClusterID)
+		t.FailNow()
+	}
+
+	metas.forget("TestNode_1")
+	if len(metas.entries) != 0 {
+		t.Logf("Expected the meta of TestNode_1 to be removed, instead got %v entries", len(metas.entries))
+		t.FailNow()
+	}
+
+	// A nil cache decodes the meta on every lookup
+	var none *metaCache
+	if meta, err := none.refresh(member); err != nil || meta.ClusterID != "mainnet" {
+		t.Logf("Expected cluster ID mainnet from a nil cache, instead got %q and error %v", meta.ClusterID, err)
+		t.FailNow()
+	}
+}
+
+func TestClusterIDMismatch(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(3)
+
+	// Initialize and start dummy nodes of two different clusters
+	node1 := initDummyNode("TestNode_1", 1, 3, ports[0])
+	node2 := initDummyNode("TestNode_2", 1, 3, ports[1])
+	node3 := initDummyNode("TestNode_3", 1, 3, ports[2])
+	node1.config.ClusterID = "mainnet"
+	node2.config.ClusterID = "testnet"
+	node3.config.ClusterID = "mainnet"
+
+	for _, node := range []*Node{node1, node2, node3} {
+		node.createMemberlist()
+		defer node.memberlist.Shutdown()
+	}
+
+	if _, err := node2.memberlist.Join([]string{node1.LocalAddr()}); err == nil {
+		t.Logf("Expected node2 of another cluster to be refused, instead error was nil")
+		t.FailNow()
+	}
+	if num := node1.memberlist.NumMembers(); num != 1 {
+		t.Logf("Expected node1 to have 1 member, instead got %v", num)
+		t.FailNow()
+	}
+	if num := node2.memberlist.NumMembers(); num != 1 {
+		t.Logf("Expected node2 to have 1 member, instead got %v", num)
+		t.FailNow()
+	}
+
+	if _, err := node3.memberlist.Join([]string{node1.LocalAddr()}); err != nil {
+		t.Logf("Expected node3 of the same cluster to join, instead got error: %v", err)
+		t.FailNow()
+	}
+}
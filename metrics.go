@@ -0,0 +1,93 @@
+package raftify
+
+import "sync/atomic"
+
+// Metrics contains counters of the messages and nodes a node has rejected or dropped and of the
+// messages it has retransmitted since it was started.
+type Metrics struct {
+	// The number of messages rejected because the member they claim to originate from
+	// doesn't match the address they have been received from or the node that signed them.
+	SourceMismatches uint64
+
+	// The number of messages rejected because they were unsigned, signed by an untrusted
+	// node or carried an invalid signature.
+	InvalidSignatures uint64
+
+	// The number of messages rejected because they were too old, originated from a previous
+	// incarnation of the sender or were addressed to another node. Memberlist user messages
+	// are also rejected if they had already been received.
+	Replays uint64
+
+	// The number of times two nodes have been found claiming the same node ID.
+	IDConflicts uint64
+
+	// The number of messages dropped unread because they exceeded the max_message_size.
+	OversizedMessages uint64
+
+	// The number of messages dropped because their sender exceeded the message rate.
+	RateLimited uint64
+
+	// The number of messages dropped because the inbound message queue was full.
+	QueueOverflows uint64
+
+	// The number of election-critical messages, i.e. heartbeats, prevotes and votes and
+	// their responses, dropped because their inbound queue was full.
+	PriorityQueueOverflows uint64
+
+	// The number of join events dropped because the event queue was full.
+	EventQueueOverflows uint64
+
+	// The number of leave events dropped while waiting for room in the event queue because
+	// a later leave event of the same member superseded them.
+	SupersededLeaves uint64
+
+	// The number of messages rejected because they were malformed, of an unknown type or
+	// carried implausible values such as a quorum of 0 or a term far ahead.
+	InvalidMessages uint64
+
+	// The number of prevote and vote responses retransmitted because they hadn't been
+	// acknowledged within the ack_timeout.
+	Retransmits uint64
+
+	// The number of prevote and vote responses that have been acknowledged.
+	Acknowledged uint64
+
+	// The number of prevote and vote responses given up on because they hadn't been
+	// acknowledged after max_retransmits retransmits.
+	Unacknowledged uint64
+
+	// The number of messages dropped because they had already been accepted, e.g. via
+	// another path of their sender.
+	Duplicates uint64
+}
+
+// snapshot returns a copy of the metrics that is safe to hand out.
+func (m *Metrics) snapshot() Metrics {
+	return Metrics{
+		SourceMismatches:       atomic.LoadUint64(&m.SourceMismatches),
+		InvalidSignatures:      atomic.LoadUint64(&m.InvalidSignatures),
+		Replays:                atomic.LoadUint64(&m.Replays),
+		IDConflicts:            atomic.LoadUint64(&m.IDConflicts),
+		OversizedMessages:      atomic.LoadUint64(&m.OversizedMessages),
+		RateLimited:            atomic.LoadUint64(&m.RateLimited),
+		QueueOverflows:         atomic.LoadUint64(&m.QueueOverflows),
+		PriorityQueueOverflows: atomic.LoadUint64(&m.PriorityQueueOverflows),
+		EventQueueOverflows:    atomic.LoadUint64(&m.EventQueueOverflows),
+		SupersededLeaves:       atomic.LoadUint64(&m.SupersededLeaves),
+		InvalidMessages:        atomic.LoadUint64(&m.InvalidMessages),
+		Retransmits:            atomic.LoadUint64(&m.Retransmits),
+		Acknowledged:           atomic.LoadUint64(&m.Acknowledged),
+		Unacknowledged:         atomic.LoadUint64(&m.Unacknowledged),
+		Duplicates:             atomic.LoadUint64(&m.Duplicates),
+	}
+}
+
+// audit records a security-relevant event in the audit log. Events are written to the
+// logger passed in via WithAuditLogger or, if there is none, to the node's logger.
+func (n *Node) audit(format string, v ...interface{}) {
+	logger := n.auditLogger
+	if logger == nil {
+		logger = n.logger
+	}
+	logger.Printf("[WARN] raftify: audit: "+format+"\n", v...)
+}
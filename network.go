@@ -0,0 +1,224 @@
+package raftify
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// DeliveryMode determines how a message is delivered to a cluster member.
+type DeliveryMode uint8
+
+// Constants for valid delivery modes.
+const (
+	// BestEffort messages are sent once without acknowledgement, e.g. via UDP.
+	BestEffort DeliveryMode = iota
+
+	// Reliable messages are sent via a connection-oriented channel, e.g. TCP, and fail if
+	// they couldn't be handed over to the receiver.
+	Reliable
+)
+
+// InboundMessage is a raftify message received by a transport alongside its sender.
+type InboundMessage struct {
+	// The host:port address of the sender as seen by the transport. Messages are only
+	// accepted if its IP address matches the address of the member they claim to originate
+	// from.
+	From string
+
+	// The name the sender has authenticated with on the transport level, e.g. the subject
+	// of its TLS certificate. Empty if the transport doesn't authenticate its peers.
+	Peer string
+
+	// The raw message.
+	Payload []byte
+
+	// Whether the message has been received as memberlist user message from a member that
+	// predates the message transport. Such messages have no source address.
+	legacy bool
+}
+
+// Member is a cluster member as seen by a Transport.
+type Member struct {
+	// The node ID of the member.
+	Name string
+
+	// The IP address and port the member is reachable at.
+	Addr net.IP
+	Port uint16
+
+	// The metadata the member advertises alongside its address.
+	Meta []byte
+}
+
+// Address returns the host:port address of the member.
+func (m *Member) Address() string {
+	return net.JoinHostPort(m.Addr.String(), strconv.Itoa(int(m.Port)))
+}
+
+// memberOf returns the member a memberlist node stands for.
+func memberOf(node *memberlist.Node) *Member {
+	return &Member{Name: node.Name, Addr: node.Addr, Port: node.Port, Meta: node.Meta}
+}
+
+// MemberEventType is the kind of change a MemberEvent reports.
+type MemberEventType uint8
+
+// Constants for valid member event types.
+const (
+	// MemberJoin reports a member that has joined the cluster.
+	MemberJoin MemberEventType = iota
+
+	// MemberLeave reports a member that has left the cluster voluntarily or failed.
+	MemberLeave
+)
+
+// MemberEvent reports a member joining or leaving the cluster.
+type MemberEvent struct {
+	Type   MemberEventType
+	Member *Member
+}
+
+// Transport is the interface raftify exchanges messages and learns about cluster membership
+// with. Members are identified by their node ID, which must be the Name of their Member, and
+// negotiate the protocol version via the Meta advertised alongside their address. By
+// default, nodes use memberlist for membership and failure detection and exchange messages via
+// its listeners. Other transports can be passed in with WithTransport.
+type Transport interface {
+	// Start is called once on initialization before the node joins the cluster. The local
+	// node must be advertised under the given ID and with the given metadata.
+	Start(id string, meta []byte) error
+
+	// LocalMember returns the local node as advertised to the other members.
+	LocalMember() *Member
+
+	// Members returns all members that are currently alive, including the local node.
+	Members() []*Member
+
+	// Join joins the cluster via the members at the given host:port addresses and returns the
+	// number of members that could be reached.
+	Join(addresses []string) (int, error)
+
+	// Send sends a message to a single member.
+	Send(member *Member, msg []byte, mode DeliveryMode) error
+
+	// Broadcast sends the same message to each of the given members and returns the errors of
+	// the members it couldn't be sent to by node ID.
+	Broadcast(members []*Member, msg []byte, mode DeliveryMode) map[string]error
+
+	// Messages returns the channel the raftify messages received from other members are
+	// delivered on.
+	Messages() <-chan InboundMessage
+
+	// Events returns the channel the join and leave events of other members are delivered on.
+	// The join of the local node isn't reported.
+	Events() <-chan MemberEvent
+
+	// Leave announces the voluntary leave of the local node to the other members and waits up
+	// to the given timeout for it to be propagated.
+	Leave(timeout time.Duration) error
+
+	// Shutdown stops exchanging messages. The transport can't be used afterwards.
+	Shutdown() error
+}
+
+// memberlistTransport is the default transport. Membership and failure detection are handled by
+// memberlist while raftify messages are exchanged via the message transport sharing memberlist's
+// listeners.
+type memberlistTransport struct {
+	list      *memberlist.Memberlist
+	messages  *messageTransport
+	admission *admissionDelegate
+
+	// The decoded node meta of the members.
+	metas *metaCache
+
+	// The function deciding whether a member is handed to raftify, nil to trust all members.
+	trusted func(*memberlist.Node) bool
+
+	messageCh chan InboundMessage
+	eventCh   chan MemberEvent
+}
+
+// Start implements the Transport interface. The memberlist has already been started with the
+// ID and metadata of the local node when it was created.
+func (t *memberlistTransport) Start(id string, meta []byte) error {
+	return nil
+}
+
+// LocalMember implements the Transport interface.
+func (t *memberlistTransport) LocalMember() *Member {
+	return memberOf(t.list.LocalNode())
+}
+
+// Members implements the Transport interface. Members that aren't trusted yet are left out.
+func (t *memberlistTransport) Members() []*Member {
+	members := []*Member{}
+	for _, node := range t.list.Members() {
+		if t.trusted == nil || t.trusted(node) {
+			members = append(members, memberOf(node))
+		}
+	}
+	return members
+}
+
+// Join implements the Transport interface. A duplicate node ID detected while merging with the
+// cluster is returned instead of the error of the failed join.
+func (t *memberlistTransport) Join(addresses []string) (int, error) {
+	t.admission.takeConflict()
+	numPeers, err := t.list.Join(addresses)
+	if conflict := t.admission.takeConflict(); conflict != nil {
+		return numPeers, conflict
+	}
+	return numPeers, err
+}
+
+// Send implements the Transport interface. Best effort messages are sent via UDP, reliable
+// ones via TCP. Members that don't advertise any protocol version are sent memberlist user
+// messages instead since they predate the message transport.
+func (t *memberlistTransport) Send(member *Member, msg []byte, mode DeliveryMode) error {
+	if t.metas.speaksLegacyTransport(member) {
+		node := &memberlist.Node{Name: member.Name, Addr: member.Addr, Port: member.Port}
+		if mode == Reliable {
+			return t.list.SendReliable(node, msg)
+		}
+		return t.list.SendBestEffort(node, msg)
+	}
+	if mode == Reliable {
+		return t.messages.sendStream(member, msg)
+	}
+	return t.messages.sendPacket(member, msg)
+}
+
+// Broadcast implements the Transport interface.
+func (t *memberlistTransport) Broadcast(members []*Member, msg []byte, mode DeliveryMode) map[string]error {
+	errs := map[string]error{}
+	for _, member := range members {
+		if err := t.Send(member, msg, mode); err != nil {
+			errs[member.Name] = err
+		}
+	}
+	return errs
+}
+
+// Messages implements the Transport interface.
+func (t *memberlistTransport) Messages() <-chan InboundMessage {
+	return t.messageCh
+}
+
+// Events implements the Transport interface.
+func (t *memberlistTransport) Events() <-chan MemberEvent {
+	return t.eventCh
+}
+
+// Leave implements the Transport interface.
+func (t *memberlistTransport) Leave(timeout time.Duration) error {
+	return t.list.Leave(timeout)
+}
+
+// Shutdown implements the Transport interface. The listeners are closed alongside the memberlist.
+func (t *memberlistTransport) Shutdown() error {
+	return t.list.Shutdown()
+}
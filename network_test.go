@@ -0,0 +1,160 @@
+package raftify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTransport is a transport that records the messages sent instead of delivering them. Sends
+// to members or addresses marked as failing return an error.
+type fakeTransport struct {
+	sync.Mutex
+
+	local   *Member
+	members []*Member
+	failing map[string]bool
+	sent    map[string][][]byte
+	sentTo  []string
+	started bool
+	stopped bool
+
+	messageCh chan InboundMessage
+	eventCh   chan MemberEvent
+}
+
+func newFakeTransport(members ...*Member) *fakeTransport {
+	return &fakeTransport{
+		members:   members,
+		failing:   map[string]bool{},
+		sent:      map[string][][]byte{},
+		messageCh: make(chan InboundMessage),
+		eventCh:   make(chan MemberEvent, 8),
+	}
+}
+
+func (t *fakeTransport) Start(id string, meta []byte) error {
+	t.local = &Member{Name: id, Addr: net.ParseIP("127.0.0.1"), Port: 1, Meta: meta}
+	t.members = append([]*Member{t.local}, t.members...)
+	t.started = true
+	return nil
+}
+
+func (t *fakeTransport) LocalMember() *Member { return t.local }
+
+func (t *fakeTransport) Members() []*Member { return t.members }
+
+func (t *fakeTransport) Join(addresses []string) (int, error) { return 0, nil }
+
+func (t *fakeTransport) Send(member *Member, msg []byte, mode DeliveryMode) error {
+	t.Lock()
+	defer t.Unlock()
+	if t.failing[member.Name] || t.failing[member.Address()] {
+		return errors.New("unreachable")
+	}
+	t.sent[member.Name] = append(t.sent[member.Name], msg)
+	t.sentTo = append(t.sentTo, member.Address())
+	return nil
+}
+
+func (t *fakeTransport) Broadcast(members []*Member, msg []byte, mode DeliveryMode) map[string]error {
+	errs := map[string]error{}
+	for _, member := range members {
+		if err := t.Send(member, msg, mode); err != nil {
+			errs[member.Name] = err
+		}
+	}
+	return errs
+}
+
+func (t *fakeTransport) Messages() <-chan InboundMessage { return t.messageCh }
+
+func (t *fakeTransport) Events() <-chan MemberEvent { return t.eventCh }
+
+func (t *fakeTransport) Leave(timeout time.Duration) error { return nil }
+
+func (t *fakeTransport) Shutdown() error {
+	t.stopped = true
+	return nil
+}
+
+func TestBroadcast(t *testing.T) {
+	node := initDummyNode("TestNode", 1, 4, 0)
+
+	jsonMeta, _ := json.Marshal(nodeMeta{})
+	msgpackMeta, _ := json.Marshal(nodeMeta{ProtocolMin: protocolJSON, ProtocolMax: protocolMsgpack})
+
+	local := &Member{Name: "TestNode"}
+	node1 := &Member{Name: "Node1", Meta: jsonMeta}
+	node2 := &Member{Name: "Node2", Meta: msgpackMeta}
+	node3 := &Member{Name: "Node3", Meta: msgpackMeta}
+
+	transport := newFakeTransport()
+	transport.failing["Node3"] = true
+	node.network = transport
+
+	errs := node.broadcast([]*Member{local, node1, node2, node3}, NewQuorumMsg, NewQuorum{NewQuorum: 2, LeavingID: "TestNode"})
+
+	if len(errs) != 1 || errs["Node3"] == nil {
+		t.Logf("Expected the broadcast to fail for Node3 only, instead got %v", errs)
+		t.FailNow()
+	}
+	if len(transport.sent["TestNode"]) != 0 {
+		t.Logf("Expected the broadcast to skip the local node")
+		t.FailNow()
+	}
+	if len(transport.sent["Node1"]) != 1 || formatOf(transport.sent["Node1"][0]) != formatJSON {
+		t.Logf("Expected Node1 to receive exactly one JSON encoded message, instead got %v", transport.sent["Node1"])
+		t.FailNow()
+	}
+	if len(transport.sent["Node2"]) != 1 || formatOf(transport.sent["Node2"][0]) != formatMsgpack {
+		t.Logf("Expected Node2 to receive exactly one msgpack encoded message, instead got %v", transport.sent["Node2"])
+		t.FailNow()
+	}
+}
+
+func TestWithTransport(t *testing.T) {
+	node := initDummyNode("TestNode", 1, 1, 0)
+	tdir := fmt.Sprintf("%v/testing/TestWithTransport", node.workingDir)
+
+	os.MkdirAll(tdir, 0755)
+	defer os.RemoveAll(fmt.Sprintf("%v/testing", node.workingDir))
+
+	configBytes, _ := json.Marshal(node.config)
+	ioutil.WriteFile(fmt.Sprintf("%v/raftify.json", tdir), configBytes, 0755)
+
+	transport := newFakeTransport()
+	node, err := initNode(node.logger, tdir, WithTransport(transport))
+	if err != nil {
+		t.Logf("Expected successful initialization of node, instead got error: %v", err.Error())
+		t.FailNow()
+	}
+
+	if !transport.started || transport.local.Name != "TestNode" {
+		t.Logf("Expected the transport to have been started for TestNode")
+		t.FailNow()
+	}
+	if node.memberlist != nil {
+		t.Logf("Expected no memberlist to be created if a transport has been passed in")
+		t.FailNow()
+	}
+	if node.GetState() != Leader {
+		t.Logf("Expected node to become the leader of its single-node cluster, instead it's in the %v state", node.state.toString())
+		t.FailNow()
+	}
+
+	if err = node.Shutdown(); err != nil {
+		t.Logf("Expected successful shutdown of node, instead got error: %v", err.Error())
+		t.FailNow()
+	}
+	if !transport.stopped {
+		t.Logf("Expected the transport to have been shut down")
+		t.FailNow()
+	}
+}
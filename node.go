@@ -1,17 +1,32 @@
 package raftify
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"math/rand"
+	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/memberlist"
 )
 
+// The longest time membership events are deferred while election-critical messages keep
+// arriving.
+const maxEventDelay = 100 * time.Millisecond
+
 // Node contains core attributes that every node has regardless of node state.
 type Node struct {
+	// The sequence number of the last message sent. Must be the first field so that it is
+	// 64-bit aligned for atomic access on 32-bit platforms.
+	seq uint64
+
+	// The time the node was started at measured in nanoseconds since the Unix epoch. Sent
+	// alongside every message so that messages of a previous run can be told apart.
+	incarnation int64
+
 	// The node's version info.
 	versionInfo VersionInfo
 
@@ -39,18 +54,105 @@ type Node struct {
 	// The secret encryption key used to encrypt messages exchanges between nodes.
 	secretKey []byte
 
+	// The keys used to sign and verify messages, nil if per-node identities are disabled.
+	identity *identity
+
+	// The keyring holding all encryption keys the node accepts, nil if encryption is disabled.
+	keyring *memberlist.Keyring
+
+	// The keyring requests sent out as leader which are still waiting for responses.
+	keyringRequests keyringRequests
+
+	// Channel used to hand keyring operations over to the main loop.
+	keyringCh chan keyringCall
+
+	// The leaves announced by other nodes whose leave events haven't been received yet.
+	pendingLeaves pendingLeaves
+
+	// The ID of the leader the node has received heartbeats from in the current term.
+	leaderID string
+
+	// The resolver used to look up the hostnames of peers on join and rejoin.
+	resolver Resolver
+
+	// The discovery providers configured in the raftify.json file.
+	configDiscovery []Discovery
+
+	// The discovery providers passed in on initialization.
+	discovery []Discovery
+
+	// The addresses of the members persisted in the state.json file, ordered by the time
+	// they were last seen.
+	statePeers []string
+
+	// The source of the peer that led to the last successful join, e.g. "state" or "static".
+	joinSource string
+
+	// The transport used to exchange messages with other cluster members and to keep track of
+	// cluster membership. Defaults to the memberlist transport.
+	network Transport
+
 	// The local list of cluster members which is used to coordinate cluster membership
-	// and failure detection.
+	// and failure detection, nil if another transport has been passed in.
 	memberlist *memberlist.Memberlist
 
+	// The transport used to exchange raftify messages with other cluster members via the
+	// memberlist listeners, nil if another transport has been passed in.
+	transport *messageTransport
+
+	// The function deciding whether traffic may be sent to an address, nil to allow all.
+	networkFilter func(addr string) bool
+
+	// The certificates used by the TLS transport, nil if TLS is disabled.
+	tls *tlsReloader
+
+	// The delegate deciding which nodes are admitted to the cluster.
+	admission *admissionDelegate
+
+	// The function conflicting node IDs are reported to, nil if none is set.
+	conflictHandler func(Conflict)
+
+	// The function changes of the node's state and term are reported to, nil if none is set.
+	stateHandler func(state State, term uint64)
+
+	// The state and term last reported to the state handler.
+	reportedState State
+	reportedTerm  uint64
+
 	// Delegate for messages.
 	messages *MessageDelegate
 
+	// The counters of rejected messages.
+	metrics *Metrics
+
+	// The sequence numbers received from all senders, used to reject replayed messages.
+	replayGuard replayGuard
+
+	// The terms and messages received from members predating the message transport, used to
+	// reject their replayed messages.
+	legacyGuard legacyGuard
+
+	// The sent messages waiting to be acknowledged.
+	acks ackTracker
+
+	// The paths messages have been received via from other members.
+	paths pathTracker
+
+	// The logger security-relevant events are recorded with, nil to use the node's logger.
+	auditLogger *log.Logger
+
 	// Delegate for join and leave updates.
 	events *ChannelEventDelegate
 
-	// Channel used to signal successful bootstrap.
-	bootstrapCh chan bool
+	// The decoded node meta of the members.
+	metas *metaCache
+
+	// The time since which membership events have been deferred in favor of election-critical
+	// messages, zero if they aren't.
+	eventsDeferred time.Time
+
+	// Channel used to signal successful bootstrap or the error it has been aborted with.
+	bootstrapCh chan error
 
 	// Channel used for shutdown.
 	shutdownCh chan error
@@ -62,15 +164,21 @@ type Node struct {
 	// The list of prevotes, keeping track of prevotes received and pending ones.
 	preVoteList *VoteList
 
+	// The clock timers and tickers are created with.
+	clock Clock
+
+	// The source the randomized election timeouts are drawn from.
+	rand Rand
+
 	// The timer used for the heartbeat and election timeout of followers, precandidates and
 	// candidates.
-	timeoutTimer *time.Timer
+	timeoutTimer Timer
 
 	// The list of votes, keeping track of votes received and pending ones.
 	voteList *VoteList
 
 	// The ticker used for periodically sending out vote requests and heartbeats.
-	messageTicker *time.Ticker
+	messageTicker Ticker
 
 	// List of heartbeat IDs, keeping track of which heartbeats were sent out and which ones
 	// have gotten a response in the respective cycle.
@@ -83,50 +191,200 @@ func (n *Node) createMemberlist() error {
 	config.Name = n.config.ID
 	config.BindAddr = n.config.BindAddr
 	config.BindPort = n.config.BindPort
+	config.AdvertiseAddr = n.config.AdvertiseAddr
 	config.AdvertisePort = n.config.BindPort
+	if n.config.AdvertisePort != 0 {
+		config.AdvertisePort = n.config.AdvertisePort
+	}
 	config.TCPTimeout = 3 * time.Second
+
+	// A node restarted at another address may reclaim its ID as soon as its previous
+	// incarnation has been declared dead. Memberlist never lets it do so if this is 0.
+	config.DeadNodeReclaimTime = time.Nanosecond
 	config.Logger = n.logger
 	config.Delegate = n.messages
 	config.Events = n.events
+	n.messages.meta = n.config.encodeNodeMeta()
+
+	// Members of other clusters, nodes that are not allowlisted and nodes exceeding max_nodes
+	// are refused on join and when learned about via gossip.
+	n.admission = &admissionDelegate{
+		logger:         n.logger,
+		localID:        n.config.ID,
+		clusterID:      n.config.ClusterID,
+		maxNodes:       n.config.MaxNodes,
+		migrationUntil: n.config.clusterIDMigrationDeadline(),
+		allowlist:      n.config.Allowlist.parse(),
+		events:         n.events,
+		onConflict:     n.raiseConflict,
+		metas:          n.metas,
+		members:        map[string]string{},
+	}
+	config.Merge = n.admission
+	config.Alive = n.admission
+	config.Events = n.admission
+	config.Conflict = n.admission
+
+	// The keyring is created up front so that keys can be rotated while the node is running.
+	// Keys rotated before a restart take precedence over the configured key, which may have
+	// been removed from the cluster in the meantime.
+	if len(n.secretKey) != 0 {
+		keys, err := n.loadKeyring()
+		if err != nil {
+			return err
+		}
+		primaryKey := n.secretKey
+		if len(keys) != 0 {
+			n.logger.Println("[DEBUG] raftify: Loading encryption keys from keyring.json...")
+			primaryKey, keys = keys[0], keys[1:]
+		}
+
+		keyring, err := memberlist.NewKeyring(keys, primaryKey)
+		if err != nil {
+			return err
+		}
+		config.SecretKey = primaryKey
+		config.Keyring = keyring
+		n.keyring = keyring
+	}
 
-	if secretKey, err := hexToByte(n.config.Encrypt); err == nil {
-		config.SecretKey = secretKey
+	// If TLS is configured, all traffic is exchanged via mutually authenticated connections
+	// and members are only handed to raftify once their certificate has been verified to be
+	// issued to their node ID.
+	var inner netTransport
+	var trusted func(*memberlist.Node) bool
+	if n.tls != nil {
+		tlsTransport, err := newTLSTransport(config, n.tls)
+		if err != nil {
+			return err
+		}
+		aliveDelegate := newTLSAliveDelegate(n.config.ID, tlsTransport, n.logger)
+		n.admission.next = aliveDelegate
+		n.events.onLeave = aliveDelegate.forget
+		trusted = aliveDelegate.trusted
+		inner = tlsTransport
+	} else {
+		netTransport, err := newNetTransport(config)
+		if err != nil {
+			return err
+		}
+		inner = netTransport
 	}
 
-	// On memberlist creation, a join event is immediately fired for the local node.
-	// At this point in time, the main loop is not running though, so the creation
-	// would block the entire application. This anonymous go routine prevents this
-	// from happening by waiting for the first join event to be fired and simply
-	// skipping it so the main loop can be started afterwards. All further join and
-	// leave events are caught in the main loop after this first occurrence.
-	go func() {
-		<-n.events.eventCh
-	}()
+	// Raftify messages are exchanged via the same listeners as memberlist's own messages but
+	// intercepted before they reach memberlist so that their source address is known.
+	transport := newMessageTransport(inner, config, n.keyring, n.config.Limits, n.metrics, n.messages.messageCh, n.handleJoinRequest)
+	transport.filter = n.networkFilter
+	n.messages.legacy = transport.enqueueLegacy
+	config.Transport = transport
+	n.transport = transport
+
+	// If the bind port is 0, the operating system has picked a free port which memberlist
+	// needs to advertise.
+	if config.BindPort == 0 {
+		config.BindPort = transport.GetAutoBindPort()
+		config.AdvertisePort = config.BindPort
+	}
 
 	var err error
 	if n.memberlist, err = memberlist.Create(config); err != nil {
+		transport.Shutdown()
 		return err
 	}
+	n.admission.setMemberlist(n.memberlist)
+	n.network = &memberlistTransport{
+		list:      n.memberlist,
+		messages:  transport,
+		admission: n.admission,
+		metas:     n.metas,
+		trusted:   trusted,
+		messageCh: n.messages.messageCh,
+		eventCh:   n.events.eventCh,
+	}
+
+	if n.config.BindPort == 0 {
+		n.logger.Printf("[DEBUG] raftify: Bound to port %v picked by the operating system\n", config.BindPort)
+	}
+	n.applyLocalAddr(n.config)
 	return nil
 }
 
+// applyLocalAddr writes the port the memberlist is actually bound to and the address it
+// advertises back into the config so that the local node can be detected in peerlists.
+func (n *Node) applyLocalAddr(config *Config) {
+	localNode := n.memberlist.LocalNode()
+	if config.BindPort == 0 || config.AdvertisePort == 0 {
+		config.BindPort = int(localNode.Port)
+		config.AdvertisePort = int(localNode.Port)
+	}
+}
+
 // tryJoin attempts to join an existing cluster via one of its peers listed in the peerlist.
 // If no peers can be reached the node is started and waits to be bootstrapped.
 func (n *Node) tryJoin() error {
 	n.logger.Println("[DEBUG] raftify: Trying to join existing cluster via peers...")
-	numPeers, err := n.memberlist.Join(n.config.PeerList)
+
+	// Hostnames are resolved on every join attempt instead of once on startup so that peers
+	// whose IP addresses change in the meantime can still be reached. The source of each
+	// resolved address is kept in order to record which one led to a successful join.
+	discovered := n.discoverPeers()
+	peers := []string{}
+	sources := map[string]string{}
+
+	for _, peer := range discovered {
+		resolved, err := n.resolvePeers([]string{peer.address})
+		if err != nil {
+			continue
+		}
+		for _, address := range resolved {
+			if _, ok := sources[address]; ok {
+				continue
+			}
+			sources[address] = peer.source
+			peers = append(peers, address)
+		}
+	}
+	if len(peers) == 0 && len(discovered) != 0 {
+		return errors.New("none of the peers could be resolved")
+	}
+
+	// Peers refusing to admit the local node are not joined, so that the reason is reported
+	// instead of the node silently being ignored by the cluster. Other transports than the
+	// memberlist transport are responsible for admission themselves.
+	if n.transport != nil {
+		var err error
+		if peers, err = n.requestAdmission(peers); err != nil {
+			return err
+		}
+	}
+
+	numPeers, err := n.network.Join(peers)
 	if err != nil {
 		return err
 	}
 
+	// The first peer in order of precedence which is now part of the memberlist is the one
+	// the join is attributed to.
+	members := map[string]bool{}
+	for _, member := range n.network.Members() {
+		members[member.Address()] = true
+	}
+	for _, address := range peers {
+		if members[address] {
+			n.joinSource = sources[address]
+			n.logger.Printf("[INFO] raftify: Joined cluster via %v (source: %v)\n", address, n.joinSource)
+			break
+		}
+	}
+
 	n.logger.Printf("[DEBUG] raftify: %v peers are currently available ✓\n", numPeers)
 	return nil
 }
 
 // printMemberlist prints out the local memberlist into the console log.
 func (n *Node) printMemberlist() {
-	n.logger.Printf("[INFO] raftify: The cluster has currently %v members:\n", len(n.memberlist.Members()))
-	for _, member := range n.memberlist.Members() {
+	n.logger.Printf("[INFO] raftify: The cluster has currently %v members:\n", len(n.network.Members()))
+	for _, member := range n.network.Members() {
 		n.logger.Printf("[INFO] raftify: - %v [%v]\n", member.Name, member.Addr)
 	}
 }
@@ -138,25 +396,37 @@ func (n *Node) printVersionInfo() {
 }
 
 // initNode initializes a new raftified node.
-func initNode(logger *log.Logger, workingDir string) (*Node, error) {
+func initNode(logger *log.Logger, workingDir string, opts ...Option) (*Node, error) {
 	node := &Node{
-		logger:        logger,
-		workingDir:    workingDir,
-		timeoutTimer:  time.NewTimer(time.Second),
-		messageTicker: time.NewTicker(time.Second),
-		bootstrapCh:   make(chan bool),  // This must NEVER be a buffered channel.
-		shutdownCh:    make(chan error), // This must NEVER be a buffered channel.
+		logger:      logger,
+		workingDir:  workingDir,
+		incarnation: time.Now().UnixNano(),
+		resolver:    net.DefaultResolver,
+		clock:       systemClock{},
+		rand:        newRand(),
+		bootstrapCh: make(chan error), // This must NEVER be a buffered channel.
+		shutdownCh:  make(chan error), // This must NEVER be a buffered channel.
+		keyringCh:   make(chan keyringCall),
 	}
 
+	for _, opt := range opts {
+		opt(node)
+	}
+
+	node.timeoutTimer = node.clock.NewTimer(time.Second)
+	node.messageTicker = node.clock.NewTicker(time.Second)
 	node.timeoutTimer.Stop()
 	node.messageTicker.Stop()
 
 	node.messages = &MessageDelegate{
 		logger:    logger,
-		messageCh: make(chan []byte),
+		messageCh: make(chan InboundMessage),
 	}
+	node.metrics = &Metrics{}
+	node.metas = &metaCache{}
 	node.events = &ChannelEventDelegate{
-		logger: logger,
+		logger:  logger,
+		metrics: node.metrics,
 	}
 	node.heartbeatIDList = &HeartbeatIDList{
 		logger:             logger,
@@ -168,13 +438,13 @@ func initNode(logger *log.Logger, workingDir string) (*Node, error) {
 	node.preVoteList = &VoteList{
 		logger:              logger,
 		received:            0,
-		pending:             []*memberlist.Node{},
+		pending:             []*Member{},
 		missedPrevoteCycles: 0,
 	}
 	node.voteList = &VoteList{
 		logger:              logger,
 		received:            0,
-		pending:             []*memberlist.Node{},
+		pending:             []*Member{},
 		missedPrevoteCycles: 0,
 	}
 
@@ -195,6 +465,7 @@ func initNode(logger *log.Logger, workingDir string) (*Node, error) {
 		if err := node.loadConfig(true); err != nil {
 			return nil, fmt.Errorf("[ERR] raftify: %v", err.Error())
 		}
+		node.restoreIncarnations()
 	} else { // Didn't find state.json
 		node.logger.Println("[DEBUG] raftify: Loading peers from raftify.json...")
 
@@ -211,12 +482,17 @@ func initNode(logger *log.Logger, workingDir string) (*Node, error) {
 
 	// Allocate enough memory for the event channel to accommodate for the self-imposed number
 	// of maximum nodes to be run in the cluster.
-	node.events.eventCh = make(chan memberlist.NodeEvent, node.config.MaxNodes)
+	node.events.eventCh = make(chan MemberEvent, node.config.MaxNodes)
+	node.events.localID = node.config.ID
 
 	// Create the local memberlist that initially only contains the local node. It is used to
-	// keep track of cluster membership.
-	if listErr := node.createMemberlist(); listErr != nil {
-		return nil, fmt.Errorf("[ERR] raftify: %v", listErr.Error())
+	// keep track of cluster membership. Transports passed in are started instead.
+	if node.network == nil {
+		if listErr := node.createMemberlist(); listErr != nil {
+			return nil, fmt.Errorf("[ERR] raftify: %v", listErr.Error())
+		}
+	} else if err := node.network.Start(node.config.ID, node.config.encodeNodeMeta()); err != nil {
+		return nil, fmt.Errorf("[ERR] raftify: couldn't start transport: %v", err.Error())
 	}
 
 	// The first quorum is determined by the number of expected nodes specified in the raftify.json.
@@ -224,23 +500,28 @@ func initNode(logger *log.Logger, workingDir string) (*Node, error) {
 
 	node.logger.Printf("[DEBUG] raftify: %v successfully initialized ✓\n", node.config.ID)
 
-	// Initialize the bootstrap phase
-	node.toBootstrap()
+	// Initialize the bootstrap phase. Joining with an ID that is already in use is fatal.
+	if err := node.toBootstrap(); err != nil {
+		node.network.Shutdown()
+		return nil, fmt.Errorf("[ERR] raftify: %w", err)
+	}
 
 	// Run the main loop
 	go node.runLoop()
 
-	// Block until cluster has been successfully bootstrapped. toBootstrap is able to unblock.
+	// Block until cluster has been successfully bootstrapped or the bootstrap has been aborted.
 	// Don't block if expect is set to 1 since that will be bootstrapped immediately.
 	if node.config.Expect != 1 {
-		<-node.bootstrapCh
+		if err := <-node.bootstrapCh; err != nil {
+			return nil, fmt.Errorf("[ERR] raftify: %w", err)
+		}
 	}
 	return node, nil
 }
 
 // getNodeByName returns the full Node struct from memberlist to the specified name.
-func (n *Node) getNodeByName(name string) (*memberlist.Node, error) {
-	for _, member := range n.memberlist.Members() {
+func (n *Node) getNodeByName(name string) (*Member, error) {
+	for _, member := range n.network.Members() {
 		if name == member.Name {
 			return member, nil
 		}
@@ -250,12 +531,14 @@ func (n *Node) getNodeByName(name string) (*memberlist.Node, error) {
 
 // resetTimeout resets the internal timeout timer to a random duration measured in milliseconds.
 func (n *Node) resetTimeout() {
-	n.timeoutTimer.Reset(time.Duration(rand.Intn(MaxTimeout*n.config.Performance-MinTimeout*n.config.Performance)+MinTimeout*n.config.Performance) * time.Millisecond)
+	n.timeoutTimer.Reset(time.Duration(n.rand.Intn(MaxTimeout*n.config.Performance-MinTimeout*n.config.Performance)+MinTimeout*n.config.Performance) * time.Millisecond)
 }
 
-// startMessageTicker starts the message ticker.
+// startMessageTicker starts the message ticker. The previous ticker is stopped since the
+// ticker is restarted on every transition into the candidate and leader state.
 func (n *Node) startMessageTicker() {
-	n.messageTicker = time.NewTicker(time.Duration((TickerInterval * n.config.Performance)) * time.Millisecond)
+	n.messageTicker.Stop()
+	n.messageTicker = n.clock.NewTicker(time.Duration((TickerInterval * n.config.Performance)) * time.Millisecond)
 }
 
 // quorumReached checks whether the specified number of votes make up the majority in order
@@ -284,16 +567,22 @@ func (n *Node) quorumReached(votes int) bool {
 	// no two leaders can exist simultaneously in both partitions. The larger partition will have
 	// a leader, the smaller one won't.
 	n.logger.Printf("[DEBUG] raftify: %v quorum reached: (%v/%v)\n", n.state.toString(), votes, n.quorum)
-	n.quorum = int(len(n.memberlist.Members())/2) + 1
+	n.quorum = int(len(n.network.Members())/2) + 1
 	return true
 }
 
 // runLoop runs the routine for the node's current state.
 func (n *Node) runLoop() {
 	for {
+		n.reportState()
+		n.expireLeaves()
+
 		switch n.state {
 		case Bootstrap:
-			n.runBootstrap()
+			if err := n.runBootstrap(); err != nil {
+				n.abortBootstrap(err)
+				return // exit loop since the node can't become a member of the cluster
+			}
 		case Rejoin:
 			n.runRejoin()
 		case Follower:
@@ -315,21 +604,52 @@ func (n *Node) runLoop() {
 	}
 }
 
+// reportState passes the node's state and term to the state handler if either has changed since
+// they were last reported.
+func (n *Node) reportState() {
+	if n.stateHandler == nil || (n.state == n.reportedState && n.currentTerm == n.reportedTerm) {
+		return
+	}
+	n.reportedState, n.reportedTerm = n.state, n.currentTerm
+	n.stateHandler(n.state, n.currentTerm)
+}
+
+// idle tells the node's clock which channels the main loop is about to wait on if the clock
+// implements Idler.
+func (n *Node) idle(chans ...interface{}) {
+	if idler, ok := n.clock.(Idler); ok {
+		idler.Idle(chans...)
+	}
+}
+
 // MessageDelegate is the interface that clients must implement if they want to hook into the gossip
 // layer of Memberlist.
 type MessageDelegate struct {
 	logger    *log.Logger
-	messageCh chan []byte
+	messageCh chan InboundMessage
+
+	// The function memberlist user messages are queued with, nil if raftify messages are
+	// exchanged via another transport.
+	legacy func(payload []byte)
+
+	// The encoded metadata of the local node.
+	meta []byte
 }
 
-// NotifyMsg implements the Delegate interface.
+// NotifyMsg implements the Delegate interface. Raftify messages are exchanged via the message
+// transport, but members predating it still send them as memberlist user messages. These are
+// queued like all other messages and only accepted as long as their sender hasn't been upgraded.
 func (d *MessageDelegate) NotifyMsg(msg []byte) {
-	d.messageCh <- msg
+	if d.legacy == nil {
+		d.logger.Println("[WARN] raftify: Received message via memberlist without message transport, discarding...")
+		return
+	}
+	d.legacy(msg)
 }
 
 // NodeMeta implements the Delegate interface.
 func (d *MessageDelegate) NodeMeta(limit int) []byte {
-	return []byte("") // Not used.
+	return d.meta
 }
 
 // LocalState implements the Delegate interface.
@@ -346,28 +666,125 @@ func (d *MessageDelegate) GetBroadcasts(overhead, limit int) [][]byte {
 func (d *MessageDelegate) MergeRemoteState(buf []byte, join bool) {} // Not used.
 
 // ChannelEventDelegate is a simpler delegate that is used only to receive notifications about members
-// joining and leaving.
+// joining and leaving. Events are queued without ever blocking memberlist. If the queue is full,
+// join events are dropped since the queued ones already cause the state to be refreshed. Leave
+// events are kept in an overflow list instead since announced leaves are only applied once the
+// leave event of their node has been received. The list holds at most one leave event per member.
 type ChannelEventDelegate struct {
 	logger  *log.Logger
-	eventCh chan memberlist.NodeEvent
+	eventCh chan MemberEvent
+
+	// The ID of the local node whose own join event is not queued.
+	localID string
+
+	// The metrics dropped events are counted in.
+	metrics *Metrics
+
+	// The function called with every member that has left, nil if none is set.
+	onLeave func(*memberlist.Node)
+
+	// The leave events waiting for room in the queue, oldest first, at most one per member.
+	sync.Mutex
+	overflow []MemberEvent
 }
 
 // NotifyJoin implements the EventDelegate interface.
 func (d *ChannelEventDelegate) NotifyJoin(newNode *memberlist.Node) {
 	d.logger.Printf("[INFO] raftify: ->[] %s [%s] joined the cluster.\n", newNode.Name, newNode.Address())
-	d.eventCh <- memberlist.NodeEvent{
-		Event: memberlist.NodeJoin,
-		Node:  newNode,
+	if newNode.Name == d.localID {
+		return
 	}
+	d.enqueue(MemberEvent{
+		Type:   MemberJoin,
+		Member: memberOf(newNode),
+	})
 }
 
 // NotifyLeave implements the EventDelegate interface.
 func (d *ChannelEventDelegate) NotifyLeave(oldNode *memberlist.Node) {
 	d.logger.Printf("[INFO] raftify: []-> %s [%s] left the cluster.\n", oldNode.Name, oldNode.Address())
-	d.eventCh <- memberlist.NodeEvent{
-		Event: memberlist.NodeLeave,
-		Node:  oldNode,
+	if d.onLeave != nil {
+		d.onLeave(oldNode)
+	}
+	d.enqueue(MemberEvent{
+		Type:   MemberLeave,
+		Member: memberOf(oldNode),
+	})
+}
+
+// enqueue queues the event. If the queue is full, leave events are added to the overflow list
+// and join events are dropped.
+func (d *ChannelEventDelegate) enqueue(event MemberEvent) {
+	d.Lock()
+	defer d.Unlock()
+
+	// Leave events must not overtake the ones already waiting in the overflow list
+	if event.Type == MemberLeave && len(d.overflow) != 0 {
+		d.deferLeave(event)
+		return
+	}
+	select {
+	case d.eventCh <- event:
+	default:
+		if event.Type == MemberLeave {
+			d.logger.Printf("[DEBUG] raftify: event queue is full, deferring leave event of %v\n", event.Member.Name)
+			d.deferLeave(event)
+			return
+		}
+		atomic.AddUint64(&d.metrics.EventQueueOverflows, 1)
+		d.logger.Printf("[WARN] raftify: event queue is full, dropping event of %v\n", event.Member.Name)
+	}
+}
+
+// deferLeave adds the leave event to the overflow list. A leave event of the same member that is
+// still waiting there is superseded and replaced by the event in its place. Must be called with
+// the lock held.
+func (d *ChannelEventDelegate) deferLeave(event MemberEvent) {
+	for i, waiting := range d.overflow {
+		if waiting.Member.Name == event.Member.Name {
+			atomic.AddUint64(&d.metrics.SupersededLeaves, 1)
+			d.logger.Printf("[DEBUG] raftify: dropping superseded leave event of %v\n", event.Member.Name)
+			d.overflow[i] = event
+			return
+		}
+	}
+	d.overflow = append(d.overflow, event)
+}
+
+// flush moves the events of the overflow list into the queue as far as there is room.
+func (d *ChannelEventDelegate) flush() {
+	d.Lock()
+	defer d.Unlock()
+
+	for len(d.overflow) != 0 {
+		select {
+		case d.eventCh <- d.overflow[0]:
+			d.overflow = d.overflow[1:]
+		default:
+			return
+		}
+	}
+}
+
+// membershipEvents returns the channel membership events are received from in the main loop.
+// While election-critical messages are waiting to be delivered, nil is returned so that the
+// messages are handled first, but membership events are never deferred for longer than
+// maxEventDelay. Leave events waiting in the overflow list are queued as soon as there is room.
+func (n *Node) membershipEvents() <-chan MemberEvent {
+	if n.events != nil {
+		n.events.flush()
+	}
+	if n.transport != nil && n.transport.pendingPriority() > 0 {
+		now := n.clock.Now()
+		if n.eventsDeferred.IsZero() {
+			n.eventsDeferred = now
+		}
+		if now.Sub(n.eventsDeferred) < maxEventDelay {
+			return nil
+		}
 	}
+	n.eventsDeferred = time.Time{}
+	return n.network.Events()
 }
 
 // NotifyUpdate implements the EventDelegate interface.
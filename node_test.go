@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"testing"
 	"time"
+
+	"github.com/hashicorp/memberlist"
 )
 
 func TestMemberlist(t *testing.T) {
@@ -26,6 +29,31 @@ func TestMemberlist(t *testing.T) {
 	}
 }
 
+func TestMemberlistBindPortZero(t *testing.T) {
+	// Initialize dummy node with a port picked by the operating system
+	node := initDummyNode("TestNode", 1, 1, 0)
+	node.config.PeerList = []string{"127.0.0.1:0"}
+
+	if err := node.createMemberlist(); err != nil {
+		t.Logf("Expected successful creation of memberlist, instead got error: %v", err.Error())
+		t.FailNow()
+	}
+	defer node.memberlist.Shutdown()
+
+	if node.config.BindPort == 0 {
+		t.Log("Expected bind port to be replaced by the port picked by the operating system, instead it is still 0")
+		t.FailNow()
+	}
+	if !node.config.isLocalAddr(node.LocalAddr()) {
+		t.Logf("Expected %v to be detected as local address, instead it was not", node.LocalAddr())
+		t.FailNow()
+	}
+	if node.LocalAddr() != fmt.Sprintf("127.0.0.1:%v", node.config.BindPort) {
+		t.Logf("Expected local address to be 127.0.0.1:%v, instead got %v", node.config.BindPort, node.LocalAddr())
+		t.FailNow()
+	}
+}
+
 func TestTryJoin(t *testing.T) {
 	// Reserve ports for this test
 	ports := reservePorts(2)
@@ -115,12 +143,12 @@ func TestResetTimeout(t *testing.T) {
 	ports := reservePorts(1)
 
 	node := initDummyNode("TestNode", 1, 1, ports[0])
-	node.timeoutTimer = time.NewTimer(time.Second)
+	node.timeoutTimer = node.clock.NewTimer(time.Second)
 	node.timeoutTimer.Stop()
 
 	start := time.Now()
 	node.resetTimeout()
-	end := <-node.timeoutTimer.C
+	end := <-node.timeoutTimer.C()
 
 	if end.Sub(start) > ((MaxTimeout*time.Duration(node.config.Performance)+10)*time.Millisecond) || time.Since(start) < (800*time.Duration(node.config.Performance)*time.Millisecond) {
 		t.Logf("Expected timeout to elapse after %v-%vms, instead it took %vms", node.config.Performance*MinTimeout, node.config.Performance*MaxTimeout, time.Since(start))
@@ -131,7 +159,7 @@ func TestResetTimeout(t *testing.T) {
 
 	start = time.Now()
 	node.resetTimeout()
-	end = <-node.timeoutTimer.C
+	end = <-node.timeoutTimer.C()
 
 	if end.Sub(start) > ((MaxTimeout*time.Duration(node.config.Performance)+10)*time.Millisecond) || time.Since(start) < (800*time.Duration(node.config.Performance)*time.Millisecond) {
 		t.Logf("Expected timeout to elapse after %v-%vms, instead it took %vms", node.config.Performance*MinTimeout, node.config.Performance*MaxTimeout, time.Since(start))
@@ -145,10 +173,10 @@ func TestStartMessageTicker(t *testing.T) {
 
 	// Initialize dummy node
 	node := initDummyNode("TestNode", 1, 1, ports[0])
-	node.messageTicker = time.NewTicker(time.Millisecond)
+	node.messageTicker = node.clock.NewTicker(time.Millisecond)
 
 	select {
-	case <-node.messageTicker.C:
+	case <-node.messageTicker.C():
 		node.messageTicker.Stop()
 	case <-time.After(210 * time.Millisecond):
 		t.Logf("Expected message ticker to have been called after 200ms, instead nothing happened")
@@ -156,6 +184,35 @@ func TestStartMessageTicker(t *testing.T) {
 	}
 }
 
+func TestReportState(t *testing.T) {
+	node := initDummyNode("TestNode", 1, 1, 0)
+
+	type report struct {
+		state State
+		term  uint64
+	}
+	var reports []report
+	node.stateHandler = func(state State, term uint64) {
+		reports = append(reports, report{state: state, term: term})
+	}
+
+	// Only changes of the state or the term are reported
+	node.reportState()
+	node.state = Follower
+	node.reportState()
+	node.reportState()
+	node.currentTerm = 1
+	node.reportState()
+	node.state = Leader
+	node.reportState()
+
+	expected := []report{{Follower, 0}, {Follower, 1}, {Leader, 1}}
+	if !reflect.DeepEqual(reports, expected) {
+		t.Logf("Expected reports %v, instead got %v", expected, reports)
+		t.FailNow()
+	}
+}
+
 func TestQuorum(t *testing.T) {
 	// Reserve ports for this test
 	ports := reservePorts(1)
@@ -183,3 +240,63 @@ func TestQuorum(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestChannelEventDelegate(t *testing.T) {
+	// Initialize dummy node with room for a single event
+	node := initDummyNode("TestNode_1", 1, 1, 0)
+	node.network = &memberlistTransport{eventCh: node.events.eventCh}
+
+	// The join event of the local node is not queued
+	node.events.NotifyJoin(&memberlist.Node{Name: "TestNode_1"})
+	node.events.NotifyJoin(&memberlist.Node{Name: "TestNode_2"})
+
+	// A full queue must never block memberlist
+	done := make(chan struct{})
+	go func() {
+		node.events.NotifyLeave(&memberlist.Node{Name: "TestNode_2"})
+		node.events.NotifyJoin(&memberlist.Node{Name: "TestNode_3"})
+		node.events.NotifyLeave(&memberlist.Node{Name: "TestNode_3"})
+
+		// TestNode_2 rejoins and leaves again while its first leave event is still waiting
+		node.events.NotifyJoin(&memberlist.Node{Name: "TestNode_2"})
+		node.events.NotifyLeave(&memberlist.Node{Name: "TestNode_2", Port: 7947})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Logf("Expected events to be deferred or dropped if the queue is full, instead the delegate blocked")
+		t.FailNow()
+	}
+
+	// Join events are dropped while leave events are queued in order once there is room, only
+	// keeping the latest leave event of every member
+	expected := []MemberEvent{
+		{Type: MemberJoin, Member: &Member{Name: "TestNode_2"}},
+		{Type: MemberLeave, Member: &Member{Name: "TestNode_2", Port: 7947}},
+		{Type: MemberLeave, Member: &Member{Name: "TestNode_3"}},
+	}
+	for _, want := range expected {
+		select {
+		case event := <-node.membershipEvents():
+			if event.Member.Name != want.Member.Name || event.Member.Port != want.Member.Port || event.Type != want.Type {
+				t.Logf("Expected event %v of %v, instead got %v of %v", want.Type, want.Member.Name, event.Type, event.Member.Name)
+				t.FailNow()
+			}
+		default:
+			t.Logf("Expected event %v of %v to be queued, instead the queue is empty", want.Type, want.Member.Name)
+			t.FailNow()
+		}
+	}
+	select {
+	case event := <-node.membershipEvents():
+		t.Logf("Expected superseded leave event to be dropped, instead got event %v of %v", event.Type, event.Member.Name)
+		t.FailNow()
+	default:
+	}
+	if metrics := node.GetMetrics(); metrics.EventQueueOverflows != 2 || metrics.SupersededLeaves != 1 {
+		t.Logf("Expected 2 dropped join events and 1 superseded leave event to be counted, instead got %+v", metrics)
+		t.FailNow()
+	}
+}
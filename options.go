@@ -0,0 +1,80 @@
+package raftify
+
+import "log"
+
+// Option is a functional option used to customize a node on initialization.
+type Option func(*Node)
+
+// WithDiscovery adds discovery providers which are queried for peers in addition to the
+// peer_list and the discovery settings of the raftify.json file.
+func WithDiscovery(providers ...Discovery) Option {
+	return func(n *Node) {
+		n.discovery = append(n.discovery, providers...)
+	}
+}
+
+// WithAuditLogger sets the logger security-relevant events are recorded with, e.g. messages
+// rejected because of a forged sender. Unlike the node's logger, it is not filtered by the
+// log_level. Defaults to the node's logger.
+func WithAuditLogger(logger *log.Logger) Option {
+	return func(n *Node) {
+		n.auditLogger = logger
+	}
+}
+
+// WithConflictHandler sets the function that is called whenever two nodes are found claiming
+// the same node ID, e.g. because a node has been started twice with the same raftify.json.
+func WithConflictHandler(handler func(Conflict)) Option {
+	return func(n *Node) {
+		n.conflictHandler = handler
+	}
+}
+
+// WithStateHandler sets the function that is called whenever the node's state or term changes,
+// e.g. to follow elections in tests. It is called by the node's main loop before the node acts
+// in its new state, so it must return quickly. The initial bootstrap state isn't reported.
+func WithStateHandler(handler func(state State, term uint64)) Option {
+	return func(n *Node) {
+		n.stateHandler = handler
+	}
+}
+
+// WithTransport sets the transport the node exchanges messages and learns about cluster
+// membership with. The node ID and the metadata are advertised via Start on initialization,
+// the bind and advertise addresses as well as the encryption and TLS settings of the
+// raftify.json file are left to the transport. Admission isn't checked for custom transports,
+// so the cluster_id and allowlist settings are rejected and duplicate IDs must be prevented by
+// the transport itself. Defaults to a memberlist-based transport.
+func WithTransport(transport Transport) Option {
+	return func(n *Node) {
+		n.network = transport
+	}
+}
+
+// WithClock sets the clock the election timeouts, message intervals, retransmissions and all
+// other deadlines of the election are measured with. Defaults to the system clock.
+func WithClock(clock Clock) Option {
+	return func(n *Node) {
+		n.clock = clock
+	}
+}
+
+// WithRand sets the source the randomized election timeouts are drawn from. Defaults to a source
+// seeded individually for every node from the operating system's random number generator.
+func WithRand(r Rand) Option {
+	return func(n *Node) {
+		n.rand = r
+	}
+}
+
+// WithNetworkFilter sets a function deciding whether packets and streams may be sent to the
+// given host:port address. Traffic to addresses it returns false for is dropped as if the
+// network was partitioned, which applies to raftify's messages as well as memberlist's gossip
+// and failure detection. Incoming traffic isn't filtered. Meant for tests, e.g. to partition
+// a cluster running on the loopback interface. Has no effect if another transport has been
+// passed in with WithTransport.
+func WithNetworkFilter(filter func(addr string) bool) Option {
+	return func(n *Node) {
+		n.networkFilter = filter
+	}
+}
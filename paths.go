@@ -0,0 +1,310 @@
+package raftify
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Maximum number of additional addresses a node can advertise. Keeps the node meta well below
+// memberlist's limit.
+const maxPaths = 4
+
+// Constants for valid path modes.
+const (
+	// Election-critical messages are sent over every path, all others over the preferred
+	// path only.
+	PathModeAll = "all"
+
+	// All messages are sent over the preferred path and only over the others if they
+	// couldn't be sent.
+	PathModeFailover = "failover"
+)
+
+// errDuplicate is returned for messages that have already been received via another path or
+// retransmitted after their ack got lost. They are dropped silently.
+var errDuplicate = errors.New("duplicate message")
+
+// PathsConfig specifies the additional addresses a node is reachable at and how messages are
+// sent to members that are reachable via more than one path. Paths only carry raftify messages,
+// memberlist probes and gossips via the advertise address only.
+type PathsConfig struct {
+	// The additional host:port addresses the node is reachable at besides its
+	// advertise address, e.g. on a second network interface. The node must be
+	// bound to an address they are routed to, usually 0.0.0.0.
+	Addrs []string `json:"addrs"`
+
+	// Either "all" to send heartbeats, prevotes and votes and their responses over
+	// every path or "failover" to send them over the preferred path only. Defaults
+	// to "all".
+	Mode string `json:"mode"`
+}
+
+// setDefaults sets the default values for all path settings left empty.
+func (p *PathsConfig) setDefaults() {
+	if p.Mode == "" {
+		p.Mode = PathModeAll
+	}
+}
+
+// validate checks for constraint violations in the path settings and returns them in the same
+// format as Config.validate.
+func (p *PathsConfig) validate(bindPort int) string {
+	var errs string
+	if len(p.Addrs) > maxPaths {
+		errs += fmt.Sprintf("\tpaths.addrs must not contain more than %v addresses\n", maxPaths)
+	}
+	if len(p.Addrs) > 0 && bindPort == 0 {
+		errs += "\tpaths.addrs must not be set if bind_port is 0\n"
+	}
+	for _, addr := range p.Addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			errs += fmt.Sprintf("\tpath address %v is not a valid host:port address\n", addr)
+			continue
+		}
+		if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+			errs += fmt.Sprintf("\tpath address %v must contain a routable IP address\n", addr)
+		}
+		if portNum, err := strconv.Atoi(port); err != nil || portNum < 1 || portNum > 65535 {
+			errs += fmt.Sprintf("\tpath address %v must contain a port in range 1-65535\n", addr)
+		}
+	}
+	if p.Mode != PathModeAll && p.Mode != PathModeFailover {
+		errs += "\tpaths.mode must be either all or failover\n"
+	}
+	return errs
+}
+
+// PathStatus is the reachability of a cluster member via one of its addresses.
+type PathStatus struct {
+	// The host:port address of the path.
+	Address string
+
+	// The time the last message has been received via the path, zero if none has.
+	LastReceived time.Time
+
+	// Whether a message has been received via the path within the maximum heartbeat
+	// timeout.
+	Reachable bool
+}
+
+// receivedSeq is a message accepted from a sender, used to tell duplicates received via another
+// path from replays.
+type receivedSeq struct {
+	incarnation int64
+	seq         uint64
+	ip          string
+}
+
+// pathTracker keeps track of the paths messages have been received via from every member.
+type pathTracker struct {
+	sync.Mutex
+
+	// The time the last message has been received by member and IP address.
+	lastReceived map[string]map[string]time.Time
+
+	// The last messages accepted from every member, indexed by their sequence number
+	// modulo the replay window size.
+	accepted map[string]*[replayWindowSize]receivedSeq
+}
+
+// memberPaths returns the addresses the member is reachable at, starting with the one it is known
+// by in the memberlist and followed by the additional addresses advertised in its node meta.
+// The returned nodes are copies of the member that only differ in their address.
+func (c *metaCache) memberPaths(member *Member) []*Member {
+	paths := []*Member{member}
+
+	meta, err := c.lookup(member)
+	if err != nil {
+		return paths
+	}
+	for _, addr := range meta.Paths {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		port, err := strconv.Atoi(portStr)
+		if ip == nil || err != nil || (ip.Equal(member.Addr) && uint16(port) == member.Port) {
+			continue
+		}
+
+		path := *member
+		path.Addr, path.Port = ip, uint16(port)
+		paths = append(paths, &path)
+	}
+	return paths
+}
+
+// pathTimeout returns the time after which a path is considered unreachable if no message has
+// been received via it.
+func (n *Node) pathTimeout() time.Duration {
+	return time.Duration(MaxTimeout*n.config.Performance) * time.Millisecond
+}
+
+// routes returns the paths a message of the given type is sent to the member over, the preferred
+// one first. Returns whether it must be sent over all of them. Paths messages have recently been
+// received via are preferred over the others, the address known by the memberlist over the
+// additional ones.
+func (n *Node) routes(member *Member, msgType MessageType) ([]*Member, bool) {
+	paths := n.metas.memberPaths(member)
+	if len(paths) == 1 {
+		return paths, false
+	}
+
+	n.paths.Lock()
+	reachable, unreachable := []*Member{}, []*Member{}
+	for _, path := range paths {
+		if last, ok := n.paths.lastReceived[member.Name][path.Addr.String()]; ok && n.clock.Now().Sub(last) < n.pathTimeout() {
+			reachable = append(reachable, path)
+		} else {
+			unreachable = append(unreachable, path)
+		}
+	}
+	n.paths.Unlock()
+
+	return append(reachable, unreachable...), n.config.Paths.Mode == PathModeAll && msgType.isElectionCritical()
+}
+
+// sendOver sends a message of the given type to the member over its preferred path. If the
+// member is reachable via more than one path, it is also sent over all other paths if required
+// by the path mode or if it couldn't be sent over the preferred one. Returns nil if the message
+// could be sent over any of them.
+func (n *Node) sendOver(member *Member, msgType MessageType, msg []byte, mode DeliveryMode) error {
+	routes, all := n.routes(member, msgType)
+	return n.sendAlternates(routes[1:], all, msg, mode, n.network.Send(routes[0], msg, mode))
+}
+
+// sendAlternates sends a message over the alternate paths of a member after it has been sent
+// over the preferred one with the given result. If all is set, it is sent over every alternate
+// path, otherwise only until it could be sent over one of them. Returns nil if the message could
+// be sent over any path.
+func (n *Node) sendAlternates(alternates []*Member, all bool, msg []byte, mode DeliveryMode, err error) error {
+	for _, path := range alternates {
+		if err == nil && !all {
+			break
+		}
+		if sendErr := n.network.Send(path, msg, mode); sendErr == nil {
+			err = nil
+		}
+	}
+	return err
+}
+
+// isPath checks whether the IP address is one of the member's paths.
+func (c *metaCache) isPath(member *Member, ip net.IP) bool {
+	for _, path := range c.memberPaths(member) {
+		if path.Addr.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// receivedVia records that a message of the member has been received via the IP address and
+// logs if the path has become reachable again.
+func (n *Node) receivedVia(member string, ip net.IP) {
+	n.paths.Lock()
+	defer n.paths.Unlock()
+
+	if n.paths.lastReceived == nil {
+		n.paths.lastReceived = map[string]map[string]time.Time{}
+	}
+	if n.paths.lastReceived[member] == nil {
+		n.paths.lastReceived[member] = map[string]time.Time{}
+	}
+
+	now := n.clock.Now()
+	if last, ok := n.paths.lastReceived[member][ip.String()]; ok && now.Sub(last) >= n.pathTimeout() {
+		n.logger.Printf("[INFO] raftify: %v is reachable via %v again\n", member, ip)
+	}
+	n.paths.lastReceived[member][ip.String()] = now
+}
+
+// acceptPath records a message that has passed all checks so that copies received via other
+// paths are recognized as duplicates.
+func (n *Node) acceptPath(msg Message) {
+	host, _, _ := net.SplitHostPort(msg.from)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return
+	}
+	n.receivedVia(msg.Sender, ip)
+
+	n.paths.Lock()
+	defer n.paths.Unlock()
+
+	if n.paths.accepted == nil {
+		n.paths.accepted = map[string]*[replayWindowSize]receivedSeq{}
+	}
+	window, ok := n.paths.accepted[msg.Sender]
+	if !ok {
+		window = &[replayWindowSize]receivedSeq{}
+		n.paths.accepted[msg.Sender] = window
+	}
+	window[msg.Seq%replayWindowSize] = receivedSeq{incarnation: msg.Incarnation, seq: msg.Seq, ip: ip.String()}
+}
+
+// checkDuplicate returns errDuplicate if the message has already been accepted, e.g. because it
+// has been received via another path of its sender or retransmitted after its ack got lost.
+// Retransmits are acknowledged again. Only copies received via another path than the accepted
+// message mark that path as reachable.
+func (n *Node) checkDuplicate(msg Message) error {
+	if !n.replayGuard.accepted(msg.Sender, msg.Incarnation, msg.Seq) {
+		return nil
+	}
+	atomic.AddUint64(&n.metrics.Duplicates, 1)
+	if msg.AckRequested {
+		n.sendAck(msg)
+	}
+
+	host, _, _ := net.SplitHostPort(msg.from)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errDuplicate
+	}
+
+	n.paths.Lock()
+	var received receivedSeq
+	if window, ok := n.paths.accepted[msg.Sender]; ok {
+		received = window[msg.Seq%replayWindowSize]
+	}
+	n.paths.Unlock()
+
+	if received.seq != msg.Seq || received.incarnation != msg.Incarnation || received.ip == ip.String() {
+		return errDuplicate
+	}
+	if member, err := n.getNodeByName(msg.Sender); err == nil && n.metas.isPath(member, ip) {
+		n.receivedVia(msg.Sender, ip)
+	}
+	return errDuplicate
+}
+
+// pathStatus returns the reachability of every cluster member but the local node via each of
+// its paths by node ID.
+func (n *Node) pathStatus() map[string][]PathStatus {
+	n.paths.Lock()
+	defer n.paths.Unlock()
+
+	now := n.clock.Now()
+	status := map[string][]PathStatus{}
+	for _, member := range n.network.Members() {
+		if member.Name == n.config.ID {
+			continue
+		}
+		for _, path := range n.metas.memberPaths(member) {
+			last := n.paths.lastReceived[member.Name][path.Addr.String()]
+			status[member.Name] = append(status[member.Name], PathStatus{
+				Address:      path.Address(),
+				LastReceived: last,
+				Reachable:    !last.IsZero() && now.Sub(last) < n.pathTimeout(),
+			})
+		}
+	}
+	return status
+}
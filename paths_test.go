@@ -0,0 +1,187 @@
+package raftify
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// pathMember returns a member known by 127.0.0.1:7946 that advertises the given additional paths.
+func pathMember(name string, paths ...string) *Member {
+	meta, _ := json.Marshal(nodeMeta{ProtocolMin: ProtocolVersionMin, ProtocolMax: ProtocolVersionMax, Paths: paths})
+	return &Member{Name: name, Addr: net.ParseIP("127.0.0.1"), Port: 7946, Meta: meta}
+}
+
+func TestValidatePaths(t *testing.T) {
+	valid := PathsConfig{Addrs: []string{"10.0.0.1:7946", "[fd00::1]:7946"}, Mode: PathModeFailover}
+	if errs := valid.validate(7946); errs != "" {
+		t.Logf("Expected path settings to be valid, instead got errors:\n%v", errs)
+		t.FailNow()
+	}
+
+	invalid := PathsConfig{Addrs: []string{"10.0.0.1", "0.0.0.0:7946", "example.com:0"}, Mode: "any"}
+	expected := "\tpaths.addrs must not be set if bind_port is 0\n" +
+		"\tpath address 10.0.0.1 is not a valid host:port address\n" +
+		"\tpath address 0.0.0.0:7946 must contain a routable IP address\n" +
+		"\tpath address example.com:0 must contain a routable IP address\n" +
+		"\tpath address example.com:0 must contain a port in range 1-65535\n" +
+		"\tpaths.mode must be either all or failover\n"
+	if errs := invalid.validate(0); errs != expected {
+		t.Logf("Unexpected validation errors:\n%v", errs)
+		t.FailNow()
+	}
+}
+
+func TestMemberPaths(t *testing.T) {
+	member := pathMember("TestNode", "127.0.0.2:7946", "127.0.0.1:7946", "invalid", "[::1]:8000")
+
+	var metas metaCache
+	var addresses []string
+	for _, path := range metas.memberPaths(member) {
+		if path.Name != "TestNode" {
+			t.Logf("Expected all paths to keep the member's name, instead got %v", path.Name)
+			t.FailNow()
+		}
+		addresses = append(addresses, path.Address())
+	}
+	if expected := []string{"127.0.0.1:7946", "127.0.0.2:7946", "[::1]:8000"}; !reflect.DeepEqual(addresses, expected) {
+		t.Logf("Expected paths %v, instead got %v", expected, addresses)
+		t.FailNow()
+	}
+	if member.Address() != "127.0.0.1:7946" {
+		t.Logf("Expected the member itself to be left untouched, instead got %v", member.Address())
+		t.FailNow()
+	}
+}
+
+func TestSendOverPaths(t *testing.T) {
+	node := initDummyNode("TestNode_1", 1, 2, 0)
+	member := pathMember("TestNode_2", "127.0.0.2:7946")
+
+	transport := newFakeTransport(member)
+	node.network = transport
+
+	sentTo := func() []string {
+		defer func() { transport.sentTo = nil }()
+		return transport.sentTo
+	}
+
+	// Election-critical messages are sent over every path
+	node.config.Paths.Mode = PathModeAll
+	node.send(member, HeartbeatMsg, Heartbeat{Term: 1, Quorum: 1, LeaderID: "TestNode_1"})
+	if sent := sentTo(); !reflect.DeepEqual(sent, []string{"127.0.0.1:7946", "127.0.0.2:7946"}) {
+		t.Logf("Expected heartbeat to be sent over both paths, instead got %v", sent)
+		t.FailNow()
+	}
+	node.send(member, KeyringResponseMsg, KeyringResponse{FollowerID: "TestNode_1"})
+	if sent := sentTo(); !reflect.DeepEqual(sent, []string{"127.0.0.1:7946"}) {
+		t.Logf("Expected keyring response to be sent over the primary path only, instead got %v", sent)
+		t.FailNow()
+	}
+	errs := node.broadcast([]*Member{member}, VoteRequestMsg, VoteRequest{Term: 1, CandidateID: "TestNode_1"})
+	if sent := sentTo(); len(errs) != 0 || !reflect.DeepEqual(sent, []string{"127.0.0.1:7946", "127.0.0.2:7946"}) {
+		t.Logf("Expected vote request to be broadcast over both paths, instead got %v and errors %v", sent, errs)
+		t.FailNow()
+	}
+
+	// Failover only uses the other paths if the preferred one fails
+	node.config.Paths.Mode = PathModeFailover
+	node.send(member, HeartbeatMsg, Heartbeat{Term: 1, Quorum: 1, LeaderID: "TestNode_1"})
+	if sent := sentTo(); !reflect.DeepEqual(sent, []string{"127.0.0.1:7946"}) {
+		t.Logf("Expected heartbeat to be sent over the primary path only, instead got %v", sent)
+		t.FailNow()
+	}
+
+	transport.failing["127.0.0.1:7946"] = true
+	if err := node.send(member, HeartbeatMsg, Heartbeat{Term: 1, Quorum: 1, LeaderID: "TestNode_1"}); err != nil {
+		t.Logf("Expected heartbeat to fail over to the second path, instead got error: %v", err)
+		t.FailNow()
+	}
+	if sent := sentTo(); !reflect.DeepEqual(sent, []string{"127.0.0.2:7946"}) {
+		t.Logf("Expected heartbeat to be sent over the second path, instead got %v", sent)
+		t.FailNow()
+	}
+	delete(transport.failing, "127.0.0.1:7946")
+
+	// Paths messages have recently been received via are preferred
+	node.receivedVia("TestNode_2", net.ParseIP("127.0.0.2"))
+	node.send(member, HeartbeatMsg, Heartbeat{Term: 1, Quorum: 1, LeaderID: "TestNode_1"})
+	if sent := sentTo(); !reflect.DeepEqual(sent, []string{"127.0.0.2:7946"}) {
+		t.Logf("Expected heartbeat to be sent over the reachable path, instead got %v", sent)
+		t.FailNow()
+	}
+
+	// Sending only fails if all paths fail
+	transport.failing["TestNode_2"] = true
+	if err := node.send(member, HeartbeatMsg, Heartbeat{Term: 1, Quorum: 1, LeaderID: "TestNode_1"}); err == nil {
+		t.Logf("Expected sending to fail if all paths fail, instead error was nil")
+		t.FailNow()
+	}
+}
+
+func TestDuplicatePaths(t *testing.T) {
+	sender := initDummyNode("TestNode_1", 1, 2, 0)
+	receiver := initDummyNode("TestNode_2", 1, 2, 0)
+	receiver.network = newFakeTransport(pathMember("TestNode_1", "127.0.0.2:7946"))
+
+	payload := sender.encodeMessageAs(ProtocolVersionMax, "TestNode_2", HeartbeatMsg, Heartbeat{Term: 1, Quorum: 1, LeaderID: "TestNode_1"})
+	receive := func(from string) error {
+		msg, err := receiver.decodeMessage(InboundMessage{From: from, Payload: payload})
+		if err != nil {
+			return err
+		}
+		var content Heartbeat
+		return receiver.decodeContent(msg, &content)
+	}
+
+	if err := receive("127.0.0.1:7946"); err != nil {
+		t.Logf("Expected heartbeat to be accepted via the primary path, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	// Forged copies don't mark the second path as reachable
+	genuine := payload
+	sender.seq--
+	payload = sender.encodeMessageAs(ProtocolVersionMax, "TestNode_2", HeartbeatMsg, Heartbeat{Term: 1, Quorum: 1, LeaderID: "TestNode_3"})
+	if err := receive("127.0.0.2:7946"); err == nil || err == errDuplicate {
+		t.Logf("Expected forged copy to be rejected, instead got error: %v", err)
+		t.FailNow()
+	}
+	if paths := receiver.GetPaths()["TestNode_1"]; len(paths) != 2 || paths[1].Reachable {
+		t.Logf("Expected the second path not to be reachable via a forged copy, instead got %+v", paths)
+		t.FailNow()
+	}
+	payload = genuine
+
+	if err := receive("127.0.0.2:7946"); err != errDuplicate {
+		t.Logf("Expected copy received via the second path to be dropped as duplicate, instead got error: %v", err)
+		t.FailNow()
+	}
+	if err := receive("127.0.0.1:7946"); err != errDuplicate {
+		t.Logf("Expected copy received via the same path to be dropped as duplicate, instead got error: %v", err)
+		t.FailNow()
+	}
+	if err := receive("10.0.0.1:7946"); err == nil || err == errDuplicate {
+		t.Logf("Expected copy received from an unknown address to be rejected, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	if metrics := receiver.GetMetrics(); metrics.Duplicates != 2 || metrics.Replays != 0 || metrics.SourceMismatches != 2 {
+		t.Logf("Expected 2 duplicates, no replays and 2 source mismatches, instead got %+v", metrics)
+		t.FailNow()
+	}
+
+	// Messages sent via the second path are accepted
+	payload = sender.encodeMessageAs(ProtocolVersionMax, "TestNode_2", HeartbeatMsg, Heartbeat{Term: 1, Quorum: 1, LeaderID: "TestNode_1"})
+	if err := receive("127.0.0.2:7946"); err != nil {
+		t.Logf("Expected heartbeat to be accepted via the second path, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	paths := receiver.GetPaths()["TestNode_1"]
+	if len(paths) != 2 || paths[0].Address != "127.0.0.1:7946" || paths[1].Address != "127.0.0.2:7946" || !paths[0].Reachable || !paths[1].Reachable {
+		t.Logf("Expected both paths to be reachable, instead got %+v", paths)
+		t.FailNow()
+	}
+}
@@ -1,15 +1,13 @@
 package raftify
 
-import (
-	"encoding/json"
-)
+import "errors"
 
 // toPreCandidate initiates the transition of a follower into a precandidate.
 func (n *Node) toPreCandidate() {
 	n.logger.Printf("[DEBUG] raftify: Entering precandidate state for term %v", n.currentTerm+1)
 
 	n.resetTimeout()
-	n.preVoteList.reset(n.memberlist.Members())
+	n.preVoteList.reset(n.network.Members())
 	n.preVoteList.remove(n.config.ID) // Self prevote
 	n.state = PreCandidate
 
@@ -18,18 +16,23 @@ func (n *Node) toPreCandidate() {
 
 // runPreCandidate runs the precandidate loop. This function is called within the runLoop function.
 func (n *Node) runPreCandidate() {
+	messages, timeout, events := n.network.Messages(), n.timeoutTimer.C(), n.membershipEvents()
+	n.idle(messages, timeout, events)
+
 	select {
-	case msgBytes := <-n.messages.messageCh:
-		var msg Message
-		if err := json.Unmarshal(msgBytes, &msg); err != nil {
-			n.logger.Printf("[ERR] raftify: error while unmarshaling wrapper message: %v\n", err.Error())
+	case in := <-messages:
+		msg, err := n.decodeMessage(in)
+		if err != nil {
+			n.logger.Printf("[ERR] raftify: %v\n", err.Error())
 			break
 		}
 
 		switch msg.Type {
 		case HeartbeatMsg:
 			var content Heartbeat
-			if err := json.Unmarshal(msg.Content, &content); err != nil {
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
 				n.logger.Printf("[ERR] raftify: error while unmarshaling heartbeat message: %v\n", err.Error())
 				break
 			}
@@ -37,7 +40,9 @@ func (n *Node) runPreCandidate() {
 
 		case PreVoteRequestMsg:
 			var content PreVoteRequest
-			if err := json.Unmarshal(msg.Content, &content); err != nil {
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
 				n.logger.Printf("[ERR] raftify: error while unmarshaling prevote request message: %v\n", err.Error())
 				break
 			}
@@ -45,7 +50,9 @@ func (n *Node) runPreCandidate() {
 
 		case PreVoteResponseMsg:
 			var content PreVoteResponse
-			if err := json.Unmarshal(msg.Content, &content); err != nil {
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
 				n.logger.Printf("[ERR] raftify: error while unmarshaling prevote response message: %v\n", err.Error())
 				break
 			}
@@ -53,7 +60,9 @@ func (n *Node) runPreCandidate() {
 
 		case VoteRequestMsg:
 			var content VoteRequest
-			if err := json.Unmarshal(msg.Content, &content); err != nil {
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
 				n.logger.Printf("[ERR] raftify: error while unmarshaling vote request message: %v\n", err.Error())
 				break
 			}
@@ -61,17 +70,29 @@ func (n *Node) runPreCandidate() {
 
 		case NewQuorumMsg:
 			var content NewQuorum
-			if err := json.Unmarshal(msg.Content, &content); err != nil {
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
 				n.logger.Printf("[ERR] raftify: error while unmarshaling new quorum message: %v\n", err.Error())
 				break
 			}
 			n.handleNewQuorum(content)
 
+		case AckMsg:
+			var content Ack
+			if err := n.decodeContent(msg, &content); errors.Is(err, errDuplicate) {
+				break
+			} else if err != nil {
+				n.logger.Printf("[ERR] raftify: error while unmarshaling ack message: %v\n", err.Error())
+				break
+			}
+			n.handleAck(content)
+
 		default:
 			n.logger.Printf("[WARN] raftify: received %v as precandidate, discarding...\n", msg.Type.toString())
 		}
 
-	case <-n.timeoutTimer.C:
+	case <-timeout:
 		n.logger.Println("[DEBUG] raftify: Election timeout elapsed")
 
 		// This is mainly to initiate a quorum check for single-node clusters since checks
@@ -100,8 +121,11 @@ func (n *Node) runPreCandidate() {
 			n.toRejoin()
 		}
 
-	case <-n.events.eventCh:
-		n.saveState()
+	case event := <-events:
+		n.handleMembershipEvent(event)
+
+	case call := <-n.keyringCh:
+		n.rejectKeyringOp(call)
 
 	case <-n.shutdownCh:
 		n.toPreShutdown()
@@ -14,7 +14,7 @@ func (n *Node) toPreShutdown() {
 
 // runPreShutdown runs the preshutdown loop. This function is called within the runLoop function.
 func (n *Node) runPreShutdown() {
-	newQuorum := math.Ceil(float64(((len(n.memberlist.Members()) - 1) / 2) + 1))
+	newQuorum := math.Ceil(float64(((len(n.network.Members()) - 1) / 2) + 1))
 	membersReached := n.sendNewQuorumToAll(int(newQuorum))
 
 	// Make sure the new quorum can actually be reached after the node leaves
@@ -23,7 +23,7 @@ func (n *Node) runPreShutdown() {
 	}
 
 	// Make sure a node in a single node cluster can leave appropriately
-	if len(n.memberlist.Members()) == 1 {
+	if len(n.network.Members()) == 1 {
 		n.toShutdown()
 	}
 
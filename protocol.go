@@ -0,0 +1,165 @@
+package raftify
+
+import (
+	"fmt"
+)
+
+// Versions of the raftify protocol. Every node advertises the range of versions it speaks in
+// its node meta. Nodes that don't advertise any range only speak protocolJSON.
+const (
+	// All messages are encoded as JSON and carry no protocol version.
+	protocolJSON = 1
+
+	// Messages are encoded as msgpack and carry the protocol version they are encoded with.
+	protocolMsgpack = 2
+
+	// Messages may ask to be acknowledged with an AckMsg.
+	protocolAcks = 3
+
+	// Messages name the node they are sent to, which is covered by their signature.
+	protocolRecipient = 4
+
+	// Adds the keyring and join message types.
+	protocolKeyring = 5
+)
+
+// The range of protocol versions spoken by this version of raftify. Two nodes talk to each other
+// in the highest version both of them speak. Nodes whose ranges don't overlap refuse each other as
+// members.
+const (
+	ProtocolVersionMin = protocolJSON
+	ProtocolVersionMax = protocolKeyring
+)
+
+// ProtocolVersions is the range of protocol versions a cluster member speaks.
+type ProtocolVersions struct {
+	Min int
+	Max int
+}
+
+// protocolVersions returns the range of protocol versions advertised in the node meta. Nodes that
+// don't advertise any range only speak protocolJSON.
+func (m *nodeMeta) protocolVersions() ProtocolVersions {
+	versions := ProtocolVersions{Min: m.ProtocolMin, Max: m.ProtocolMax}
+	if versions.Min == 0 {
+		versions.Min = protocolJSON
+	}
+	if versions.Max == 0 {
+		versions.Max = protocolJSON
+	}
+	return versions
+}
+
+// negotiateVersion returns the highest protocol version spoken by both the local node and a
+// node speaking the given range of versions. Returns an error if there is none.
+func negotiateVersion(peer ProtocolVersions) (int, error) {
+	version := ProtocolVersionMax
+	if peer.Max < version {
+		version = peer.Max
+	}
+	if version < ProtocolVersionMin || version < peer.Min {
+		return 0, fmt.Errorf("speaks protocol versions %v to %v, the local node speaks %v to %v", peer.Min, peer.Max, ProtocolVersionMin, ProtocolVersionMax)
+	}
+	return version, nil
+}
+
+// versionFor returns the protocol version to use for messages sent to the given member. Members
+// whose node meta can't be decoded or that speak no common version are sent the lowest version
+// spoken by the local node. They aren't admitted to the cluster anyway.
+func (c *metaCache) versionFor(member *Member) int {
+	meta, err := c.lookup(member)
+	if err != nil {
+		return ProtocolVersionMin
+	}
+	version, err := negotiateVersion(meta.protocolVersions())
+	if err != nil {
+		return ProtocolVersionMin
+	}
+	return version
+}
+
+// speaksLegacyTransport returns whether the member predates the message transport and exchanges
+// raftify messages as memberlist user messages only. Such members don't advertise any protocol
+// versions in their node meta.
+func (c *metaCache) speaksLegacyTransport(member *Member) bool {
+	meta, err := c.lookup(member)
+	return err == nil && meta.ProtocolMax == 0
+}
+
+// minProtocolVersion returns the protocol version the message type has been introduced in. Nodes
+// don't send messages of a type before every cluster member speaks its version, and reject
+// messages of a type encoded in an older version. Message types added to the protocol later
+// on must return the version they have been added in.
+func (t *MessageType) minProtocolVersion() int {
+	switch *t {
+	case HeartbeatMsg, HeartbeatResponseMsg, PreVoteRequestMsg, PreVoteResponseMsg, VoteRequestMsg, VoteResponseMsg,
+		NewQuorumMsg:
+		return protocolJSON
+	case AckMsg:
+		return protocolAcks
+	case KeyringRequestMsg, KeyringResponseMsg, JoinRequestMsg, JoinResponseMsg:
+		return protocolKeyring
+	default:
+		return ProtocolVersionMax + 1
+	}
+}
+
+// clusterVersion returns the highest protocol version spoken by all cluster members, i.e. the
+// lowest version negotiated with any of them.
+func (n *Node) clusterVersion() int {
+	version := ProtocolVersionMax
+	for _, member := range n.network.Members() {
+		if member.Name == n.config.ID {
+			continue
+		}
+		if memberVersion := n.metas.versionFor(member); memberVersion < version {
+			version = memberVersion
+		}
+	}
+	return version
+}
+
+// checkMessageType returns an error if messages of the given type must not be sent yet because
+// some cluster members don't speak the protocol version it has been introduced in.
+func (n *Node) checkMessageType(msgType MessageType) error {
+	if required, version := msgType.minProtocolVersion(), n.clusterVersion(); version < required {
+		return fmt.Errorf("%v requires protocol version %v but the cluster speaks version %v, upgrade all members first", msgType.toString(), required, version)
+	}
+	return nil
+}
+
+// checkVersion returns an error if a received message has been encoded in a protocol version the
+// local node doesn't speak or that predates its type.
+func checkVersion(msg *Message) error {
+	version := msg.Version
+	if version == 0 {
+		version = protocolJSON
+	}
+	if version < ProtocolVersionMin || version > ProtocolVersionMax {
+		return fmt.Errorf("rejected %v from %v in unsupported protocol version %v", msg.Type.toString(), msg.from, version)
+	}
+	if required := msg.Type.minProtocolVersion(); version < required {
+		return fmt.Errorf("rejected %v from %v in protocol version %v, expected version %v or later", msg.Type.toString(), msg.from, version, required)
+	}
+	if msg.AckRequested && version < protocolAcks {
+		return fmt.Errorf("rejected %v from %v asking for an ack in protocol version %v, expected version %v or later", msg.Type.toString(), msg.from, version, protocolAcks)
+	}
+	if msg.Recipient != "" && version < protocolRecipient {
+		return fmt.Errorf("rejected %v from %v naming its recipient in protocol version %v, expected version %v or later", msg.Type.toString(), msg.from, version, protocolRecipient)
+	}
+	return nil
+}
+
+// protocolMatrix returns the range of protocol versions every cluster member speaks by node ID.
+// Members whose node meta can't be decoded are left out.
+func (n *Node) protocolMatrix() map[string]ProtocolVersions {
+	matrix := map[string]ProtocolVersions{}
+	for _, member := range n.network.Members() {
+		meta, err := n.metas.lookup(member)
+		if err != nil {
+			continue
+		}
+		matrix[member.Name] = meta.protocolVersions()
+	}
+	return matrix
+}
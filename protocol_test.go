@@ -0,0 +1,154 @@
+package raftify
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	var metas metaCache
+	current := &Member{Meta: (&Config{}).encodeNodeMeta()}
+	if version := metas.versionFor(current); version != ProtocolVersionMax {
+		t.Logf("Expected version %v for members speaking the current protocol, instead got %v", ProtocolVersionMax, version)
+		t.FailNow()
+	}
+
+	// Members that predate protocol versions only speak JSON
+	legacy := &Member{Meta: []byte(`{"cluster_id":"mainnet"}`)}
+	if version := metas.versionFor(legacy); version != protocolJSON || versionFormat(version) != formatJSON {
+		t.Logf("Expected JSON for members without protocol version, instead got version %v", version)
+		t.FailNow()
+	}
+	if version := metas.versionFor(&Member{}); version != protocolJSON {
+		t.Logf("Expected JSON for members without node meta, instead got version %v", version)
+		t.FailNow()
+	}
+
+	// Members of later releases talk to the local node in the highest version it speaks
+	if version, err := negotiateVersion(ProtocolVersions{Min: ProtocolVersionMin, Max: ProtocolVersionMax + 1}); err != nil || version != ProtocolVersionMax {
+		t.Logf("Expected version %v, instead got %v and error %v", ProtocolVersionMax, version, err)
+		t.FailNow()
+	}
+	if _, err := negotiateVersion(ProtocolVersions{Min: ProtocolVersionMax + 1, Max: ProtocolVersionMax + 2}); err == nil {
+		t.Logf("Expected members without common protocol version to be rejected, instead error was nil")
+		t.FailNow()
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	for _, version := range []int{0, ProtocolVersionMin, ProtocolVersionMax} {
+		if err := checkVersion(&Message{Type: HeartbeatMsg, Version: version}); err != nil {
+			t.Logf("Expected message in version %v to be accepted, instead got error: %v", version, err)
+			t.FailNow()
+		}
+	}
+	if err := checkVersion(&Message{Type: HeartbeatMsg, Version: ProtocolVersionMax + 1}); err == nil {
+		t.Logf("Expected message in unsupported version to be rejected, instead error was nil")
+		t.FailNow()
+	}
+	if err := checkVersion(&Message{Type: AckMsg, Version: protocolMsgpack}); err == nil {
+		t.Logf("Expected AckMsg predating its protocol version to be rejected, instead error was nil")
+		t.FailNow()
+	}
+	for _, msgType := range []MessageType{KeyringRequestMsg, KeyringResponseMsg, JoinRequestMsg, JoinResponseMsg} {
+		if err := checkVersion(&Message{Type: msgType, Version: protocolRecipient}); err == nil {
+			t.Logf("Expected %v predating its protocol version to be rejected, instead error was nil", msgType.toString())
+			t.FailNow()
+		}
+	}
+	if err := checkVersion(&Message{Type: VoteResponseMsg, Version: protocolMsgpack, AckRequested: true}); err == nil {
+		t.Logf("Expected ack request predating its protocol version to be rejected, instead error was nil")
+		t.FailNow()
+	}
+}
+
+func TestMixedVersionCluster(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(2)
+
+	// node2 pretends to predate protocol versions
+	node1 := initDummyNode("TestNode_1", 1, 2, ports[0])
+	node2 := initDummyNode("TestNode_2", 1, 2, ports[1])
+
+	node1.createMemberlist()
+	defer node1.memberlist.Shutdown()
+	node2.createMemberlist()
+	defer node2.memberlist.Shutdown()
+
+	node2.messages.meta = []byte(`{}`)
+	node2.memberlist.UpdateNode(time.Second)
+
+	if _, err := node2.memberlist.Join([]string{node1.LocalAddr()}); err != nil {
+		t.Logf("Expected node2 to join node1, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	matrix := node1.GetProtocolVersions()
+	if matrix["TestNode_1"] != (ProtocolVersions{ProtocolVersionMin, ProtocolVersionMax}) || matrix["TestNode_2"] != (ProtocolVersions{protocolJSON, protocolJSON}) {
+		t.Logf("Unexpected protocol versions %+v", matrix)
+		t.FailNow()
+	}
+	if version := node1.GetClusterProtocolVersion(); version != protocolJSON {
+		t.Logf("Expected cluster protocol version %v, instead got %v", protocolJSON, version)
+		t.FailNow()
+	}
+
+	// node2 is sent JSON without protocol version
+	member, _ := node1.getNodeByName("TestNode_2")
+	payload := node1.encodeMessageAs(node1.metas.versionFor(member), "TestNode_2", HeartbeatMsg, Heartbeat{Term: 1, Quorum: 2, LeaderID: "TestNode_1"})
+	if formatOf(payload) != formatJSON {
+		t.Logf("Expected JSON message for node2, instead got format %v", formatOf(payload))
+		t.FailNow()
+	}
+	msg, err := node2.decodeMessage(InboundMessage{From: node1.LocalAddr(), Payload: payload})
+	if err != nil || msg.Version != 0 {
+		t.Logf("Expected message without protocol version, instead got version %v and error %v", msg.Version, err)
+		t.FailNow()
+	}
+
+	// Message types the cluster doesn't speak yet are not sent
+	if err := node1.send(member, MessageType(200), Heartbeat{}); err == nil {
+		t.Logf("Expected message type of a later protocol version to be held back, instead error was nil")
+		t.FailNow()
+	}
+	contents := map[MessageType]interface{}{
+		KeyringRequestMsg:  KeyringRequest{RequestID: 1, Op: ListKeysOp, LeaderID: "TestNode_1"},
+		KeyringResponseMsg: KeyringResponse{RequestID: 1, FollowerID: "TestNode_1"},
+		JoinRequestMsg:     JoinRequest{NodeID: "TestNode_1", Address: node1.LocalAddr()},
+		JoinResponseMsg:    JoinResponse{MemberID: "TestNode_1", Admitted: true},
+	}
+	for msgType, content := range contents {
+		if err := node1.send(member, msgType, content); err == nil {
+			t.Logf("Expected %v to be held back from node2, instead error was nil", msgType.toString())
+			t.FailNow()
+		}
+		if errs := node1.broadcast([]*Member{member}, msgType, content); errs["TestNode_2"] == nil {
+			t.Logf("Expected broadcast of %v to be held back from node2, instead error was nil", msgType.toString())
+			t.FailNow()
+		}
+	}
+}
+
+func TestIncompatibleVersion(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(2)
+
+	// node2 pretends to only speak protocol versions the local node doesn't speak yet
+	node1 := initDummyNode("TestNode_1", 1, 2, ports[0])
+	node2 := initDummyNode("TestNode_2", 1, 2, ports[1])
+
+	node1.createMemberlist()
+	defer node1.memberlist.Shutdown()
+	node2.createMemberlist()
+	defer node2.memberlist.Shutdown()
+
+	node2.messages.meta = []byte(fmt.Sprintf(`{"protocol_min":%v,"protocol_max":%v}`, ProtocolVersionMax+1, ProtocolVersionMax+1))
+	node2.memberlist.UpdateNode(time.Second)
+
+	node2.memberlist.Join([]string{node1.LocalAddr()})
+	if num := node1.memberlist.NumMembers(); num != 1 {
+		t.Logf("Expected node1 to refuse node2, instead it has %v members", num)
+		t.FailNow()
+	}
+}
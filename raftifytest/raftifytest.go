@@ -0,0 +1,439 @@
+// Package raftifytest runs raftify clusters on the loopback interface for the tests of
+// applications embedding raftify. Every node is a real node with its own memberlist and
+// working directory, so clusters behave like they do in production. Partitions and crashes are
+// injected by dropping the traffic between nodes, elections are followed via the nodes' state
+// reports and everything is shut down and removed once the test has finished.
+package raftifytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BlockscapeLab/raftify"
+)
+
+// DefaultTimeout is the time WaitForLeader and KillLeader wait for a leader to be elected if
+// no other timeout is set in the options.
+const DefaultTimeout = 10 * time.Second
+
+// Interval in which the nodes' states are checked while waiting for a leader.
+const waitInterval = 10 * time.Millisecond
+
+// Options configures a cluster. Zero values are replaced by their defaults.
+type Options struct {
+	// Called with the raftify.json of every node before it is started, e.g. to change the
+	// delivery settings. The ID, addresses and peers must be left untouched.
+	Configure func(config *raftify.Config)
+
+	// The options every node is initialized with in addition to the cluster's network filter
+	// and state handler, which must not be overridden.
+	NodeOptions []raftify.Option
+
+	// The time WaitForLeader and KillLeader wait for a leader to be elected. Defaults to 10s.
+	Timeout time.Duration
+
+	// The writer the logs of all nodes are written to, prefixed by the node ID. Logs are
+	// discarded if nil.
+	Log io.Writer
+}
+
+// setDefaults sets the default values for all options left empty.
+func (o *Options) setDefaults() {
+	if o.Timeout == 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.Log == nil {
+		o.Log = ioutil.Discard
+	}
+}
+
+// link is the one-way connection between two nodes.
+type link struct {
+	from, to string
+}
+
+// clusterNode is a node of the cluster.
+type clusterNode struct {
+	id   string
+	addr string
+	dir  string
+	node *raftify.Node
+
+	// The state and term last reported by the node. Guarded by the cluster's mutex, like the
+	// flag below.
+	state raftify.State
+	term  uint64
+
+	// Set once the node has been killed.
+	killed bool
+}
+
+// Cluster is a raftify cluster running on the loopback interface. It is shut down once the
+// test it has been created for has finished.
+type Cluster struct {
+	t       testing.TB
+	dir     string
+	timeout time.Duration
+
+	mu      sync.Mutex
+	nodes   []*clusterNode
+	byID    map[string]*clusterNode
+	byAddr  map[string]*clusterNode
+	blocked map[link]bool
+
+	// The nodes that have been observed as leader of each term.
+	leaders map[uint64]map[string]bool
+}
+
+// NewCluster starts a cluster of n nodes and waits for it to be bootstrapped. Nodes are named
+// node-1 to node-N and bound to free ports on 127.0.0.1. Fails the test if the cluster can't be
+// started.
+func NewCluster(t testing.TB, n int, opts Options) *Cluster {
+	t.Helper()
+	opts.setDefaults()
+
+	if n < 1 {
+		t.Logf("Expected the number of nodes to be at least 1, instead got %v", n)
+		t.FailNow()
+	}
+
+	dir, err := ioutil.TempDir("", "raftifytest")
+	if err != nil {
+		t.Logf("Expected working directory to be created, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	c := &Cluster{
+		t:       t,
+		dir:     dir,
+		timeout: opts.Timeout,
+		byID:    map[string]*clusterNode{},
+		byAddr:  map[string]*clusterNode{},
+		blocked: map[link]bool{},
+		leaders: map[uint64]map[string]bool{},
+	}
+	t.Cleanup(c.shutdown)
+
+	ports, err := reservePorts(n)
+	if err != nil {
+		t.Logf("Expected %v ports to be reserved, instead got error: %v", n, err)
+		t.FailNow()
+	}
+
+	peers := []string{}
+	for i := 1; i <= n; i++ {
+		cn := &clusterNode{
+			id:   fmt.Sprintf("node-%v", i),
+			addr: net.JoinHostPort("127.0.0.1", fmt.Sprint(ports[i-1])),
+			dir:  filepath.Join(dir, fmt.Sprintf("node-%v", i)),
+		}
+		c.nodes = append(c.nodes, cn)
+		c.byID[cn.id] = cn
+		c.byAddr[cn.addr] = cn
+		peers = append(peers, cn.addr)
+	}
+
+	if err := c.start(opts, ports, peers); err != nil {
+		t.Logf("Expected cluster to be started, instead got error: %v", err)
+		t.FailNow()
+	}
+	return c
+}
+
+// start writes the raftify.json of every node, initializes all nodes at once and waits until
+// each of them has been bootstrapped.
+func (c *Cluster) start(opts Options, ports []int, peers []string) error {
+	logs := &syncWriter{w: opts.Log}
+	errs := make(chan error, len(c.nodes))
+
+	for i, cn := range c.nodes {
+		config := raftify.Config{
+			ID:          cn.id,
+			MaxNodes:    len(c.nodes),
+			Expect:      len(c.nodes),
+			Performance: 1,
+			LogLevel:    "DEBUG",
+			BindAddr:    "127.0.0.1",
+			BindPort:    ports[i],
+			PeerList:    peers,
+		}
+		if opts.Configure != nil {
+			opts.Configure(&config)
+		}
+		if err := writeConfig(cn.dir, config); err != nil {
+			return err
+		}
+
+		nodeOpts := append([]raftify.Option{
+			raftify.WithNetworkFilter(c.filter(cn)),
+			raftify.WithStateHandler(c.observe(cn)),
+		}, opts.NodeOptions...)
+		logger := log.New(logs, cn.id+" ", 0)
+
+		go func(cn *clusterNode) {
+			node, err := raftify.InitNode(logger, cn.dir, nodeOpts...)
+			if err == nil {
+				c.mu.Lock()
+				cn.node = node
+				c.mu.Unlock()
+			}
+			errs <- err
+		}(cn)
+	}
+
+	var err error
+	for range c.nodes {
+		if nodeErr := <-errs; nodeErr != nil && err == nil {
+			err = nodeErr
+		}
+	}
+	return err
+}
+
+// filter returns the network filter of the node. Traffic is dropped if it is sent by or to a
+// node that has been killed or crosses a partition.
+func (c *Cluster) filter(from *clusterNode) func(addr string) bool {
+	return func(addr string) bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		to, ok := c.byAddr[addr]
+		if !ok {
+			return !from.killed
+		}
+		return !from.killed && !to.killed && !c.blocked[link{from: from.id, to: to.id}]
+	}
+}
+
+// observe returns the state handler of the node which keeps track of its state and records the
+// terms it has led.
+func (c *Cluster) observe(cn *clusterNode) func(state raftify.State, term uint64) {
+	return func(state raftify.State, term uint64) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		cn.state, cn.term = state, term
+		if state != raftify.Leader {
+			return
+		}
+		if c.leaders[term] == nil {
+			c.leaders[term] = map[string]bool{}
+		}
+		c.leaders[term][cn.id] = true
+	}
+}
+
+// node returns the node with the given ID or fails the test if there is none. The cluster's
+// mutex must be held.
+func (c *Cluster) node(id string) *clusterNode {
+	cn, ok := c.byID[id]
+	if !ok {
+		c.t.Logf("Expected %v to be a node of the cluster, instead it is unknown", id)
+		c.t.FailNow()
+	}
+	return cn
+}
+
+// IDs returns the IDs of all nodes.
+func (c *Cluster) IDs() []string {
+	ids := make([]string, 0, len(c.nodes))
+	for _, cn := range c.nodes {
+		ids = append(ids, cn.id)
+	}
+	return ids
+}
+
+// Node returns the raftify node with the given ID.
+func (c *Cluster) Node(id string) *raftify.Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.node(id).node
+}
+
+// Leaders returns the IDs of all nodes that haven't been killed and consider themselves the
+// leader.
+func (c *Cluster) Leaders() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	leaders := []string{}
+	for _, cn := range c.nodes {
+		if !cn.killed && cn.state == raftify.Leader {
+			leaders = append(leaders, cn.id)
+		}
+	}
+	return leaders
+}
+
+// WaitForLeader waits until exactly one of the nodes that haven't been killed considers itself
+// the leader and returns its ID. Fails the test if no single leader has been elected within
+// the timeout.
+func (c *Cluster) WaitForLeader() string {
+	c.t.Helper()
+
+	deadline := time.Now().Add(c.timeout)
+	for {
+		leaders := c.Leaders()
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		if time.Now().After(deadline) {
+			c.t.Logf("Expected a single leader to be elected within %v, instead got %v", c.timeout, leaders)
+			c.t.FailNow()
+		}
+		time.Sleep(waitInterval)
+	}
+}
+
+// Kill cuts the node off from the network as if it had crashed. It neither sends nor receives
+// messages anymore, so that the other nodes lose sight of it once memberlist's failure
+// detection has noticed. Killed nodes stay cut off until the cluster is shut down.
+func (c *Cluster) Kill(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.node(id).killed = true
+}
+
+// KillLeader waits for a leader to be elected, kills it and returns its ID.
+func (c *Cluster) KillLeader() string {
+	c.t.Helper()
+
+	leader := c.WaitForLeader()
+	c.Kill(leader)
+	return leader
+}
+
+// Partition blocks all traffic between the nodes of both groups in both directions. Nodes not
+// listed in either group can still reach every other node.
+func (c *Cluster) Partition(a, b []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, from := range a {
+		for _, to := range b {
+			c.blocked[link{from: c.node(from).id, to: c.node(to).id}] = true
+			c.blocked[link{from: c.node(to).id, to: c.node(from).id}] = true
+		}
+	}
+}
+
+// Heal lifts all partitions. Killed nodes stay cut off.
+func (c *Cluster) Heal() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blocked = map[link]bool{}
+}
+
+// LeadersByTerm returns the IDs of the nodes that have been observed as leader by term.
+func (c *Cluster) LeadersByTerm() map[uint64][]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	leaders := map[uint64][]string{}
+	for term, ids := range c.leaders {
+		for id := range ids {
+			leaders[term] = append(leaders[term], id)
+		}
+		sort.Strings(leaders[term])
+	}
+	return leaders
+}
+
+// AssertOneLeaderPerTerm fails the test if more than one node has been the leader of the same
+// term since the cluster has been started.
+func (c *Cluster) AssertOneLeaderPerTerm() {
+	c.t.Helper()
+
+	for term, leaders := range c.LeadersByTerm() {
+		if len(leaders) > 1 {
+			c.t.Logf("Expected at most one leader per term, instead %v have been leaders of term %v", leaders, term)
+			c.t.FailNow()
+		}
+	}
+}
+
+// shutdown lifts all partitions, revives killed nodes so that they can leave the cluster and
+// shuts down all nodes one after another. Their working directories are removed afterwards.
+func (c *Cluster) shutdown() {
+	c.mu.Lock()
+	c.blocked = map[link]bool{}
+	for _, cn := range c.nodes {
+		cn.killed = false
+	}
+	c.mu.Unlock()
+
+	for _, cn := range c.nodes {
+		c.mu.Lock()
+		node := cn.node
+		c.mu.Unlock()
+
+		if node == nil {
+			continue
+		}
+		if err := node.Shutdown(); err != nil {
+			c.t.Logf("Expected successful shutdown of %v, instead got error: %v", cn.id, err)
+			c.t.Fail()
+		}
+	}
+	os.RemoveAll(c.dir)
+}
+
+// reservePorts returns ports picked by the operating system that are free for both TCP and UDP
+// at the time of reservation.
+func reservePorts(number int) ([]int, error) {
+	var ports []int
+	for attempt := 0; len(ports) < number; attempt++ {
+		if attempt == 10*number {
+			return nil, fmt.Errorf("found only %v free ports", len(ports))
+		}
+
+		tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			continue
+		}
+		port := tcpListener.Addr().(*net.TCPAddr).Port
+
+		udpListener, err := net.ListenPacket("udp", fmt.Sprintf("127.0.0.1:%v", port))
+		if err == nil {
+			udpListener.Close()
+			ports = append(ports, port)
+		}
+		tcpListener.Close()
+	}
+	return ports, nil
+}
+
+// writeConfig writes the raftify.json of a node into its working directory.
+func writeConfig(dir string, config raftify.Config) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "raftify.json"), configJSON, 0644)
+}
+
+// syncWriter serializes the writes of all nodes' loggers to the same writer.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Write implements the io.Writer interface.
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
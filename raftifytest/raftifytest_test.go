@@ -0,0 +1,120 @@
+package raftifytest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/BlockscapeLab/raftify"
+)
+
+func TestKillLeader(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping TestKillLeader in short mode")
+	}
+
+	cluster := NewCluster(t, 3, Options{})
+	leader := cluster.KillLeader()
+
+	// The remaining nodes elect a new leader
+	if newLeader := cluster.WaitForLeader(); newLeader == leader {
+		t.Logf("Expected a new leader to be elected after %v has been killed, instead it is still the leader", leader)
+		t.FailNow()
+	}
+	cluster.AssertOneLeaderPerTerm()
+}
+
+func TestPartition(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping TestPartition in short mode")
+	}
+
+	cluster := NewCluster(t, 5, Options{})
+	leader := cluster.WaitForLeader()
+
+	// The leader is cut off together with one follower, leaving the majority on the other side
+	minority := []string{leader}
+	majority := []string{}
+	for _, id := range cluster.IDs() {
+		if id == leader {
+			continue
+		}
+		if len(minority) < 2 {
+			minority = append(minority, id)
+		} else {
+			majority = append(majority, id)
+		}
+	}
+	cluster.Partition(minority, majority)
+
+	// The old leader steps down once it has lost the majority
+	deadline := time.Now().Add(DefaultTimeout)
+	for leaders := cluster.Leaders(); len(leaders) != 1 || leaders[0] == leader; leaders = cluster.Leaders() {
+		if time.Now().After(deadline) {
+			t.Logf("Expected the majority %v to elect a new leader, instead got %v", majority, leaders)
+			t.FailNow()
+		}
+		time.Sleep(waitInterval)
+	}
+	if newLeader := cluster.WaitForLeader(); newLeader == minority[1] {
+		t.Logf("Expected the new leader to be elected by the majority %v, instead got %v", majority, newLeader)
+		t.FailNow()
+	}
+
+	// After healing, the cluster settles on a single leader again
+	cluster.Heal()
+	cluster.WaitForLeader()
+	cluster.AssertOneLeaderPerTerm()
+}
+
+func TestFilter(t *testing.T) {
+	c := &Cluster{t: t, byID: map[string]*clusterNode{}, byAddr: map[string]*clusterNode{}, blocked: map[link]bool{}}
+	for _, id := range []string{"node-1", "node-2", "node-3"} {
+		cn := &clusterNode{id: id, addr: id + ":7946"}
+		c.nodes = append(c.nodes, cn)
+		c.byID[id], c.byAddr[cn.addr] = cn, cn
+	}
+	reachable := func(from, to string) bool {
+		return c.filter(c.byID[from])(to + ":7946")
+	}
+
+	c.Partition([]string{"node-1"}, []string{"node-2"})
+	if reachable("node-1", "node-2") || reachable("node-2", "node-1") || !reachable("node-1", "node-3") {
+		t.Logf("Expected only the traffic between node-1 and node-2 to be blocked")
+		t.FailNow()
+	}
+
+	c.Kill("node-3")
+	if reachable("node-1", "node-3") || reachable("node-3", "node-2") {
+		t.Logf("Expected all traffic from and to the killed node-3 to be blocked")
+		t.FailNow()
+	}
+
+	// Killed nodes stay cut off after healing
+	c.Heal()
+	if !reachable("node-1", "node-2") || reachable("node-1", "node-3") {
+		t.Logf("Expected node-1 and node-2 to reach each other again while node-3 stays cut off")
+		t.FailNow()
+	}
+}
+
+func TestLeadersByTerm(t *testing.T) {
+	c := &Cluster{t: t, leaders: map[uint64]map[string]bool{}}
+	node1, node2 := &clusterNode{id: "node-1"}, &clusterNode{id: "node-2"}
+	c.nodes = []*clusterNode{node1, node2}
+
+	c.observe(node1)(raftify.Leader, 1)
+	c.observe(node1)(raftify.Follower, 2)
+	c.observe(node2)(raftify.Leader, 2)
+	c.observe(node2)(raftify.Leader, 2)
+
+	leaders := c.LeadersByTerm()
+	if len(leaders) != 2 || !reflect.DeepEqual(leaders[1], []string{"node-1"}) || !reflect.DeepEqual(leaders[2], []string{"node-2"}) {
+		t.Logf("Expected node-1 to have led term 1 and node-2 term 2, instead got %v", leaders)
+		t.FailNow()
+	}
+	if current := c.Leaders(); !reflect.DeepEqual(current, []string{"node-2"}) {
+		t.Logf("Expected node-2 to be the current leader, instead got %v", current)
+		t.FailNow()
+	}
+}
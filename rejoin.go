@@ -14,7 +14,9 @@ func (n *Node) toRejoin() {
 // runRejoin runs the rejoin loop. This function is called within the runLoop function.
 func (n *Node) runRejoin() {
 	// Wait for the timeout timer to elapse
-	<-n.timeoutTimer.C
+	timeout := n.timeoutTimer.C()
+	n.idle(timeout)
+	<-timeout
 
 	// Try rejoining the existing cluster via the peers in the peerlist
 	if err := n.tryJoin(); err != nil {
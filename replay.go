@@ -0,0 +1,177 @@
+package raftify
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+)
+
+// Number of sequence numbers below the highest one received from a sender that are still
+// accepted if they arrive out of order. Older messages are rejected.
+const replayWindowSize = 64
+
+// replayWindow keeps track of the sequence numbers received from a single sender in its
+// current incarnation.
+type replayWindow struct {
+	// The incarnation of the sender, i.e. the time it was started at or, if its clock has
+	// gone backwards since, the incarnation of its previous run plus one.
+	incarnation int64
+
+	// The highest sequence number received.
+	highest uint64
+
+	// Bitmap of the sequence numbers received within the window. Bit i is set if the
+	// sequence number highest-i has been received.
+	seen uint64
+}
+
+// replayGuard keeps track of the replay windows of all senders.
+type replayGuard struct {
+	sync.Mutex
+	windows map[string]*replayWindow
+}
+
+// check verifies that the message with the given incarnation and sequence number from the
+// sender is neither a replay nor stale, and records it as received if so. Messages from a
+// previous incarnation of the sender are rejected once a newer one has been seen.
+func (g *replayGuard) check(sender string, incarnation int64, seq uint64) error {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.windows == nil {
+		g.windows = map[string]*replayWindow{}
+	}
+
+	w, ok := g.windows[sender]
+	if !ok || incarnation > w.incarnation {
+		g.windows[sender] = &replayWindow{incarnation: incarnation, highest: seq, seen: 1}
+		return nil
+	}
+	if incarnation < w.incarnation {
+		return fmt.Errorf("message from previous incarnation %v of %v, current incarnation is %v", incarnation, sender, w.incarnation)
+	}
+
+	switch {
+	case seq > w.highest:
+		if shift := seq - w.highest; shift < replayWindowSize {
+			w.seen = w.seen<<shift | 1
+		} else {
+			w.seen = 1
+		}
+		w.highest = seq
+		return nil
+
+	case w.highest-seq >= replayWindowSize:
+		return fmt.Errorf("stale message %v from %v, latest is %v", seq, sender, w.highest)
+
+	case w.seen&(1<<(w.highest-seq)) != 0:
+		return fmt.Errorf("replayed message %v from %v", seq, sender)
+	}
+
+	w.seen |= 1 << (w.highest - seq)
+	return nil
+}
+
+// accepted checks whether the message with the given incarnation and sequence number from the
+// sender has already been accepted, e.g. because it is retransmitted after its ack got lost.
+func (g *replayGuard) accepted(sender string, incarnation int64, seq uint64) bool {
+	g.Lock()
+	defer g.Unlock()
+
+	w, ok := g.windows[sender]
+	if !ok || incarnation != w.incarnation || seq > w.highest || w.highest-seq >= replayWindowSize {
+		return false
+	}
+	return w.seen&(1<<(w.highest-seq)) != 0
+}
+
+// seed records an incarnation of the sender that has been persisted by a previous run of the
+// local node so that messages of the sender's earlier runs stay rejected. Windows of the same or
+// a later incarnation are kept.
+func (g *replayGuard) seed(sender string, incarnation int64) {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.windows == nil {
+		g.windows = map[string]*replayWindow{}
+	}
+	if w, ok := g.windows[sender]; !ok || incarnation > w.incarnation {
+		g.windows[sender] = &replayWindow{incarnation: incarnation}
+	}
+}
+
+// incarnation returns the latest incarnation received from the sender, 0 if none is known.
+func (g *replayGuard) incarnation(sender string) int64 {
+	g.Lock()
+	defer g.Unlock()
+
+	if w, ok := g.windows[sender]; ok {
+		return w.incarnation
+	}
+	return 0
+}
+
+// Number of content hashes kept per sender predating the message transport.
+const legacyHashLimit = 1024
+
+// legacyWindow keeps track of the messages received from a single sender predating the message
+// transport, which neither numbers its messages nor signs them.
+type legacyWindow struct {
+	// The highest term received.
+	term uint64
+
+	// The hashes of the messages received in the current term in the order they were received.
+	hashes map[[sha256.Size]byte]struct{}
+	order  [][sha256.Size]byte
+}
+
+// legacyGuard keeps track of the legacy windows of all senders predating the message transport.
+type legacyGuard struct {
+	sync.Mutex
+	windows map[string]*legacyWindow
+}
+
+// check verifies that a message from a sender predating the message transport is neither stale
+// nor a replay and records it as received if so. Messages of a term older than the latest one
+// received from the sender are rejected. If the content is unique to a single message, an exact
+// copy of a message received in the current term is rejected as well. The term is ignored for
+// messages that don't carry one.
+func (g *legacyGuard) check(sender string, msgType MessageType, term uint64, hasTerm, unique bool, content []byte) error {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.windows == nil {
+		g.windows = map[string]*legacyWindow{}
+	}
+
+	w, ok := g.windows[sender]
+	if !ok || (hasTerm && term > w.term) {
+		w = &legacyWindow{term: term, hashes: map[[sha256.Size]byte]struct{}{}}
+		g.windows[sender] = w
+	} else if hasTerm && term < w.term {
+		return fmt.Errorf("stale %v of term %v from %v, latest term is %v", msgType.toString(), term, sender, w.term)
+	}
+	if !unique {
+		return nil
+	}
+
+	hash := sha256.Sum256(append([]byte{byte(msgType)}, content...))
+	if _, ok := w.hashes[hash]; ok {
+		return fmt.Errorf("replayed %v from %v", msgType.toString(), sender)
+	}
+	if len(w.order) >= legacyHashLimit {
+		delete(w.hashes, w.order[0])
+		w.order = w.order[1:]
+	}
+	w.hashes[hash] = struct{}{}
+	w.order = append(w.order, hash)
+	return nil
+}
+
+// forget drops the window of a sender, e.g. because it has rejoined after a restart and starts
+// over with its terms.
+func (g *legacyGuard) forget(sender string) {
+	g.Lock()
+	defer g.Unlock()
+	delete(g.windows, sender)
+}
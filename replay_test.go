@@ -0,0 +1,182 @@
+package raftify
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestReplayGuard(t *testing.T) {
+	var guard replayGuard
+
+	// In order
+	for seq := uint64(1); seq <= 3; seq++ {
+		if err := guard.check("TestNode", 1, seq); err != nil {
+			t.Logf("Expected message %v to be accepted, instead got error: %v", seq, err)
+			t.FailNow()
+		}
+	}
+
+	// Replay of the latest and an earlier message
+	for _, seq := range []uint64{3, 2} {
+		if err := guard.check("TestNode", 1, seq); err == nil {
+			t.Logf("Expected replay of message %v to be rejected, instead error was nil", seq)
+			t.FailNow()
+		}
+	}
+
+	// Out of order within the window
+	if err := guard.check("TestNode", 1, 10); err != nil {
+		t.Logf("Expected message 10 to be accepted, instead got error: %v", err)
+		t.FailNow()
+	}
+	if err := guard.check("TestNode", 1, 7); err != nil {
+		t.Logf("Expected delayed message 7 to be accepted, instead got error: %v", err)
+		t.FailNow()
+	}
+	if err := guard.check("TestNode", 1, 7); err == nil {
+		t.Logf("Expected replay of delayed message 7 to be rejected, instead error was nil")
+		t.FailNow()
+	}
+
+	// Accepted messages are recognized, e.g. when they are retransmitted
+	for seq, accepted := range map[uint64]bool{7: true, 10: true, 8: false, 11: false} {
+		if guard.accepted("TestNode", 1, seq) != accepted {
+			t.Logf("Expected message %v to be accepted %v, instead got %v", seq, accepted, !accepted)
+			t.FailNow()
+		}
+	}
+	if guard.accepted("TestNode", 2, 7) {
+		t.Logf("Expected message 7 of another incarnation not to be accepted")
+		t.FailNow()
+	}
+
+	// Outside of the window
+	if err := guard.check("TestNode", 1, 10+replayWindowSize); err != nil {
+		t.Logf("Expected message %v to be accepted, instead got error: %v", 10+replayWindowSize, err)
+		t.FailNow()
+	}
+	if err := guard.check("TestNode", 1, 8); err == nil {
+		t.Logf("Expected stale message 8 to be rejected, instead error was nil")
+		t.FailNow()
+	}
+
+	// Other senders have their own window
+	if err := guard.check("TestNode_2", 1, 1); err != nil {
+		t.Logf("Expected message 1 of another sender to be accepted, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	// Restart of the sender
+	if err := guard.check("TestNode", 2, 1); err != nil {
+		t.Logf("Expected first message of a new incarnation to be accepted, instead got error: %v", err)
+		t.FailNow()
+	}
+	if err := guard.check("TestNode", 1, 100); err == nil {
+		t.Logf("Expected message of the previous incarnation to be rejected, instead error was nil")
+		t.FailNow()
+	}
+}
+
+func TestLegacyGuard(t *testing.T) {
+	var guard legacyGuard
+
+	hb := []byte(`{"term":2,"quorum":2,"heartbeat_id":1,"leader_id":"TestNode"}`)
+	if err := guard.check("TestNode", HeartbeatMsg, 2, true, true, hb); err != nil {
+		t.Logf("Expected heartbeat to be accepted, instead got error: %v", err)
+		t.FailNow()
+	}
+	if err := guard.check("TestNode", HeartbeatMsg, 2, true, true, hb); err == nil {
+		t.Logf("Expected replayed heartbeat to be rejected, instead error was nil")
+		t.FailNow()
+	}
+
+	// Vote requests are resent with the same content
+	vote := []byte(`{"term":2,"candidate_id":"TestNode"}`)
+	for i := 0; i < 2; i++ {
+		if err := guard.check("TestNode", VoteRequestMsg, 2, true, false, vote); err != nil {
+			t.Logf("Expected resent vote request to be accepted, instead got error: %v", err)
+			t.FailNow()
+		}
+	}
+
+	// Messages of earlier terms are stale, messages without term are only checked by content
+	if err := guard.check("TestNode", VoteRequestMsg, 1, true, false, vote); err == nil {
+		t.Logf("Expected vote request of an earlier term to be rejected, instead error was nil")
+		t.FailNow()
+	}
+	quorum := []byte(`{"new_quorum":1,"leaving_id":"TestNode"}`)
+	if err := guard.check("TestNode", NewQuorumMsg, 0, false, true, quorum); err != nil {
+		t.Logf("Expected new quorum to be accepted, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	// The sender starts over once it has rejoined
+	guard.forget("TestNode")
+	if err := guard.check("TestNode", NewQuorumMsg, 0, false, true, quorum); err != nil {
+		t.Logf("Expected new quorum to be accepted after a rejoin, instead got error: %v", err)
+		t.FailNow()
+	}
+	if err := guard.check("TestNode", HeartbeatMsg, 1, true, true, hb); err != nil {
+		t.Logf("Expected heartbeat of an earlier term to be accepted after a rejoin, instead got error: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestDecodeContentReplay(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(2)
+
+	// Initialize and start dummy nodes
+	node1 := initDummyNode("TestNode_1", 1, 2, ports[0])
+	node2 := initDummyNode("TestNode_2", 1, 2, ports[1])
+	node1.incarnation = 1
+
+	node1.createMemberlist()
+	defer node1.memberlist.Shutdown()
+	node2.createMemberlist()
+	defer node2.memberlist.Shutdown()
+
+	node2.memberlist.Join([]string{fmt.Sprintf("127.0.0.1:%v", ports[0])})
+
+	received := InboundMessage{
+		From:    node1.LocalAddr(),
+		Payload: node1.encodeMessage(HeartbeatMsg, Heartbeat{Term: 1, Quorum: 1, LeaderID: "TestNode_1"}),
+	}
+
+	// First receival
+	msg, _ := node2.decodeMessage(received)
+	var content Heartbeat
+	if err := node2.decodeContent(msg, &content); err != nil {
+		t.Logf("Expected heartbeat to be accepted, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	// Repeats of accepted messages are dropped as duplicates
+	msg, _ = node2.decodeMessage(received)
+	if err := node2.decodeContent(msg, &content); err != errDuplicate {
+		t.Logf("Expected repeated heartbeat to be dropped as duplicate, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	// node1 restarts and its new incarnation is seen, then the old heartbeat is replayed
+	node1.incarnation = 2
+	msg, _ = node2.decodeMessage(InboundMessage{
+		From:    node1.LocalAddr(),
+		Payload: node1.encodeMessage(HeartbeatMsg, Heartbeat{Term: 1, Quorum: 1, LeaderID: "TestNode_1"}),
+	})
+	if err := node2.decodeContent(msg, &content); err != nil {
+		t.Logf("Expected heartbeat of the new incarnation to be accepted, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	msg, _ = node2.decodeMessage(received)
+	if err := node2.decodeContent(msg, &content); err == nil {
+		t.Logf("Expected heartbeat of the previous incarnation to be rejected, instead error was nil")
+		t.FailNow()
+	}
+
+	if metrics := node2.GetMetrics(); metrics.Replays != 1 || metrics.Duplicates != 1 {
+		t.Logf("Expected 1 replay and 1 duplicate to be counted, instead got %+v", metrics)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,76 @@
+package raftify
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// Time measured in milliseconds after which the lookup of a single peer hostname is aborted.
+const LookupTimeout = 2000
+
+// Resolver is the interface used to resolve the hostnames of peers into IP addresses.
+// It is satisfied by *net.Resolver.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// resolvePeers resolves all peers passed in into IP addresses in the host:port format.
+// IP addresses are kept as they are, hostnames are looked up every time this method is
+// called so that peers whose IP addresses change are followed. Peers that cannot be
+// resolved are skipped and the local node is filtered out.
+func (n *Node) resolvePeers(peers []string) ([]string, error) {
+	resolver := n.resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	resolved := []string{}
+	seen := map[string]bool{}
+
+	for _, peer := range peers {
+		host, port, err := net.SplitHostPort(peer)
+		if err != nil {
+			n.logger.Printf("[WARN] raftify: skipping peer %v: %v\n", peer, err.Error())
+			continue
+		}
+
+		var ips []string
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []string{ip.String()}
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), LookupTimeout*time.Millisecond)
+			ips, err = resolver.LookupHost(ctx, host)
+			cancel()
+
+			if err != nil {
+				n.logger.Printf("[WARN] raftify: couldn't resolve peer %v: %v\n", peer, err.Error())
+				continue
+			}
+			n.logger.Printf("[DEBUG] raftify: Resolved peer %v to %v\n", peer, ips)
+		}
+
+		for _, ip := range ips {
+			address := net.JoinHostPort(ip, port)
+			if seen[address] || n.isLocalNode(address) {
+				continue
+			}
+			seen[address] = true
+			resolved = append(resolved, address)
+		}
+	}
+
+	if len(resolved) == 0 && len(peers) != 0 {
+		return nil, errors.New("none of the peers could be resolved")
+	}
+	return resolved, nil
+}
+
+// isLocalNode checks whether the resolved host:port address points to the local node.
+func (n *Node) isLocalNode(address string) bool {
+	if n.config.isLocalAddr(address) {
+		return true
+	}
+	return n.network != nil && n.network.LocalMember().Address() == address
+}
@@ -0,0 +1,99 @@
+package raftify
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// staticResolver is a local stand-in for a DNS resolver.
+type staticResolver map[string][]string
+
+// LookupHost implements the Resolver interface.
+func (r staticResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if ips, ok := r[host]; ok {
+		return ips, nil
+	}
+	return nil, fmt.Errorf("no such host %v", host)
+}
+
+func TestResolvePeers(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(1)
+
+	// Initialize dummy node
+	node := initDummyNode("TestNode", 1, 3, ports[0])
+	node.resolver = staticResolver{
+		"node-2.raftify.local": []string{"10.0.0.2"},
+		"node-3.raftify.local": []string{"10.0.0.3", "fd00::3"},
+		"localhost":            []string{"127.0.0.1"},
+	}
+
+	peers, err := node.resolvePeers([]string{
+		"node-2.raftify.local:7946",
+		"node-3.raftify.local:7946",
+		"[::1]:7946",
+		"10.0.0.2:7946", // Duplicate of node-2
+		"unknown.raftify.local:7946",
+		fmt.Sprintf("localhost:%v", ports[0]), // Local node
+	})
+	if err != nil {
+		t.Logf("Expected peers to be resolved, instead got error: %v", err.Error())
+		t.FailNow()
+	}
+
+	expected := []string{"10.0.0.2:7946", "10.0.0.3:7946", "[fd00::3]:7946", "[::1]:7946"}
+	if len(peers) != len(expected) {
+		t.Logf("Expected resolved peers to be %v, instead got %v", expected, peers)
+		t.FailNow()
+	}
+	for i := range expected {
+		if peers[i] != expected[i] {
+			t.Logf("Expected resolved peers to be %v, instead got %v", expected, peers)
+			t.FailNow()
+		}
+	}
+
+	// Peers change their IP addresses
+	node.resolver = staticResolver{
+		"node-2.raftify.local": []string{"10.0.1.2"},
+	}
+
+	peers, err = node.resolvePeers([]string{"node-2.raftify.local:7946"})
+	if err != nil {
+		t.Logf("Expected peers to be resolved, instead got error: %v", err.Error())
+		t.FailNow()
+	}
+	if len(peers) != 1 || peers[0] != "10.0.1.2:7946" {
+		t.Logf("Expected peer to be resolved to its new IP address, instead got %v", peers)
+		t.FailNow()
+	}
+
+	// None of the peers can be resolved
+	if _, err := node.resolvePeers([]string{"unknown.raftify.local:7946"}); err == nil {
+		t.Log("Expected an error if none of the peers can be resolved, instead got nil")
+		t.FailNow()
+	}
+}
+
+func TestTryJoinHostname(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(2)
+
+	// Initialize dummy nodes
+	node1 := initDummyNode("TestNode_1", 1, 2, ports[0])
+	node2 := initDummyNode("TestNode_2", 1, 2, ports[1])
+
+	node2.resolver = staticResolver{"node-1.raftify.local": []string{"127.0.0.1"}}
+	node2.config.PeerList = []string{fmt.Sprintf("node-1.raftify.local:%v", node1.config.BindPort)}
+
+	node1.createMemberlist()
+	defer node1.memberlist.Shutdown()
+	node2.createMemberlist()
+	defer node2.memberlist.Shutdown()
+
+	if err := node2.tryJoin(); err != nil {
+		t.Logf("Expected node2 to join node1 via its hostname, instead got error: %v", err.Error())
+		t.FailNow()
+	}
+}
@@ -0,0 +1,127 @@
+package raftify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// Time measured in milliseconds after which the command configured in encrypt_command is
+// killed if it hasn't returned the encryption key yet.
+const EncryptCommandTimeout = 10000
+
+// keySources returns the names of all sources configured for the encryption key.
+func (c *Config) keySources() []string {
+	sources := []string{}
+	if c.Encrypt != "" {
+		sources = append(sources, "encrypt")
+	}
+	if c.EncryptFile != "" {
+		sources = append(sources, "encrypt_file")
+	}
+	if c.EncryptEnv != "" {
+		sources = append(sources, "encrypt_env")
+	}
+	if len(c.EncryptCommand) != 0 {
+		sources = append(sources, "encrypt_command")
+	}
+	return sources
+}
+
+// loadSecretKey reads the encryption key from the source configured in the raftify.json.
+// Returns nil if encryption is disabled. The key itself is never part of the error messages
+// returned.
+func (c *Config) loadSecretKey(workingDir string) ([]byte, error) {
+	var hexKey, source string
+
+	switch {
+	case c.Encrypt != "":
+		hexKey, source = c.Encrypt, "encrypt"
+
+	case c.EncryptFile != "":
+		path := c.EncryptFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(workingDir, path)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read encrypt_file: %v", err)
+		}
+		if perm := info.Mode().Perm(); perm&0077 != 0 {
+			return nil, fmt.Errorf("encrypt_file %v must not be accessible by group or others: got permissions %04o, expected 0600 or 0400", path, perm)
+		}
+
+		keyBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read encrypt_file: %v", err)
+		}
+		hexKey, source = string(keyBytes), "encrypt_file"
+
+	case c.EncryptEnv != "":
+		value, ok := os.LookupEnv(c.EncryptEnv)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("environment variable %v set in encrypt_env is empty or not set", c.EncryptEnv)
+		}
+		hexKey, source = value, "encrypt_env"
+
+	case len(c.EncryptCommand) != 0:
+		ctx, cancel := context.WithTimeout(context.Background(), EncryptCommandTimeout*time.Millisecond)
+		defer cancel()
+
+		var stdout bytes.Buffer
+		cmd := exec.CommandContext(ctx, c.EncryptCommand[0], c.EncryptCommand[1:]...)
+		cmd.Dir = workingDir
+		cmd.Stdout = &stdout
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("encrypt_command %v failed: %v", c.EncryptCommand[0], err)
+		}
+		hexKey, source = stdout.String(), "encrypt_command"
+
+	default:
+		return nil, nil
+	}
+
+	secretKey, err := hexToByte(strings.TrimSpace(hexKey))
+	if err != nil {
+		return nil, fmt.Errorf("%v does not contain a valid hex-encoded key", source)
+	}
+	if err := memberlist.ValidateKey(secretKey); err != nil {
+		return nil, fmt.Errorf("%v must contain a key of length 16, 24 or 32 bytes: got %v bytes", source, len(secretKey))
+	}
+	return secretKey, nil
+}
+
+// sameKeySource checks whether the encryption key is loaded from the same source as in the
+// other config.
+func (c *Config) sameKeySource(other *Config) bool {
+	if len(c.EncryptCommand) != len(other.EncryptCommand) {
+		return false
+	}
+	for i := range c.EncryptCommand {
+		if c.EncryptCommand[i] != other.EncryptCommand[i] {
+			return false
+		}
+	}
+	return c.Encrypt == other.Encrypt && c.EncryptFile == other.EncryptFile && c.EncryptEnv == other.EncryptEnv
+}
+
+// validateKeySources checks that at most one source is configured for the encryption key
+// and returns the violations in the same format as Config.validate.
+func (c *Config) validateKeySources() string {
+	if sources := c.keySources(); len(sources) > 1 {
+		return fmt.Sprintf("\tonly one of encrypt, encrypt_file, encrypt_env and encrypt_command may be set: got %v\n", strings.Join(sources, ", "))
+	}
+	if len(c.EncryptCommand) != 0 && c.EncryptCommand[0] == "" {
+		return "\tencrypt_command must start with the command to run\n"
+	}
+	return ""
+}
@@ -0,0 +1,130 @@
+package raftify
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testHexKey = "8ba4770b00f703fcc9e7d94f857db0e76fd53178d3d55c3e600a9f0fda9a75ad"
+
+func TestLoadSecretKey(t *testing.T) {
+	expected, _ := hexToByte(testHexKey)
+
+	// Encryption disabled
+	if key, err := (&Config{}).loadSecretKey(""); err != nil || key != nil {
+		t.Logf("Expected no key and no error without encryption, instead got key of %v bytes and error %v", len(key), err)
+		t.FailNow()
+	}
+
+	// Inline key
+	if key, err := (&Config{Encrypt: testHexKey}).loadSecretKey(""); err != nil || !bytes.Equal(key, expected) {
+		t.Logf("Expected inline key to be loaded, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	// Key file
+	dir, _ := ioutil.TempDir("", "raftify-secret")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/raftify.key", []byte(testHexKey+"\n"), 0600)
+
+	if key, err := (&Config{EncryptFile: "raftify.key"}).loadSecretKey(dir); err != nil || !bytes.Equal(key, expected) {
+		t.Logf("Expected key to be loaded from file, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	// Key file with permissions too open
+	os.Chmod(dir+"/raftify.key", 0644)
+	if _, err := (&Config{EncryptFile: "raftify.key"}).loadSecretKey(dir); err == nil {
+		t.Log("Expected key file readable by others to be rejected, instead it was loaded")
+		t.FailNow()
+	}
+
+	// Environment variable
+	os.Setenv("RAFTIFY_TEST_KEY", testHexKey)
+	defer os.Unsetenv("RAFTIFY_TEST_KEY")
+
+	if key, err := (&Config{EncryptEnv: "RAFTIFY_TEST_KEY"}).loadSecretKey(""); err != nil || !bytes.Equal(key, expected) {
+		t.Logf("Expected key to be loaded from environment, instead got error: %v", err)
+		t.FailNow()
+	}
+	if _, err := (&Config{EncryptEnv: "RAFTIFY_TEST_KEY_UNSET"}).loadSecretKey(""); err == nil {
+		t.Log("Expected unset environment variable to be rejected, instead it was accepted")
+		t.FailNow()
+	}
+
+	// Command
+	if key, err := (&Config{EncryptCommand: []string{"echo", testHexKey}}).loadSecretKey(dir); err != nil || !bytes.Equal(key, expected) {
+		t.Logf("Expected key to be loaded from command, instead got error: %v", err)
+		t.FailNow()
+	}
+	if _, err := (&Config{EncryptCommand: []string{"false"}}).loadSecretKey(dir); err == nil {
+		t.Log("Expected failing command to be rejected, instead it was accepted")
+		t.FailNow()
+	}
+
+	// Invalid key length must not leak the key into the error message
+	_, err := (&Config{EncryptCommand: []string{"echo", "abcdef0123"}}).loadSecretKey(dir)
+	if err == nil {
+		t.Log("Expected key of invalid length to be rejected, instead it was accepted")
+		t.FailNow()
+	}
+	if strings.Contains(err.Error(), "abcdef0123") {
+		t.Logf("Expected error message not to contain the key, instead got: %v", err.Error())
+		t.FailNow()
+	}
+}
+
+func TestReloadSecretKey(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "raftify-secret")
+	defer os.RemoveAll(dir)
+
+	// The command counts how often it has been run
+	node := initDummyNode("TestNode", 1, 1, 0)
+	node.workingDir = dir
+	node.config.EncryptCommand = []string{"sh", "-c", "echo >> runs; echo " + testHexKey}
+	genConfig(node)
+
+	runs := func() int {
+		output, _ := ioutil.ReadFile(dir + "/runs")
+		return len(output)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := node.loadConfig(false); err != nil || len(node.secretKey) == 0 {
+			t.Logf("Expected key to be loaded, instead got error: %v", err)
+			t.FailNow()
+		}
+	}
+	if runs() != 1 {
+		t.Logf("Expected encrypt_command to be run once for an unchanged source, instead it was run %v times", runs())
+		t.FailNow()
+	}
+
+	// A changed source is loaded again
+	previous := *node.config
+	node.config.EncryptCommand = append(node.config.EncryptCommand, "changed")
+	genConfig(node)
+	node.config = &previous
+	if err := node.loadConfig(false); err != nil || runs() != 2 {
+		t.Logf("Expected encrypt_command to be run again after it has changed, instead got %v runs and error: %v", runs(), err)
+		t.FailNow()
+	}
+}
+
+func TestValidateKeySources(t *testing.T) {
+	if errs := (&Config{EncryptEnv: "RAFTIFY_KEY"}).validateKeySources(); errs != "" {
+		t.Logf("Expected a single key source to be valid, instead got: %v", errs)
+		t.Fail()
+	}
+	if errs := (&Config{Encrypt: testHexKey, EncryptFile: "raftify.key"}).validateKeySources(); errs == "" {
+		t.Log("Expected multiple key sources to be invalid, instead they passed as valid")
+		t.Fail()
+	}
+	if errs := (&Config{EncryptCommand: []string{""}}).validateKeySources(); errs == "" {
+		t.Log("Expected empty command to be invalid, instead it passed as valid")
+		t.Fail()
+	}
+}
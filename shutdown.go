@@ -15,12 +15,13 @@ func (n *Node) toShutdown() {
 // and shuts down the node eventually.
 func (n *Node) runShutdown() {
 	n.deleteState()
+	n.stopAcks()
 
 	var errs string
-	if err := n.memberlist.Leave(0); err != nil {
+	if err := n.network.Leave(0); err != nil {
 		errs += fmt.Sprintf("\t%v\n", err)
 	}
-	if err := n.memberlist.Shutdown(); err != nil {
+	if err := n.network.Shutdown(); err != nil {
 		errs += fmt.Sprintf("\t%v\n", err)
 	}
 
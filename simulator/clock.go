@@ -0,0 +1,271 @@
+package simulator
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/BlockscapeLab/raftify"
+)
+
+// event is an action scheduled on the virtual clock, e.g. the delivery of a message or the
+// firing of a timer.
+type event struct {
+	at  time.Time
+	seq uint64
+
+	// The node the action is performed on, nil for scripted actions.
+	node *simNode
+
+	// Set if the event has been cancelled before it was due, e.g. by stopping its timer.
+	cancelled bool
+
+	// Set for the firings of timers and tickers. They are held back while their node is
+	// crashed instead of being discarded like messages.
+	timer bool
+
+	// Set for functions called on behalf of the node, e.g. retransmissions. They are called
+	// by the simulation itself, so the node doesn't have to pick them up.
+	inline bool
+
+	action func()
+}
+
+// eventQueue orders events by the time they are due. Events due at the same time are performed
+// in the order they have been scheduled in.
+type eventQueue []*event
+
+// Len implements the heap.Interface.
+func (q eventQueue) Len() int { return len(q) }
+
+// Less implements the heap.Interface.
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at.Before(q[j].at)
+}
+
+// Swap implements the heap.Interface.
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+// Push implements the heap.Interface.
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(*event)) }
+
+// Pop implements the heap.Interface.
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// virtualClock is the clock shared by all nodes of a simulation. Time only passes when the
+// simulation performs the next scheduled event.
+type virtualClock struct {
+	sync.Mutex
+	now   time.Time
+	seq   uint64
+	queue eventQueue
+}
+
+// Now returns the current virtual time.
+func (c *virtualClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// schedule schedules the action to be performed on the node after the given duration.
+func (c *virtualClock) schedule(d time.Duration, node *simNode, action func()) *event {
+	c.Lock()
+	defer c.Unlock()
+	return c.scheduleLocked(c.now.Add(d), node, action)
+}
+
+// scheduleLocked schedules the action to be performed on the node at the given time. The clock
+// must be locked.
+func (c *virtualClock) scheduleLocked(at time.Time, node *simNode, action func()) *event {
+	c.seq++
+	e := &event{at: at, seq: c.seq, node: node, action: action}
+	heap.Push(&c.queue, e)
+	return e
+}
+
+// next removes the next event that is due at or before the given time from the queue and
+// advances the clock to the time it is due. Returns nil if there is none.
+func (c *virtualClock) next(until time.Time) *event {
+	c.Lock()
+	defer c.Unlock()
+
+	for len(c.queue) > 0 {
+		e := c.queue[0]
+		if e.at.After(until) {
+			return nil
+		}
+		heap.Pop(&c.queue)
+		if e.cancelled {
+			continue
+		}
+		c.now = e.at
+		return e
+	}
+	return nil
+}
+
+// requeue schedules events that have been held back to be performed right away.
+func (c *virtualClock) requeue(events []*event) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, e := range events {
+		c.seq++
+		e.at, e.seq = c.now, c.seq
+		heap.Push(&c.queue, e)
+	}
+}
+
+// advance moves the clock forward to the given time once all events due until then have been
+// performed.
+func (c *virtualClock) advance(to time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	if to.After(c.now) {
+		c.now = to
+	}
+}
+
+// nodeClock is the raftify.Clock passed to a single node. Timers and tickers created by it fire
+// on the virtual clock, and the node tells it whenever it waits for its next event.
+type nodeClock struct {
+	clock *virtualClock
+	node  *simNode
+}
+
+// Now implements the raftify.Clock interface.
+func (c *nodeClock) Now() time.Time {
+	return c.clock.Now()
+}
+
+// Idle implements the raftify.Idler interface.
+func (c *nodeClock) Idle(chans ...interface{}) {
+	c.node.idle(chans)
+}
+
+// NewTimer implements the raftify.Clock interface.
+func (c *nodeClock) NewTimer(d time.Duration) raftify.Timer {
+	t := &timer{clock: c.clock, node: c.node, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// NewTicker implements the raftify.Clock interface.
+func (c *nodeClock) NewTicker(d time.Duration) raftify.Ticker {
+	t := &timer{clock: c.clock, node: c.node, c: make(chan time.Time, 1), period: d}
+	t.Reset(d)
+	return ticker{timer: t}
+}
+
+// AfterFunc implements the raftify.Clock interface. The function is called by the goroutine
+// running the simulation once the timer fires.
+func (c *nodeClock) AfterFunc(d time.Duration, f func()) raftify.Timer {
+	t := &timer{clock: c.clock, node: c.node, f: f}
+	t.Reset(d)
+	return t
+}
+
+// timer implements the raftify.Timer interface on the virtual clock. Like with the time package,
+// a tick is dropped if the previous one hasn't been received yet.
+type timer struct {
+	clock  *virtualClock
+	node   *simNode
+	c      chan time.Time
+	period time.Duration
+
+	// The function called instead of delivering the time on the channel, nil for timers
+	// and tickers.
+	f func()
+
+	// The pending firing, nil if the timer is stopped. Guarded by the clock's mutex.
+	pending *event
+}
+
+// C implements the raftify.Timer interface.
+func (t *timer) C() <-chan time.Time {
+	return t.c
+}
+
+// Reset implements the raftify.Timer interface.
+func (t *timer) Reset(d time.Duration) bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+
+	active := t.stopLocked()
+	t.scheduleLocked(t.clock.now.Add(d))
+	return active
+}
+
+// Stop implements the raftify.Timer interface.
+func (t *timer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	return t.stopLocked()
+}
+
+// stopLocked cancels the pending firing. The clock must be locked.
+func (t *timer) stopLocked() bool {
+	if t.pending == nil {
+		return false
+	}
+	t.pending.cancelled = true
+	t.pending = nil
+	return true
+}
+
+// scheduleLocked schedules the next firing at the given time. The clock must be locked.
+func (t *timer) scheduleLocked(at time.Time) {
+	var e *event
+	e = t.clock.scheduleLocked(at, t.node, func() {
+		t.fire(e)
+	})
+	e.timer, e.inline = true, t.f != nil
+	t.pending = e
+}
+
+// fire delivers the time on the timer's channel and schedules the next tick of tickers.
+func (t *timer) fire(e *event) {
+	t.clock.Lock()
+	if t.pending != e {
+		t.clock.Unlock()
+		return
+	}
+	t.pending = nil
+	if t.period > 0 {
+		t.scheduleLocked(e.at.Add(t.period))
+	}
+	t.clock.Unlock()
+
+	if t.f != nil {
+		t.f()
+		return
+	}
+	t.node.deliver(t.C(), func() bool {
+		select {
+		case t.c <- e.at:
+			return true
+		default:
+			return false
+		}
+	})
+}
+
+// ticker implements the raftify.Ticker interface on the virtual clock. It is a timer that is
+// rescheduled every time it fires.
+type ticker struct {
+	*timer
+}
+
+// Stop implements the raftify.Ticker interface.
+func (t ticker) Stop() {
+	t.timer.Stop()
+}
@@ -0,0 +1,56 @@
+package simulator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVirtualClock(t *testing.T) {
+	clock := &virtualClock{now: epoch}
+	node := &simNode{id: "node-1"}
+	nodeClock := &nodeClock{clock: clock, node: node}
+
+	timer := nodeClock.NewTimer(300 * time.Millisecond)
+	ticker := nodeClock.NewTicker(100 * time.Millisecond)
+	stopped := nodeClock.NewTimer(50 * time.Millisecond)
+	stopped.Stop()
+
+	// Events due at the same time are performed in the order they have been scheduled in
+	var fired []time.Duration
+	for e := clock.next(epoch.Add(time.Second)); e != nil; e = clock.next(epoch.Add(time.Second)) {
+		e.action()
+		select {
+		case at := <-timer.C():
+			fired = append(fired, at.Sub(epoch))
+		case at := <-ticker.C():
+			fired = append(fired, at.Sub(epoch))
+			if at.Sub(epoch) == 300*time.Millisecond {
+				ticker.Stop()
+			}
+		case <-stopped.C():
+			t.Logf("Expected stopped timer not to fire")
+			t.FailNow()
+		}
+	}
+
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}
+	if len(fired) != len(expected) {
+		t.Logf("Expected timers to fire at %v, instead got %v", expected, fired)
+		t.FailNow()
+	}
+	for i := range expected {
+		if fired[i] != expected[i] {
+			t.Logf("Expected timers to fire at %v, instead got %v", expected, fired)
+			t.FailNow()
+		}
+	}
+
+	if now := clock.Now(); !now.Equal(epoch.Add(300 * time.Millisecond)) {
+		t.Logf("Expected clock to stop at the last event, instead got %v", now.Sub(epoch))
+		t.FailNow()
+	}
+	if timer.Reset(time.Second) {
+		t.Logf("Expected fired timer to be inactive")
+		t.FailNow()
+	}
+}
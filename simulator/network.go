@@ -0,0 +1,336 @@
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/BlockscapeLab/raftify"
+)
+
+// The port every simulated node is bound to.
+const simPort = 7946
+
+// The capacity of the message and event queues of every simulated node.
+const queueSize = 1024
+
+// errShutdown is returned by transports that have already been shut down.
+var errShutdown = errors.New("transport has been shut down")
+
+// link is the one-way connection between two nodes.
+type link struct {
+	from, to string
+}
+
+// transport is the in-memory raftify.Transport of a simulated node. Messages are delivered via
+// the simulation's clock after a random latency. Membership is tracked per node, so that nodes
+// on different sides of a partition lose sight of each other like they would with memberlist.
+type transport struct {
+	sim  *Simulation
+	node *simNode
+
+	local    *raftify.Member
+	messages chan raftify.InboundMessage
+	events   chan raftify.MemberEvent
+
+	// The members the node currently knows of by node ID, including itself. Guarded by the
+	// simulation's mutex, like the flags below.
+	members map[string]*raftify.Member
+
+	// Set once the transport has been started, has joined a cluster, has left it or has been
+	// shut down.
+	started, joined, left, shutdown bool
+}
+
+// newTransport creates the transport of the node.
+func newTransport(sim *Simulation, node *simNode) *transport {
+	return &transport{
+		sim:      sim,
+		node:     node,
+		messages: make(chan raftify.InboundMessage, queueSize),
+		events:   make(chan raftify.MemberEvent, queueSize),
+		members:  map[string]*raftify.Member{},
+	}
+}
+
+// Start implements the raftify.Transport interface.
+func (t *transport) Start(id string, meta []byte) error {
+	t.sim.mu.Lock()
+	defer t.sim.mu.Unlock()
+
+	t.local = &raftify.Member{Name: id, Addr: net.ParseIP(t.node.ip), Port: simPort, Meta: meta}
+	t.members[id] = t.local
+	t.started = true
+	return nil
+}
+
+// LocalMember implements the raftify.Transport interface.
+func (t *transport) LocalMember() *raftify.Member {
+	return t.local
+}
+
+// Members implements the raftify.Transport interface. Members are sorted by node ID so that
+// messages are always sent in the same order.
+func (t *transport) Members() []*raftify.Member {
+	t.sim.mu.Lock()
+	defer t.sim.mu.Unlock()
+	return sortedMembers(t.members)
+}
+
+// Join implements the raftify.Transport interface. The node learns about all members known by
+// the peers it can reach and vice versa.
+func (t *transport) Join(addresses []string) (int, error) {
+	t.sim.mu.Lock()
+	defer t.sim.mu.Unlock()
+
+	if t.shutdown {
+		return 0, errShutdown
+	}
+	if t.sim.closing {
+		return 1, nil
+	}
+
+	reached := 0
+	for _, address := range addresses {
+		peer := t.sim.byAddr[address]
+		if peer == nil || peer == t.node || !t.sim.reachable(t.node, peer) {
+			continue
+		}
+		reached++
+
+		for _, member := range sortedMembers(peer.transport.members) {
+			if other := t.sim.byID[member.Name]; other != nil && t.sim.reachable(t.node, other) {
+				t.sim.connect(t.node, other)
+			}
+		}
+	}
+	if reached == 0 {
+		return 0, fmt.Errorf("none of the %v peers could be reached", len(addresses))
+	}
+	return reached, nil
+}
+
+// Send implements the raftify.Transport interface.
+func (t *transport) Send(member *raftify.Member, msg []byte, mode raftify.DeliveryMode) error {
+	return t.sim.send(t.node, member.Address(), msg, mode)
+}
+
+// Broadcast implements the raftify.Transport interface.
+func (t *transport) Broadcast(members []*raftify.Member, msg []byte, mode raftify.DeliveryMode) map[string]error {
+	errs := map[string]error{}
+	for _, member := range members {
+		if err := t.Send(member, msg, mode); err != nil {
+			errs[member.Name] = err
+		}
+	}
+	return errs
+}
+
+// Messages implements the raftify.Transport interface.
+func (t *transport) Messages() <-chan raftify.InboundMessage {
+	return t.messages
+}
+
+// Events implements the raftify.Transport interface.
+func (t *transport) Events() <-chan raftify.MemberEvent {
+	return t.events
+}
+
+// Leave implements the raftify.Transport interface. The leave is announced to all members
+// that can still be reached, the others notice it once the failure detection has elapsed.
+func (t *transport) Leave(timeout time.Duration) error {
+	t.sim.mu.Lock()
+	defer t.sim.mu.Unlock()
+
+	for _, other := range t.sim.nodes {
+		if other != t.node && t.sim.reachable(t.node, other) {
+			t.sim.disconnect(other, t.node)
+		}
+	}
+	t.left = true
+
+	if !t.sim.closing {
+		t.sim.clock.schedule(t.sim.failureDetection, nil, t.sim.detectFailures)
+	}
+	return nil
+}
+
+// Shutdown implements the raftify.Transport interface.
+func (t *transport) Shutdown() error {
+	t.sim.mu.Lock()
+	defer t.sim.mu.Unlock()
+
+	t.shutdown = true
+	t.node.stop()
+	return nil
+}
+
+// sortedMembers returns the members sorted by node ID.
+func sortedMembers(members map[string]*raftify.Member) []*raftify.Member {
+	sorted := make([]*raftify.Member, 0, len(members))
+	for _, member := range members {
+		sorted = append(sorted, member)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// alive checks whether the node is running and part of the cluster. The simulation's mutex
+// must be held.
+func (s *Simulation) alive(n *simNode) bool {
+	return n.transport.started && !n.transport.left && !n.transport.shutdown && !n.crashed
+}
+
+// reachable checks whether messages can currently be sent from one node to the other. The
+// simulation's mutex must be held.
+func (s *Simulation) reachable(from, to *simNode) bool {
+	return s.alive(from) && s.alive(to) && !s.blocked[link{from: from.id, to: to.id}]
+}
+
+// connect makes two nodes aware of each other and notifies them about the join of the other
+// one. The simulation's mutex must be held.
+func (s *Simulation) connect(a, b *simNode) {
+	if a == b {
+		return
+	}
+	a.transport.joined, b.transport.joined = true, true
+
+	for _, pair := range [][2]*simNode{{a, b}, {b, a}} {
+		local, other := pair[0], pair[1]
+		if _, ok := local.transport.members[other.id]; ok {
+			continue
+		}
+		member := other.transport.local
+		local.transport.members[other.id] = member
+		s.notify(local, raftify.MemberEvent{Type: raftify.MemberJoin, Member: member})
+	}
+}
+
+// disconnect removes the other node from the local node's members and notifies it about the
+// leave. The simulation's mutex must be held.
+func (s *Simulation) disconnect(local, other *simNode) {
+	member, ok := local.transport.members[other.id]
+	if !ok {
+		return
+	}
+	delete(local.transport.members, other.id)
+	s.notify(local, raftify.MemberEvent{Type: raftify.MemberLeave, Member: member})
+}
+
+// notify schedules the delivery of a membership event to the node. The simulation's mutex must
+// be held.
+func (s *Simulation) notify(n *simNode, e raftify.MemberEvent) {
+	if s.closing {
+		return
+	}
+	s.clock.schedule(0, n, func() {
+		n.deliver(n.transport.Events(), func() bool {
+			select {
+			case n.transport.events <- e:
+				return true
+			default:
+				return false
+			}
+		})
+	})
+}
+
+// send schedules the delivery of a message to the node bound to the address after a random
+// latency. Best effort messages are dropped at the configured rate and silently lost if the
+// receiver can't be reached, while reliable ones fail.
+func (s *Simulation) send(from *simNode, address string, msg []byte, mode raftify.DeliveryMode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if from.transport.shutdown {
+		return errShutdown
+	}
+	if s.closing {
+		return nil
+	}
+
+	to := s.byAddr[address]
+	if to == nil {
+		return fmt.Errorf("no node is bound to %v", address)
+	}
+	if !s.reachable(from, to) {
+		if mode == raftify.Reliable {
+			return fmt.Errorf("%v is unreachable", address)
+		}
+		return nil
+	}
+	if mode == raftify.BestEffort && s.dropRate > 0 && s.rand.Float64() < s.dropRate {
+		s.dropped++
+		return nil
+	}
+
+	latency := s.minLatency
+	if s.maxLatency > s.minLatency {
+		latency += time.Duration(s.rand.Int63n(int64(s.maxLatency - s.minLatency)))
+	}
+
+	in := raftify.InboundMessage{
+		From:    net.JoinHostPort(from.ip, fmt.Sprint(simPort)),
+		Payload: append([]byte(nil), msg...),
+	}
+	s.clock.schedule(latency, to, func() {
+		// Messages in flight are lost if the link breaks before they arrive.
+		s.mu.Lock()
+		ok := s.reachable(from, to)
+		if ok {
+			s.delivered++
+		} else {
+			s.dropped++
+		}
+		s.mu.Unlock()
+
+		if ok {
+			to.deliver(to.transport.Messages(), func() bool {
+				select {
+				case to.transport.messages <- in:
+					return true
+				default:
+					return false
+				}
+			})
+		}
+	})
+	return nil
+}
+
+// detectFailures removes all members that can't be reached anymore from the members of every
+// node, like memberlist's failure detection does.
+func (s *Simulation) detectFailures() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, local := range s.nodes {
+		if !s.alive(local) {
+			continue
+		}
+		for _, member := range sortedMembers(local.transport.members) {
+			if other := s.byID[member.Name]; other != nil && other != local && !s.reachable(local, other) {
+				s.disconnect(local, other)
+			}
+		}
+	}
+}
+
+// reconcile makes all nodes that have joined the cluster and can reach each other aware of
+// each other again, like memberlist does once a partition has healed.
+func (s *Simulation) reconcile() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, a := range s.nodes {
+		for _, b := range s.nodes {
+			if a.transport.joined && b.transport.joined && s.reachable(a, b) && s.reachable(b, a) {
+				s.connect(a, b)
+			}
+		}
+	}
+}
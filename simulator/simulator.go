@@ -0,0 +1,633 @@
+// Package simulator runs raftify clusters in a single process on an in-memory network and a
+// virtual clock. Message latencies, drops and election timeouts are drawn from sources seeded
+// by the simulation's seed and every event is performed one after another, so that runs with
+// the same seed and script lead to the same elections. Nodes signal whenever they wait for their
+// next event, so that each event is only performed once the previous one has been handled.
+// Partitions, message drops, latencies and node crashes can be scripted to reproduce election
+// scenarios in tests.
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/BlockscapeLab/raftify"
+)
+
+// Default simulation settings applied if they are omitted in the options.
+const (
+	// Number of nodes the cluster consists of.
+	DefaultNodes = 3
+
+	// Minimum time it takes a message to arrive.
+	DefaultMinLatency = time.Millisecond
+
+	// Maximum time it takes a message to arrive.
+	DefaultMaxLatency = 5 * time.Millisecond
+
+	// Time after which nodes notice that a member can't be reached anymore or can be reached
+	// again.
+	DefaultFailureDetection = 5 * time.Second
+)
+
+// The time the virtual clock starts at.
+var epoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Options configures a simulation. Zero values are replaced by their defaults.
+type Options struct {
+	// The number of nodes. Nodes are named node-1 to node-N and bound to 10.0.0.1:7946 to
+	// 10.0.0.N:7946. Defaults to 3.
+	Nodes int
+
+	// The seed the latencies, message drops and election timeouts are drawn with.
+	Seed int64
+
+	// The range message latencies are drawn from. Default to 1ms and 5ms.
+	MinLatency, MaxLatency time.Duration
+
+	// The fraction of best effort messages that are dropped, between 0 and 1.
+	DropRate float64
+
+	// The time after which nodes notice that a member can't be reached anymore or can be
+	// reached again. Defaults to 5s.
+	FailureDetection time.Duration
+
+	// Called with the raftify.json of every node before it is started, e.g. to change the
+	// delivery settings. The ID, addresses and peers must be left untouched.
+	Configure func(config *raftify.Config)
+
+	// The options every node is initialized with in addition to the simulation's transport,
+	// clock and random source.
+	NodeOptions []raftify.Option
+
+	// The writer the logs of all nodes are written to, prefixed by the elapsed virtual time
+	// and the node ID. Logs are discarded if nil.
+	Log io.Writer
+}
+
+// setDefaults sets the default values for all options left empty.
+func (o *Options) setDefaults() {
+	if o.Nodes == 0 {
+		o.Nodes = DefaultNodes
+	}
+	if o.MinLatency == 0 && o.MaxLatency == 0 {
+		o.MinLatency, o.MaxLatency = DefaultMinLatency, DefaultMaxLatency
+	}
+	if o.FailureDetection == 0 {
+		o.FailureDetection = DefaultFailureDetection
+	}
+	if o.Log == nil {
+		o.Log = ioutil.Discard
+	}
+}
+
+// simNode is a node of the simulation.
+type simNode struct {
+	id        string
+	ip        string
+	dir       string
+	node      *raftify.Node
+	transport *transport
+	clock     *nodeClock
+
+	// Set once the node has crashed. Guarded by the simulation's mutex.
+	crashed bool
+
+	// The timer firings held back while the node is crashed. Only accessed by the goroutine
+	// running the simulation.
+	frozen []*event
+
+	// Guards the fields below, which track whether the node is idle.
+	mu sync.Mutex
+
+	// The channels the node's main loop waits on since it last signalled that it is idle.
+	waiting []interface{}
+
+	// Set once the node has signalled that it is idle for the first time.
+	idled bool
+
+	// Set if a value has been delivered on one of the channels the node waits on since it
+	// last signalled that it is idle, i.e. the node is busy until it signals again.
+	woken bool
+
+	// Receives a value whenever the node signals that it is idle.
+	idleCh chan struct{}
+}
+
+// Simulation is a raftify cluster running on an in-memory network and a virtual clock. Its
+// methods must not be called concurrently.
+type Simulation struct {
+	clock *virtualClock
+	dir   string
+	log   io.Writer
+
+	mu               sync.Mutex
+	nodes            []*simNode
+	byID             map[string]*simNode
+	byAddr           map[string]*simNode
+	blocked          map[link]bool
+	rand             *rand.Rand
+	dropRate         float64
+	minLatency       time.Duration
+	maxLatency       time.Duration
+	failureDetection time.Duration
+	delivered        uint64
+	dropped          uint64
+	closing          bool
+}
+
+// New creates a simulation and bootstraps its cluster. All nodes are followers of term 0 once
+// it returns. The simulation must be closed after use.
+func New(opts Options) (*Simulation, error) {
+	opts.setDefaults()
+	if opts.Nodes < 1 || opts.Nodes > 254 {
+		return nil, fmt.Errorf("number of nodes must be between 1 and 254: got %v", opts.Nodes)
+	}
+	if opts.DropRate < 0 || opts.DropRate > 1 {
+		return nil, fmt.Errorf("drop rate must be between 0 and 1: got %v", opts.DropRate)
+	}
+	if opts.MinLatency < 0 || opts.MaxLatency < opts.MinLatency {
+		return nil, fmt.Errorf("latency range %v-%v is invalid", opts.MinLatency, opts.MaxLatency)
+	}
+
+	dir, err := ioutil.TempDir("", "raftify-simulation")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Simulation{
+		clock:            &virtualClock{now: epoch},
+		dir:              dir,
+		log:              &syncWriter{w: opts.Log},
+		byID:             map[string]*simNode{},
+		byAddr:           map[string]*simNode{},
+		blocked:          map[link]bool{},
+		rand:             rand.New(rand.NewSource(opts.Seed)),
+		dropRate:         opts.DropRate,
+		minLatency:       opts.MinLatency,
+		maxLatency:       opts.MaxLatency,
+		failureDetection: opts.FailureDetection,
+	}
+
+	peers := []string{}
+	for i := 1; i <= opts.Nodes; i++ {
+		n := &simNode{
+			id:     fmt.Sprintf("node-%v", i),
+			ip:     fmt.Sprintf("10.0.0.%v", i),
+			dir:    filepath.Join(dir, fmt.Sprintf("node-%v", i)),
+			idleCh: make(chan struct{}, 1),
+		}
+		n.transport = newTransport(s, n)
+		n.clock = &nodeClock{clock: s.clock, node: n}
+
+		s.nodes = append(s.nodes, n)
+		s.byID[n.id] = n
+		s.byAddr[net.JoinHostPort(n.ip, fmt.Sprint(simPort))] = n
+		peers = append(peers, net.JoinHostPort(n.ip, fmt.Sprint(simPort)))
+	}
+
+	if err := s.bootstrap(opts, peers); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// bootstrap starts the nodes one after another and waits for the cluster to be bootstrapped.
+// Each node only starts once the previous one has tried to join so that the nodes always join
+// in the same order.
+func (s *Simulation) bootstrap(opts Options, peers []string) error {
+	errs := make(chan error, len(s.nodes))
+	pending := len(s.nodes)
+
+	for i, n := range s.nodes {
+		config := raftify.Config{
+			ID:          n.id,
+			MaxNodes:    len(s.nodes),
+			Expect:      len(s.nodes),
+			Performance: 1,
+			LogLevel:    "DEBUG",
+			BindAddr:    n.ip,
+			BindPort:    simPort,
+			PeerList:    peers,
+		}
+		if opts.Configure != nil {
+			opts.Configure(&config)
+		}
+		if err := writeConfig(n.dir, config); err != nil {
+			return err
+		}
+
+		nodeOpts := append([]raftify.Option{
+			raftify.WithTransport(n.transport),
+			raftify.WithClock(n.clock),
+			raftify.WithRand(rand.New(rand.NewSource(opts.Seed + int64(i) + 1))),
+		}, opts.NodeOptions...)
+		logger := log.New(&logWriter{sim: s, id: n.id}, "", 0)
+
+		go func(n *simNode) {
+			node, err := raftify.InitNode(logger, n.dir, nodeOpts...)
+			if err == nil {
+				s.mu.Lock()
+				n.node = node
+				s.mu.Unlock()
+			}
+			errs <- err
+		}(n)
+
+		// Wait for the join attempt of the node before starting the next one.
+		for !s.attempted(n) {
+			select {
+			case err := <-errs:
+				if err != nil {
+					return err
+				}
+				pending--
+			case <-n.idleCh:
+			}
+		}
+		s.runUntil(s.clock.Now())
+	}
+
+	for ; pending > 0; pending-- {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+	s.runUntil(s.clock.Now())
+	return nil
+}
+
+// attempted checks whether the node has tried to join the cluster, i.e. has started waiting
+// for the other nodes.
+func (s *Simulation) attempted(n *simNode) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.idled
+}
+
+// writeConfig writes the raftify.json of a node into its working directory.
+func writeConfig(dir string, config raftify.Config) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "raftify.json"), configJSON, 0644)
+}
+
+// syncWriter serializes the writes of all nodes' loggers to the same writer.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Write implements the io.Writer interface.
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// logWriter prefixes every log line of a node with the elapsed virtual time and its ID.
+type logWriter struct {
+	sim *Simulation
+	id  string
+}
+
+// Write implements the io.Writer interface.
+func (w *logWriter) Write(p []byte) (int, error) {
+	if _, err := fmt.Fprintf(w.sim.log, "%10v %v %s", w.sim.Elapsed(), w.id, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Elapsed returns the virtual time that has passed since the simulation has been started.
+func (s *Simulation) Elapsed() time.Duration {
+	return s.clock.Now().Sub(epoch)
+}
+
+// Run performs all events due within the given virtual time.
+func (s *Simulation) Run(d time.Duration) {
+	s.runUntil(s.clock.Now().Add(d))
+}
+
+// RunUntil performs events until the condition is met or the given virtual time has elapsed.
+// The condition is checked after every event. Returns whether it has been met.
+func (s *Simulation) RunUntil(condition func() bool, limit time.Duration) bool {
+	deadline := s.clock.Now().Add(limit)
+	for !condition() {
+		if !s.step(deadline) {
+			s.clock.advance(deadline)
+			return condition()
+		}
+	}
+	return true
+}
+
+// At schedules an action at the given virtual time since the start of the simulation, e.g. a
+// partition or a crash. Actions scheduled in the past are performed right away.
+func (s *Simulation) At(elapsed time.Duration, action func()) {
+	s.clock.Lock()
+	defer s.clock.Unlock()
+
+	at := epoch.Add(elapsed)
+	if at.Before(s.clock.now) {
+		at = s.clock.now
+	}
+	s.clock.scheduleLocked(at, nil, action)
+}
+
+// runUntil performs all events due until the given time and advances the clock to it.
+func (s *Simulation) runUntil(until time.Time) {
+	for s.step(until) {
+	}
+	s.clock.advance(until)
+}
+
+// step performs the next event due until the given time and waits for the node it has been
+// performed on to process it. Returns false if there is none.
+func (s *Simulation) step(until time.Time) bool {
+	e := s.clock.next(until)
+	if e == nil {
+		return false
+	}
+	if e.node == nil {
+		e.action()
+		return true
+	}
+
+	s.mu.Lock()
+	crashed, stopped := e.node.crashed, e.node.transport.shutdown
+	s.mu.Unlock()
+
+	switch {
+	case stopped:
+		return true
+	case crashed:
+		if e.timer {
+			e.node.frozen = append(e.node.frozen, e)
+		}
+		return true
+	case e.inline:
+		e.action()
+		return true
+	}
+
+	e.action()
+	s.settle(e.node)
+	return true
+}
+
+// settle waits until the node has processed the event performed on it. Nodes that don't wait on
+// the channel the event has been delivered on, e.g. because they are waiting for their rejoin
+// timeout, are left alone until they do.
+func (s *Simulation) settle(n *simNode) {
+	for n.busy() {
+		<-n.idleCh
+	}
+}
+
+// idle records the channels the node's main loop waits on. The node stays busy if one of them
+// already holds a value, e.g. a message that has arrived while it was waiting on others.
+func (n *simNode) idle(chans []interface{}) {
+	n.mu.Lock()
+	n.waiting, n.idled, n.woken = chans, true, false
+	for _, ch := range chans {
+		n.woken = n.woken || queued(ch) > 0
+	}
+	n.mu.Unlock()
+	n.signal()
+}
+
+// deliver calls put to hand a value to the node on the given channel and marks the node as busy
+// if it waits on the channel. Both happen at once so that the node can't signal that it is idle
+// in between.
+func (n *simNode) deliver(ch interface{}, put func() bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !put() {
+		return
+	}
+	for _, waiting := range n.waiting {
+		n.woken = n.woken || waiting == ch
+	}
+}
+
+// stop marks the node as idle for good once its transport has been shut down, since its main
+// loop has exited.
+func (n *simNode) stop() {
+	n.mu.Lock()
+	n.woken = false
+	n.mu.Unlock()
+	n.signal()
+}
+
+// busy checks whether the node is still processing a value delivered to it.
+func (n *simNode) busy() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.woken
+}
+
+// signal wakes up the goroutine running the simulation if it is waiting for the node.
+func (n *simNode) signal() {
+	select {
+	case n.idleCh <- struct{}{}:
+	default:
+	}
+}
+
+// queued returns the number of values waiting on one of the channels a node waits on.
+func queued(ch interface{}) int {
+	switch ch := ch.(type) {
+	case <-chan raftify.InboundMessage:
+		return len(ch)
+	case <-chan raftify.MemberEvent:
+		return len(ch)
+	case <-chan time.Time:
+		return len(ch)
+	}
+	return 0
+}
+
+// node returns the node with the given ID or panics if there is none.
+func (s *Simulation) node(id string) *simNode {
+	n, ok := s.byID[id]
+	if !ok {
+		panic(fmt.Sprintf("simulator: unknown node %v", id))
+	}
+	return n
+}
+
+// IDs returns the IDs of all nodes.
+func (s *Simulation) IDs() []string {
+	ids := make([]string, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		ids = append(ids, n.id)
+	}
+	return ids
+}
+
+// Node returns the raftify node with the given ID.
+func (s *Simulation) Node(id string) *raftify.Node {
+	n := s.node(id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return n.node
+}
+
+// Leaders returns the IDs of all nodes that haven't crashed and consider themselves the leader.
+func (s *Simulation) Leaders() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	leaders := []string{}
+	for _, n := range s.nodes {
+		if !n.crashed && n.node != nil && n.node.GetState() == raftify.Leader {
+			leaders = append(leaders, n.id)
+		}
+	}
+	return leaders
+}
+
+// Partition blocks all messages between nodes of different groups. Nodes not listed in any
+// group can still reach every other node. Once the failure detection has elapsed, nodes lose
+// sight of the members on the other side.
+func (s *Simulation) Partition(groups ...[]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, group := range groups {
+		for j, other := range groups {
+			if i == j {
+				continue
+			}
+			for _, a := range group {
+				for _, b := range other {
+					s.blocked[link{from: s.node(a).id, to: s.node(b).id}] = true
+				}
+			}
+		}
+	}
+	s.clock.schedule(s.failureDetection, nil, s.detectFailures)
+}
+
+// Heal lifts all partitions. Once the failure detection has elapsed, nodes that can reach each
+// other again become aware of each other.
+func (s *Simulation) Heal() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blocked = map[link]bool{}
+	s.clock.schedule(s.failureDetection, nil, s.reconcile)
+}
+
+// SetDropRate changes the fraction of best effort messages that are dropped.
+func (s *Simulation) SetDropRate(rate float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropRate = rate
+}
+
+// SetLatency changes the range message latencies are drawn from. Messages already in flight
+// keep their latency.
+func (s *Simulation) SetLatency(min, max time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.minLatency, s.maxLatency = min, max
+}
+
+// Crash stops the node without leaving the cluster. It neither sends nor receives messages
+// anymore and its timers don't fire. Once the failure detection has elapsed, the other nodes
+// lose sight of it.
+func (s *Simulation) Crash(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.node(id).crashed = true
+	s.clock.schedule(s.failureDetection, nil, s.detectFailures)
+}
+
+// Messages returns the number of messages that have been delivered and dropped so far.
+func (s *Simulation) Messages() (delivered, dropped uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.delivered, s.dropped
+}
+
+// Close shuts down all nodes and removes their working directories. Crashed nodes are shut
+// down as if they were the only member left. Messages in flight are discarded.
+func (s *Simulation) Close() error {
+	s.mu.Lock()
+	s.closing = true
+	for _, n := range s.nodes {
+		if n.crashed {
+			n.crashed = false
+			n.transport.members = map[string]*raftify.Member{n.id: n.transport.local}
+			s.clock.requeue(n.frozen)
+			n.frozen = nil
+		}
+	}
+	s.mu.Unlock()
+
+	var errs []error
+	for _, n := range s.nodes {
+		s.mu.Lock()
+		node, stopped := n.node, n.transport.shutdown
+		s.mu.Unlock()
+		if node == nil || stopped {
+			continue
+		}
+
+		// Timers keep firing while the node shuts down since it can't be interrupted while
+		// waiting for its rejoin timeout.
+		done := make(chan error, 1)
+		go func() {
+			done <- node.Shutdown()
+		}()
+
+		var err error
+		for shutdown := false; !shutdown; {
+			select {
+			case err = <-done:
+				shutdown = true
+			default:
+				if s.step(s.clock.Now().Add(time.Hour)) {
+					break
+				}
+				// Nothing is due until the node has shut down or waits for its next event.
+				select {
+				case err = <-done:
+					shutdown = true
+				case <-n.idleCh:
+				}
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", n.id, err))
+		}
+	}
+
+	if err := os.RemoveAll(s.dir); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("couldn't close simulation: %v", errs)
+	}
+	return nil
+}
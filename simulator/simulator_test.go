@@ -0,0 +1,162 @@
+package simulator
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/BlockscapeLab/raftify"
+)
+
+// newSimulation creates a simulation and closes it once the test has finished.
+func newSimulation(t *testing.T, opts Options) *Simulation {
+	sim, err := New(opts)
+	if err != nil {
+		t.Logf("Expected simulation to be created, instead got error: %v", err)
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		if err := sim.Close(); err != nil {
+			t.Logf("Expected simulation to be closed, instead got error: %v", err)
+			t.Fail()
+		}
+	})
+	return sim
+}
+
+// waitForLeader runs the simulation until exactly one leader has been elected and returns it.
+func waitForLeader(t *testing.T, sim *Simulation, limit time.Duration) string {
+	if !sim.RunUntil(func() bool { return len(sim.Leaders()) == 1 }, limit) {
+		t.Logf("Expected a single leader to be elected within %v, instead got %v", limit, sim.Leaders())
+		t.FailNow()
+	}
+	return sim.Leaders()[0]
+}
+
+func TestElection(t *testing.T) {
+	sim := newSimulation(t, Options{Nodes: 5, Seed: 1})
+	leader := waitForLeader(t, sim, 10*time.Second)
+
+	// The leader stays in charge as long as nothing happens
+	sim.Run(10 * time.Second)
+	if leaders := sim.Leaders(); len(leaders) != 1 || leaders[0] != leader {
+		t.Logf("Expected %v to stay the only leader, instead got %v", leader, leaders)
+		t.FailNow()
+	}
+}
+
+func TestDeterminism(t *testing.T) {
+	run := func(seed int64) string {
+		var log bytes.Buffer
+		sim := newSimulation(t, Options{Nodes: 3, Seed: seed, DropRate: 0.1, Log: &log})
+		waitForLeader(t, sim, 10*time.Second)
+		sim.Run(3 * time.Second)
+		return log.String()
+	}
+
+	if first, second := run(42), run(42); first != second {
+		t.Logf("Expected runs with the same seed to produce the same logs")
+		t.FailNow()
+	}
+}
+
+func TestRetransmissions(t *testing.T) {
+	run := func() (string, uint64) {
+		var log bytes.Buffer
+		sim := newSimulation(t, Options{
+			Nodes:    5,
+			Seed:     7,
+			DropRate: 0.3,
+			Log:      &log,
+			Configure: func(config *raftify.Config) {
+				config.Delivery.Acks = true
+			},
+		})
+		sim.Run(10 * time.Second)
+
+		var retransmits uint64
+		for _, id := range sim.IDs() {
+			retransmits += sim.Node(id).GetMetrics().Retransmits
+		}
+		return log.String(), retransmits
+	}
+
+	// Retransmissions are scheduled on the virtual clock, so they are reproducible as well
+	first, retransmits := run()
+	if retransmits == 0 {
+		t.Logf("Expected dropped responses to be retransmitted")
+		t.FailNow()
+	}
+	if second, _ := run(); first != second {
+		t.Logf("Expected runs with the same seed to produce the same logs")
+		t.FailNow()
+	}
+}
+
+func TestLeaderCrash(t *testing.T) {
+	sim := newSimulation(t, Options{Nodes: 5, Seed: 2})
+	leader := waitForLeader(t, sim, 10*time.Second)
+
+	sim.Crash(leader)
+	if next := waitForLeader(t, sim, 20*time.Second); next == leader {
+		t.Logf("Expected another node to take over from the crashed leader %v", leader)
+		t.FailNow()
+	}
+}
+
+func TestPartition(t *testing.T) {
+	sim := newSimulation(t, Options{Nodes: 5, Seed: 3})
+	leader := waitForLeader(t, sim, 10*time.Second)
+
+	// Cut the leader and one follower off from the other three nodes
+	minority, majority := []string{leader}, []string{}
+	for _, id := range sim.IDs() {
+		switch {
+		case id == leader:
+		case len(minority) < 2:
+			minority = append(minority, id)
+		default:
+			majority = append(majority, id)
+		}
+	}
+	sim.Partition(minority, majority)
+
+	inMajority := func() bool {
+		leaders := sim.Leaders()
+		if len(leaders) != 1 {
+			return false
+		}
+		for _, id := range majority {
+			if leaders[0] == id {
+				return true
+			}
+		}
+		return false
+	}
+	if !sim.RunUntil(inMajority, 30*time.Second) {
+		t.Logf("Expected the majority %v to elect the only leader, instead got %v", majority, sim.Leaders())
+		t.FailNow()
+	}
+
+	// Once healed, the cluster settles on a single leader again
+	sim.Heal()
+	sim.Run(30 * time.Second)
+	waitForLeader(t, sim, 30*time.Second)
+}
+
+func TestScriptedDrops(t *testing.T) {
+	sim := newSimulation(t, Options{Nodes: 3, Seed: 4})
+	waitForLeader(t, sim, 10*time.Second)
+
+	// Dropping every message for a while makes all nodes lose the leader
+	start := sim.Elapsed()
+	sim.At(start+time.Second, func() { sim.SetDropRate(1) })
+	sim.At(start+5*time.Second, func() { sim.SetDropRate(0) })
+
+	sim.Run(4 * time.Second)
+	if _, dropped := sim.Messages(); dropped == 0 || len(sim.Leaders()) != 0 {
+		t.Logf("Expected the leader to step down while messages are dropped, instead got leaders %v and %v dropped messages", sim.Leaders(), dropped)
+		t.FailNow()
+	}
+	waitForLeader(t, sim, 20*time.Second)
+}
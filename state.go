@@ -4,15 +4,64 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"os"
-
-	"github.com/hashicorp/memberlist"
+	"sort"
+	"time"
 )
 
+// Time measured in hours for which members that are no longer part of the local memberlist
+// are kept in the state.json file as rejoin candidates.
+const StateRetention = 24
+
+// stateMember is a cluster member persisted in the state.json file alongside the time it was
+// last seen in the local memberlist.
+type stateMember struct {
+	Member
+	LastSeen time.Time `json:"last_seen"`
+
+	// The latest incarnation of the member the local node has received messages from.
+	Incarnation int64 `json:"incarnation,omitempty"`
+}
+
 // saveState saves the current memberlist into a separate state.json file. This file is used
 // to allow a timed out or crashed node which has lost its internal memberlist to rejoin the
 // cluster it is already part of. The state.json file is generated on the first successful join.
+// Members which have been persisted before but are no longer part of the memberlist are kept
+// until they exceed the retention period. The latest incarnation of every member is persisted
+// alongside it.
 func (n *Node) saveState() error {
-	stateJSON, _ := json.MarshalIndent(n.memberlist.Members(), "", "	")
+	now := time.Now()
+	state := []*stateMember{}
+	current := map[string]*stateMember{}
+
+	for _, member := range n.network.Members() {
+		entry := &stateMember{Member: *member, LastSeen: now}
+		state = append(state, entry)
+		current[member.Name] = entry
+	}
+	if previous, err := n.loadState(); err == nil {
+		for _, member := range previous {
+			if entry, ok := current[member.Name]; ok {
+				entry.Incarnation = member.Incarnation
+				continue
+			}
+			if now.Sub(member.LastSeen) > StateRetention*time.Hour {
+				continue
+			}
+			state = append(state, member)
+		}
+	}
+
+	for _, member := range state {
+		incarnation := n.replayGuard.incarnation(member.Name)
+		if member.Name == n.config.ID {
+			incarnation = n.incarnation
+		}
+		if incarnation > member.Incarnation {
+			member.Incarnation = incarnation
+		}
+	}
+
+	stateJSON, _ := json.MarshalIndent(state, "", "	")
 	_ = ioutil.WriteFile(n.workingDir+"/state.json", stateJSON, 0755)
 	n.logger.Println("[DEBUG] raftify: Created/Updated state.json ✓")
 	return nil
@@ -26,8 +75,9 @@ func (n *Node) deleteState() error {
 	return nil
 }
 
-// loadState loads the contents of the state.json file.
-func (n *Node) loadState() ([]*memberlist.Node, error) {
+// loadState loads the contents of the state.json file, ordered by the time the members were
+// last seen, starting with the most recent one.
+func (n *Node) loadState() ([]*stateMember, error) {
 	stateJSON, err := os.Open(n.workingDir + "/state.json")
 	if err != nil {
 		return nil, err
@@ -39,9 +89,41 @@ func (n *Node) loadState() ([]*memberlist.Node, error) {
 		return nil, err
 	}
 
-	var list []*memberlist.Node
+	var list []*stateMember
 	if err = json.Unmarshal(stateBytes, &list); err != nil {
 		return nil, err
 	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].LastSeen.After(list[j].LastSeen)
+	})
 	return list, nil
 }
+
+// restoreIncarnations restores the incarnations persisted in the state.json by the previous run
+// of the local node. Messages from earlier runs of the other members stay rejected and the local
+// node's incarnation exceeds the one of its previous run even if the clock has gone backwards.
+func (n *Node) restoreIncarnations() {
+	list, err := n.loadState()
+	if err != nil {
+		return
+	}
+	for _, member := range list {
+		if member.Incarnation == 0 {
+			continue
+		}
+		if member.Name != n.config.ID {
+			n.replayGuard.seed(member.Name, member.Incarnation)
+		} else if member.Incarnation >= n.incarnation {
+			n.incarnation = member.Incarnation + 1
+		}
+	}
+}
+
+// recordIncarnation persists the new incarnation of a member in the state.json. Nothing is
+// written before the state.json has been created on the first successful join.
+func (n *Node) recordIncarnation() {
+	if _, err := os.Stat(n.workingDir + "/state.json"); err == nil {
+		n.saveState()
+	}
+}
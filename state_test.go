@@ -1,9 +1,13 @@
 package raftify
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestSaveLoadDeleteState(t *testing.T) {
@@ -52,3 +56,76 @@ func TestSaveLoadDeleteState(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestSaveStateKeepsPreviousMembers(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(1)
+
+	// Initialize and start dummy node
+	node := initDummyNode("TestNode", 1, 3, ports[0])
+	node.createMemberlist()
+	defer node.memberlist.Shutdown()
+	defer node.deleteState()
+
+	// Persist a state with a member that has since left and one that has expired
+	previous := []*stateMember{
+		{Member: Member{Name: "TestNode_Left", Addr: net.ParseIP("10.0.0.2"), Port: 7946}, LastSeen: time.Now().Add(-time.Hour)},
+		{Member: Member{Name: "TestNode_Expired", Addr: net.ParseIP("10.0.0.3"), Port: 7946}, LastSeen: time.Now().Add(-(StateRetention + 1) * time.Hour)},
+	}
+	stateJSON, _ := json.Marshal(previous)
+	ioutil.WriteFile(node.workingDir+"/state.json", stateJSON, 0755)
+
+	node.saveState()
+
+	list, err := node.loadState()
+	if err != nil {
+		t.Logf("Expected state.json to be loaded successfully, instead got error: %v", err.Error())
+		t.FailNow()
+	}
+	if len(list) != 2 || list[0].Name != "TestNode" || list[1].Name != "TestNode_Left" {
+		t.Logf("Expected the local node followed by the member that left, instead got %v entries", len(list))
+		t.FailNow()
+	}
+}
+
+func TestRestoreIncarnations(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(1)
+
+	// Initialize and start dummy node
+	node := initDummyNode("TestNode", 1, 3, ports[0])
+	node.workingDir, _ = ioutil.TempDir("", "raftify-state")
+	defer os.RemoveAll(node.workingDir)
+	node.incarnation = 100
+	node.createMemberlist()
+	defer node.memberlist.Shutdown()
+
+	// TestNode_2 has been seen before and has since been restarted
+	previous := []*stateMember{
+		{Member: Member{Name: "TestNode_2", Addr: net.ParseIP("10.0.0.2"), Port: 7946}, LastSeen: time.Now(), Incarnation: 40},
+	}
+	stateJSON, _ := json.Marshal(previous)
+	ioutil.WriteFile(node.workingDir+"/state.json", stateJSON, 0755)
+
+	node.replayGuard.check("TestNode_2", 50, 1)
+	node.saveState()
+
+	// The restarted node's clock has gone backwards
+	restarted := initDummyNode("TestNode", 1, 3, ports[0])
+	restarted.workingDir = node.workingDir
+	restarted.incarnation = 10
+	restarted.restoreIncarnations()
+
+	if restarted.incarnation != 101 {
+		t.Logf("Expected incarnation to exceed the previous one, instead got %v", restarted.incarnation)
+		t.FailNow()
+	}
+	if err := restarted.replayGuard.check("TestNode_2", 49, 1); err == nil {
+		t.Logf("Expected message of a previous run of TestNode_2 to be rejected, instead error was nil")
+		t.FailNow()
+	}
+	if err := restarted.replayGuard.check("TestNode_2", 50, 2); err != nil {
+		t.Logf("Expected message of the current run of TestNode_2 to be accepted, instead got error: %v", err)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,735 @@
+package raftify
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	sockaddr "github.com/hashicorp/go-sockaddr"
+	"github.com/hashicorp/memberlist"
+)
+
+// Maximum size in bytes of a packet received via the TLS transport.
+const maxTLSPacketSize = 64 * 1024
+
+// The first byte written by the dialing side of a TLS connection determines its purpose.
+const (
+	// The connection carries a sequence of length-prefixed packets.
+	tlsPacketConn byte = 'P'
+
+	// The connection is a stream handed to memberlist or raftify.
+	tlsStreamConn byte = 'S'
+
+	// The connection is only used to verify the peer's certificate and closed right away.
+	tlsVerifyConn byte = 'V'
+)
+
+// tlsEnabled checks whether the TLS transport is configured.
+func (c *Config) tlsEnabled() bool {
+	return c.TLSCert != "" || c.TLSKey != "" || c.TLSCA != ""
+}
+
+// validateTLS checks for constraint violations in the TLS settings and returns them in the
+// same format as Config.validate.
+func (c *Config) validateTLS() string {
+	if c.tlsEnabled() && (c.TLSCert == "" || c.TLSKey == "" || c.TLSCA == "") {
+		return "\ttls_cert, tls_key and tls_ca must either all be set or all be omitted\n"
+	}
+	return ""
+}
+
+// loadTLS loads the certificates configured for the TLS transport. Returns nil if the TLS
+// transport is disabled.
+func (c *Config) loadTLS(workingDir string, logger *log.Logger) (*tlsReloader, error) {
+	if !c.tlsEnabled() {
+		return nil, nil
+	}
+
+	abs := func(path string) string {
+		if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(workingDir, path)
+	}
+
+	r := &tlsReloader{
+		certFile: abs(c.TLSCert),
+		keyFile:  abs(c.TLSKey),
+		caFile:   abs(c.TLSCA),
+		logger:   logger,
+	}
+	if err := r.reload(r.modTimes()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// tlsReloader holds the certificate of the local node and the pool of trusted CAs. The files
+// are checked for modifications on every handshake and reloaded if they have changed, so that
+// certificates can be replaced without restarting the node.
+type tlsReloader struct {
+	sync.Mutex
+
+	certFile, keyFile, caFile string
+
+	logger *log.Logger
+
+	// The modification times of the files the current certificates have been loaded from.
+	loaded [3]time.Time
+
+	cert *tls.Certificate
+	pool *x509.CertPool
+}
+
+// modTimes returns the modification times of the certificate, key and CA file. Files that
+// can't be accessed have a zero modification time.
+func (r *tlsReloader) modTimes() [3]time.Time {
+	var times [3]time.Time
+	for i, path := range []string{r.certFile, r.keyFile, r.caFile} {
+		if info, err := os.Stat(path); err == nil {
+			times[i] = info.ModTime()
+		}
+	}
+	return times
+}
+
+// reload loads the certificate, key and CA file and replaces the current certificates if
+// all of them are valid.
+func (r *tlsReloader) reload(times [3]time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("couldn't load tls_cert and tls_key: %v", err)
+	}
+
+	caPEM, err := ioutil.ReadFile(r.caFile)
+	if err != nil {
+		return fmt.Errorf("couldn't read tls_ca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return errors.New("tls_ca does not contain any PEM-encoded certificates")
+	}
+
+	r.Lock()
+	r.cert, r.pool, r.loaded = &cert, pool, times
+	r.Unlock()
+	return nil
+}
+
+// current returns the current certificate and CA pool after reloading them if any of the
+// files has been modified. If reloading fails, the previous certificates are kept.
+func (r *tlsReloader) current() (*tls.Certificate, *x509.CertPool) {
+	times := r.modTimes()
+
+	r.Lock()
+	changed := times != r.loaded
+	r.Unlock()
+
+	if changed {
+		if err := r.reload(times); err != nil {
+			r.logger.Printf("[ERR] raftify: Couldn't reload TLS certificates, keeping the previous ones: %v\n", err)
+		} else {
+			r.logger.Println("[INFO] raftify: Reloaded TLS certificates")
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	return r.cert, r.pool
+}
+
+// verifyPeer verifies the certificate chain presented by a peer against the current CAs and
+// makes sure the certificate has been issued to a node ID. If name is not empty, it must be the
+// node ID the certificate has been issued to.
+func (r *tlsReloader) verifyPeer(rawCerts [][]byte, usage x509.ExtKeyUsage, name string) error {
+	if len(rawCerts) == 0 {
+		return errors.New("peer did not present a certificate")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("couldn't parse peer certificate: %v", err)
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, pool := r.current()
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}); err != nil {
+		return err
+	}
+
+	id, err := certificateID(certs[0])
+	if err != nil {
+		return err
+	}
+	if name != "" && id != name {
+		return fmt.Errorf("certificate has been issued to %v, expected %v", id, name)
+	}
+	return nil
+}
+
+// certificateID returns the node ID a certificate has been issued to. The node ID must be one of
+// the DNS names in the certificate's subject alternative names. If there are several, the one
+// matching the subject common name is the node ID.
+func certificateID(cert *x509.Certificate) (string, error) {
+	switch len(cert.DNSNames) {
+	case 0:
+		return "", errors.New("certificate doesn't name a node ID in its subject alternative names")
+	case 1:
+		return cert.DNSNames[0], nil
+	}
+	for _, name := range cert.DNSNames {
+		if name == cert.Subject.CommonName {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("certificate names several DNS names, none of which is its subject common name %v", cert.Subject.CommonName)
+}
+
+// serverConfig returns the TLS configuration for accepted connections. Peers must present a
+// client certificate issued by one of the trusted CAs.
+func (r *tlsReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequireAnyClientCert,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return r.verifyPeer(rawCerts, x509.ExtKeyUsageClientAuth, "")
+		},
+	}
+}
+
+// clientConfig returns the TLS configuration for dialed connections. The peer must present a
+// server certificate issued by one of the trusted CAs and, if name is not empty, to the node ID
+// passed in. The standard verification is skipped since peers are dialed by IP address while
+// their certificates name their node ID, which is verified by verifyPeer instead.
+func (r *tlsReloader) clientConfig(name string) *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if err := r.verifyPeer(rawCerts, x509.ExtKeyUsageServerAuth, name); err != nil {
+				return fmt.Errorf("%w: %v", errCertificateRejected, err)
+			}
+			return nil
+		},
+	}
+}
+
+// authenticatedConn is a connection whose remote address carries the name the peer has
+// authenticated with.
+type authenticatedConn struct {
+	net.Conn
+	addr *authenticatedAddr
+}
+
+// RemoteAddr implements the net.Conn interface.
+func (c *authenticatedConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// packetConn is a pooled connection packets are sent to a peer with.
+type packetConn struct {
+	sync.Mutex
+	conn net.Conn
+}
+
+// tlsTransport is a memberlist transport that exchanges all packets and streams via mutually
+// authenticated TLS connections over TCP. Packets sent to a peer share a single connection.
+type tlsTransport struct {
+	tls    *tlsReloader
+	logger *log.Logger
+
+	bindAddr string
+	timeout  time.Duration
+	listener net.Listener
+
+	packetCh chan *memberlist.Packet
+	streamCh chan net.Conn
+
+	// The outgoing packet connections by address and the accepted ones still open.
+	connLock    sync.Mutex
+	packetConns map[string]*packetConn
+	accepted    map[net.Conn]struct{}
+
+	wg           sync.WaitGroup
+	shutdownCh   chan struct{}
+	shutdownOnce sync.Once
+}
+
+// newTLSTransport creates the TLS transport and starts accepting connections.
+func newTLSTransport(config *memberlist.Config, reloader *tlsReloader) (*tlsTransport, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(config.BindAddr, strconv.Itoa(config.BindPort)))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't set up TLS transport: %v", err)
+	}
+
+	t := &tlsTransport{
+		tls:         reloader,
+		logger:      config.Logger,
+		bindAddr:    config.BindAddr,
+		timeout:     config.TCPTimeout,
+		listener:    listener,
+		packetCh:    make(chan *memberlist.Packet),
+		streamCh:    make(chan net.Conn),
+		packetConns: map[string]*packetConn{},
+		accepted:    map[net.Conn]struct{}{},
+		shutdownCh:  make(chan struct{}),
+	}
+
+	t.wg.Add(1)
+	go t.accept()
+	return t, nil
+}
+
+// GetAutoBindPort returns the port the transport is bound to.
+func (t *tlsTransport) GetAutoBindPort() int {
+	return t.listener.Addr().(*net.TCPAddr).Port
+}
+
+// FinalAdvertiseAddr implements the memberlist Transport interface.
+func (t *tlsTransport) FinalAdvertiseAddr(ip string, port int) (net.IP, int, error) {
+	if ip != "" {
+		advertiseAddr := net.ParseIP(ip)
+		if advertiseAddr == nil {
+			return nil, 0, fmt.Errorf("couldn't parse advertise address %q", ip)
+		}
+		if ip4 := advertiseAddr.To4(); ip4 != nil {
+			advertiseAddr = ip4
+		}
+		return advertiseAddr, port, nil
+	}
+
+	if t.bindAddr != "0.0.0.0" {
+		return t.listener.Addr().(*net.TCPAddr).IP, t.GetAutoBindPort(), nil
+	}
+
+	// If the transport isn't bound to a specific address, a private address is advertised.
+	privateIP, err := sockaddr.GetPrivateIP()
+	if err != nil {
+		return nil, 0, fmt.Errorf("couldn't get interface addresses: %v", err)
+	}
+	advertiseAddr := net.ParseIP(privateIP)
+	if advertiseAddr == nil {
+		return nil, 0, errors.New("no private IP address found and no advertise address set")
+	}
+	return advertiseAddr, t.GetAutoBindPort(), nil
+}
+
+// PacketCh implements the memberlist Transport interface.
+func (t *tlsTransport) PacketCh() <-chan *memberlist.Packet {
+	return t.packetCh
+}
+
+// StreamCh implements the memberlist Transport interface.
+func (t *tlsTransport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+// WriteTo implements the memberlist Transport interface.
+func (t *tlsTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	return t.WriteToAddress(b, memberlist.Address{Addr: addr})
+}
+
+// WriteToAddress implements the memberlist NodeAwareTransport interface. The packet is sent
+// via the pooled connection to the address, which is redialed once if it has been closed.
+func (t *tlsTransport) WriteToAddress(b []byte, addr memberlist.Address) (time.Time, error) {
+	frame := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	copy(frame[4:], b)
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var pc *packetConn
+		if pc, err = t.packetConn(addr); err != nil {
+			return time.Time{}, err
+		}
+
+		pc.Lock()
+		pc.conn.SetWriteDeadline(time.Now().Add(t.timeout))
+		_, err = pc.conn.Write(frame)
+		pc.Unlock()
+
+		if err == nil {
+			return time.Now(), nil
+		}
+		t.dropPacketConn(addr, pc)
+	}
+	return time.Time{}, err
+}
+
+// DialTimeout implements the memberlist Transport interface.
+func (t *tlsTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	return t.DialAddressTimeout(memberlist.Address{Addr: addr}, timeout)
+}
+
+// DialAddressTimeout implements the memberlist NodeAwareTransport interface.
+func (t *tlsTransport) DialAddressTimeout(addr memberlist.Address, timeout time.Duration) (net.Conn, error) {
+	return t.dial(addr.Addr, addr.Name, tlsStreamConn, timeout)
+}
+
+// IngestPacket implements the memberlist IngestionAwareTransport interface.
+func (t *tlsTransport) IngestPacket(net.Conn, net.Addr, time.Time, bool) error {
+	return errors.New("packet ingestion is not supported by the TLS transport")
+}
+
+// IngestStream implements the memberlist IngestionAwareTransport interface.
+func (t *tlsTransport) IngestStream(net.Conn) error {
+	return errors.New("stream ingestion is not supported by the TLS transport")
+}
+
+// Shutdown implements the memberlist Transport interface.
+func (t *tlsTransport) Shutdown() error {
+	t.shutdownOnce.Do(func() {
+		close(t.shutdownCh)
+		t.listener.Close()
+
+		t.connLock.Lock()
+		for _, pc := range t.packetConns {
+			pc.conn.Close()
+		}
+		for conn := range t.accepted {
+			conn.Close()
+		}
+		t.connLock.Unlock()
+	})
+
+	t.wg.Wait()
+	return nil
+}
+
+// dial establishes a TLS connection of the given kind to the address. If name is not empty,
+// the peer's certificate must have been issued to it.
+func (t *tlsTransport) dial(addr, name string, kind byte, timeout time.Duration) (net.Conn, error) {
+	raw, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := tls.Client(raw, t.tls.clientConfig(name))
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := conn.Handshake(); err != nil {
+		raw.Close()
+		return nil, fmt.Errorf("TLS handshake with %v failed: %w", addr, err)
+	}
+	if _, err := conn.Write([]byte{kind}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// packetConn returns the pooled packet connection to the address and dials it if necessary.
+func (t *tlsTransport) packetConn(addr memberlist.Address) (*packetConn, error) {
+	key := addr.Name + "@" + addr.Addr
+
+	t.connLock.Lock()
+	pc, ok := t.packetConns[key]
+	t.connLock.Unlock()
+	if ok {
+		return pc, nil
+	}
+
+	conn, err := t.dial(addr.Addr, addr.Name, tlsPacketConn, t.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+	select {
+	case <-t.shutdownCh:
+		conn.Close()
+		return nil, errors.New("TLS transport has been shut down")
+	default:
+	}
+
+	// Another packet may have dialed the address concurrently.
+	if existing, ok := t.packetConns[key]; ok {
+		conn.Close()
+		return existing, nil
+	}
+	pc = &packetConn{conn: conn}
+	t.packetConns[key] = pc
+	return pc, nil
+}
+
+// dropPacketConn closes the pooled packet connection to the address after a failed write.
+func (t *tlsTransport) dropPacketConn(addr memberlist.Address, pc *packetConn) {
+	key := addr.Name + "@" + addr.Addr
+
+	t.connLock.Lock()
+	if t.packetConns[key] == pc {
+		delete(t.packetConns, key)
+	}
+	t.connLock.Unlock()
+	pc.conn.Close()
+}
+
+// accept accepts connections until the transport is shut down.
+func (t *tlsTransport) accept() {
+	defer t.wg.Done()
+
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			select {
+			case <-t.shutdownCh:
+				return
+			default:
+			}
+			t.logger.Printf("[ERR] raftify: Couldn't accept TLS connection: %v\n", err)
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+
+		t.wg.Add(1)
+		go t.handleConn(conn)
+	}
+}
+
+// handleConn performs the TLS handshake on an accepted connection. Peers that don't present a
+// trusted certificate are rejected before memberlist or raftify get to see any of their data.
+func (t *tlsTransport) handleConn(raw net.Conn) {
+	defer t.wg.Done()
+
+	conn := tls.Server(raw, t.tls.serverConfig())
+	conn.SetDeadline(time.Now().Add(t.timeout))
+	if err := conn.Handshake(); err != nil {
+		t.logger.Printf("[WARN] raftify: Rejected TLS connection from %v: %v\n", raw.RemoteAddr(), err)
+		raw.Close()
+		return
+	}
+
+	// The certificate has already been verified to name a node ID during the handshake.
+	name, _ := certificateID(conn.ConnectionState().PeerCertificates[0])
+	addr := &authenticatedAddr{Addr: raw.RemoteAddr(), name: name}
+
+	var kind [1]byte
+	if _, err := io.ReadFull(conn, kind[:]); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	switch kind[0] {
+	case tlsPacketConn:
+		t.readPackets(conn, addr)
+	case tlsStreamConn:
+		select {
+		case t.streamCh <- &authenticatedConn{Conn: conn, addr: addr}:
+		case <-t.shutdownCh:
+			conn.Close()
+		}
+	default:
+		conn.Close()
+	}
+}
+
+// readPackets reads the packets sent via an accepted packet connection until it is closed.
+func (t *tlsTransport) readPackets(conn net.Conn, addr *authenticatedAddr) {
+	t.connLock.Lock()
+	select {
+	case <-t.shutdownCh:
+		t.connLock.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	t.accepted[conn] = struct{}{}
+	t.connLock.Unlock()
+
+	defer func() {
+		t.connLock.Lock()
+		delete(t.accepted, conn)
+		t.connLock.Unlock()
+		conn.Close()
+	}()
+
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if size > maxTLSPacketSize {
+			t.logger.Printf("[ERR] raftify: Packet from %v exceeds %v bytes, closing connection...\n", addr, maxTLSPacketSize)
+			return
+		}
+
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+
+		select {
+		case t.packetCh <- &memberlist.Packet{Buf: buf, From: addr, Timestamp: time.Now()}:
+		case <-t.shutdownCh:
+			return
+		}
+	}
+}
+
+// The delays before the certificate of a member that couldn't be dialed is verified again. The
+// delay doubles with every failed attempt up to tlsVerifyBackoffMax.
+const (
+	tlsVerifyBackoffMin = time.Second
+	tlsVerifyBackoffMax = 30 * time.Second
+)
+
+// errCertificateRejected is returned if a dialed peer presents a certificate that isn't trusted
+// or hasn't been issued to the node ID it has been dialed as.
+var errCertificateRejected = errors.New("certificate rejected")
+
+// tlsAliveDelegate makes sure that members are only handed to raftify once the certificate
+// presented at their advertised address has been issued to their node ID. This prevents a peer
+// holding a trusted certificate from joining under another node's ID. Certificates are verified
+// in the background so that memberlist isn't blocked by the handshake.
+type tlsAliveDelegate struct {
+	localID   string
+	transport *tlsTransport
+	logger    *log.Logger
+
+	// The delay before the first retry of a verification that failed to reach the member.
+	backoff time.Duration
+
+	sync.Mutex
+
+	// The addresses members are being verified at, have been verified at and have failed
+	// verification at by node ID.
+	pending  map[string]string
+	verified map[string]string
+	rejected map[string]string
+}
+
+// newTLSAliveDelegate creates the alive delegate verifying members via the TLS transport.
+func newTLSAliveDelegate(localID string, transport *tlsTransport, logger *log.Logger) *tlsAliveDelegate {
+	return &tlsAliveDelegate{
+		localID:   localID,
+		transport: transport,
+		logger:    logger,
+		backoff:   tlsVerifyBackoffMin,
+		pending:   map[string]string{},
+		verified:  map[string]string{},
+		rejected:  map[string]string{},
+	}
+}
+
+// NotifyAlive implements the memberlist AliveDelegate interface. Members whose certificate
+// has failed verification at their address are refused, all others are accepted by memberlist
+// while their certificate is verified.
+func (d *tlsAliveDelegate) NotifyAlive(peer *memberlist.Node) error {
+	if peer.Name == d.localID {
+		return nil
+	}
+
+	addr := net.JoinHostPort(peer.Addr.String(), strconv.Itoa(int(peer.Port)))
+
+	d.Lock()
+	defer d.Unlock()
+	switch addr {
+	case d.verified[peer.Name], d.pending[peer.Name]:
+		return nil
+	case d.rejected[peer.Name]:
+		return fmt.Errorf("certificate of %v at %v has not been issued to it", peer.Name, addr)
+	}
+
+	d.pending[peer.Name] = addr
+	go d.verify(peer.Name, addr, d.backoff)
+	return nil
+}
+
+// verify dials the member at the address and records whether its certificate has been issued to
+// its node ID. Members are only rejected if they present a certificate that isn't, verifications
+// that fail to reach the member are retried after the given backoff, which doubles with every
+// retry. The result is discarded if the member has moved or left in the meantime.
+func (d *tlsAliveDelegate) verify(id, addr string, backoff time.Duration) {
+	conn, err := d.transport.dial(addr, id, tlsVerifyConn, d.transport.timeout)
+	if err == nil {
+		conn.Close()
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if d.pending[id] != addr {
+		return
+	}
+
+	switch {
+	case err == nil:
+		delete(d.pending, id)
+		d.verified[id] = addr
+		delete(d.rejected, id)
+
+	case errors.Is(err, errCertificateRejected):
+		delete(d.pending, id)
+		d.rejected[id] = addr
+		d.logger.Printf("[WARN] raftify: Ignoring %v, couldn't verify its certificate at %v: %v\n", id, addr, err)
+
+	default:
+		select {
+		case <-d.transport.shutdownCh:
+			delete(d.pending, id)
+			return
+		default:
+		}
+
+		d.logger.Printf("[DEBUG] raftify: Couldn't reach %v at %v to verify its certificate, retrying in %v: %v\n", id, addr, backoff, err)
+		next := 2 * backoff
+		if next > tlsVerifyBackoffMax {
+			next = tlsVerifyBackoffMax
+		}
+		time.AfterFunc(backoff, func() { d.verify(id, addr, next) })
+	}
+}
+
+// trusted returns whether the certificate of the member has been verified at its current
+// address.
+func (d *tlsAliveDelegate) trusted(member *memberlist.Node) bool {
+	if member.Name == d.localID {
+		return true
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	return d.verified[member.Name] == net.JoinHostPort(member.Addr.String(), strconv.Itoa(int(member.Port)))
+}
+
+// forget discards everything known about the member after it has left.
+func (d *tlsAliveDelegate) forget(member *memberlist.Node) {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.pending, member.Name)
+	delete(d.verified, member.Name)
+	delete(d.rejected, member.Name)
+}
@@ -0,0 +1,349 @@
+package raftify
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// testCA is a certificate authority issuing node certificates for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// genCA generates a new self-signed certificate authority.
+func genCA() *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "raftify test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// writeNodeCert issues a certificate to the given name and writes it alongside its key and the
+// CA certificate to the directory. Returns a config with the TLS settings set.
+func (ca *testCA) writeNodeCert(dir, name string) *Config {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	config := &Config{
+		TLSCert: filepath.Join(dir, name+".crt"),
+		TLSKey:  filepath.Join(dir, name+".key"),
+		TLSCA:   filepath.Join(dir, name+"-ca.crt"),
+	}
+	ioutil.WriteFile(config.TLSCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(config.TLSKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	ioutil.WriteFile(config.TLSCA, ca.pem, 0600)
+	return config
+}
+
+// initTLSNode returns a dummy node whose certificate has been issued to name by the CA.
+func initTLSNode(t *testing.T, ca *testCA, dir, id, name string) *Node {
+	node := initDummyNode(id, 1, 2, 0)
+	tlsConfig := ca.writeNodeCert(dir, name)
+
+	var err error
+	if node.tls, err = tlsConfig.loadTLS(dir, node.logger); err != nil {
+		t.Logf("Expected certificates of %v to be loaded, instead got error: %v", id, err)
+		t.FailNow()
+	}
+	return node
+}
+
+func TestValidateTLS(t *testing.T) {
+	if errs := (&Config{}).validateTLS(); errs != "" {
+		t.Logf("Expected no errors without TLS, instead got: %v", errs)
+		t.FailNow()
+	}
+	if errs := (&Config{TLSCert: "node.crt", TLSKey: "node.key", TLSCA: "ca.crt"}).validateTLS(); errs != "" {
+		t.Logf("Expected no errors with all TLS settings, instead got: %v", errs)
+		t.FailNow()
+	}
+	if errs := (&Config{TLSCert: "node.crt", TLSKey: "node.key"}).validateTLS(); errs == "" {
+		t.Logf("Expected error for missing tls_ca, instead got none")
+		t.FailNow()
+	}
+}
+
+func TestTLSReloader(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "raftify")
+	defer os.RemoveAll(dir)
+
+	ca := genCA()
+	config := ca.writeNodeCert(dir, "TestNode")
+	node := initDummyNode("TestNode", 1, 1, 0)
+
+	reloader, err := config.loadTLS(dir, node.logger)
+	if err != nil {
+		t.Logf("Expected certificates to be loaded, instead got error: %v", err)
+		t.FailNow()
+	}
+	cert, _ := reloader.current()
+
+	// Replace the certificate and make sure the modification is noticed
+	ca.writeNodeCert(dir, "TestNode")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(config.TLSCert, future, future)
+
+	if reloaded, _ := reloader.current(); reloaded == cert {
+		t.Logf("Expected replaced certificate to be reloaded, instead the previous one is still used")
+		t.FailNow()
+	}
+	cert, _ = reloader.current()
+
+	// An invalid replacement keeps the previous certificate
+	ioutil.WriteFile(config.TLSCert, []byte("invalid"), 0600)
+	future = future.Add(time.Minute)
+	os.Chtimes(config.TLSCert, future, future)
+
+	if reloaded, _ := reloader.current(); reloaded != cert {
+		t.Logf("Expected previous certificate to be kept after an invalid replacement")
+		t.FailNow()
+	}
+
+	// Missing files are reported on startup
+	os.Remove(config.TLSCA)
+	if _, err := config.loadTLS(dir, node.logger); err == nil {
+		t.Logf("Expected missing tls_ca to be reported, instead error was nil")
+		t.FailNow()
+	}
+}
+
+func TestTLSTransport(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "raftify")
+	defer os.RemoveAll(dir)
+
+	ca := genCA()
+	node1 := initTLSNode(t, ca, dir, "TestNode_1", "TestNode_1")
+	node2 := initTLSNode(t, ca, dir, "TestNode_2", "TestNode_2")
+
+	node1.createMemberlist()
+	defer node1.memberlist.Shutdown()
+	node2.createMemberlist()
+	defer node2.memberlist.Shutdown()
+
+	if _, err := node2.memberlist.Join([]string{node1.LocalAddr()}); err != nil {
+		t.Logf("Expected node2 to join node1 via TLS, instead got error: %v", err)
+		t.FailNow()
+	}
+	if num := node1.memberlist.NumMembers(); num != 2 {
+		t.Logf("Expected node1 to have 2 members, instead got %v", num)
+		t.FailNow()
+	}
+
+	// node2 is handed to raftify once its certificate has been verified
+	member, err := node1.getNodeByName("TestNode_2")
+	for deadline := time.Now().Add(5 * time.Second); err != nil; member, err = node1.getNodeByName("TestNode_2") {
+		if time.Now().After(deadline) {
+			t.Logf("Expected certificate of node2 to be verified, instead got error: %v", err)
+			t.FailNow()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Raftify messages carry the name the sender has authenticated with
+	send := map[string]func() error{
+		"packet": func() error { return node1.sendBestEffort(member, []byte("best effort")) },
+		"stream": func() error { return node1.sendReliable(member, []byte("reliable")) },
+	}
+
+	for name, sendFunc := range send {
+		if err := sendFunc(); err != nil {
+			t.Logf("Expected %v to be sent, instead got error: %v", name, err)
+			t.FailNow()
+		}
+
+		select {
+		case in := <-node2.messages.messageCh:
+			if in.Peer != "TestNode_1" {
+				t.Logf("Expected %v to be received from TestNode_1, instead got %q", name, in.Peer)
+				t.FailNow()
+			}
+		case <-time.After(time.Second):
+			t.Logf("Expected %v to be received, instead nothing happened", name)
+			t.FailNow()
+		}
+	}
+
+	if err := node2.verifySource("TestNode_2", "127.0.0.1:54321", "TestNode_1"); err == nil {
+		t.Logf("Expected message from a peer authenticated as another node to be rejected, instead error was nil")
+		t.FailNow()
+	}
+}
+
+func TestTLSUntrustedPeer(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "raftify")
+	defer os.RemoveAll(dir)
+
+	// node2's certificate has been issued by another CA
+	node1 := initTLSNode(t, genCA(), dir, "TestNode_1", "TestNode_1")
+	node2 := initTLSNode(t, genCA(), dir, "TestNode_2", "TestNode_2")
+
+	node1.createMemberlist()
+	defer node1.memberlist.Shutdown()
+	node2.createMemberlist()
+	defer node2.memberlist.Shutdown()
+
+	if _, err := node2.memberlist.Join([]string{node1.LocalAddr()}); err == nil {
+		t.Logf("Expected node2 with an untrusted certificate to be rejected, instead error was nil")
+		t.FailNow()
+	}
+	if num := node1.memberlist.NumMembers(); num != 1 {
+		t.Logf("Expected node1 to have 1 member, instead got %v", num)
+		t.FailNow()
+	}
+}
+
+func TestTLSNameMismatch(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "raftify")
+	defer os.RemoveAll(dir)
+
+	// node2 holds a trusted certificate issued to another node ID
+	ca := genCA()
+	node1 := initTLSNode(t, ca, dir, "TestNode_1", "TestNode_1")
+	node2 := initTLSNode(t, ca, dir, "TestNode_2", "TestNode_3")
+
+	node1.createMemberlist()
+	defer node1.memberlist.Shutdown()
+	node2.createMemberlist()
+	defer node2.memberlist.Shutdown()
+
+	node2.memberlist.Join([]string{node1.LocalAddr()})
+
+	// node2 is never handed to raftify and refused once its certificate has been checked
+	delegate := node1.admission.next.(*tlsAliveDelegate)
+	member := &memberlist.Node{Name: "TestNode_2", Addr: net.ParseIP("127.0.0.1"), Port: uint16(node2.memberlist.LocalNode().Port)}
+	for deadline := time.Now().Add(5 * time.Second); delegate.NotifyAlive(member) == nil; time.Sleep(10 * time.Millisecond) {
+		if _, err := node1.getNodeByName("TestNode_2"); err == nil {
+			t.Logf("Expected node2 to be hidden while its certificate is verified, instead it is a member of node1")
+			t.FailNow()
+		}
+		if time.Now().After(deadline) {
+			t.Logf("Expected node2 to be refused due to its certificate name, instead it is still accepted")
+			t.FailNow()
+		}
+	}
+	if _, err := node1.getNodeByName("TestNode_2"); err == nil {
+		t.Logf("Expected node2 to be rejected due to its certificate name, instead it is a member of node1")
+		t.FailNow()
+	}
+}
+
+func TestTLSVerifyRetry(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "raftify")
+	defer os.RemoveAll(dir)
+
+	// Reserve ports for this test
+	ports := reservePorts(2)
+
+	ca := genCA()
+	node1 := initTLSNode(t, ca, dir, "TestNode_1", "TestNode_1")
+	node2 := initTLSNode(t, ca, dir, "TestNode_2", "TestNode_2")
+	node1.config.BindPort, node2.config.BindPort = ports[0], ports[1]
+
+	node1.createMemberlist()
+	defer node1.memberlist.Shutdown()
+
+	// node2 isn't listening yet, so the first verification fails to reach it
+	delegate := node1.admission.next.(*tlsAliveDelegate)
+	delegate.backoff = 100 * time.Millisecond
+	member := &memberlist.Node{Name: "TestNode_2", Addr: net.ParseIP("127.0.0.1"), Port: uint16(ports[1])}
+	if err := delegate.NotifyAlive(member); err != nil {
+		t.Logf("Expected node2 to be accepted while its certificate is verified, instead got error: %v", err)
+		t.FailNow()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if delegate.trusted(member) {
+		t.Logf("Expected node2 not to be trusted before it could be reached")
+		t.FailNow()
+	}
+
+	// A later attempt reaches node2 and verifies its certificate
+	node2.createMemberlist()
+	defer node2.memberlist.Shutdown()
+	for deadline := time.Now().Add(5 * time.Second); !delegate.trusted(member); time.Sleep(10 * time.Millisecond) {
+		if err := delegate.NotifyAlive(member); err != nil {
+			t.Logf("Expected node2 not to be rejected because it couldn't be reached, instead got error: %v", err)
+			t.FailNow()
+		}
+		if time.Now().After(deadline) {
+			t.Logf("Expected node2 to be trusted once it could be reached, instead it is still pending")
+			t.FailNow()
+		}
+	}
+}
+
+func TestTLSAliveDelegateForget(t *testing.T) {
+	node := initDummyNode("TestNode_1", 1, 3, 0)
+	delegate := newTLSAliveDelegate("TestNode_1", nil, node.logger)
+	node.events.onLeave = delegate.forget
+
+	member := &memberlist.Node{Name: "TestNode_2", Addr: net.ParseIP("127.0.0.1"), Port: 7946}
+	delegate.verified["TestNode_2"] = "127.0.0.1:7946"
+	delegate.rejected["TestNode_2"] = "127.0.0.1:7947"
+	if !delegate.trusted(member) {
+		t.Logf("Expected verified member to be trusted")
+		t.FailNow()
+	}
+
+	// Everything known about a member is discarded once it has left
+	node.events.NotifyLeave(member)
+	if delegate.trusted(member) || len(delegate.verified) != 0 || len(delegate.rejected) != 0 {
+		t.Logf("Expected everything known about the member to be discarded after it has left, instead got %v verified and %v rejected", delegate.verified, delegate.rejected)
+		t.FailNow()
+	}
+}
+
+func TestCertificateID(t *testing.T) {
+	cases := []struct {
+		cn       string
+		dnsNames []string
+		id       string
+	}{
+		{"TestNode_1", []string{"TestNode_1"}, "TestNode_1"},
+		{"host.example.com", []string{"TestNode_1"}, "TestNode_1"},
+		{"TestNode_1", []string{"host.example.com", "TestNode_1"}, "TestNode_1"},
+		{"TestNode_1", nil, ""},
+		{"TestNode_1", []string{"host.example.com", "TestNode_2"}, ""},
+	}
+
+	for _, c := range cases {
+		id, err := certificateID(&x509.Certificate{Subject: pkix.Name{CommonName: c.cn}, DNSNames: c.dnsNames})
+		if id != c.id || (err == nil) != (c.id != "") {
+			t.Logf("Expected certificate issued to %v with DNS names %v to name node ID %q, instead got %q and error %v", c.cn, c.dnsNames, c.id, id, err)
+			t.FailNow()
+		}
+	}
+}
@@ -0,0 +1,714 @@
+package raftify
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/memberlist"
+)
+
+// raftifyMsg is the first byte of every packet and stream carrying a raftify message. It is
+// chosen such that it never collides with the message types and encryption versions used by
+// memberlist so that both can share the same listeners.
+const raftifyMsg byte = 'R'
+
+// raftifyJoin is the first byte of every stream carrying a join request. Unlike other raftify
+// messages, join requests are answered on the same stream.
+const raftifyJoin byte = 'J'
+
+// Number of received raftify messages that can be queued per priority before new packets are
+// dropped.
+const inboundQueueDepth = 1024
+
+// netTransport is the interface of the transports raftify and memberlist messages are
+// exchanged with, i.e. memberlist's network transport or the TLS transport.
+type netTransport interface {
+	memberlist.NodeAwareTransport
+
+	// GetAutoBindPort returns the port the transport is bound to.
+	GetAutoBindPort() int
+}
+
+// authenticatedAddr is the address of a peer that has authenticated itself on the transport
+// level under the given name.
+type authenticatedAddr struct {
+	net.Addr
+	name string
+}
+
+// peerName returns the name the peer with the given address has authenticated with, or an
+// empty string if the transport doesn't authenticate its peers.
+func peerName(addr net.Addr) string {
+	if authAddr, ok := addr.(*authenticatedAddr); ok {
+		return authAddr.name
+	}
+	return ""
+}
+
+// messageTransport wraps the transport memberlist uses and intercepts all packets and streams
+// carrying raftify messages. Unlike messages sent via memberlist's delegate, this allows the
+// address a message has been received from to be checked against the member it claims to
+// originate from. Everything else is passed on to memberlist untouched.
+type messageTransport struct {
+	netTransport
+
+	logger *log.Logger
+
+	// The keyring used to encrypt and decrypt raftify messages, nil if encryption is disabled.
+	keyring *memberlist.Keyring
+
+	// The timeout for writing and reading raftify messages via stream.
+	timeout time.Duration
+
+	// The channels memberlist receives the packets and streams not meant for raftify from.
+	packetCh chan *memberlist.Packet
+	streamCh chan net.Conn
+
+	// The queues of received raftify messages and the channel they are delivered to. Messages
+	// in the priority queue are delivered before all others.
+	priorityCh chan InboundMessage
+	inboundCh  chan InboundMessage
+	messageCh  chan<- InboundMessage
+
+	// The handler join requests are answered with. Requests it returns nil for stay unanswered.
+	admit func(InboundMessage) []byte
+
+	// The maximum size of received messages and the rate limiter applied per sender.
+	maxSize int
+	limiter *rateLimiter
+
+	// The metrics dropped messages are counted in.
+	metrics *Metrics
+
+	// The function deciding whether traffic may be sent to an address, nil to allow all.
+	filter func(addr string) bool
+
+	shutdownCh   chan struct{}
+	shutdownOnce sync.Once
+}
+
+// newNetTransport creates memberlist's network transport. If the port is 0, creating the
+// transport is retried a few times since the port picked by the operating system may only be
+// free for TCP but not for UDP.
+func newNetTransport(config *memberlist.Config) (*memberlist.NetTransport, error) {
+	netConfig := &memberlist.NetTransportConfig{
+		BindAddrs: []string{config.BindAddr},
+		BindPort:  config.BindPort,
+		Logger:    config.Logger,
+	}
+
+	var transport *memberlist.NetTransport
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		if transport, err = memberlist.NewNetTransport(netConfig); err == nil || config.BindPort != 0 {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't set up network transport: %v", err)
+	}
+	return transport, nil
+}
+
+// newMessageTransport wraps the transport passed in and starts intercepting raftify messages.
+// Received messages exceeding the limits are dropped and counted in the metrics.
+func newMessageTransport(inner netTransport, config *memberlist.Config, keyring *memberlist.Keyring, limits LimitsConfig, metrics *Metrics, messageCh chan<- InboundMessage, admit func(InboundMessage) []byte) *messageTransport {
+	t := &messageTransport{
+		netTransport: inner,
+		logger:       config.Logger,
+		keyring:      keyring,
+		timeout:      config.TCPTimeout,
+		packetCh:     make(chan *memberlist.Packet),
+		streamCh:     make(chan net.Conn),
+		priorityCh:   make(chan InboundMessage, inboundQueueDepth),
+		inboundCh:    make(chan InboundMessage, inboundQueueDepth),
+		messageCh:    messageCh,
+		admit:        admit,
+		maxSize:      limits.MaxMessageSize,
+		limiter:      newRateLimiter(limits),
+		metrics:      metrics,
+		shutdownCh:   make(chan struct{}),
+	}
+
+	go t.listenPackets()
+	go t.listenStreams()
+	go t.deliver()
+	return t
+}
+
+// PacketCh implements the memberlist Transport interface.
+func (t *messageTransport) PacketCh() <-chan *memberlist.Packet {
+	return t.packetCh
+}
+
+// StreamCh implements the memberlist Transport interface.
+func (t *messageTransport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+// Shutdown implements the memberlist Transport interface.
+func (t *messageTransport) Shutdown() error {
+	t.shutdownOnce.Do(func() {
+		close(t.shutdownCh)
+	})
+
+	// The listeners of the network transport block until their last packet or stream has been
+	// taken, so both are drained until the listeners have stopped.
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-t.netTransport.PacketCh():
+			case conn := <-t.netTransport.StreamCh():
+				conn.Close()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := t.netTransport.Shutdown()
+	close(done)
+	return err
+}
+
+// listenPackets takes raftify messages out of the packets received and passes on the rest.
+func (t *messageTransport) listenPackets() {
+	for {
+		select {
+		case packet := <-t.netTransport.PacketCh():
+			if len(packet.Buf) == 0 || packet.Buf[0] != raftifyMsg {
+				select {
+				case t.packetCh <- packet:
+				case <-t.shutdownCh:
+					return
+				}
+				continue
+			}
+			if !t.accept(packet.From, len(packet.Buf)-1, false) {
+				continue
+			}
+			t.enqueue(packet.From, packet.Buf[1:], false)
+
+		case <-t.shutdownCh:
+			return
+		}
+	}
+}
+
+// listenStreams takes raftify messages out of the streams received and passes on the rest.
+func (t *messageTransport) listenStreams() {
+	for {
+		select {
+		case conn := <-t.netTransport.StreamCh():
+			go t.handleStream(conn)
+		case <-t.shutdownCh:
+			return
+		}
+	}
+}
+
+// handleStream reads the first byte of a stream to determine whether it carries a raftify
+// message. Streams meant for memberlist are passed on with the byte put back in front.
+func (t *messageTransport) handleStream(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(t.timeout))
+	reader := bufio.NewReader(conn)
+
+	first, err := reader.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if first[0] != raftifyMsg && first[0] != raftifyJoin {
+		conn.SetDeadline(time.Time{})
+		select {
+		case t.streamCh <- &peekedConn{Conn: conn, reader: reader}:
+		case <-t.shutdownCh:
+			conn.Close()
+		}
+		return
+	}
+	defer conn.Close()
+
+	if !t.accept(conn.RemoteAddr(), 0, true) {
+		return
+	}
+	payload, err := readFrame(reader, t.maxSize)
+	if errors.Is(err, errMessageTooLarge) {
+		atomic.AddUint64(&t.metrics.OversizedMessages, 1)
+		t.logger.Printf("[WARN] raftify: Dropped message stream from %v: %v\n", conn.RemoteAddr(), err.Error())
+		return
+	} else if err != nil {
+		t.logger.Printf("[ERR] raftify: couldn't read message stream from %v: %v\n", conn.RemoteAddr(), err.Error())
+		return
+	}
+
+	if first[0] == raftifyJoin {
+		t.answerJoin(conn, payload)
+		return
+	}
+	t.enqueue(conn.RemoteAddr(), payload, true)
+}
+
+// answerJoin passes a join request to the admission handler and writes its response back to
+// the stream the request has been received on.
+func (t *messageTransport) answerJoin(conn net.Conn, payload []byte) {
+	msg, err := t.open(conn.RemoteAddr(), payload)
+	if err != nil {
+		t.logger.Printf("[ERR] raftify: %v\n", err.Error())
+		return
+	}
+	answer := t.admit(msg)
+	if answer == nil {
+		return
+	}
+
+	resp, err := t.seal(answer)
+	if err != nil {
+		t.logger.Printf("[ERR] raftify: couldn't encrypt join response to %v: %v\n", conn.RemoteAddr(), err.Error())
+		return
+	}
+	conn.Write(frame(raftifyJoin, resp))
+}
+
+// accept checks a received message against the limits before it is read any further. Streams
+// are checked with a size of 0 since their size is only known once the frame is read.
+func (t *messageTransport) accept(from net.Addr, size int, stream bool) bool {
+	if size > t.maxSize {
+		atomic.AddUint64(&t.metrics.OversizedMessages, 1)
+		t.logger.Printf("[WARN] raftify: Dropped message from %v: %v bytes exceed the max_message_size of %v bytes\n", from, size, t.maxSize)
+		return false
+	}
+	if !t.limiter.allow(rateLimitKey(from, stream), time.Now()) {
+		atomic.AddUint64(&t.metrics.RateLimited, 1)
+		t.logger.Printf("[DEBUG] raftify: Dropped message from %v: message rate exceeded\n", from)
+		return false
+	}
+	return true
+}
+
+// readFrame reads the length-prefixed payload of a raftify stream whose first byte has already
+// been peeked at. Payloads larger than maxSize are not read.
+func readFrame(reader io.Reader, maxSize int) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if uint64(size) > uint64(maxSize) {
+		return nil, fmt.Errorf("%w: %v bytes exceed %v bytes", errMessageTooLarge, size, maxSize)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// frame prepends the kind and length of the payload for sending it via stream.
+func frame(kind byte, payload []byte) []byte {
+	buf := make([]byte, 5, 5+len(payload))
+	buf[0] = kind
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(payload)))
+	return append(buf, payload...)
+}
+
+// open decrypts a received raftify message if encryption is enabled.
+func (t *messageTransport) open(from net.Addr, payload []byte) (InboundMessage, error) {
+	if t.keyring != nil {
+		var err error
+		if payload, err = decryptPayload(t.keyring.GetKeys(), payload); err != nil {
+			return InboundMessage{}, fmt.Errorf("couldn't decrypt message from %v: %v", from, err.Error())
+		}
+	}
+	return InboundMessage{From: from.String(), Peer: peerName(from), Payload: payload}, nil
+}
+
+// enqueue decrypts a received raftify message and queues it for delivery. Election-critical
+// messages are queued separately so that they are delivered first. Messages received via stream
+// wait for space in their queue, packets are dropped if the queue is full.
+func (t *messageTransport) enqueue(from net.Addr, payload []byte, wait bool) {
+	msg, err := t.open(from, payload)
+	if err != nil {
+		t.logger.Printf("[ERR] raftify: %v\n", err.Error())
+		return
+	}
+	t.queue(msg, wait)
+}
+
+// enqueueLegacy queues a raftify message received as memberlist user message from a member that
+// predates the message transport. Memberlist has already decrypted it, but its source address is
+// unknown, so it is rate limited by the node it claims to originate from instead. The claim is
+// verified once the message is decoded. The payload is copied since memberlist reuses its buffer.
+func (t *messageTransport) enqueueLegacy(payload []byte) {
+	if len(payload) > t.maxSize {
+		atomic.AddUint64(&t.metrics.OversizedMessages, 1)
+		t.logger.Printf("[WARN] raftify: Dropped memberlist user message: %v bytes exceed the max_message_size of %v bytes\n", len(payload), t.maxSize)
+		return
+	}
+	sender := legacySender(payload)
+	if sender == "" {
+		atomic.AddUint64(&t.metrics.InvalidMessages, 1)
+		t.logger.Printf("[WARN] raftify: Dropped memberlist user message without sender\n")
+		return
+	}
+	if !t.limiter.allow("legacy/"+sender, time.Now()) {
+		atomic.AddUint64(&t.metrics.RateLimited, 1)
+		t.logger.Printf("[DEBUG] raftify: Dropped memberlist user message from %v: message rate exceeded\n", sender)
+		return
+	}
+	t.queue(InboundMessage{Payload: append([]byte(nil), payload...), legacy: true}, false)
+}
+
+// legacySender returns the node ID a message received as memberlist user message claims to
+// originate from, i.e. the sender of the envelope or, for members that don't name themselves,
+// the node ID in its content. Returns an empty string if the message is malformed.
+func legacySender(payload []byte) string {
+	var msg Message
+	format := formatOf(payload)
+	if format == formatMsgpack {
+		payload = payload[1:]
+	}
+	if err := unmarshal(format, payload, &msg); err != nil {
+		return ""
+	}
+	if msg.Sender != "" {
+		return msg.Sender
+	}
+
+	var content struct {
+		LeaderID       string `json:"leader_id" codec:"leader_id"`
+		FollowerID     string `json:"follower_id" codec:"follower_id"`
+		PreCandidateID string `json:"pre_candidate_id" codec:"pre_candidate_id"`
+		CandidateID    string `json:"candidate_id" codec:"candidate_id"`
+		LeavingID      string `json:"leaving_id" codec:"leaving_id"`
+		NodeID         string `json:"node_id" codec:"node_id"`
+		MemberID       string `json:"member_id" codec:"member_id"`
+	}
+	var err error
+	if format == formatJSON {
+		err = json.Unmarshal(msg.Content, &content) // The content's other fields are unknown here.
+	} else {
+		err = unmarshal(format, msg.Content, &content)
+	}
+	if err != nil {
+		return ""
+	}
+	for _, id := range []string{content.LeaderID, content.FollowerID, content.PreCandidateID, content.CandidateID, content.LeavingID, content.NodeID, content.MemberID} {
+		if id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// queue queues a received raftify message for delivery. Election-critical messages are queued
+// separately so that they are delivered first. If wait is set, it waits for space in the queue,
+// otherwise the message is dropped if the queue is full.
+func (t *messageTransport) queue(msg InboundMessage, wait bool) {
+	queue, overflows := t.inboundCh, &t.metrics.QueueOverflows
+	if msgType, ok := peekType(msg.Payload); ok && msgType.isElectionCritical() {
+		queue, overflows = t.priorityCh, &t.metrics.PriorityQueueOverflows
+	}
+
+	if wait {
+		select {
+		case queue <- msg:
+		case <-t.shutdownCh:
+		}
+		return
+	}
+
+	select {
+	case queue <- msg:
+	default:
+		atomic.AddUint64(overflows, 1)
+		t.logger.Printf("[WARN] raftify: inbound message queue is full, dropping message from %v\n", msg.From)
+	}
+}
+
+// peekType returns the type of a received message in either wire format without decoding the
+// rest of it.
+func peekType(payload []byte) (MessageType, bool) {
+	var msg struct {
+		Type *MessageType `json:"type" codec:"type"`
+	}
+	if formatOf(payload) == formatJSON {
+		if err := json.Unmarshal(payload, &msg); err != nil || msg.Type == nil {
+			return 0, false
+		}
+		return *msg.Type, true
+	}
+
+	payload = payload[1:]
+	if err := checkMsgpack(payload); err != nil {
+		return 0, false
+	}
+	if err := codec.NewDecoderBytes(payload, msgpackPeekHandle).Decode(&msg); err != nil || msg.Type == nil {
+		return 0, false
+	}
+	return *msg.Type, true
+}
+
+// pendingPriority returns the number of election-critical messages waiting to be delivered.
+func (t *messageTransport) pendingPriority() int {
+	return len(t.priorityCh)
+}
+
+// deliver hands the queued raftify messages over to the node one by one. Election-critical
+// messages are handed over first.
+func (t *messageTransport) deliver() {
+	for {
+		var msg InboundMessage
+		select {
+		case msg = <-t.priorityCh:
+		default:
+			select {
+			case msg = <-t.priorityCh:
+			case msg = <-t.inboundCh:
+			case <-t.shutdownCh:
+				return
+			}
+		}
+
+		select {
+		case t.messageCh <- msg:
+		case <-t.shutdownCh:
+			return
+		}
+	}
+}
+
+// seal encrypts the message with the primary key if encryption is enabled.
+func (t *messageTransport) seal(msg []byte) ([]byte, error) {
+	if t.keyring == nil {
+		return msg, nil
+	}
+	return encryptPayload(t.keyring.GetPrimaryKey(), msg)
+}
+
+// reachable checks whether the network filter allows traffic to be sent to the address.
+func (t *messageTransport) reachable(addr string) bool {
+	return t.filter == nil || t.filter(addr)
+}
+
+// WriteTo implements the memberlist Transport interface. Packets to addresses blocked by the
+// network filter are dropped silently like packets lost on the network.
+func (t *messageTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	if !t.reachable(addr) {
+		return time.Now(), nil
+	}
+	return t.netTransport.WriteTo(b, addr)
+}
+
+// WriteToAddress implements the memberlist NodeAwareTransport interface. Packets to addresses
+// blocked by the network filter are dropped silently like packets lost on the network.
+func (t *messageTransport) WriteToAddress(b []byte, addr memberlist.Address) (time.Time, error) {
+	if !t.reachable(addr.Addr) {
+		return time.Now(), nil
+	}
+	return t.netTransport.WriteToAddress(b, addr)
+}
+
+// DialTimeout implements the memberlist Transport interface. Streams to addresses blocked by
+// the network filter fail like streams to unreachable hosts.
+func (t *messageTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	if !t.reachable(addr) {
+		return nil, fmt.Errorf("%v is blocked by the network filter", addr)
+	}
+	return t.netTransport.DialTimeout(addr, timeout)
+}
+
+// DialAddressTimeout implements the memberlist NodeAwareTransport interface. Streams to
+// addresses blocked by the network filter fail like streams to unreachable hosts.
+func (t *messageTransport) DialAddressTimeout(addr memberlist.Address, timeout time.Duration) (net.Conn, error) {
+	if !t.reachable(addr.Addr) {
+		return nil, fmt.Errorf("%v is blocked by the network filter", addr.Addr)
+	}
+	return t.netTransport.DialAddressTimeout(addr, timeout)
+}
+
+// sendPacket sends a raftify message to the member via UDP.
+func (t *messageTransport) sendPacket(member *Member, msg []byte) error {
+	payload, err := t.seal(msg)
+	if err != nil {
+		return err
+	}
+
+	packet := append([]byte{raftifyMsg}, payload...)
+	_, err = t.WriteToAddress(packet, memberlist.Address{Addr: member.Address(), Name: member.Name})
+	return err
+}
+
+// sendStream sends a raftify message to the member via TCP.
+func (t *messageTransport) sendStream(member *Member, msg []byte) error {
+	payload, err := t.seal(msg)
+	if err != nil {
+		return err
+	}
+
+	conn, err := t.DialAddressTimeout(memberlist.Address{Addr: member.Address(), Name: member.Name}, t.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(t.timeout))
+
+	_, err = conn.Write(frame(raftifyMsg, payload))
+	return err
+}
+
+// request sends a join request to the address via TCP and waits for the response. Returns an
+// error wrapping errPeerUnreachable if the address couldn't be dialed.
+func (t *messageTransport) request(addr string, msg []byte) (InboundMessage, error) {
+	payload, err := t.seal(msg)
+	if err != nil {
+		return InboundMessage{}, err
+	}
+
+	conn, err := t.DialAddressTimeout(memberlist.Address{Addr: addr}, t.timeout)
+	if err != nil {
+		return InboundMessage{}, fmt.Errorf("%w: %v", errPeerUnreachable, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(t.timeout))
+
+	if _, err := conn.Write(frame(raftifyJoin, payload)); err != nil {
+		return InboundMessage{}, err
+	}
+	resp, err := readFrame(conn, t.maxSize)
+	if err != nil {
+		return InboundMessage{}, fmt.Errorf("couldn't read join response from %v: %v", addr, err)
+	}
+	return t.open(conn.RemoteAddr(), resp)
+}
+
+// peekedConn is a connection whose first bytes have already been read into a buffer.
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read implements the net.Conn interface.
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// encryptPayload encrypts the payload with AES-GCM. The nonce is prepended to the ciphertext.
+func encryptPayload(key, payload []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, payload, []byte{raftifyMsg}), nil
+}
+
+// decryptPayload decrypts the payload with the first of the keys that succeeds.
+func decryptPayload(keys [][]byte, payload []byte) ([]byte, error) {
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			continue
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil || len(payload) < gcm.NonceSize() {
+			continue
+		}
+
+		nonce, ciphertext := payload[:gcm.NonceSize()], payload[gcm.NonceSize():]
+		if plain, err := gcm.Open(nil, nonce, ciphertext, []byte{raftifyMsg}); err == nil {
+			return plain, nil
+		}
+	}
+	return nil, errors.New("no installed key could decrypt the message")
+}
+
+// sendBestEffort sends a raftify message to the member without acknowledgement, e.g. via UDP.
+func (n *Node) sendBestEffort(member *Member, msg []byte) error {
+	return n.network.Send(member, msg, BestEffort)
+}
+
+// sendReliable sends a raftify message to the member reliably, e.g. via TCP.
+func (n *Node) sendReliable(member *Member, msg []byte) error {
+	return n.network.Send(member, msg, Reliable)
+}
+
+// verifyLegacySender checks that a message received as memberlist user message claims to
+// originate from a member that predates the message transport. The source address of such
+// messages is unknown, so they are only accepted until their sender advertises a protocol version.
+func (n *Node) verifyLegacySender(id string, msg Message) error {
+	member, err := n.getNodeByName(id)
+	if err != nil {
+		return fmt.Errorf("sender %v is not a cluster member", id)
+	}
+	if msg.Sender != "" && msg.Sender != id {
+		return fmt.Errorf("claims to originate from %v but was sent by %v", id, msg.Sender)
+	}
+	if msg.Version != 0 || !n.metas.speaksLegacyTransport(member) {
+		return fmt.Errorf("was received as memberlist user message but %v speaks the message transport", id)
+	}
+	return nil
+}
+
+// verifySource checks that a message claiming to originate from the member with the given ID
+// has been sent by that member. If the sender has authenticated itself on the transport level,
+// the name it has authenticated with must match. Senders that have neither authenticated via TLS
+// nor signed the message are checked against the member's address unless skip_source_addr_check
+// is set.
+// Only the IP address is compared since the port messages are sent from differs from the one
+// advertised for streams.
+func (n *Node) verifySource(id, from, peer string) error {
+	member, err := n.getNodeByName(id)
+	if err != nil {
+		return fmt.Errorf("sender %v is not a cluster member", id)
+	}
+	return n.verifyMemberSource(member, from, peer)
+}
+
+// verifyMemberSource returns an error if a message claiming to originate from the given member
+// has been received from another address or peer, see verifySource.
+func (n *Node) verifyMemberSource(member *Member, from, peer string) error {
+	id := member.Name
+	if peer != "" && peer != id {
+		return fmt.Errorf("claims to originate from %v but the sender authenticated as %v", id, peer)
+	}
+
+	// Senders authenticated via TLS or their signature are identified more reliably than by
+	// their address, which differs behind NATs and on multi-homed hosts.
+	if peer != "" || n.identity != nil || n.config.SkipSourceAddrCheck {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(from)
+	if err != nil {
+		return fmt.Errorf("unknown source address %q", from)
+	}
+	if ip := net.ParseIP(host); ip == nil || !n.metas.isPath(member, ip) {
+		return fmt.Errorf("claims to originate from %v [%v] but was received from %v", id, member.Addr, host)
+	}
+	return nil
+}
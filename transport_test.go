@@ -0,0 +1,418 @@
+package raftify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEncryptDecryptPayload(t *testing.T) {
+	key1, _ := hexToByte(testHexKey)
+	key2, _ := hexToByte(testHexKey2)
+
+	encrypted, err := encryptPayload(key1, []byte("raftify"))
+	if err != nil {
+		t.Logf("Expected payload to be encrypted, instead got error: %v", err)
+		t.FailNow()
+	}
+	if bytes.Contains(encrypted, []byte("raftify")) {
+		t.Logf("Expected payload not to be readable after encryption")
+		t.FailNow()
+	}
+
+	// The key used for encryption is not the first one installed
+	decrypted, err := decryptPayload([][]byte{key2, key1}, encrypted)
+	if err != nil || string(decrypted) != "raftify" {
+		t.Logf("Expected payload to be decrypted, instead got %q and error %v", decrypted, err)
+		t.FailNow()
+	}
+
+	// None of the keys match
+	if _, err := decryptPayload([][]byte{key2}, encrypted); err == nil {
+		t.Logf("Expected decryption with the wrong key to fail, instead error was nil")
+		t.FailNow()
+	}
+
+	// Truncated payload
+	if _, err := decryptPayload([][]byte{key1}, encrypted[:4]); err == nil {
+		t.Logf("Expected decryption of a truncated payload to fail, instead error was nil")
+		t.FailNow()
+	}
+}
+
+func TestMessageTransport(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(2)
+
+	// Initialize and start dummy nodes with encryption enabled
+	node1 := initDummyNode("TestNode_1", 1, 2, ports[0])
+	node2 := initDummyNode("TestNode_2", 1, 2, ports[1])
+	node1.secretKey, _ = hexToByte(testHexKey)
+	node2.secretKey, _ = hexToByte(testHexKey)
+
+	node1.createMemberlist()
+	defer node1.memberlist.Shutdown()
+	node2.createMemberlist()
+	defer node2.memberlist.Shutdown()
+
+	// Memberlist's own traffic still passes through the transport
+	if _, err := node2.memberlist.Join([]string{fmt.Sprintf("127.0.0.1:%v", ports[0])}); err != nil {
+		t.Logf("Expected node2 to join node1, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	member, _ := node1.getNodeByName("TestNode_2")
+	send := map[string]func() error{
+		"packet": func() error { return node1.sendBestEffort(member, []byte("best effort")) },
+		"stream": func() error { return node1.sendReliable(member, []byte("reliable")) },
+	}
+
+	for name, sendFunc := range send {
+		if err := sendFunc(); err != nil {
+			t.Logf("Expected %v to be sent, instead got error: %v", name, err)
+			t.FailNow()
+		}
+
+		select {
+		case in := <-node2.messages.messageCh:
+			if host, _, _ := net.SplitHostPort(in.From); host != "127.0.0.1" {
+				t.Logf("Expected %v to be received from 127.0.0.1, instead got %v", name, in.From)
+				t.FailNow()
+			}
+		case <-time.After(time.Second):
+			t.Logf("Expected %v to be received, instead nothing happened", name)
+			t.FailNow()
+		}
+	}
+}
+
+func TestNetworkFilter(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(2)
+
+	node1 := initDummyNode("TestNode_1", 1, 2, ports[0])
+	node2 := initDummyNode("TestNode_2", 1, 2, ports[1])
+
+	var blocked int32
+	node1.networkFilter = func(addr string) bool {
+		return atomic.LoadInt32(&blocked) == 0 || addr != fmt.Sprintf("127.0.0.1:%v", ports[1])
+	}
+
+	node1.createMemberlist()
+	defer node1.memberlist.Shutdown()
+	node2.createMemberlist()
+	defer node2.memberlist.Shutdown()
+
+	if _, err := node1.memberlist.Join([]string{fmt.Sprintf("127.0.0.1:%v", ports[1])}); err != nil {
+		t.Logf("Expected node1 to join node2, instead got error: %v", err)
+		t.FailNow()
+	}
+	member, _ := node1.getNodeByName("TestNode_2")
+	atomic.StoreInt32(&blocked, 1)
+
+	// Packets to blocked addresses are lost silently while streams fail
+	if err := node1.sendBestEffort(member, []byte("best effort")); err != nil {
+		t.Logf("Expected blocked packet to be dropped silently, instead got error: %v", err)
+		t.FailNow()
+	}
+	if err := node1.sendReliable(member, []byte("reliable")); err == nil {
+		t.Logf("Expected blocked stream to fail, instead error was nil")
+		t.FailNow()
+	}
+	select {
+	case in := <-node2.messages.messageCh:
+		t.Logf("Expected no message to be received, instead got %q", in.Payload)
+		t.FailNow()
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Traffic in the other direction isn't filtered
+	if err := node2.sendReliable(node1.network.LocalMember(), []byte("reliable")); err != nil {
+		t.Logf("Expected stream in the other direction to be sent, instead got error: %v", err)
+		t.FailNow()
+	}
+	select {
+	case <-node1.messages.messageCh:
+	case <-time.After(time.Second):
+		t.Logf("Expected stream in the other direction to be received, instead nothing happened")
+		t.FailNow()
+	}
+}
+
+func TestLegacyTransport(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(3)
+
+	// node2 pretends to predate the message transport
+	node1 := initDummyNode("TestNode_1", 1, 3, ports[0])
+	node2 := initDummyNode("TestNode_2", 1, 3, ports[1])
+	node3 := initDummyNode("TestNode_3", 1, 3, ports[2])
+
+	node1.createMemberlist()
+	defer node1.memberlist.Shutdown()
+	node2.createMemberlist()
+	defer node2.memberlist.Shutdown()
+	node3.createMemberlist()
+	defer node3.memberlist.Shutdown()
+
+	node2.messages.meta = []byte{}
+	node2.memberlist.UpdateNode(time.Second)
+
+	for _, node := range []*Node{node2, node3} {
+		if _, err := node.memberlist.Join([]string{node1.LocalAddr()}); err != nil {
+			t.Logf("Expected %v to join node1, instead got error: %v", node.config.ID, err)
+			t.FailNow()
+		}
+	}
+
+	// node2 is sent memberlist user messages
+	member, _ := node1.getNodeByName("TestNode_2")
+	if err := node1.send(member, HeartbeatMsg, Heartbeat{Term: 1, Quorum: 2, LeaderID: "TestNode_1"}); err != nil {
+		t.Logf("Expected heartbeat to be sent to node2, instead got error: %v", err)
+		t.FailNow()
+	}
+	select {
+	case in := <-node2.messages.messageCh:
+		if !in.legacy {
+			t.Logf("Expected heartbeat to be received as memberlist user message, instead got %+v", in)
+			t.FailNow()
+		}
+	case <-time.After(time.Second):
+		t.Logf("Expected node2 to receive the heartbeat, instead nothing happened")
+		t.FailNow()
+	}
+
+	// User messages are sent without sender and source address
+	receive := func(from *Node, term, heartbeatID uint64) error {
+		content, _ := json.Marshal(HeartbeatResponse{Term: term, HeartbeatID: heartbeatID, FollowerID: from.config.ID})
+		payload, _ := json.Marshal(Message{Type: HeartbeatResponseMsg, Content: content})
+		if err := from.memberlist.SendBestEffort(node1.memberlist.LocalNode(), payload); err != nil {
+			return err
+		}
+
+		select {
+		case in := <-node1.messages.messageCh:
+			msg, err := node1.decodeMessage(in)
+			if err != nil {
+				return err
+			}
+			var resp HeartbeatResponse
+			return node1.decodeContent(msg, &resp)
+		case <-time.After(time.Second):
+			return errors.New("nothing received")
+		}
+	}
+	if err := receive(node2, 2, 1); err != nil {
+		t.Logf("Expected heartbeat response of node2 to be accepted, instead got error: %v", err)
+		t.FailNow()
+	}
+
+	// Replayed and stale user messages are rejected
+	if err := receive(node2, 2, 1); err == nil {
+		t.Logf("Expected replayed heartbeat response of node2 to be rejected, instead error was nil")
+		t.FailNow()
+	}
+	if err := receive(node2, 1, 2); err == nil {
+		t.Logf("Expected heartbeat response of node2 from an earlier term to be rejected, instead error was nil")
+		t.FailNow()
+	}
+	if err := receive(node2, 2, 2); err != nil {
+		t.Logf("Expected next heartbeat response of node2 to be accepted, instead got error: %v", err)
+		t.FailNow()
+	}
+	if replays := node1.GetMetrics().Replays; replays != 2 {
+		t.Logf("Expected 2 replays, instead got %v", replays)
+		t.FailNow()
+	}
+
+	// node3 advertises its protocol versions, so its user messages are rejected
+	if err := receive(node3, 2, 1); err == nil {
+		t.Logf("Expected user message of node3 to be rejected, instead error was nil")
+		t.FailNow()
+	}
+}
+
+func TestLegacyRateLimit(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(1)
+
+	node := initDummyNode("TestNode_1", 1, 3, ports[0])
+	node.createMemberlist()
+	defer node.memberlist.Shutdown()
+	node.transport.limiter = newRateLimiter(LimitsConfig{MessageRate: 1, MessageBurst: 2})
+
+	legacyMessage := func(msgType MessageType, content interface{}) []byte {
+		raw, _ := json.Marshal(content)
+		payload, _ := json.Marshal(Message{Type: msgType, Content: raw})
+		return payload
+	}
+
+	// User messages are rate limited by the node they claim to originate from
+	for i := 0; i < 3; i++ {
+		node.transport.enqueueLegacy(legacyMessage(HeartbeatResponseMsg, HeartbeatResponse{Term: 1, FollowerID: "TestNode_2"}))
+	}
+	node.transport.enqueueLegacy(legacyMessage(VoteRequestMsg, VoteRequest{Term: 1, CandidateID: "TestNode_3"}))
+	if limited := node.GetMetrics().RateLimited; limited != 1 {
+		t.Logf("Expected 1 rate limited message, instead got %v", limited)
+		t.FailNow()
+	}
+
+	// User messages without sender are dropped
+	node.transport.enqueueLegacy(legacyMessage(HeartbeatResponseMsg, HeartbeatResponse{Term: 1}))
+	if invalid := node.GetMetrics().InvalidMessages; invalid != 1 {
+		t.Logf("Expected user message without sender to be dropped, instead got %v invalid messages", invalid)
+		t.FailNow()
+	}
+}
+
+func TestVerifySource(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(2)
+
+	// Initialize and start dummy nodes
+	node1 := initDummyNode("TestNode_1", 1, 2, ports[0])
+	node2 := initDummyNode("TestNode_2", 1, 2, ports[1])
+
+	node1.createMemberlist()
+	defer node1.memberlist.Shutdown()
+	node2.createMemberlist()
+	defer node2.memberlist.Shutdown()
+
+	node2.memberlist.Join([]string{fmt.Sprintf("127.0.0.1:%v", ports[0])})
+
+	// Streams are received from an ephemeral port
+	if err := node2.verifySource("TestNode_1", "127.0.0.1:54321", ""); err != nil {
+		t.Logf("Expected source to match TestNode_1, instead got error: %v", err)
+		t.FailNow()
+	}
+	if err := node2.verifySource("TestNode_1", "10.0.0.1:54321", ""); err == nil {
+		t.Logf("Expected source from another address to be rejected, instead error was nil")
+		t.FailNow()
+	}
+	if err := node2.verifySource("TestNode_3", "127.0.0.1:54321", ""); err == nil {
+		t.Logf("Expected message from a non-member to be rejected, instead error was nil")
+		t.FailNow()
+	}
+	if err := node2.verifySource("TestNode_1", "", ""); err == nil {
+		t.Logf("Expected message without source address to be rejected, instead error was nil")
+		t.FailNow()
+	}
+
+	// With skip_source_addr_check set, only the membership is checked
+	node2.config.SkipSourceAddrCheck = true
+	if err := node2.verifySource("TestNode_1", "10.0.0.1:54321", ""); err != nil {
+		t.Logf("Expected source from another address to be accepted, instead got error: %v", err)
+		t.FailNow()
+	}
+	if err := node2.verifySource("TestNode_3", "127.0.0.1:54321", ""); err == nil {
+		t.Logf("Expected message from a non-member to be rejected, instead error was nil")
+		t.FailNow()
+	}
+}
+
+func TestDecodeContentSourceMismatch(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(2)
+
+	// Initialize and start dummy nodes
+	node1 := initDummyNode("TestNode_1", 1, 2, ports[0])
+	node2 := initDummyNode("TestNode_2", 1, 2, ports[1])
+
+	node1.createMemberlist()
+	defer node1.memberlist.Shutdown()
+	node2.createMemberlist()
+	defer node2.memberlist.Shutdown()
+
+	node2.memberlist.Join([]string{fmt.Sprintf("127.0.0.1:%v", ports[0])})
+
+	// Vote response claiming to originate from TestNode_1, received from another host
+	msg, _ := node2.decodeMessage(InboundMessage{
+		From:    "10.0.0.1:54321",
+		Payload: node1.encodeMessage(VoteResponseMsg, VoteResponse{FollowerID: "TestNode_1", VoteGranted: true}),
+	})
+
+	var content VoteResponse
+	if err := node2.decodeContent(msg, &content); err == nil {
+		t.Logf("Expected vote response from the wrong address to be rejected, instead error was nil")
+		t.FailNow()
+	}
+	if metrics := node2.GetMetrics(); metrics.SourceMismatches != 1 {
+		t.Logf("Expected 1 source mismatch to be counted, instead got %v", metrics.SourceMismatches)
+		t.FailNow()
+	}
+}
+
+func TestMessagePriority(t *testing.T) {
+	// Reserve ports for this test
+	ports := reservePorts(2)
+
+	// Initialize and start dummy nodes
+	node1 := initDummyNode("TestNode_1", 1, 2, ports[0])
+	node2 := initDummyNode("TestNode_2", 1, 2, ports[1])
+
+	node1.createMemberlist()
+	defer node1.memberlist.Shutdown()
+	node2.createMemberlist()
+	defer node2.memberlist.Shutdown()
+
+	if _, err := node2.memberlist.Join([]string{node1.LocalAddr()}); err != nil {
+		t.Logf("Expected node2 to join node1, instead got error: %v", err)
+		t.FailNow()
+	}
+	member, _ := node1.getNodeByName("TestNode_2")
+
+	// node2 doesn't handle messages yet, so the first one is held back while the others queue up
+	for i := 0; i < 3; i++ {
+		node1.sendBestEffort(member, node1.encodeMessage(KeyringResponseMsg, KeyringResponse{FollowerID: "TestNode_1"}))
+	}
+	node1.sendBestEffort(member, node1.encodeMessage(HeartbeatMsg, Heartbeat{Term: 1, Quorum: 1, LeaderID: "TestNode_1"}))
+
+	for start := time.Now(); len(node2.transport.inboundCh) != 2 || node2.transport.pendingPriority() != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Logf("Expected messages to be queued, instead got %v regular and %v priority messages", len(node2.transport.inboundCh), node2.transport.pendingPriority())
+			t.FailNow()
+		}
+	}
+
+	// Membership events wait until the heartbeat has been handled
+	if node2.membershipEvents() != nil {
+		t.Logf("Expected membership events to wait for the queued heartbeat")
+		t.FailNow()
+	}
+
+	// but not for longer than maxEventDelay
+	node2.eventsDeferred = time.Now().Add(-maxEventDelay)
+	if node2.membershipEvents() == nil {
+		t.Logf("Expected membership events to be received once they have been deferred for maxEventDelay")
+		t.FailNow()
+	}
+	if node2.membershipEvents() != nil {
+		t.Logf("Expected membership events to be deferred again for the queued heartbeat")
+		t.FailNow()
+	}
+
+	var types []MessageType
+	for i := 0; i < 4; i++ {
+		select {
+		case in := <-node2.messages.messageCh:
+			msg, _ := node2.decodeMessage(in)
+			types = append(types, msg.Type)
+		case <-time.After(time.Second):
+			t.Logf("Expected message %v to be received, instead nothing happened", i)
+			t.FailNow()
+		}
+	}
+	if types[1] != HeartbeatMsg {
+		t.Logf("Expected heartbeat to overtake the queued keyring responses, instead got %v", types)
+		t.FailNow()
+	}
+	if node2.membershipEvents() == nil {
+		t.Logf("Expected membership events to be received once no heartbeats are queued")
+		t.FailNow()
+	}
+}
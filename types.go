@@ -103,8 +103,46 @@ const (
 	// an immediate quorum change instead of having to wait for the cluster to
 	// detect and kick the dead node eventually.
 	NewQuorumMsg
+
+	// A keyring request message is sent out by the leader to all cluster members
+	// in order to install, use, remove or list encryption keys.
+	KeyringRequestMsg
+
+	// A keyring response message is sent by the node who received the keyring
+	// request to the leader it originated from.
+	KeyringResponseMsg
+
+	// A join request message is sent by a node to a peer before joining the cluster
+	// via that peer in order to find out whether it is admitted.
+	JoinRequestMsg
+
+	// A join response message is the answer to a join request and is sent back on
+	// the same stream. It contains the reason if the join has been refused.
+	JoinResponseMsg
+
+	// An ack message is sent by the node who received a prevote or vote response
+	// that asked to be acknowledged to the node it originated from.
+	AckMsg
 )
 
+// isElectionCritical checks whether messages of the type are needed to keep or elect a leader.
+// They take priority over all other messages and membership events.
+func (t *MessageType) isElectionCritical() bool {
+	switch *t {
+	case HeartbeatMsg, HeartbeatResponseMsg, PreVoteRequestMsg, PreVoteResponseMsg, VoteRequestMsg, VoteResponseMsg, AckMsg:
+		return true
+	default:
+		return false
+	}
+}
+
+// isJoin returns whether the message type is exchanged while a node asks to join. Join messages
+// are sent before the node ID and protocol version of the other side are known, so they don't
+// name a recipient.
+func (t *MessageType) isJoin() bool {
+	return *t == JoinRequestMsg || *t == JoinResponseMsg
+}
+
 // toString returns the string representation of a message type.
 func (t *MessageType) toString() string {
 	switch *t {
@@ -122,6 +160,50 @@ func (t *MessageType) toString() string {
 		return "VoteResponseMsg"
 	case NewQuorumMsg:
 		return "NewQuorumMsg"
+	case KeyringRequestMsg:
+		return "KeyringRequestMsg"
+	case KeyringResponseMsg:
+		return "KeyringResponseMsg"
+	case JoinRequestMsg:
+		return "JoinRequestMsg"
+	case JoinResponseMsg:
+		return "JoinResponseMsg"
+	case AckMsg:
+		return "AckMsg"
+	default:
+		return "unknown"
+	}
+}
+
+// KeyringOp is a custom type for all valid keyring operations.
+type KeyringOp uint8
+
+// Constants for valid keyring operations.
+const (
+	// InstallKeyOp adds a new key to the keyring without using it for encryption yet.
+	InstallKeyOp KeyringOp = iota
+
+	// UseKeyOp makes an installed key the primary key used for encryption.
+	UseKeyOp
+
+	// RemoveKeyOp removes a key that is no longer the primary key from the keyring.
+	RemoveKeyOp
+
+	// ListKeysOp lists all keys installed in the keyring.
+	ListKeysOp
+)
+
+// toString returns the string representation of a keyring operation.
+func (o *KeyringOp) toString() string {
+	switch *o {
+	case InstallKeyOp:
+		return "InstallKey"
+	case UseKeyOp:
+		return "UseKey"
+	case RemoveKeyOp:
+		return "RemoveKey"
+	case ListKeysOp:
+		return "ListKeys"
 	default:
 		return "unknown"
 	}
@@ -2,8 +2,17 @@ package raftify
 
 import (
 	"encoding/hex"
+	"net"
+	"regexp"
+	"strings"
 )
 
+// hostnameRegexp matches hostnames as specified in RFC 1123.
+var hostnameRegexp = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*\.?$`)
+
+// numericRegexp matches strings consisting of digits only.
+var numericRegexp = regexp.MustCompile(`^[0-9]+$`)
+
 // hexToByte decodes the string representation of the input into a byte slice.
 func hexToByte(hexString string) ([]byte, error) {
 	byteRep := make([]byte, hex.DecodedLen(len(hexString)))
@@ -12,3 +21,18 @@ func hexToByte(hexString string) ([]byte, error) {
 	}
 	return byteRep, nil
 }
+
+// isValidHost checks whether the host is either an IPv4/IPv6 address or a valid hostname.
+func isValidHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return true
+	}
+	if len(host) > 253 || !hostnameRegexp.MatchString(host) {
+		return false
+	}
+
+	// A hostname whose last label is all-numeric would be indistinguishable from a
+	// malformed IPv4 address like 192.168.500.1, so it is rejected.
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	return !numericRegexp.MatchString(labels[len(labels)-1])
+}
@@ -26,3 +26,18 @@ func TestHexToByte(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestIsValidHost(t *testing.T) {
+	for _, host := range []string{"127.0.0.1", "::1", "fd00::3", "localhost", "node-1.raftify.local", "node-1.raftify.local."} {
+		if !isValidHost(host) {
+			t.Logf("Expected %v to be a valid host, instead it was rejected", host)
+			t.Fail()
+		}
+	}
+	for _, host := range []string{"", "192.168.500.213", "-node.local", "node_1.local", "[::1]"} {
+		if isValidHost(host) {
+			t.Logf("Expected %v to be an invalid host, instead it was accepted", host)
+			t.Fail()
+		}
+	}
+}